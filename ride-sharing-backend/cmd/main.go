@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"kenyan-ride-share-backend/internal/config"
 	"kenyan-ride-share-backend/internal/handlers"
 	"kenyan-ride-share-backend/internal/middleware"
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
 	"kenyan-ride-share-backend/pkg/database"
+	"kenyan-ride-share-backend/pkg/email"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -31,6 +41,11 @@ func main() {
 
 	// Initialize Gin router
 	r := gin.Default()
+	// Payment callbacks are allowed by client address, so only our own
+	// proxies may set it through X-Forwarded-For
+	if err := r.SetTrustedProxies(cfg.GetTrustedProxies()); err != nil {
+		log.Fatal("Invalid trusted proxies:", err)
+	}
 
 	// CORS middleware
 	r.Use(cors.New(cors.Config{
@@ -41,11 +56,95 @@ func main() {
 		AllowCredentials: true,
 	}))
 
+	// Background workers stop when the server receives SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	var workers sync.WaitGroup
+	startWorker := func(run func(context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run(ctx)
+		}()
+	}
+
+	// Start the dispatcher that offers ride requests to drivers
+	dispatcher := services.NewDispatchService(db, services.DispatchConfig{
+		InitialRadiusKm: cfg.DispatchInitialRadiusKm,
+		RadiusStepKm:    cfg.DispatchRadiusStepKm,
+		MaxRadiusKm:     cfg.DispatchMaxRadiusKm,
+		OfferTimeout:    time.Duration(cfg.DispatchOfferTimeoutSeconds) * time.Second,
+		SweepInterval:   5 * time.Second,
+	}, services.SystemClock{})
+	startWorker(dispatcher.Run)
+
+	// Expire ride requests nobody accepted
+	notifier := services.NewNotificationService(db, email.NewEmailService())
+	expiryWorker := services.NewRequestExpiryWorker(db, services.NewRideLifecycleService(db), notifier, services.SystemClock{},
+		time.Duration(cfg.RideRequestTTLMinutes)*time.Minute,
+		time.Duration(cfg.RequestExpiryIntervalSeconds)*time.Second)
+	startWorker(expiryWorker.Run)
+
+	// Remind passengers of scheduled rides and dispatch them before pickup
+	scheduledRideWorker := services.NewScheduledRideWorker(db, services.NewRideLifecycleService(db), dispatcher, notifier, services.SystemClock{}, services.ScheduleConfig{
+		DispatchLead: time.Duration(cfg.ScheduledDispatchLeadMinutes) * time.Minute,
+		ReminderLead: time.Duration(cfg.ScheduledReminderLeadMinutes) * time.Minute,
+		Interval:     time.Duration(cfg.ScheduledRideIntervalSeconds) * time.Second,
+	})
+	startWorker(scheduledRideWorker.Run)
+
+	// Keep surge multipliers up to date with demand in each part of town
+	surge := services.NewSurgeService(db, services.SystemClock{}, services.SurgeConfig{
+		CellSizeKm:    cfg.SurgeCellSizeKm,
+		Window:        time.Duration(cfg.SurgeWindowMinutes) * time.Minute,
+		Sensitivity:   cfg.SurgeSensitivity,
+		Smoothing:     cfg.SurgeSmoothing,
+		MaxMultiplier: cfg.SurgeMaxMultiplier,
+		Interval:      time.Duration(cfg.SurgeIntervalSeconds) * time.Second,
+	})
+	startWorker(surge.Run)
+
+	mpesa := services.NewMpesaService(db, cfg)
+
+	// Pay drivers out daily and reconcile payouts M-Pesa has not reported on
+	payouts := services.NewPayoutService(db, mpesa, services.PayoutConfig{
+		MinimumBalance: cfg.PayoutMinimumBalance,
+		Fee:            cfg.PayoutFee,
+		ScheduleHour:   cfg.PayoutScheduleHour,
+		ResultTimeout:  time.Duration(cfg.PayoutResultTimeoutMinutes) * time.Minute,
+		Interval:       time.Duration(cfg.PayoutIntervalSeconds) * time.Second,
+	}, services.SystemClock{})
+	startWorker(payouts.Run)
+
+	// Passengers pay with M-Pesa, Airtel Money or cash to the driver
+	providers := services.NewPaymentProviders(
+		mpesa,
+		services.NewAirtelMoneyService(),
+		services.CashProvider{},
+	)
+	payments := services.NewPaymentService(db, providers, services.SystemClock{})
+
+	// Settle payments whose callback never arrived
+	paymentReconciler := services.NewPaymentReconciler(db, payments, services.SystemClock{},
+		time.Duration(cfg.PaymentReconcileAfterMinutes)*time.Minute,
+		time.Duration(cfg.PaymentReconcileIntervalSeconds)*time.Second)
+	startWorker(paymentReconciler.Run)
+
+	refunds := services.NewRefundService(db, providers, services.RefundConfig{
+		ApprovalThreshold: cfg.RefundApprovalThreshold,
+	}, services.SystemClock{})
+
 	// Initialize handlers
 	userHandler := handlers.NewUserHandler(db, cfg)
-	rideHandler := handlers.NewRideHandler(db)
-	paymentHandler := handlers.NewPaymentHandler(db)
+	notificationHandler := handlers.NewNotificationHandler(db)
+	rideHandler := handlers.NewRideHandler(db, cfg, dispatcher, surge, providers)
+	paymentHandler := handlers.NewPaymentHandler(db, payments)
 	complianceHandler := handlers.NewComplianceHandler(db)
+	vehicleCategoryHandler := handlers.NewVehicleCategoryHandler(db)
+	promoHandler := handlers.NewPromoHandler(db)
+	walletHandler := handlers.NewWalletHandler(db)
+	payoutHandler := handlers.NewPayoutHandler(db, mpesa, payouts, refunds)
+	refundHandler := handlers.NewRefundHandler(db, refunds)
 
 	// API routes
 	api := r.Group(cfg.APIBasePath)
@@ -68,26 +167,72 @@ func main() {
 			// User routes
 			protected.GET("/users/:id", userHandler.GetUser)
 			protected.PUT("/users/:id", userHandler.UpdateUser)
+			protected.GET("/users/:id/referrals", userHandler.GetReferralStats)
+			protected.GET("/users/:id/wallet", walletHandler.GetWallet)
+			protected.GET("/users/:id/wallet/statement", walletHandler.GetWalletStatement)
 			protected.POST("/drivers/onboard", userHandler.OnboardDriver)
+			protected.GET("/users/:id/notifications", notificationHandler.GetUserNotifications)
 
 			// Ride routes
+			protected.POST("/fare_quotes", rideHandler.CreateFareQuote)
+			protected.GET("/surge_map", rideHandler.GetSurgeMap)
 			protected.POST("/ride_requests", rideHandler.CreateRideRequest)
 			protected.GET("/ride_requests/:id", rideHandler.GetRideRequest)
 			protected.GET("/ride_requests/nearby_drivers", rideHandler.GetNearbyDrivers)
 			protected.PUT("/ride_requests/:id/accept", rideHandler.AcceptRideRequest)
 			protected.PUT("/ride_requests/:id/reject", rideHandler.RejectRideRequest)
+			protected.PUT("/ride_requests/:id/cancel", rideHandler.CancelRideRequest)
+			protected.PUT("/rides/:id/arrived", rideHandler.MarkArrived)
+			protected.PUT("/rides/:id/no_show", rideHandler.MarkNoShow)
 			protected.PUT("/rides/:id/start", rideHandler.StartRide)
 			protected.PUT("/rides/:id/end", rideHandler.EndRide)
+			protected.PUT("/rides/:id/cancel", rideHandler.CancelRide)
 			protected.GET("/rides/:id", rideHandler.GetRide)
+			protected.GET("/rides/:id/timeline", rideHandler.GetRideTimeline)
+			protected.GET("/rides/:id/pin", rideHandler.GetRidePIN)
+			protected.PUT("/rides/:id/stops/:sequence/reached", rideHandler.MarkStopReached)
+			protected.GET("/rides/:id/receipt", rideHandler.GetRideReceipt)
+			protected.GET("/rides/:id/waypoints", rideHandler.GetRideWaypoints)
+			protected.PUT("/rides/:id/waypoints/:sequence/complete", rideHandler.CompleteWaypoint)
 			protected.GET("/users/:id/rides", rideHandler.GetUserRides)
 
+			// Vehicle category routes
+			protected.GET("/vehicle_categories", vehicleCategoryHandler.ListVehicleCategories)
+			protected.POST("/vehicle_categories", vehicleCategoryHandler.CreateVehicleCategory)
+			protected.PUT("/vehicle_categories/:code", vehicleCategoryHandler.UpdateVehicleCategory)
+
+			// Promo code routes
+			protected.GET("/promo_codes", promoHandler.ListPromoCodes)
+			protected.POST("/promo_codes", promoHandler.CreatePromoCode)
+			protected.PUT("/promo_codes/:id", promoHandler.UpdatePromoCode)
+
 			// Location routes
 			protected.PUT("/drivers/:id/location", rideHandler.UpdateDriverLocation)
 			protected.GET("/drivers/location/:id", rideHandler.GetDriverLocation)
 
+			// Dispatch routes
+			protected.PUT("/drivers/:id/availability", rideHandler.UpdateDriverAvailability)
+			protected.GET("/drivers/:id/ride_offers", rideHandler.GetDriverOffers)
+			protected.GET("/drivers/:id/response_stats", rideHandler.GetDriverResponseStats)
+			protected.GET("/ops/drivers/response_stats", rideHandler.ListDriverResponseStats)
+
 			// Payment routes
-			protected.POST("/payments/mpesa/stk_push", paymentHandler.InitiateMpesaPayment)
+			protected.POST("/payments/initiate", paymentHandler.InitiatePayment)
+			protected.POST("/payments/mpesa/stk_push", paymentHandler.InitiatePayment)
 			protected.GET("/payments/:id", paymentHandler.GetPayment)
+			protected.GET("/rides/:id/amount_due", paymentHandler.GetAmountDue)
+			protected.POST("/payments/:id/recheck", paymentHandler.RecheckPayment)
+
+			// Refund routes
+			protected.POST("/payments/:id/refunds", refundHandler.CreateRefund)
+			protected.POST("/refunds/:id/approve", refundHandler.ApproveRefund)
+			protected.POST("/refunds/:id/reject", refundHandler.RejectRefund)
+			protected.GET("/rides/:id/refunds", refundHandler.GetRideRefunds)
+
+			// Payout routes
+			protected.POST("/payouts", payoutHandler.RequestPayout)
+			protected.GET("/payouts", payoutHandler.ListPayouts)
+			protected.POST("/payouts/:id/resolve", payoutHandler.ResolvePayout)
 
 			// Review routes
 			protected.POST("/reviews", rideHandler.CreateReview)
@@ -100,8 +245,25 @@ func main() {
 			protected.POST("/compliance/vehicles/validate", complianceHandler.ValidateVehicle)
 		}
 
-		// M-Pesa callback (no auth required)
-		api.POST("/payments/mpesa/callback", paymentHandler.MpesaCallback)
+		// M-Pesa callbacks, authenticated by the secret token in their URL
+		// and the address they come from
+		mpesaCallbacks := api.Group("/")
+		mpesaCallbacks.Use(middleware.MpesaCallbackMiddleware(cfg))
+		{
+			mpesaCallbacks.POST("/payments/mpesa/callback/:token", paymentHandler.ProviderCallback(models.PaymentMethodMpesa))
+			mpesaCallbacks.POST("/payouts/mpesa/result/:token", payoutHandler.MpesaB2CResult)
+			mpesaCallbacks.POST("/payouts/mpesa/timeout/:token", payoutHandler.MpesaB2CTimeout)
+		}
+
+		// Airtel Money callbacks, authenticated the same way
+		if cfg.AirtelCallbackIPs == "" {
+			log.Println("AIRTEL_CALLBACK_IPS is not set, so Airtel Money callbacks will be rejected")
+		}
+		airtelCallbacks := api.Group("/")
+		airtelCallbacks.Use(middleware.ProviderCallbackMiddleware("Airtel Money", cfg.AirtelCallbackToken, cfg.AirtelCallbackIPs))
+		{
+			airtelCallbacks.POST("/payments/airtel_money/callback/:token", paymentHandler.ProviderCallback(models.PaymentMethodAirtelMoney))
+		}
 	}
 
 	// Health check
@@ -125,8 +287,26 @@ func main() {
 	log.Printf("📊 Health check: %s/health", cfg.BaseURL)
 	log.Printf("📖 API Documentation: %s%s", cfg.BaseURL, cfg.APIBasePath)
 	
-	if err := r.Run("0.0.0.0:" + port); err != nil {
-		log.Fatal("Failed to start server:", err)
+	srv := &http.Server{
+		Addr:    "0.0.0.0:" + port,
+		Handler: r,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Failed to start server:", err)
+		}
+	}()
+
+	// Wait for a shutdown signal, then drain requests and workers
+	<-ctx.Done()
+	log.Println("Shutting down server...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server forced to shut down: %v", err)
 	}
+	workers.Wait()
+	log.Println("Server stopped")
 }
 
@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
 )
 
 type Config struct {
@@ -12,11 +14,89 @@ type Config struct {
 	MpesaPasskey        string
 	MpesaShortcode      string
 	MpesaCallbackURL    string
+	// MpesaCallbackToken is the secret last segment of every M-Pesa callback
+	// URL, and MpesaCallbackIPs the addresses callbacks may come from ("*"
+	// allows any)
+	MpesaCallbackToken  string
+	MpesaCallbackIPs    string
+	// The same for Airtel Money collection callbacks. Airtel publishes no
+	// addresses, so callbacks are rejected until AIRTEL_CALLBACK_IPS is set.
+	AirtelCallbackToken string
+	AirtelCallbackIPs   string
+	// M-Pesa B2C payouts to drivers
+	MpesaB2CShortcode          string
+	MpesaB2CInitiatorName      string
+	MpesaB2CSecurityCredential string
+	// MpesaBaseURL overrides the Daraja API host, e.g. for a local mock
+	MpesaBaseURL        string
+	// TrustedProxies are the comma-separated addresses of our own proxies,
+	// the only ones whose X-Forwarded-For gives the client address. Empty
+	// trusts none, so the client address is the connecting one.
+	TrustedProxies      string
 	Environment         string
 	// URL Configuration
 	BaseURL         string
 	APIBasePath     string
 	// Note: No frontend URL needed - Flutter mobile app communicates directly with API
+	// Cancellation policy
+	CancellationFreeWindowMinutes int
+	PassengerCancellationFee      float64
+	NoShowAfterMinutes            int
+	NoShowFee                     float64
+	// Waiting at pickup
+	WaitingGraceMinutes    int
+	WaitingChargePerMinute float64
+	// Trip start PIN
+	StartPINMaxAttempts int
+	// Ride location traces
+	TraceMinDistanceMeters float64
+	TraceMaxAccuracyMeters float64
+	TraceMaxSpeedKmh       float64
+	// Dispatch
+	DispatchInitialRadiusKm     float64
+	DispatchRadiusStepKm        float64
+	DispatchMaxRadiusKm         float64
+	DispatchOfferTimeoutSeconds int
+	// Ride request expiry
+	RideRequestTTLMinutes        int
+	RequestExpiryIntervalSeconds int
+	// Scheduled rides
+	ScheduledRideMinLeadMinutes  int
+	ScheduledRideMaxLeadDays     int
+	ScheduledDispatchLeadMinutes int
+	ScheduledReminderLeadMinutes int
+	ScheduledRideIntervalSeconds int
+	// Fare quotes
+	FareQuoteTTLMinutes int
+	// Surge pricing
+	SurgeCellSizeKm      float64
+	SurgeWindowMinutes   int
+	SurgeSensitivity     float64
+	SurgeSmoothing       float64
+	SurgeMaxMultiplier   float64
+	SurgeIntervalSeconds int
+	// Pooled rides
+	PoolSeatCapacity int
+	PoolMaxDetourKm  float64
+	PoolDiscount     float64
+	// Referrals
+	ReferralRequiredRides   int
+	ReferrerReward          float64
+	RefereeReward           float64
+	ReferralRewardValidDays int
+	// Driver payouts
+	PayoutMinimumBalance       float64
+	PayoutFee                  float64
+	PayoutScheduleHour         int
+	PayoutResultTimeoutMinutes int
+	PayoutIntervalSeconds      int
+	// Pending M-Pesa payments are rechecked once their callback is this late
+	PaymentReconcileAfterMinutes    int
+	PaymentReconcileIntervalSeconds int
+	// Refunds above this amount need a second admin's approval
+	RefundApprovalThreshold float64
+	// Drivers owing more than this in commission on cash rides cannot go online
+	DriverCashDebtLimit float64
 }
 
 func Load() *Config {
@@ -27,14 +107,84 @@ func Load() *Config {
 		MpesaConsumerSecret: getEnv("MPESA_CONSUMER_SECRET", ""),
 		MpesaPasskey:       getEnv("MPESA_PASSKEY", ""),
 		MpesaShortcode:     getEnv("MPESA_SHORTCODE", ""),
+		MpesaCallbackToken: getEnv("MPESA_CALLBACK_TOKEN", ""),
+		// Safaricom's published callback addresses
+		MpesaCallbackIPs: getEnv("MPESA_CALLBACK_IPS", "196.201.214.200,196.201.214.206,196.201.213.114,196.201.214.207,196.201.214.208,196.201.213.44,196.201.212.127,196.201.212.138,196.201.212.129,196.201.212.136,196.201.212.74,196.201.212.69"),
+		AirtelCallbackToken: getEnv("AIRTEL_CALLBACK_TOKEN", ""),
+		AirtelCallbackIPs:   getEnv("AIRTEL_CALLBACK_IPS", ""),
+		MpesaB2CShortcode:          getEnv("MPESA_B2C_SHORTCODE", ""),
+		MpesaB2CInitiatorName:      getEnv("MPESA_B2C_INITIATOR_NAME", ""),
+		MpesaB2CSecurityCredential: getEnv("MPESA_B2C_SECURITY_CREDENTIAL", ""),
+		MpesaBaseURL:        getEnv("MPESA_BASE_URL", ""),
+		TrustedProxies:      getEnv("TRUSTED_PROXIES", ""),
 		Environment:        getEnv("ENVIRONMENT", "development"),
 		// URL Configuration
 		BaseURL:         getEnv("BASE_URL", "http://localhost:8080"),
 		APIBasePath:     getEnv("API_BASE_PATH", "/api/v1"),
+		// Cancellation policy
+		CancellationFreeWindowMinutes: getEnvInt("CANCELLATION_FREE_WINDOW_MINUTES", 3),
+		PassengerCancellationFee:      getEnvFloat("PASSENGER_CANCELLATION_FEE", 100.0),
+		NoShowAfterMinutes:            getEnvInt("NO_SHOW_AFTER_MINUTES", 5),
+		NoShowFee:                     getEnvFloat("NO_SHOW_FEE", 150.0),
+		// Waiting at pickup
+		WaitingGraceMinutes:    getEnvInt("WAITING_GRACE_MINUTES", 3),
+		WaitingChargePerMinute: getEnvFloat("WAITING_CHARGE_PER_MINUTE", 5.0),
+		// Trip start PIN
+		StartPINMaxAttempts: getEnvInt("START_PIN_MAX_ATTEMPTS", 3),
+		// Ride location traces
+		TraceMinDistanceMeters: getEnvFloat("TRACE_MIN_DISTANCE_METERS", 10.0),
+		TraceMaxAccuracyMeters: getEnvFloat("TRACE_MAX_ACCURACY_METERS", 50.0),
+		TraceMaxSpeedKmh:       getEnvFloat("TRACE_MAX_SPEED_KMH", 150.0),
+		// Dispatch
+		DispatchInitialRadiusKm:     getEnvFloat("DISPATCH_INITIAL_RADIUS_KM", 3.0),
+		DispatchRadiusStepKm:        getEnvFloat("DISPATCH_RADIUS_STEP_KM", 2.0),
+		DispatchMaxRadiusKm:         getEnvFloat("DISPATCH_MAX_RADIUS_KM", 10.0),
+		DispatchOfferTimeoutSeconds: getEnvInt("DISPATCH_OFFER_TIMEOUT_SECONDS", 20),
+		// Ride request expiry
+		RideRequestTTLMinutes:        getEnvInt("RIDE_REQUEST_TTL_MINUTES", 10),
+		RequestExpiryIntervalSeconds: getEnvInt("REQUEST_EXPIRY_INTERVAL_SECONDS", 30),
+		// Scheduled rides
+		ScheduledRideMinLeadMinutes:  getEnvInt("SCHEDULED_RIDE_MIN_LEAD_MINUTES", 30),
+		ScheduledRideMaxLeadDays:     getEnvInt("SCHEDULED_RIDE_MAX_LEAD_DAYS", 7),
+		ScheduledDispatchLeadMinutes: getEnvInt("SCHEDULED_DISPATCH_LEAD_MINUTES", 15),
+		ScheduledReminderLeadMinutes: getEnvInt("SCHEDULED_REMINDER_LEAD_MINUTES", 60),
+		ScheduledRideIntervalSeconds: getEnvInt("SCHEDULED_RIDE_INTERVAL_SECONDS", 30),
+		// Fare quotes
+		FareQuoteTTLMinutes: getEnvInt("FARE_QUOTE_TTL_MINUTES", 5),
+		// Surge pricing
+		SurgeCellSizeKm:      getEnvFloat("SURGE_CELL_SIZE_KM", 1.0),
+		SurgeWindowMinutes:   getEnvInt("SURGE_WINDOW_MINUTES", 10),
+		SurgeSensitivity:     getEnvFloat("SURGE_SENSITIVITY", 0.5),
+		SurgeSmoothing:       getEnvFloat("SURGE_SMOOTHING", 0.5),
+		SurgeMaxMultiplier:   getEnvFloat("SURGE_MAX_MULTIPLIER", 2.5),
+		SurgeIntervalSeconds: getEnvInt("SURGE_INTERVAL_SECONDS", 60),
+		// Pooled rides
+		PoolSeatCapacity: getEnvInt("POOL_SEAT_CAPACITY", 3),
+		PoolMaxDetourKm:  getEnvFloat("POOL_MAX_DETOUR_KM", 2.5),
+		PoolDiscount:     getEnvFloat("POOL_DISCOUNT", 0.25),
+		// Referrals
+		ReferralRequiredRides:   getEnvInt("REFERRAL_REQUIRED_RIDES", 3),
+		ReferrerReward:          getEnvFloat("REFERRER_REWARD", 200),
+		RefereeReward:           getEnvFloat("REFEREE_REWARD", 100),
+		ReferralRewardValidDays: getEnvInt("REFERRAL_REWARD_VALID_DAYS", 90),
+		// Driver payouts
+		PayoutMinimumBalance:       getEnvFloat("PAYOUT_MINIMUM_BALANCE", 500),
+		PayoutFee:                  getEnvFloat("PAYOUT_FEE", 15),
+		PayoutScheduleHour:         getEnvInt("PAYOUT_SCHEDULE_HOUR", 18),
+		PayoutResultTimeoutMinutes: getEnvInt("PAYOUT_RESULT_TIMEOUT_MINUTES", 30),
+		PayoutIntervalSeconds:      getEnvInt("PAYOUT_INTERVAL_SECONDS", 300),
+		// Payment reconciliation
+		PaymentReconcileAfterMinutes:    getEnvInt("PAYMENT_RECONCILE_AFTER_MINUTES", 5),
+		PaymentReconcileIntervalSeconds: getEnvInt("PAYMENT_RECONCILE_INTERVAL_SECONDS", 60),
+		// Refunds
+		RefundApprovalThreshold: getEnvFloat("REFUND_APPROVAL_THRESHOLD", 1000),
+		// Cash rides
+		DriverCashDebtLimit: getEnvFloat("DRIVER_CASH_DEBT_LIMIT", 2000),
 	}
 	
-	// Build M-Pesa callback URL dynamically if not explicitly set
-	cfg.MpesaCallbackURL = getEnv("MPESA_CALLBACK_URL", cfg.GetMpesaCallbackURL())
+	// Build M-Pesa callback URL dynamically. It always ends in the secret
+	// token the callback routes check.
+	cfg.MpesaCallbackURL = cfg.GetMpesaCallbackURL()
 	
 	return cfg
 }
@@ -46,6 +196,36 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+// GetTrustedProxies returns the trusted proxy addresses, nil when there are
+// none
+func (c *Config) GetTrustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(c.TrustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
 // GetAPIURL returns the full API URL with base path
 func (c *Config) GetAPIURL() string {
 	return c.BaseURL + c.APIBasePath
@@ -53,6 +233,16 @@ func (c *Config) GetAPIURL() string {
 
 // GetCallbackURL returns the full M-Pesa callback URL
 func (c *Config) GetMpesaCallbackURL() string {
-	return c.BaseURL + c.APIBasePath + "/payments/mpesa/callback"
+	return c.BaseURL + c.APIBasePath + "/payments/mpesa/callback/" + c.MpesaCallbackToken
+}
+
+// GetMpesaB2CResultURL returns the URL M-Pesa posts payout results to
+func (c *Config) GetMpesaB2CResultURL() string {
+	return c.BaseURL + c.APIBasePath + "/payouts/mpesa/result/" + c.MpesaCallbackToken
+}
+
+// GetMpesaB2CTimeoutURL returns the URL M-Pesa posts payout timeouts to
+func (c *Config) GetMpesaB2CTimeoutURL() string {
+	return c.BaseURL + c.APIBasePath + "/payouts/mpesa/timeout/" + c.MpesaCallbackToken
 }
 
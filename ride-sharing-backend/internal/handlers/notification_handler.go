@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"net/http"
+
+	"kenyan-ride-share-backend/internal/services"
+	"kenyan-ride-share-backend/pkg/email"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type NotificationHandler struct {
+	db                  *gorm.DB
+	notificationService *services.NotificationService
+}
+
+func NewNotificationHandler(db *gorm.DB) *NotificationHandler {
+	return &NotificationHandler{
+		db:                  db,
+		notificationService: services.NewNotificationService(db, email.NewEmailService()),
+	}
+}
+
+func (h *NotificationHandler) GetUserNotifications(c *gin.Context) {
+	userID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+
+	if userID != currentUserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only view your own notifications"})
+		return
+	}
+
+	notifications, err := h.notificationService.GetUserNotifications(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch notifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, notifications)
+}
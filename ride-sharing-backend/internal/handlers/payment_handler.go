@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
 	"kenyan-ride-share-backend/internal/models"
@@ -13,27 +14,76 @@ import (
 )
 
 type PaymentHandler struct {
-	db           *gorm.DB
-	mpesaService *services.MpesaService
+	db       *gorm.DB
+	payments *services.PaymentService
 }
 
-func NewPaymentHandler(db *gorm.DB) *PaymentHandler {
+func NewPaymentHandler(db *gorm.DB, payments *services.PaymentService) *PaymentHandler {
 	return &PaymentHandler{
-		db:           db,
-		mpesaService: services.NewMpesaService(db),
+		db:       db,
+		payments: payments,
 	}
 }
 
-type MpesaSTKPushRequest struct {
-	RideID      string  `json:"ride_id" binding:"required"`
-	PhoneNumber string  `json:"phone_number" binding:"required"`
-	Amount      float64 `json:"amount" binding:"required"`
+type InitiatePaymentRequest struct {
+	RideID      string `json:"ride_id" binding:"required"`
+	PhoneNumber string `json:"phone_number" binding:"required"`
+	// Amount defaults to all that is owed for the ride. Less pays part of
+	// it; more is rejected.
+	Amount float64 `json:"amount" binding:"omitempty,gt=0"`
 }
 
-func (h *PaymentHandler) InitiateMpesaPayment(c *gin.Context) {
+// amountDueResponse is what a passenger owes for a ride, worked out from
+// the fare rather than anything the client sends
+func amountDueResponse(payment *models.Payment) gin.H {
+	return gin.H{
+		"payment_id":     payment.ID,
+		"ride_id":        payment.RideID,
+		"payment_method": payment.PaymentMethod,
+		"payment_status": payment.PaymentStatus,
+		"fare":           payment.Amount,
+		"wallet_credit":  payment.WalletCredit,
+		"wallet_debt":    payment.WalletDebt,
+		"amount_paid":    payment.AmountPaid,
+		"amount_due":     services.FromCents(services.AmountDue(payment)),
+		"currency":       "KES",
+	}
+}
+
+// passengerRide finds a ride the current user was a passenger on, or one of
+// the passengers on a pooled ride, that there is something to pay for: a
+// completed ride, or a cancelled one whose cancellation fee is still owed
+func (h *PaymentHandler) passengerRide(c *gin.Context, rideID string) (*models.Ride, bool) {
+	currentUserID := c.GetString("user_id")
+
+	rideUUID, err := uuid.Parse(rideID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ride ID"})
+		return nil, false
+	}
+
+	var ride models.Ride
+	owedFees := h.db.Model(&models.Payment{}).Select("ride_id").
+		Where("passenger_id = ? AND payment_status NOT IN ?", currentUserID, []string{"completed", "refunded"})
+	if err := h.db.Where("id = ?", rideUUID).
+		Where("status = ? OR (status = ? AND id IN (?))", models.RideStatusCompleted, models.RideStatusCancelled, owedFees).
+		Where("passenger_id = ? OR id IN (?)", currentUserID,
+			h.db.Model(&models.RideRequest{}).Select("ride_id").Where("passenger_id = ?", currentUserID)).
+		First(&ride).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found or not authorized"})
+		return nil, false
+	}
+	return &ride, true
+}
+
+// InitiatePayment asks the passenger to pay for a completed ride, or the fee
+// for a cancelled one, through the payment method they chose for it. The
+// amount asked for comes from the ride's fare, less wallet credit and what
+// was already paid.
+func (h *PaymentHandler) InitiatePayment(c *gin.Context) {
 	currentUserID := c.GetString("user_id")
 
-	var req MpesaSTKPushRequest
+	var req InitiatePaymentRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -46,83 +96,109 @@ func (h *PaymentHandler) InitiateMpesaPayment(c *gin.Context) {
 	}
 	req.PhoneNumber = utils.FormatKenyanPhoneNumber(req.PhoneNumber)
 
-	// Parse ride ID
-	rideUUID, err := uuid.Parse(req.RideID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ride ID"})
+	ride, ok := h.passengerRide(c, req.RideID)
+	if !ok {
 		return
 	}
 
-	// Verify ride exists and user is the passenger
-	var ride models.Ride
-	if err := h.db.Preload("RideRequest").Where("id = ? AND passenger_id = ? AND status = ?", rideUUID, currentUserID, "completed").First(&ride).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found or not authorized"})
+	payment, request, err := h.payments.Initiate(ride, uuid.MustParse(currentUserID), req.PhoneNumber, req.Amount)
+	if err != nil {
+		respondPaymentError(c, err, "Failed to initiate payment")
 		return
 	}
 
-	// Check if payment already exists
-	var existingPayment models.Payment
-	if err := h.db.Where("ride_id = ?", rideUUID).First(&existingPayment).Error; err == nil {
-		if existingPayment.PaymentStatus == "completed" {
-			c.JSON(http.StatusConflict, gin.H{"error": "Payment already completed"})
-			return
-		}
+	response := amountDueResponse(payment)
+	response["message"] = "Payment initiated"
+	response["amount_requested"] = payment.RequestedAmount
+	response["checkout_request_id"] = request.Reference
+	response["customer_message"] = request.CustomerMessage
+	c.JSON(http.StatusOK, response)
+}
+
+// GetAmountDue returns what the current user still owes for a ride
+func (h *PaymentHandler) GetAmountDue(c *gin.Context) {
+	ride, ok := h.passengerRide(c, c.Param("id"))
+	if !ok {
+		return
 	}
 
-	// Initiate M-Pesa STK Push
-	accountReference := "RIDE-" + ride.ID.String()[:8]
-	stkResponse, err := h.mpesaService.InitiateSTKPush(req.PhoneNumber, req.Amount, accountReference)
+	payment, err := h.payments.Bill(ride, uuid.MustParse(c.GetString("user_id")))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initiate M-Pesa payment: " + err.Error()})
+		respondPaymentError(c, err, "Failed to get amount due")
 		return
 	}
+	c.JSON(http.StatusOK, amountDueResponse(payment))
+}
 
-	// Create or update payment record
-	payment := models.Payment{
-		RideID:        rideUUID,
-		Amount:        req.Amount,
-		Currency:      "KES",
-		PaymentMethod: "mpesa",
-		TransactionID: &stkResponse.CheckoutRequestID,
-		PaymentStatus: "pending",
+func respondPaymentError(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, services.ErrPaymentCompleted), errors.Is(err, services.ErrPaymentInProgress):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrCollectedByDriver), errors.Is(err, services.ErrUnsupportedPayment),
+		errors.Is(err, services.ErrAmountExceedsDue):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrNoFare):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback + ": " + err.Error()})
 	}
+}
 
-	if existingPayment.ID != uuid.Nil {
-		// Update existing payment
-		if err := h.db.Model(&existingPayment).Updates(payment).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update payment record"})
+// ProviderCallback receives the outcome of payments from the provider for a
+// payment method. Every callback is stored before it is processed.
+func (h *PaymentHandler) ProviderCallback(method string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		payment.ID = existingPayment.ID
-	} else {
-		// Create new payment
-		if err := h.db.Create(&payment).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment record"})
+
+		callback, err := h.payments.RecordCallback(method, c.ClientIP(), body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record callback"})
 			return
 		}
-	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message":            "M-Pesa payment initiated",
-		"payment_id":         payment.ID,
-		"checkout_request_id": stkResponse.CheckoutRequestID,
-		"customer_message":   stkResponse.CustomerMessage,
-	})
+		if err := h.payments.ProcessCallback(method, callback); err != nil {
+			if errors.Is(err, services.ErrCallbackRejected) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process callback: " + err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Callback processed successfully"})
+	}
 }
 
-func (h *PaymentHandler) MpesaCallback(c *gin.Context) {
-	var callbackData map[string]interface{}
-	if err := c.ShouldBindJSON(&callbackData); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// RecheckPayment asks the payment provider for the outcome of a pending
+// payment straight away instead of waiting for the reconciler
+func (h *PaymentHandler) RecheckPayment(c *gin.Context) {
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can recheck payments"})
+		return
+	}
+
+	var payment models.Payment
+	if err := h.db.Where("id = ?", c.Param("id")).First(&payment).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
 		return
 	}
 
-	if err := h.mpesaService.ProcessCallback(callbackData); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process callback: " + err.Error()})
+	if err := h.payments.Recheck(&payment); err != nil {
+		if errors.Is(err, services.ErrPaymentNotPending) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to query the payment provider: " + err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Callback processed successfully"})
+	c.JSON(http.StatusOK, payment)
 }
 
 func (h *PaymentHandler) GetPayment(c *gin.Context) {
@@ -0,0 +1,87 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/handlers"
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+	"kenyan-ride-share-backend/internal/services/paymenttest"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayCancellationFee(t *testing.T) {
+	db := setupTestDB()
+	clock := services.SystemClock{}
+	cancellations := services.NewCancellationService(db, services.NewRideLifecycleService(db),
+		services.CancellationPolicy{FreeWindow: 3 * time.Minute, PassengerFee: 100}, clock)
+	mpesa := paymenttest.NewFakeProvider(models.PaymentMethodMpesa)
+	payments := services.NewPaymentService(db, services.NewPaymentProviders(mpesa,
+		paymenttest.NewFakeProvider(models.PaymentMethodAirtelMoney), services.CashProvider{}), clock)
+	paymentHandler := handlers.NewPaymentHandler(db, payments)
+
+	driver := models.Driver{DriverID: uuid.New(), LicensePlate: "KDA 123A", DriverLicenseNumber: "DL123"}
+	require.NoError(t, db.Create(&driver).Error)
+	rideRequest := models.RideRequest{PassengerID: uuid.New(), Status: models.RideRequestStatusAccepted}
+	require.NoError(t, db.Create(&rideRequest).Error)
+	ride := models.Ride{RequestID: rideRequest.ID, DriverID: driver.DriverID, PassengerID: rideRequest.PassengerID,
+		Status: models.RideStatusDriverArriving, CreatedAt: time.Now().Add(-10 * time.Minute)}
+	require.NoError(t, db.Create(&ride).Error)
+	_, err := cancellations.CancelRideRequest(&rideRequest, services.CancellationRequest{ActorID: rideRequest.PassengerID, ReasonCode: "change_of_plans"})
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("user_id", rideRequest.PassengerID.String())
+		c.Next()
+	})
+	router.GET("/rides/:id/amount_due", paymentHandler.GetAmountDue)
+	router.POST("/payments/initiate", paymentHandler.InitiatePayment)
+	router.POST("/payments/mpesa/callback", paymentHandler.ProviderCallback(models.PaymentMethodMpesa))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/rides/"+ride.ID.String()+"/amount_due", nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var due map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &due))
+	assert.Equal(t, 100.0, due["amount_due"])
+
+	body, _ := json.Marshal(map[string]interface{}{"ride_id": ride.ID.String(), "phone_number": "254712345678"})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/payments/initiate", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var initiated map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &initiated))
+	assert.Equal(t, []float64{100}, mpesa.Initiated)
+
+	receipt := "RKF200"
+	paid := 100.0
+	body, _ = json.Marshal(services.PaymentResult{Reference: initiated["checkout_request_id"].(string), Completed: true, Receipt: &receipt, Amount: &paid, Phone: "254712345678"})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/payments/mpesa/callback", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var payment models.Payment
+	require.NoError(t, db.First(&payment, "ride_id = ?", ride.ID).Error)
+	assert.Equal(t, "completed", payment.PaymentStatus)
+
+	// Nothing more is owed, so the cancelled ride can no longer be paid for
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/rides/"+ride.ID.String()+"/amount_due", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
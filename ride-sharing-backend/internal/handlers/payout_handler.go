@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type PayoutHandler struct {
+	db      *gorm.DB
+	payouts *services.PayoutService
+	refunds *services.RefundService
+	mpesa   *services.MpesaService
+}
+
+func NewPayoutHandler(db *gorm.DB, mpesa *services.MpesaService, payouts *services.PayoutService, refunds *services.RefundService) *PayoutHandler {
+	return &PayoutHandler{
+		db:      db,
+		payouts: payouts,
+		refunds: refunds,
+		mpesa:   mpesa,
+	}
+}
+
+type RequestPayoutRequest struct {
+	// Amount defaults to the whole earnings balance less the payout fee
+	Amount float64 `json:"amount" binding:"omitempty,gt=0"`
+}
+
+type ResolvePayoutRequest struct {
+	Completed     bool    `json:"completed"`
+	TransactionID *string `json:"transaction_id"`
+	Reason        string  `json:"reason"`
+}
+
+// RequestPayout pays the current driver's earnings out to their M-Pesa
+func (h *PayoutHandler) RequestPayout(c *gin.Context) {
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "driver" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can request payouts"})
+		return
+	}
+
+	// An empty body pays out the whole balance
+	var req RequestPayoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payout, err := h.payouts.RequestPayout(uuid.MustParse(currentUserID), services.ToCents(req.Amount), models.PayoutTriggerOnDemand)
+	if err != nil {
+		respondPayoutError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, payout)
+}
+
+// ListPayouts returns the current driver's payouts, or every payout for an
+// admin
+func (h *PayoutHandler) ListPayouts(c *gin.Context) {
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	var driverID *uuid.UUID
+	switch currentUserType {
+	case "admin":
+	case "driver":
+		id := uuid.MustParse(currentUserID)
+		driverID = &id
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can view payouts"})
+		return
+	}
+
+	payouts, err := h.payouts.List(driverID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch payouts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, payouts)
+}
+
+// ResolvePayout settles a payout M-Pesa never reported back on
+func (h *PayoutHandler) ResolvePayout(c *gin.Context) {
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can resolve payouts"})
+		return
+	}
+
+	payoutID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payout ID"})
+		return
+	}
+
+	var req ResolvePayoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Completed && (req.TransactionID == nil || *req.TransactionID == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "transaction_id is required for a completed payout"})
+		return
+	}
+	if !req.Completed && req.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reason is required for a failed payout"})
+		return
+	}
+
+	payout, err := h.payouts.Resolve(payoutID, req.Completed, req.TransactionID, req.Reason)
+	if err != nil {
+		respondPayoutError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, payout)
+}
+
+// MpesaB2CResult receives the outcome of a payout or M-Pesa refund from
+// M-Pesa
+func (h *PayoutHandler) MpesaB2CResult(c *gin.Context) {
+	h.handleB2CCallback(c, models.MpesaCallbackB2CResult, h.payouts.HandleResult, h.refunds.HandleResult)
+}
+
+// MpesaB2CTimeout is called by M-Pesa when it could not process a payout or
+// M-Pesa refund in time
+func (h *PayoutHandler) MpesaB2CTimeout(c *gin.Context) {
+	h.handleB2CCallback(c, models.MpesaCallbackB2CTimeout, h.payouts.HandleTimeout, h.refunds.HandleTimeout)
+}
+
+// handleB2CCallback stores a B2C callback and settles the payout or refund it
+// reports on. Both go out through B2C, so a conversation that is not a
+// payout's is tried as a refund. Repeated callbacks are recorded as
+// duplicates.
+func (h *PayoutHandler) handleB2CCallback(c *gin.Context, kind string, handlePayout, handleRefund func(*services.MpesaB2CResult) error) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	record, err := h.mpesa.RecordCallback(kind, c.ClientIP(), body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record callback"})
+		return
+	}
+
+	var callback services.MpesaB2CCallback
+	if err := json.Unmarshal(body, &callback); err != nil {
+		h.finishCallback(record, models.MpesaCallbackRejected, "invalid JSON")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	record.Reference = callback.Result.ConversationID
+
+	err = handlePayout(&callback.Result)
+	if errors.Is(err, services.ErrPayoutNotFound) {
+		err = handleRefund(&callback.Result)
+	}
+	switch {
+	case err == nil:
+		h.finishCallback(record, models.MpesaCallbackProcessed, "")
+	case errors.Is(err, services.ErrPayoutSettled), errors.Is(err, services.ErrRefundSettled):
+		h.finishCallback(record, models.MpesaCallbackDuplicate, "already settled")
+	case errors.Is(err, services.ErrRefundNotFound):
+		// Nothing to retry for a conversation we do not know about
+		h.finishCallback(record, models.MpesaCallbackRejected, "no payout or refund for this conversation")
+		c.JSON(http.StatusOK, gin.H{"message": "Callback ignored"})
+		return
+	default:
+		h.finishCallback(record, models.MpesaCallbackFailed, err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process callback: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Callback processed successfully"})
+}
+
+func (h *PayoutHandler) finishCallback(record *models.MpesaCallback, status, reason string) {
+	if err := h.mpesa.FinishCallback(record, status, reason); err != nil {
+		log.Printf("Failed to record outcome of M-Pesa callback %s: %v", record.ID, err)
+	}
+}
+
+// respondPayoutError maps payout errors to the matching status code
+func respondPayoutError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrPayoutNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrPayoutBelowMinimum), errors.Is(err, services.ErrPayoutInsufficientBalance):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrPayoutInProgress), errors.Is(err, services.ErrPayoutNotResolvable),
+		errors.Is(err, services.ErrPayoutSettled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process payout"})
+	}
+}
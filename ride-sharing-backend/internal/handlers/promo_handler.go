@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type PromoHandler struct {
+	db         *gorm.DB
+	promos     *services.PromoService
+	categories *services.VehicleCategoryService
+}
+
+func NewPromoHandler(db *gorm.DB) *PromoHandler {
+	return &PromoHandler{
+		db:         db,
+		promos:     services.NewPromoService(db, services.SystemClock{}),
+		categories: services.NewVehicleCategoryService(db),
+	}
+}
+
+type CreatePromoCodeRequest struct {
+	Code          string   `json:"code" binding:"required,max=32,alphanum"`
+	Description   string   `json:"description"`
+	DiscountType  string   `json:"discount_type" binding:"required,oneof=percentage flat"`
+	DiscountValue float64  `json:"discount_value" binding:"required,gt=0"`
+	MaxDiscount   *float64 `json:"max_discount" binding:"omitempty,gt=0"`
+	UsageLimit    *int     `json:"usage_limit" binding:"omitempty,min=1"`
+	// PerUserLimit defaults to one use per passenger; 0 means unlimited
+	PerUserLimit      *int       `json:"per_user_limit" binding:"omitempty,min=0"`
+	FirstRideOnly     bool       `json:"first_ride_only"`
+	VehicleCategories []string   `json:"vehicle_categories"`
+	ValidFrom         *time.Time `json:"valid_from"`
+	ValidUntil        *time.Time `json:"valid_until"`
+}
+
+type UpdatePromoCodeRequest struct {
+	Description *string    `json:"description"`
+	UsageLimit  *int       `json:"usage_limit" binding:"omitempty,min=1"`
+	ValidUntil  *time.Time `json:"valid_until"`
+	IsActive    *bool      `json:"is_active"`
+}
+
+func (h *PromoHandler) ListPromoCodes(c *gin.Context) {
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can manage promo codes"})
+		return
+	}
+
+	promos, err := h.promos.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch promo codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, promos)
+}
+
+func (h *PromoHandler) CreatePromoCode(c *gin.Context) {
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can manage promo codes"})
+		return
+	}
+
+	var req CreatePromoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.DiscountType == models.PromoDiscountPercentage && req.DiscountValue > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Percentage discount cannot exceed 100"})
+		return
+	}
+	if req.ValidFrom != nil && req.ValidUntil != nil && !req.ValidUntil.After(*req.ValidFrom) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "valid_until must be after valid_from"})
+		return
+	}
+	for _, code := range req.VehicleCategories {
+		if _, err := h.categories.Get(code); err != nil {
+			respondVehicleCategoryError(c, err)
+			return
+		}
+	}
+
+	perUserLimit := 1
+	if req.PerUserLimit != nil {
+		perUserLimit = *req.PerUserLimit
+	}
+
+	promo := models.PromoCode{
+		Code:              req.Code,
+		Description:       req.Description,
+		DiscountType:      req.DiscountType,
+		DiscountValue:     req.DiscountValue,
+		MaxDiscount:       req.MaxDiscount,
+		UsageLimit:        req.UsageLimit,
+		PerUserLimit:      perUserLimit,
+		FirstRideOnly:     req.FirstRideOnly,
+		VehicleCategories: strings.Join(req.VehicleCategories, ","),
+		ValidFrom:         req.ValidFrom,
+		ValidUntil:        req.ValidUntil,
+		IsActive:          true,
+	}
+	if err := h.promos.Create(&promo); err != nil {
+		respondPromoError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, promo)
+}
+
+func (h *PromoHandler) UpdatePromoCode(c *gin.Context) {
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can manage promo codes"})
+		return
+	}
+
+	promoID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid promo code ID"})
+		return
+	}
+
+	var req UpdatePromoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := make(map[string]interface{})
+	if req.Description != nil {
+		updates["description"] = *req.Description
+	}
+	if req.UsageLimit != nil {
+		updates["usage_limit"] = *req.UsageLimit
+	}
+	if req.ValidUntil != nil {
+		updates["valid_until"] = *req.ValidUntil
+	}
+	if req.IsActive != nil {
+		updates["is_active"] = *req.IsActive
+	}
+	if len(updates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No changes given"})
+		return
+	}
+
+	promo, err := h.promos.Update(promoID, updates)
+	if err != nil {
+		if errors.Is(err, services.ErrPromoNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update promo code"})
+		return
+	}
+
+	c.JSON(http.StatusOK, promo)
+}
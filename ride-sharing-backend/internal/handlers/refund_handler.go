@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type RefundHandler struct {
+	db      *gorm.DB
+	refunds *services.RefundService
+}
+
+func NewRefundHandler(db *gorm.DB, refunds *services.RefundService) *RefundHandler {
+	return &RefundHandler{
+		db:      db,
+		refunds: refunds,
+	}
+}
+
+type CreateRefundRequest struct {
+	// Amount defaults to all that is left of the payment
+	Amount      float64 `json:"amount" binding:"omitempty,gt=0"`
+	Destination string  `json:"destination" binding:"required"` // "wallet" or the payment method
+	Reason      string  `json:"reason" binding:"required"`
+}
+
+type ReviewRefundRequest struct {
+	Note string `json:"note"`
+}
+
+// CreateRefund refunds some or all of a completed payment
+func (h *RefundHandler) CreateRefund(c *gin.Context) {
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "admin" && currentUserType != "support" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only support staff can issue refunds"})
+		return
+	}
+
+	paymentID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payment ID"})
+		return
+	}
+
+	var req CreateRefundRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	refund, err := h.refunds.Request(paymentID, services.ToCents(req.Amount), req.Destination, req.Reason, uuid.MustParse(currentUserID))
+	if err != nil {
+		respondRefundError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, refund)
+}
+
+// ApproveRefund makes a refund that was above the approval threshold
+func (h *RefundHandler) ApproveRefund(c *gin.Context) {
+	h.reviewRefund(c, h.refunds.Approve)
+}
+
+// RejectRefund turns down a refund that was above the approval threshold
+func (h *RefundHandler) RejectRefund(c *gin.Context) {
+	h.reviewRefund(c, h.refunds.Reject)
+}
+
+func (h *RefundHandler) reviewRefund(c *gin.Context, review func(id, adminID uuid.UUID, note string) (*models.Refund, error)) {
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can review refunds"})
+		return
+	}
+
+	refundID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid refund ID"})
+		return
+	}
+
+	// The note is optional
+	var req ReviewRefundRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	refund, err := review(refundID, uuid.MustParse(currentUserID), req.Note)
+	if err != nil {
+		respondRefundError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, refund)
+}
+
+// GetRideRefunds lists the refunds for a ride. Passengers only see their
+// own refunds.
+func (h *RefundHandler) GetRideRefunds(c *gin.Context) {
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	rideID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ride ID"})
+		return
+	}
+
+	var ride models.Ride
+	if err := h.db.Where("id = ?", rideID).First(&ride).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
+		return
+	}
+
+	refunds, err := h.refunds.ListForRide(ride.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch refunds"})
+		return
+	}
+
+	if currentUserType != "admin" && currentUserType != "support" {
+		own := []models.Refund{}
+		for _, refund := range refunds {
+			if refund.PassengerID.String() == currentUserID {
+				own = append(own, refund)
+			}
+		}
+		refunds = own
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ride_id": ride.ID,
+		"refunds": refunds,
+	})
+}
+
+// respondRefundError maps refund errors to the matching status code
+func respondRefundError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrRefundNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+	case errors.Is(err, services.ErrRefundExceedsPayment), errors.Is(err, services.ErrRefundDestination):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrRefundSelfApproval):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrRefundNotRefundable), errors.Is(err, services.ErrRefundNotAwaitingReview),
+		errors.Is(err, services.ErrRefundSettled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process refund"})
+	}
+}
@@ -1,11 +1,17 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
 
+	"kenyan-ride-share-backend/internal/config"
 	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+	"kenyan-ride-share-backend/pkg/email"
 	"kenyan-ride-share-backend/pkg/utils"
 
 	"github.com/gin-gonic/gin"
@@ -14,11 +20,76 @@ import (
 )
 
 type RideHandler struct {
-	db *gorm.DB
+	db            *gorm.DB
+	lifecycle     *services.RideLifecycleService
+	cancellations *services.CancellationService
+	dispatcher    *services.DispatchService
+	stops         *services.RideStopService
+	receipts      *services.ReceiptService
+	pool          *services.PoolService
+	pins          *services.TripPINService
+	traces        *services.RideTraceService
+	fares         *services.FareService
+	quotes        *services.FareQuoteService
+	categories    *services.VehicleCategoryService
+	promos        *services.PromoService
+	referrals     *services.ReferralService
+	ledger        *services.LedgerService
+	cash          *services.CashService
+	providers     *services.PaymentProviders
+	payments      *services.PaymentService
+	surge         *services.SurgeService
+	notifier      services.Notifier
+	waiting       services.WaitingPolicy
+	schedule      services.ScheduleConfig
 }
 
-func NewRideHandler(db *gorm.DB) *RideHandler {
-	return &RideHandler{db: db}
+func NewRideHandler(db *gorm.DB, cfg *config.Config, dispatcher *services.DispatchService, surge *services.SurgeService, providers *services.PaymentProviders) *RideHandler {
+	lifecycle := services.NewRideLifecycleService(db)
+	poolConfig := services.PoolConfig{
+		SeatCapacity: cfg.PoolSeatCapacity,
+		MaxDetourKm:  cfg.PoolMaxDetourKm,
+		Discount:     cfg.PoolDiscount,
+	}
+	return &RideHandler{
+		db:         db,
+		lifecycle:  lifecycle,
+		dispatcher: dispatcher,
+		surge:      surge,
+		cancellations: services.NewCancellationService(db, lifecycle, services.CancellationPolicy{
+			FreeWindow:   time.Duration(cfg.CancellationFreeWindowMinutes) * time.Minute,
+			PassengerFee: cfg.PassengerCancellationFee,
+			NoShowAfter:  time.Duration(cfg.NoShowAfterMinutes) * time.Minute,
+			NoShowFee:    cfg.NoShowFee,
+		}, services.SystemClock{}),
+		stops:    services.NewRideStopService(db, lifecycle),
+		receipts: services.NewReceiptService(db),
+		pool:     services.NewPoolService(db, lifecycle, poolConfig),
+		fares:      services.NewFareService(db, poolConfig),
+		categories: services.NewVehicleCategoryService(db),
+		promos:     services.NewPromoService(db, services.SystemClock{}),
+		referrals:  services.NewReferralService(db, referralConfig(cfg), services.SystemClock{}),
+		ledger:     services.NewLedgerService(db, services.SystemClock{}),
+		cash:       services.NewCashService(db, services.SystemClock{}, cfg.DriverCashDebtLimit),
+		providers:  providers,
+		payments:   services.NewPaymentService(db, providers, services.SystemClock{}),
+		quotes:   services.NewFareQuoteService(db, surge, poolConfig, time.Duration(cfg.FareQuoteTTLMinutes)*time.Minute, services.SystemClock{}),
+		pins:     services.NewTripPINService(db, lifecycle, cfg.StartPINMaxAttempts),
+		traces: services.NewRideTraceService(db, services.TraceConfig{
+			MinDistanceMeters: cfg.TraceMinDistanceMeters,
+			MaxAccuracyMeters: cfg.TraceMaxAccuracyMeters,
+			MaxSpeedKmh:       cfg.TraceMaxSpeedKmh,
+		}),
+		notifier: services.NewNotificationService(db, email.NewEmailService()),
+		waiting: services.WaitingPolicy{
+			GracePeriod:   time.Duration(cfg.WaitingGraceMinutes) * time.Minute,
+			RatePerMinute: cfg.WaitingChargePerMinute,
+		},
+		schedule: services.ScheduleConfig{
+			MinLead: time.Duration(cfg.ScheduledRideMinLeadMinutes) * time.Minute,
+			MaxLead: time.Duration(cfg.ScheduledRideMaxLeadDays) * 24 * time.Hour,
+		},
+	}
 }
 
 type CreateRideRequestRequest struct {
@@ -28,11 +99,59 @@ type CreateRideRequestRequest struct {
 	DropoffLongitude float64 `json:"dropoff_longitude" binding:"required"`
 	PickupAddress    string  `json:"pickup_address"`
 	DropoffAddress   string  `json:"dropoff_address"`
+	// ScheduledFor books the ride in advance for the given pickup time
+	ScheduledFor *time.Time `json:"scheduled_for"`
+	// Stops are visited in order between pickup and dropoff
+	Stops []StopRequest `json:"stops" binding:"omitempty,max=5,dive"`
+	// RideType "pool" shares the ride with other passengers going the same way
+	RideType string `json:"ride_type" binding:"omitempty,oneof=standard pool"`
+	Seats    int    `json:"seats" binding:"omitempty,min=1,max=2"`
+	// QuoteID locks the price of a fare quote that is still valid
+	QuoteID string `json:"quote_id" binding:"omitempty,uuid"`
+	// VehicleCategory defaults to economy
+	VehicleCategory string `json:"vehicle_category"`
+	// PromoCode takes a discount off the fare, replacing any promo on the quote
+	PromoCode string `json:"promo_code" binding:"omitempty,max=32"`
+	// PaymentMethod defaults to M-Pesa; cash is paid to the driver
+	PaymentMethod string `json:"payment_method"`
 }
 
-type UpdateLocationRequest struct {
+type CreateFareQuoteRequest struct {
+	PickupLatitude   float64       `json:"pickup_latitude" binding:"required"`
+	PickupLongitude  float64       `json:"pickup_longitude" binding:"required"`
+	DropoffLatitude  float64       `json:"dropoff_latitude" binding:"required"`
+	DropoffLongitude float64       `json:"dropoff_longitude" binding:"required"`
+	Stops            []StopRequest `json:"stops" binding:"omitempty,max=5,dive"`
+	PromoCode        string        `json:"promo_code" binding:"omitempty,max=32"`
+}
+
+type StopRequest struct {
 	Latitude  float64 `json:"latitude" binding:"required"`
 	Longitude float64 `json:"longitude" binding:"required"`
+	Address   string  `json:"address"`
+}
+
+type StartRideRequest struct {
+	PIN string `json:"pin" binding:"required,len=4,numeric"`
+}
+
+type UpdateLocationRequest struct {
+	Latitude  float64  `json:"latitude" binding:"required"`
+	Longitude float64  `json:"longitude" binding:"required"`
+	Accuracy  *float64 `json:"accuracy" binding:"omitempty,gte=0"` // meters, as reported by the device
+}
+
+type UpdateAvailabilityRequest struct {
+	IsAvailable *bool `json:"is_available" binding:"required"`
+}
+
+type CancelRequest struct {
+	ReasonCode string `json:"reason_code" binding:"required"`
+	Note       string `json:"note"`
+}
+
+type DeclineRequest struct {
+	Reason string `json:"reason"`
 }
 
 type CreateReviewRequest struct {
@@ -64,10 +183,105 @@ func (h *RideHandler) CreateRideRequest(c *gin.Context) {
 		return
 	}
 
-	// Calculate estimated fare and distance
-	distance := utils.CalculateDistance(req.PickupLatitude, req.PickupLongitude, req.DropoffLatitude, req.DropoffLongitude)
-	estimatedFare := calculateFare(distance)
-	estimatedDuration := int(distance * 3) // Rough estimate: 3 minutes per km
+	if req.RideType == "" {
+		req.RideType = models.RideTypeStandard
+	}
+	if req.Seats == 0 {
+		req.Seats = 1
+	}
+	if req.VehicleCategory == "" {
+		req.VehicleCategory = models.VehicleCategoryEconomy
+	}
+	if req.PaymentMethod == "" {
+		req.PaymentMethod = models.PaymentMethodMpesa
+	}
+	if _, err := h.providers.Get(req.PaymentMethod); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.RideType == models.RideTypePool && len(req.Stops) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Pool rides cannot have intermediate stops"})
+		return
+	}
+	if req.RideType == models.RideTypePool && req.VehicleCategory != services.PoolVehicleCategory {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Pool rides are only available in the " + services.PoolVehicleCategory + " category"})
+		return
+	}
+
+	category, err := h.categories.GetBookable(req.VehicleCategory)
+	if err != nil {
+		respondVehicleCategoryError(c, err)
+		return
+	}
+
+	var promo *models.PromoCode
+	if req.PromoCode != "" {
+		if promo, err = h.promos.Check(req.PromoCode, userUUID, category.Code); err != nil {
+			respondPromoError(c, err)
+			return
+		}
+	}
+
+	// Calculate estimated fare and distance across every leg of the route
+	route := quoteRoute(req.PickupLatitude, req.PickupLongitude, req.DropoffLatitude, req.DropoffLongitude, req.Stops)
+	stops := make([]models.RideStop, 0, len(req.Stops))
+	for i, stop := range req.Stops {
+		stops = append(stops, models.RideStop{
+			Sequence:  i + 1,
+			Latitude:  stop.Latitude,
+			Longitude: stop.Longitude,
+			Address:   stop.Address,
+		})
+	}
+	distance := utils.CalculateRouteDistance(route.Points())
+	surgeMultiplier, err := h.surge.MultiplierAt(req.PickupLatitude, req.PickupLongitude)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up surge pricing"})
+		return
+	}
+	estimatedDuration := services.EstimateDuration(distance)
+	estimatedFare := services.CalculateFinalFare(services.FareInput{
+		Rates:           services.CategoryRates(category),
+		DistanceKm:      distance,
+		DurationMinutes: estimatedDuration,
+		SurgeMultiplier: surgeMultiplier,
+	}).Total
+	if req.RideType == models.RideTypePool {
+		// Pool passengers pay for their own leg less the pooling discount
+		estimatedFare = h.pool.Config().DiscountedFare(estimatedFare)
+	}
+
+	// A valid quote locks the price the passenger was shown
+	var quoteID *uuid.UUID
+	var lockedFare *float64
+	if req.QuoteID != "" {
+		id := uuid.MustParse(req.QuoteID)
+		quote, option, err := h.quotes.ValidateQuote(id, userUUID, req.RideType, req.VehicleCategory, route)
+		if err != nil {
+			respondQuoteError(c, err)
+			return
+		}
+		quoteID = &id
+		surgeMultiplier = quote.SurgeMultiplier
+		// The price is locked before the promo, which comes off again when
+		// the ride ends
+		estimatedFare = option.Total + option.PromoDiscount
+		lockedFare = &estimatedFare
+		if promo == nil && quote.PromoCodeID != nil {
+			if promo, err = h.promos.CheckByID(*quote.PromoCodeID, userUUID, category.Code); err != nil {
+				respondPromoError(c, err)
+				return
+			}
+		}
+	}
+
+	// The passenger is shown the fare after their promo
+	passengerFare := estimatedFare
+	var promoCodeID *uuid.UUID
+	if promo != nil {
+		passengerFare -= services.PromoDiscount(promo, estimatedFare)
+		promoCodeID = &promo.ID
+	}
 
 	// Create ride request
 	rideRequest := models.RideRequest{
@@ -78,32 +292,175 @@ func (h *RideHandler) CreateRideRequest(c *gin.Context) {
 		DropoffLongitude:         req.DropoffLongitude,
 		PickupAddress:            req.PickupAddress,
 		DropoffAddress:           req.DropoffAddress,
-		Status:                   "pending",
-		EstimatedFare:            &estimatedFare,
+		Status:                   models.RideRequestStatusPending,
+		EstimatedFare:            &passengerFare,
 		EstimatedDistanceKm:      &distance,
 		EstimatedDurationMinutes: &estimatedDuration,
+		Stops:                    stops,
+		RideType:                 req.RideType,
+		Seats:                    req.Seats,
+		LockedFare:               lockedFare,
+		SurgeMultiplier:          surgeMultiplier,
+		VehicleCategory:          category.Code,
+		PromoCodeID:              promoCodeID,
+		PaymentMethod:            req.PaymentMethod,
+	}
+
+	// Advance bookings wait for the scheduler and keep the fare quoted now
+	if req.ScheduledFor != nil {
+		if err := h.schedule.ValidatePickupTime(*req.ScheduledFor, time.Now()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rideRequest.Status = models.RideRequestStatusScheduled
+		rideRequest.ScheduledFor = req.ScheduledFor
+		rideRequest.LockedFare = &estimatedFare
 	}
 
-	if err := h.db.Create(&rideRequest).Error; err != nil {
+	// Start transaction
+	tx := h.db.Begin()
+
+	if err := tx.Create(&rideRequest).Error; err != nil {
+		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create ride request"})
 		return
 	}
 
+	if quoteID != nil {
+		if err := h.quotes.RedeemQuote(tx, *quoteID, rideRequest.ID); err != nil {
+			tx.Rollback()
+			respondQuoteError(c, err)
+			return
+		}
+	}
+
+	if promo != nil {
+		if err := h.promos.Reserve(tx, promo, userUUID, rideRequest.ID); err != nil {
+			tx.Rollback()
+			respondPromoError(c, err)
+			return
+		}
+	}
+
+	event := models.RideEvent{
+		RequestID: rideRequest.ID,
+		EventType: models.RideEventStatusChanged,
+		Entity:    "ride_request",
+		ToStatus:  rideRequest.Status,
+		ActorID:   &userUUID,
+	}
+	if err := h.lifecycle.RecordEvent(tx, &event); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record ride request event"})
+		return
+	}
+
+	tx.Commit()
+
+	// A pool request first tries to join a pooled ride already on the road
+	if rideRequest.RideType == models.RideTypePool && rideRequest.Status == models.RideRequestStatusPending {
+		if _, err := h.pool.MatchRequest(&rideRequest); err != nil {
+			log.Printf("Failed to match pool ride request %s: %v", rideRequest.ID, err)
+		}
+	}
+
+	// Offer the request to the best driver nearby. A failure here is not
+	// fatal since the dispatch sweep retries pending requests.
+	if rideRequest.Status == models.RideRequestStatusPending {
+		if err := h.dispatcher.Dispatch(rideRequest.ID); err != nil {
+			log.Printf("Failed to dispatch ride request %s: %v", rideRequest.ID, err)
+		}
+	}
+
 	// Return ride request details
 	// Note: Additional details like passenger info can be fetched separately if needed
 
 	c.JSON(http.StatusCreated, rideRequest)
 }
 
+// GetSurgeMap lists the cells of the service area that are currently surging
+func (h *RideHandler) GetSurgeMap(c *gin.Context) {
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "driver" && currentUserType != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers and admins can view the surge map"})
+		return
+	}
+
+	cells, err := h.surge.SurgeMap()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch surge map"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"cells": cells})
+}
+
+// CreateFareQuote prices a route for each kind of ride. The prices are locked
+// until the quote expires and can be used by passing quote_id when
+// requesting the ride.
+func (h *RideHandler) CreateFareQuote(c *gin.Context) {
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "passenger" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only passengers can request fare quotes"})
+		return
+	}
+
+	var req CreateFareQuoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userUUID, err := uuid.Parse(currentUserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var promo *models.PromoCode
+	if req.PromoCode != "" {
+		if promo, err = h.promos.Check(req.PromoCode, userUUID, ""); err != nil {
+			respondPromoError(c, err)
+			return
+		}
+	}
+
+	quote, err := h.quotes.CreateQuote(userUUID, quoteRoute(req.PickupLatitude, req.PickupLongitude, req.DropoffLatitude, req.DropoffLongitude, req.Stops), promo)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create fare quote"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, quote)
+}
+
 func (h *RideHandler) GetRideRequest(c *gin.Context) {
 	requestID := c.Param("id")
 
 	var rideRequest models.RideRequest
-	if err := h.db.Where("id = ?", requestID).First(&rideRequest).Error; err != nil {
+	if err := h.db.Preload("Stops", orderStops).Where("id = ?", requestID).First(&rideRequest).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Ride request not found"})
 		return
 	}
 
+	// Requests a driver has declined are hidden from that driver
+	if c.GetString("user_type") == "driver" {
+		if driverUUID, err := uuid.Parse(c.GetString("user_id")); err == nil {
+			declined, err := h.dispatcher.HasDeclined(rideRequest.ID, driverUUID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch ride request"})
+				return
+			}
+			if declined {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Ride request not found"})
+				return
+			}
+		}
+	}
+
 	c.JSON(http.StatusOK, rideRequest)
 }
 
@@ -135,9 +492,13 @@ func (h *RideHandler) GetNearbyDrivers(c *gin.Context) {
 		return
 	}
 
-	// Find nearby available drivers
+	// Find nearby available drivers, optionally of one vehicle category
+	query := h.db.Where("is_available = ? AND is_approved = ? AND current_latitude IS NOT NULL AND current_longitude IS NOT NULL", true, true)
+	if category := c.Query("vehicle_category"); category != "" {
+		query = query.Where("vehicle_category = ?", category)
+	}
 	var drivers []models.Driver
-	if err := h.db.Where("is_available = ? AND is_approved = ? AND current_latitude IS NOT NULL AND current_longitude IS NOT NULL", true, true).Find(&drivers).Error; err != nil {
+	if err := query.Find(&drivers).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find drivers"})
 		return
 	}
@@ -182,27 +543,45 @@ func (h *RideHandler) AcceptRideRequest(c *gin.Context) {
 
 	// Get ride request
 	var rideRequest models.RideRequest
-	if err := h.db.Where("id = ? AND status = ?", requestID, "pending").First(&rideRequest).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Ride request not found or already processed"})
+	if err := h.db.Where("id = ?", requestID).First(&rideRequest).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride request not found"})
 		return
 	}
 
 	// Start transaction
 	tx := h.db.Begin()
 
-	// Update ride request status
-	if err := tx.Model(&rideRequest).Update("status", "accepted").Error; err != nil {
+	// Only the driver holding the current offer may accept
+	if err := h.dispatcher.AcceptOffer(tx, rideRequest.ID, driverUUID); err != nil {
+		tx.Rollback()
+		if errors.Is(err, services.ErrNoActiveOffer) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept ride offer"})
+		return
+	}
+
+	// The passenger reads this PIN to the driver at pickup
+	pin, err := services.GeneratePIN()
+	if err != nil {
 		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update ride request"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate trip PIN"})
 		return
 	}
 
 	// Create ride
 	ride := models.Ride{
-		RequestID:   rideRequest.ID,
-		DriverID:    driverUUID,
-		PassengerID: rideRequest.PassengerID,
-		Status:      "in_progress",
+		RequestID:       rideRequest.ID,
+		DriverID:        driverUUID,
+		PassengerID:     rideRequest.PassengerID,
+		RideType:        rideRequest.RideType,
+		VehicleCategory: rideRequest.VehicleCategory,
+		StartPIN:        pin,
+		Status:          models.RideStatusAccepted,
+	}
+	if ride.RideType == "" {
+		ride.RideType = models.RideTypeStandard
 	}
 
 	if err := tx.Create(&ride).Error; err != nil {
@@ -211,6 +590,51 @@ func (h *RideHandler) AcceptRideRequest(c *gin.Context) {
 		return
 	}
 
+	// Update ride request status
+	if err := h.lifecycle.TransitionRideRequest(tx, &rideRequest, services.Transition{
+		To:      models.RideRequestStatusAccepted,
+		ActorID: &driverUUID,
+		Updates: map[string]interface{}{"ride_id": ride.ID},
+	}); err != nil {
+		tx.Rollback()
+		respondTransitionError(c, err, "Failed to update ride request")
+		return
+	}
+
+	// A pooled ride starts its route with the first passenger
+	if ride.RideType == models.RideTypePool {
+		if err := h.pool.CreateInitialWaypoints(tx, &ride, &rideRequest); err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create ride route"})
+			return
+		}
+	}
+
+	rideID := ride.ID
+	event := models.RideEvent{
+		RequestID: ride.RequestID,
+		RideID:    &rideID,
+		EventType: models.RideEventStatusChanged,
+		Entity:    "ride",
+		ToStatus:  ride.Status,
+		ActorID:   &driverUUID,
+	}
+	if err := h.lifecycle.RecordEvent(tx, &event); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record ride event"})
+		return
+	}
+
+	// The driver heads to the pickup as soon as the ride is accepted
+	if err := h.lifecycle.TransitionRide(tx, &ride, services.Transition{
+		To:      models.RideStatusDriverArriving,
+		ActorID: &driverUUID,
+	}); err != nil {
+		tx.Rollback()
+		respondTransitionError(c, err, "Failed to update ride")
+		return
+	}
+
 	// Update driver availability
 	if err := tx.Model(&driver).Update("is_available", false).Error; err != nil {
 		tx.Rollback()
@@ -231,6 +655,7 @@ func (h *RideHandler) AcceptRideRequest(c *gin.Context) {
 
 func (h *RideHandler) RejectRideRequest(c *gin.Context) {
 	requestID := c.Param("id")
+	currentUserID := c.GetString("user_id")
 	currentUserType := c.GetString("user_type")
 
 	if currentUserType != "driver" {
@@ -238,68 +663,98 @@ func (h *RideHandler) RejectRideRequest(c *gin.Context) {
 		return
 	}
 
+	// Parse user ID
+	driverUUID, err := uuid.Parse(currentUserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	// The reason is optional
+	var req DeclineRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	// Get ride request
 	var rideRequest models.RideRequest
-	if err := h.db.Where("id = ? AND status = ?", requestID, "pending").First(&rideRequest).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Ride request not found or already processed"})
+	if err := h.db.Where("id = ?", requestID).First(&rideRequest).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride request not found"})
 		return
 	}
 
-	// Update ride request status
-	if err := h.db.Model(&rideRequest).Update("status", "rejected").Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update ride request"})
+	if rideRequest.Status != models.RideRequestStatusPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Ride request is no longer pending"})
+		return
+	}
+
+	// Hide the request from this driver only; it stays pending for everyone
+	// else and moves on to the next candidate if this driver held the offer
+	if err := h.dispatcher.DeclineRequest(rideRequest.ID, driverUUID, req.Reason); err != nil {
+		log.Printf("Failed to decline ride request %s: %v", rideRequest.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decline ride request"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Ride request rejected"})
+	c.JSON(http.StatusOK, gin.H{"message": "Ride request declined"})
 }
 
-func (h *RideHandler) StartRide(c *gin.Context) {
-	rideID := c.Param("id")
+func (h *RideHandler) CancelRideRequest(c *gin.Context) {
+	requestID := c.Param("id")
 	currentUserID := c.GetString("user_id")
-	currentUserType := c.GetString("user_type")
 
-	if currentUserType != "driver" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can start rides"})
+	var req CancelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Parse user ID
-	driverUUID, err := uuid.Parse(currentUserID)
+	userUUID, err := uuid.Parse(currentUserID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
 		return
 	}
 
-	// Get ride
-	var ride models.Ride
-	if err := h.db.Where("id = ? AND driver_id = ? AND status = ?", rideID, driverUUID, "in_progress").First(&ride).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found or not authorized"})
+	// Get ride request
+	var rideRequest models.RideRequest
+	if err := h.db.Where("id = ?", requestID).First(&rideRequest).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride request not found"})
 		return
 	}
 
-	// Update ride start time
-	now := time.Now()
-	if err := h.db.Model(&ride).Update("start_time", now).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start ride"})
+	cancellation, err := h.cancellations.CancelRideRequest(&rideRequest, services.CancellationRequest{
+		ActorID:    userUUID,
+		ReasonCode: req.ReasonCode,
+		Note:       req.Note,
+	})
+	if err != nil {
+		respondCancellationError(c, err)
 		return
 	}
+	h.redispatchAfterCancellation(cancellation)
 
-	c.JSON(http.StatusOK, gin.H{"message": "Ride started", "start_time": now})
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Ride request cancelled",
+		"cancellation": cancellation,
+	})
 }
 
-func (h *RideHandler) EndRide(c *gin.Context) {
+func (h *RideHandler) CancelRide(c *gin.Context) {
 	rideID := c.Param("id")
 	currentUserID := c.GetString("user_id")
-	currentUserType := c.GetString("user_type")
 
-	if currentUserType != "driver" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can end rides"})
+	var req CancelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Parse user ID
-	driverUUID, err := uuid.Parse(currentUserID)
+	userUUID, err := uuid.Parse(currentUserID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
 		return
@@ -307,100 +762,682 @@ func (h *RideHandler) EndRide(c *gin.Context) {
 
 	// Get ride
 	var ride models.Ride
-	if err := h.db.Where("id = ? AND driver_id = ? AND status = ?", rideID, driverUUID, "in_progress").First(&ride).Error; err != nil {
+	if err := h.db.Where("id = ?", rideID).First(&ride).Error; err != nil || !h.isRideParticipant(&ride, currentUserID) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found or not authorized"})
 		return
 	}
 
-	if ride.StartTime == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Ride has not been started yet"})
+	cancellation, err := h.cancellations.CancelRide(&ride, services.CancellationRequest{
+		ActorID:    userUUID,
+		ReasonCode: req.ReasonCode,
+		Note:       req.Note,
+	})
+	if err != nil {
+		respondCancellationError(c, err)
 		return
 	}
+	h.redispatchAfterCancellation(cancellation)
 
-	// Get ride request for fare calculation
-	var rideRequest models.RideRequest
-	if err := h.db.Where("id = ?", ride.RequestID).First(&rideRequest).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Ride request not found"})
-		return
-	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Ride cancelled",
+		"cancellation": cancellation,
+	})
+}
 
-	// Calculate actual fare and duration
-	now := time.Now()
-	duration := int(now.Sub(*ride.StartTime).Minutes())
-	actualFare := *rideRequest.EstimatedFare // Use estimated fare for now
-	actualDistance := *rideRequest.EstimatedDistanceKm
+func (h *RideHandler) StartRide(c *gin.Context) {
+	rideID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
 
-	// Start transaction
-	tx := h.db.Begin()
+	if currentUserType != "driver" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can start rides"})
+		return
+	}
 
-	// Update ride
-	updates := map[string]interface{}{
-		"end_time":                now,
-		"status":                  "completed",
-		"actual_fare":             actualFare,
-		"actual_distance_km":      actualDistance,
-		"actual_duration_minutes": duration,
+	var req StartRideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	if err := tx.Model(&ride).Updates(updates).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end ride"})
+	// Parse user ID
+	driverUUID, err := uuid.Parse(currentUserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
 		return
 	}
 
-	// Update ride request status
-	if err := tx.Model(&models.RideRequest{}).Where("id = ?", ride.RequestID).Update("status", "completed").Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update ride request"})
+	// Get ride
+	var ride models.Ride
+	if err := h.db.Where("id = ? AND driver_id = ?", rideID, driverUUID).First(&ride).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found or not authorized"})
 		return
 	}
 
-	// Update driver availability
-	if err := tx.Model(&models.Driver{}).Where("driver_id = ?", driverUUID).Update("is_available", true).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update driver availability"})
+	// Check the status first so a wrong PIN on a ride that cannot start
+	// does not count as an attempt
+	if !services.CanTransitionRide(ride.Status, models.RideStatusInProgress) {
+		respondTransitionError(c, &services.InvalidTransitionError{Entity: "ride", From: ride.Status, To: models.RideStatusInProgress}, "Failed to start ride")
 		return
 	}
 
-	// Create payment record
-	payment := models.Payment{
-		RideID:        ride.ID,
-		Amount:        actualFare,
-		Currency:      "KES",
-		PaymentMethod: "mpesa", // Default to M-Pesa
-		PaymentStatus: "pending",
+	// The driver must enter the passenger's PIN
+	if err := h.pins.VerifyPIN(&ride, req.PIN, driverUUID); err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidPIN):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":              err.Error(),
+				"attempts_remaining": h.pins.AttemptsRemaining(&ride),
+			})
+		case errors.Is(err, services.ErrRideFlagged):
+			c.JSON(http.StatusLocked, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify trip PIN"})
+		}
+		return
 	}
 
-	if err := tx.Create(&payment).Error; err != nil {
+	// Move the ride to in_progress, stamp the start time and charge for
+	// any waiting past the grace period
+	now := time.Now()
+	waitingMinutes, waitingCharge := h.waiting.ChargeFor(ride.ArrivedAt, now)
+	tx := h.db.Begin()
+	if err := h.lifecycle.TransitionRide(tx, &ride, services.Transition{
+		To:      models.RideStatusInProgress,
+		ActorID: &driverUUID,
+		Updates: map[string]interface{}{
+			"start_time":      now,
+			"waiting_minutes": waitingMinutes,
+			"waiting_charge":  waitingCharge,
+		},
+	}); err != nil {
 		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment record"})
+		respondTransitionError(c, err, "Failed to start ride")
 		return
 	}
-
 	tx.Commit()
 
 	c.JSON(http.StatusOK, gin.H{
-		"message":     "Ride completed",
-		"ride":        ride,
-		"payment_id":  payment.ID,
-		"total_fare":  actualFare,
+		"message":         "Ride started",
+		"start_time":      now,
+		"waiting_minutes": waitingMinutes,
+		"waiting_charge":  waitingCharge,
 	})
 }
 
-func (h *RideHandler) GetRide(c *gin.Context) {
+func (h *RideHandler) MarkArrived(c *gin.Context) {
 	rideID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
 
-	var ride models.Ride
-	if err := h.db.Preload("Driver.User").Preload("Passenger").Where("id = ?", rideID).First(&ride).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
+	if currentUserType != "driver" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can mark arrival"})
 		return
 	}
 
-	c.JSON(http.StatusOK, ride)
-}
-
-func (h *RideHandler) GetUserRides(c *gin.Context) {
-	userID := c.Param("id")
+	driverUUID, err := uuid.Parse(currentUserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var ride models.Ride
+	if err := h.db.Where("id = ? AND driver_id = ?", rideID, driverUUID).First(&ride).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found or not authorized"})
+		return
+	}
+
+	now := time.Now()
+	tx := h.db.Begin()
+	if err := h.lifecycle.TransitionRide(tx, &ride, services.Transition{
+		To:      models.RideStatusArrived,
+		ActorID: &driverUUID,
+		Updates: map[string]interface{}{"arrived_at": now},
+	}); err != nil {
+		tx.Rollback()
+		respondTransitionError(c, err, "Failed to mark arrival")
+		return
+	}
+	tx.Commit()
+
+	// Let the passenger know the driver is waiting
+	rideUUID := ride.ID
+	go func() {
+		if err := h.notifier.Notify(&models.Notification{
+			UserID:  ride.PassengerID,
+			Type:    models.NotificationDriverArrived,
+			Title:   "Your driver has arrived",
+			Message: fmt.Sprintf("Your driver is waiting at the pickup. Waiting is free for %d minutes, then KES %.0f per minute.", int(h.waiting.GracePeriod.Minutes()), h.waiting.RatePerMinute),
+			RideID:  &rideUUID,
+		}); err != nil {
+			log.Printf("Failed to notify passenger of arrival for ride %s: %v", ride.ID, err)
+		}
+	}()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Arrival recorded", "arrived_at": now})
+}
+
+func (h *RideHandler) MarkNoShow(c *gin.Context) {
+	rideID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "driver" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can mark a no-show"})
+		return
+	}
+
+	driverUUID, err := uuid.Parse(currentUserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	// The note is optional
+	var req struct {
+		Note string `json:"note"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var ride models.Ride
+	if err := h.db.Where("id = ? AND driver_id = ?", rideID, driverUUID).First(&ride).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found or not authorized"})
+		return
+	}
+
+	cancellation, err := h.cancellations.MarkNoShow(&ride, driverUUID, req.Note)
+	if err != nil {
+		respondCancellationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Passenger marked as no-show",
+		"cancellation": cancellation,
+	})
+}
+
+func (h *RideHandler) MarkStopReached(c *gin.Context) {
+	rideID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "driver" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can mark stops as reached"})
+		return
+	}
+
+	driverUUID, err := uuid.Parse(currentUserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	sequence, err := strconv.Atoi(c.Param("sequence"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid stop sequence"})
+		return
+	}
+
+	var ride models.Ride
+	if err := h.db.Where("id = ? AND driver_id = ?", rideID, driverUUID).First(&ride).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found or not authorized"})
+		return
+	}
+
+	stop, err := h.stops.MarkStopReached(&ride, sequence, driverUUID)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrStopNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrStopAlreadyReached), errors.Is(err, services.ErrStopOutOfOrder), errors.Is(err, services.ErrRideNotInProgress):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark stop as reached"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, stop)
+}
+
+func (h *RideHandler) EndRide(c *gin.Context) {
+	rideID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "driver" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can end rides"})
+		return
+	}
+
+	// Parse user ID
+	driverUUID, err := uuid.Parse(currentUserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	// Get ride
+	var ride models.Ride
+	if err := h.db.Where("id = ? AND driver_id = ?", rideID, driverUUID).First(&ride).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found or not authorized"})
+		return
+	}
+
+	if ride.StartTime == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Ride has not been started yet"})
+		return
+	}
+
+	// Get the ride requests for fare calculation. A pooled ride carries
+	// several, each paying for their own leg.
+	var rideRequests []models.RideRequest
+	if err := h.db.Where("status = ?", models.RideRequestStatusAccepted).
+		Where("ride_id = ? OR (ride_id IS NULL AND id = ?)", ride.ID, ride.RequestID).
+		Find(&rideRequests).Error; err != nil || len(rideRequests) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride request not found"})
+		return
+	}
+
+	// Calculate actual distance and duration
+	now := time.Now()
+	duration := int(now.Sub(*ride.StartTime).Minutes())
+	actualDistance := 0.0
+	for _, rideRequest := range rideRequests {
+		if rideRequest.ID == ride.RequestID && rideRequest.EstimatedDistanceKm != nil {
+			actualDistance = *rideRequest.EstimatedDistanceKm
+		}
+	}
+	if ride.RideType == models.RideTypePool {
+		waypoints, err := h.pool.GetWaypoints(ride.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load ride route"})
+			return
+		}
+		route := make([]utils.Coordinate, 0, len(waypoints))
+		for _, waypoint := range waypoints {
+			route = append(route, utils.Coordinate{Latitude: waypoint.Latitude, Longitude: waypoint.Longitude})
+		}
+		actualDistance = utils.CalculateRouteDistance(route)
+	}
+
+	// Prefer the distance actually driven when enough of the route was recorded
+	trace, err := h.traces.BuildTrace(ride.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load ride trace"})
+		return
+	}
+	if trace.Points >= 2 {
+		actualDistance = trace.DistanceKm
+	}
+
+	// Calculate each passenger's fare from the measured trip
+	breakdowns, err := h.fares.CalculateRideFares(&ride, rideRequests, actualDistance, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate fare"})
+		return
+	}
+	actualFare := 0.0
+	for _, breakdown := range breakdowns {
+		actualFare += breakdown.Total
+	}
+
+	// Start transaction
+	tx := h.db.Begin()
+
+	// Update ride
+	updates := map[string]interface{}{
+		"end_time":                now,
+		"actual_fare":             actualFare,
+		"actual_distance_km":      actualDistance,
+		"actual_duration_minutes": duration,
+		"route_geojson":           trace.GeoJSON,
+		"route_polyline":          trace.Polyline,
+	}
+
+	if err := h.lifecycle.TransitionRide(tx, &ride, services.Transition{
+		To:      models.RideStatusCompleted,
+		ActorID: &driverUUID,
+		Updates: updates,
+	}); err != nil {
+		tx.Rollback()
+		respondTransitionError(c, err, "Failed to end ride")
+		return
+	}
+
+	// Update ride request status
+	for i := range rideRequests {
+		if err := h.lifecycle.TransitionRideRequest(tx, &rideRequests[i], services.Transition{
+			To:      models.RideRequestStatusCompleted,
+			ActorID: &driverUUID,
+		}); err != nil {
+			tx.Rollback()
+			respondTransitionError(c, err, "Failed to update ride request")
+			return
+		}
+	}
+
+	// Update driver availability
+	if err := tx.Model(&models.Driver{}).Where("driver_id = ?", driverUUID).Updates(map[string]interface{}{
+		"is_available":    true,
+		"available_since": now,
+	}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update driver availability"})
+		return
+	}
+
+	// Store the fare breakdowns and create a payment record for each passenger
+	if err := tx.Create(&breakdowns).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save fare breakdown"})
+		return
+	}
+	ride.FareBreakdowns = breakdowns
+
+	// Post what each passenger owes and the driver's and platform's shares
+	for i := range breakdowns {
+		if err := h.ledger.PostRideFare(tx, &breakdowns[i], driverUUID); err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to post ride fare to the ledger"})
+			return
+		}
+	}
+
+	promoCodes := make(map[uuid.UUID]*uuid.UUID, len(rideRequests))
+	paymentMethods := make(map[uuid.UUID]string, len(rideRequests))
+	for _, rideRequest := range rideRequests {
+		promoCodes[rideRequest.ID] = rideRequest.PromoCodeID
+		paymentMethods[rideRequest.ID] = rideRequest.PaymentMethod
+	}
+
+	paymentIDs := make([]uuid.UUID, 0, len(breakdowns))
+	for _, breakdown := range breakdowns {
+		if promoCodes[breakdown.RequestID] != nil {
+			if err := h.promos.Apply(tx, breakdown.RequestID, breakdown.PromoDiscount); err != nil {
+				tx.Rollback()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record promo redemption"})
+				return
+			}
+		}
+
+		passengerID := breakdown.PassengerID
+		payment := models.Payment{
+			RideID:        ride.ID,
+			PassengerID:   &passengerID,
+			Amount:        breakdown.Total,
+			Discount:      breakdown.PromoDiscount,
+			PromoCodeID:   promoCodes[breakdown.RequestID],
+			Currency:      "KES",
+			PaymentMethod: paymentMethods[breakdown.RequestID],
+			PaymentStatus: "pending",
+		}
+		if payment.PaymentMethod == "" {
+			payment.PaymentMethod = models.PaymentMethodMpesa
+		}
+		if err := h.payments.ApplyWalletCredit(tx, &payment, passengerID); err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply wallet credit"})
+			return
+		}
+		// Cash is paid to the driver before they leave, along with any fees
+		// the passenger still owes
+		if payment.PaymentMethod == models.PaymentMethodCash {
+			payment.PaymentStatus = "completed"
+			payment.AmountPaid = payment.Amount + payment.WalletDebt
+			payment.PaymentDate = now
+		}
+
+		if err := tx.Create(&payment).Error; err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment record"})
+			return
+		}
+		// Fares paid in cash or covered by wallet credit are already
+		// collected, so the driver's share can be paid out
+		if payment.PaymentStatus == "completed" {
+			if err := h.ledger.ReleaseEarnings(tx, &payment); err != nil {
+				tx.Rollback()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release driver earnings"})
+				return
+			}
+		}
+		if payment.PaymentMethod == models.PaymentMethodCash {
+			if err := h.cash.Collect(tx, &payment, passengerID, driverUUID); err != nil {
+				tx.Rollback()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to post cash payment to the ledger"})
+				return
+			}
+		}
+		paymentIDs = append(paymentIDs, payment.ID)
+	}
+
+	// A driver who now owes too much commission on cash rides goes offline
+	if err := h.cash.CheckDebt(tx, driverUUID); err != nil {
+		if !errors.Is(err, services.ErrDriverDebtLimit) {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check commission owed"})
+			return
+		}
+		if err := tx.Model(&models.Driver{}).Where("driver_id = ?", driverUUID).Update("is_available", false).Error; err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update driver availability"})
+			return
+		}
+	}
+
+	tx.Commit()
+
+	// Completed rides count towards the referrals of the driver and riders
+	referees := []uuid.UUID{driverUUID}
+	for _, rideRequest := range rideRequests {
+		referees = append(referees, rideRequest.PassengerID)
+	}
+	for _, userID := range referees {
+		if err := h.referrals.RecordCompletedRide(userID); err != nil {
+			log.Printf("Failed to update referral of user %s: %v", userID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Ride completed",
+		"ride":        ride,
+		"payment_id":  paymentIDs[0],
+		"payment_ids": paymentIDs,
+		"total_fare":  actualFare,
+	})
+}
+
+func (h *RideHandler) GetRide(c *gin.Context) {
+	rideID := c.Param("id")
+
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	var ride models.Ride
+	if err := h.db.Where("id = ?", rideID).First(&ride).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
+		return
+	}
+
+	// Passengers see their own fare breakdown; the driver and admins see all
+	breakdowns := h.db.Where("ride_id = ?", ride.ID)
+	if currentUserType != "admin" && ride.DriverID.String() != currentUserID {
+		breakdowns = breakdowns.Where("passenger_id = ?", currentUserID)
+	}
+	if err := breakdowns.Find(&ride.FareBreakdowns).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load fare breakdown"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ride)
+}
+
+// GetRidePIN shows the trip start PIN to the passenger who booked the ride
+func (h *RideHandler) GetRidePIN(c *gin.Context) {
+	rideID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+
+	var ride models.Ride
+	if err := h.db.Where("id = ?", rideID).First(&ride).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
+		return
+	}
+
+	if ride.PassengerID.String() != currentUserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the passenger can view the trip PIN"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ride_id": ride.ID,
+		"pin":     ride.StartPIN,
+	})
+}
+
+func (h *RideHandler) GetRideTimeline(c *gin.Context) {
+	rideID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	var ride models.Ride
+	if err := h.db.Where("id = ?", rideID).First(&ride).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
+		return
+	}
+
+	// Only the ride participants or an admin can view the timeline
+	if currentUserType != "admin" && !h.isRideParticipant(&ride, currentUserID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only view the timeline of your own rides"})
+		return
+	}
+
+	events, err := h.lifecycle.GetRideTimeline(&ride)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch ride timeline"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ride_id": ride.ID,
+		"status":  ride.Status,
+		"events":  events,
+	})
+}
+
+func (h *RideHandler) GetRideReceipt(c *gin.Context) {
+	rideID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	var ride models.Ride
+	if err := h.db.Where("id = ?", rideID).First(&ride).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
+		return
+	}
+
+	// Only the ride participants or an admin can view the receipt
+	if currentUserType != "admin" && !h.isRideParticipant(&ride, currentUserID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	// Passengers see their own fare; the driver and admins see the booking passenger's
+	passengerID := ride.PassengerID
+	if currentUserType == "passenger" {
+		passengerID, _ = uuid.Parse(currentUserID)
+	}
+
+	receipt, err := h.receipts.GetReceipt(&ride, passengerID)
+	if err != nil {
+		if errors.Is(err, services.ErrRideNotCompleted) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build receipt"})
+		return
+	}
+
+	c.JSON(http.StatusOK, receipt)
+}
+
+func (h *RideHandler) GetRideWaypoints(c *gin.Context) {
+	rideID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	var ride models.Ride
+	if err := h.db.Where("id = ?", rideID).First(&ride).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
+		return
+	}
+
+	if currentUserType != "admin" && !h.isRideParticipant(&ride, currentUserID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	waypoints, err := h.pool.GetWaypoints(ride.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch waypoints"})
+		return
+	}
+
+	c.JSON(http.StatusOK, waypoints)
+}
+
+func (h *RideHandler) CompleteWaypoint(c *gin.Context) {
+	rideID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "driver" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can complete waypoints"})
+		return
+	}
+
+	driverUUID, err := uuid.Parse(currentUserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	sequence, err := strconv.Atoi(c.Param("sequence"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid waypoint sequence"})
+		return
+	}
+
+	var ride models.Ride
+	if err := h.db.Where("id = ? AND driver_id = ?", rideID, driverUUID).First(&ride).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found or not authorized"})
+		return
+	}
+
+	waypoint, err := h.pool.CompleteWaypoint(&ride, sequence, driverUUID)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrWaypointNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrNotPoolRide), errors.Is(err, services.ErrWaypointAlreadyDone), errors.Is(err, services.ErrWaypointOutOfOrder):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete waypoint"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, waypoint)
+}
+
+func (h *RideHandler) GetUserRides(c *gin.Context) {
+	userID := c.Param("id")
 	currentUserID := c.GetString("user_id")
 
 	// Users can only view their own rides
@@ -454,9 +1491,181 @@ func (h *RideHandler) UpdateDriverLocation(c *gin.Context) {
 		return
 	}
 
+	// Add the location to the trace of the ride in progress, if any. A
+	// failure here should not stop the driver's location from updating.
+	if _, err := h.traces.RecordLocation(driverUUID, req.Latitude, req.Longitude, req.Accuracy, now); err != nil {
+		log.Printf("Failed to record ride location for driver %s: %v", driverUUID, err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Location updated successfully"})
 }
 
+func (h *RideHandler) UpdateDriverAvailability(c *gin.Context) {
+	driverID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "driver" || driverID != currentUserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only update your own availability"})
+		return
+	}
+
+	var req UpdateAvailabilityRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var driver models.Driver
+	if err := h.db.Where("driver_id = ?", driverID).First(&driver).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Driver not found"})
+		return
+	}
+
+	if *req.IsAvailable && !driver.IsApproved {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Driver is not approved yet"})
+		return
+	}
+
+	// Commission owed on cash rides has to come down before going online
+	if *req.IsAvailable {
+		if err := h.cash.CheckDebt(h.db, driver.DriverID); err != nil {
+			if errors.Is(err, services.ErrDriverDebtLimit) {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check commission owed"})
+			return
+		}
+	}
+
+	// Availability is managed by the ride flow while the driver is on a trip
+	var activeRides int64
+	if err := h.db.Model(&models.Ride{}).Where("driver_id = ? AND status NOT IN ?", driver.DriverID, []string{models.RideStatusCompleted, models.RideStatusCancelled}).Count(&activeRides).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check active rides"})
+		return
+	}
+	if activeRides > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Driver has an active ride"})
+		return
+	}
+
+	updates := map[string]interface{}{"is_available": *req.IsAvailable}
+	if *req.IsAvailable && !driver.IsAvailable {
+		updates["available_since"] = time.Now()
+	}
+	if err := h.db.Model(&driver).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update availability"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Availability updated successfully",
+		"is_available": *req.IsAvailable,
+	})
+}
+
+func (h *RideHandler) GetDriverOffers(c *gin.Context) {
+	driverID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "driver" || driverID != currentUserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only view your own ride offers"})
+		return
+	}
+
+	driverUUID, err := uuid.Parse(driverID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid driver ID"})
+		return
+	}
+
+	offers, err := h.dispatcher.GetDriverOffers(driverUUID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch ride offers"})
+		return
+	}
+
+	// Include the request details so the driver can decide
+	requestIDs := make([]uuid.UUID, 0, len(offers))
+	for _, offer := range offers {
+		requestIDs = append(requestIDs, offer.RequestID)
+	}
+	var rideRequests []models.RideRequest
+	if len(requestIDs) > 0 {
+		if err := h.db.Preload("Stops", orderStops).Where("id IN ?", requestIDs).Find(&rideRequests).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch ride requests"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"offers":        offers,
+		"ride_requests": rideRequests,
+	})
+}
+
+func (h *RideHandler) GetDriverResponseStats(c *gin.Context) {
+	driverID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "admin" && driverID != currentUserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	driverUUID, err := uuid.Parse(driverID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid driver ID"})
+		return
+	}
+
+	since, ok := responseStatsSince(c)
+	if !ok {
+		return
+	}
+
+	stats, err := h.dispatcher.GetDriverResponseStats(&driverUUID, since)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch response stats"})
+		return
+	}
+
+	if len(stats) == 0 {
+		c.JSON(http.StatusOK, services.DriverResponseStats{DriverID: driverUUID})
+		return
+	}
+	c.JSON(http.StatusOK, stats[0])
+}
+
+// ListDriverResponseStats returns decline and acceptance rates for every
+// driver, highest decline rate first, for ops review.
+func (h *RideHandler) ListDriverResponseStats(c *gin.Context) {
+	currentUserType := c.GetString("user_type")
+	if currentUserType != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+		return
+	}
+
+	since, ok := responseStatsSince(c)
+	if !ok {
+		return
+	}
+
+	stats, err := h.dispatcher.GetDriverResponseStats(nil, since)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch response stats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"since":   since,
+		"drivers": stats,
+	})
+}
+
 func (h *RideHandler) GetDriverLocation(c *gin.Context) {
 	driverID := c.Param("id")
 
@@ -553,11 +1762,131 @@ func (h *RideHandler) GetUserReviews(c *gin.Context) {
 }
 
 // Helper functions
-func calculateFare(distanceKm float64) float64 {
-	// Basic fare calculation for Kenya
-	baseFare := 50.0  // KES 50 base fare
-	perKmRate := 25.0 // KES 25 per km
-	return baseFare + (distanceKm * perKmRate)
+// isRideParticipant reports whether the user is the ride's driver or one of
+// its passengers, including pooled passengers who joined later.
+func (h *RideHandler) isRideParticipant(ride *models.Ride, userID string) bool {
+	if ride.PassengerID.String() == userID || ride.DriverID.String() == userID {
+		return true
+	}
+	if ride.RideType != models.RideTypePool {
+		return false
+	}
+	var count int64
+	h.db.Model(&models.RideRequest{}).Where("ride_id = ? AND passenger_id = ?", ride.ID, userID).Count(&count)
+	return count > 0
+}
+
+// orderStops preloads ride stops in visiting order
+func orderStops(db *gorm.DB) *gorm.DB {
+	return db.Order("sequence ASC")
+}
+
+// quoteRoute builds the route of a quote or ride request
+func quoteRoute(pickupLatitude, pickupLongitude, dropoffLatitude, dropoffLongitude float64, stops []StopRequest) services.QuoteRoute {
+	route := services.QuoteRoute{
+		Pickup:  utils.Coordinate{Latitude: pickupLatitude, Longitude: pickupLongitude},
+		Dropoff: utils.Coordinate{Latitude: dropoffLatitude, Longitude: dropoffLongitude},
+	}
+	for _, stop := range stops {
+		route.Stops = append(route.Stops, utils.Coordinate{Latitude: stop.Latitude, Longitude: stop.Longitude})
+	}
+	return route
+}
+
+// responseStatsSince reads the optional "days" query parameter (default 30)
+func responseStatsSince(c *gin.Context) (time.Time, bool) {
+	days := 30
+	if value := c.Query("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid days"})
+			return time.Time{}, false
+		}
+		days = parsed
+	}
+	return time.Now().AddDate(0, 0, -days), true
+}
+
+// respondTransitionError maps lifecycle errors to a 409 and anything else to a 500 with the given message
+func respondTransitionError(c *gin.Context, err error, message string) {
+	var transitionErr *services.InvalidTransitionError
+	if errors.As(err, &transitionErr) || errors.Is(err, services.ErrStatusChanged) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+}
+
+// redispatchAfterCancellation offers a request to the next driver when its
+// driver pulled out
+func (h *RideHandler) redispatchAfterCancellation(cancellation *models.RideCancellation) {
+	if cancellation.CancelledByType != models.CancelledByDriver {
+		return
+	}
+	if err := h.dispatcher.Dispatch(cancellation.RequestID); err != nil {
+		log.Printf("Failed to re-dispatch ride request %s: %v", cancellation.RequestID, err)
+	}
+}
+
+// respondCancellationError maps cancellation errors to the matching status code
+func respondCancellationError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrNotRideParticipant):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidReasonCode):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrTripAlreadyStarted), errors.Is(err, services.ErrNotArrived),
+		errors.Is(err, services.ErrNoShowTooEarly), errors.Is(err, services.ErrNoShowSharedRide):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
+	default:
+		respondTransitionError(c, err, "Failed to cancel ride")
+	}
+}
+
+// respondVehicleCategoryError maps vehicle category errors to the matching status code
+func respondVehicleCategoryError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrVehicleCategoryNotFound), errors.Is(err, services.ErrVehicleCategoryUnavailable):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrVehicleCategoryExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load vehicle category"})
+	}
+}
+
+// respondQuoteError maps fare quote errors to the matching status code
+func respondQuoteError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrQuoteNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrQuoteRouteMismatch), errors.Is(err, services.ErrQuoteOptionNotOffered):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrQuoteExpired), errors.Is(err, services.ErrQuoteUsed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to use fare quote"})
+	}
+}
+
+// respondPromoError maps promo code errors to the matching status code
+func respondPromoError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrPromoNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrPromoNotOwner):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrPromoInactive), errors.Is(err, services.ErrPromoNotValidNow),
+		errors.Is(err, services.ErrPromoFirstRideOnly), errors.Is(err, services.ErrPromoCategory):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrPromoExhausted), errors.Is(err, services.ErrPromoUserLimit),
+		errors.Is(err, services.ErrPromoExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply promo code"})
+	}
 }
 
 func (h *RideHandler) updateUserRating(userID uuid.UUID) {
@@ -1,11 +1,13 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	"kenyan-ride-share-backend/internal/config"
 	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
 	"kenyan-ride-share-backend/pkg/email"
 	"kenyan-ride-share-backend/pkg/utils"
 
@@ -18,6 +20,7 @@ type UserHandler struct {
 	db           *gorm.DB
 	emailService *email.EmailService
 	config       *config.Config
+	referrals    *services.ReferralService
 }
 
 func NewUserHandler(db *gorm.DB, cfg *config.Config) *UserHandler {
@@ -25,6 +28,17 @@ func NewUserHandler(db *gorm.DB, cfg *config.Config) *UserHandler {
 		db:           db,
 		emailService: email.NewEmailService(),
 		config:       cfg,
+		referrals:    services.NewReferralService(db, referralConfig(cfg), services.SystemClock{}),
+	}
+}
+
+// referralConfig reads the referral program settings
+func referralConfig(cfg *config.Config) services.ReferralConfig {
+	return services.ReferralConfig{
+		RequiredRides:  cfg.ReferralRequiredRides,
+		ReferrerReward: cfg.ReferrerReward,
+		RefereeReward:  cfg.RefereeReward,
+		RewardValidity: time.Duration(cfg.ReferralRewardValidDays) * 24 * time.Hour,
 	}
 }
 
@@ -35,6 +49,10 @@ type RegisterRequest struct {
 	Email       string `json:"email" binding:"required,email"`
 	PhoneNumber string `json:"phone_number" binding:"required"`
 	Password    string `json:"password" binding:"required,min=6"`
+	// ReferralCode is the code of the user who referred this one
+	ReferralCode string `json:"referral_code"`
+	// DeviceID identifies the app install, to spot self-referrals
+	DeviceID string `json:"device_id" binding:"omitempty,max=128"`
 }
 
 type LoginRequest struct {
@@ -48,6 +66,7 @@ type OnboardDriverRequest struct {
 	LicensePlate          string `json:"license_plate" binding:"required"`
 	DriverLicenseNumber   string `json:"driver_license_number" binding:"required"`
 	InsuranceDetails      string `json:"insurance_details"`
+	VehicleCategory       string `json:"vehicle_category"` // defaults to economy
 }
 
 type ForgotPasswordRequest struct {
@@ -77,6 +96,19 @@ func (h *UserHandler) Register(c *gin.Context) {
 		return
 	}
 
+	var referrer *models.User
+	if req.ReferralCode != "" {
+		var err error
+		if referrer, err = h.referrals.FindReferrer(req.ReferralCode); err != nil {
+			if errors.Is(err, services.ErrReferralCodeNotFound) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid referral code"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up referral code"})
+			return
+		}
+	}
+
 	// Hash password
 	hashedPassword, err := utils.HashPassword(req.Password)
 	if err != nil {
@@ -106,12 +138,32 @@ func (h *UserHandler) Register(c *gin.Context) {
 		EmailVerificationToken:  &verificationToken,
 		EmailVerificationExpiry: &verificationExpiry,
 	}
+	if req.DeviceID != "" {
+		user.DeviceID = &req.DeviceID
+	}
+	if err := h.referrals.AssignCode(&user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate referral code"})
+		return
+	}
+
+	tx := h.db.Begin()
 
-	if err := h.db.Create(&user).Error; err != nil {
+	if err := tx.Create(&user).Error; err != nil {
+		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
 
+	if referrer != nil {
+		if _, err := h.referrals.Refer(tx, referrer, &user); err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record referral"})
+			return
+		}
+	}
+
+	tx.Commit()
+
 	// Send verification email
 	if err := h.emailService.SendVerificationEmail(user.Email, user.FirstName, verificationToken); err != nil {
 		// Log error but don't fail registration
@@ -213,6 +265,8 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 	delete(updateData, "password_hash")
 	delete(updateData, "user_type")
 	delete(updateData, "created_at")
+	delete(updateData, "referral_code")
+	delete(updateData, "device_id")
 
 	updateData["updated_at"] = time.Now()
 
@@ -224,6 +278,33 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 	c.JSON(http.StatusOK, user)
 }
 
+// GetReferralStats returns the referrals a user has made and the rewards
+// earned. Users can only see their own unless they are an admin.
+func (h *UserHandler) GetReferralStats(c *gin.Context) {
+	userID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	if userID != currentUserID && currentUserType != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only view your own referrals"})
+		return
+	}
+
+	var user models.User
+	if err := h.db.Where("id = ?", userID).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	stats, err := h.referrals.Stats(&user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch referral stats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
 func (h *UserHandler) OnboardDriver(c *gin.Context) {
 	currentUserID := c.GetString("user_id")
 	currentUserType := c.GetString("user_type")
@@ -253,6 +334,15 @@ func (h *UserHandler) OnboardDriver(c *gin.Context) {
 		return
 	}
 
+	// Check the vehicle category exists
+	if req.VehicleCategory == "" {
+		req.VehicleCategory = models.VehicleCategoryEconomy
+	}
+	if _, err := services.NewVehicleCategoryService(h.db).Get(req.VehicleCategory); err != nil {
+		respondVehicleCategoryError(c, err)
+		return
+	}
+
 	// Create driver profile
 	driver := models.Driver{
 		DriverID:            userUUID,
@@ -261,6 +351,7 @@ func (h *UserHandler) OnboardDriver(c *gin.Context) {
 		LicensePlate:        req.LicensePlate,
 		DriverLicenseNumber: req.DriverLicenseNumber,
 		InsuranceDetails:    req.InsuranceDetails,
+		VehicleCategory:     req.VehicleCategory,
 		IsApproved:          false, // Requires admin approval
 		IsAvailable:         false,
 	}
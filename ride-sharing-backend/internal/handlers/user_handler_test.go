@@ -5,10 +5,14 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"kenyan-ride-share-backend/internal/config"
 	"kenyan-ride-share-backend/internal/handlers"
 	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/pkg/database"
+	"kenyan-ride-share-backend/pkg/utils"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -21,16 +25,38 @@ func setupTestDB() *gorm.DB {
 	if err != nil {
 		panic("failed to connect database")
 	}
-	
-	// Auto-migrate tables
-	db.AutoMigrate(&models.User{}, &models.Driver{}, &models.RideRequest{}, &models.Ride{}, &models.Payment{}, &models.Review{})
-	
+	// A single connection keeps every query on the same in-memory database
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+	migrateTestModels(db, database.Models()...)
 	return db
 }
 
+// migrateTestModels auto-migrates models on SQLite, which cannot create the
+// Postgres gen_random_uuid() column default. IDs are still assigned by the
+// BeforeCreate hooks.
+func migrateTestModels(db *gorm.DB, dst ...interface{}) {
+	for _, model := range dst {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			panic(err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if strings.Contains(field.DefaultValue, "gen_random_uuid") {
+				field.HasDefaultValue = false
+				field.DefaultValue = ""
+				field.DefaultValueInterface = nil
+			}
+		}
+	}
+	if err := db.AutoMigrate(dst...); err != nil {
+		panic(err)
+	}
+}
+
 func TestUserRegistration(t *testing.T) {
 	db := setupTestDB()
-	userHandler := handlers.NewUserHandler(db)
+	userHandler := handlers.NewUserHandler(db, config.Load())
 
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
@@ -57,13 +83,13 @@ func TestUserRegistration(t *testing.T) {
 
 	var response map[string]interface{}
 	json.Unmarshal(w.Body.Bytes(), &response)
-	assert.Equal(t, "User registered successfully", response["message"])
+	assert.Contains(t, response["message"], "User registered successfully")
 	assert.NotEmpty(t, response["user_id"])
 }
 
 func TestUserLogin(t *testing.T) {
 	db := setupTestDB()
-	userHandler := handlers.NewUserHandler(db)
+	userHandler := handlers.NewUserHandler(db, config.Load())
 
 	// Create a test user first
 	testUser := models.User{
@@ -72,9 +98,12 @@ func TestUserLogin(t *testing.T) {
 		Email:       "jane.smith@example.com",
 		PhoneNumber: "254712345679",
 		UserType:    "passenger",
+		// Only verified users can log in
+		IsEmailVerified: true,
 	}
-	// Set password hash manually for testing
-	testUser.PasswordHash = "$2a$12$LQv3c1yqBWVHxkd0LHAkCOYz6TtxMQJqhN8/LewdBPj/VjPyV8Paa" // "password123"
+	passwordHash, err := utils.HashPassword("password123")
+	assert.NoError(t, err)
+	testUser.PasswordHash = passwordHash
 	db.Create(&testUser)
 
 	gin.SetMode(gin.TestMode)
@@ -104,7 +133,7 @@ func TestUserLogin(t *testing.T) {
 
 func TestInvalidLogin(t *testing.T) {
 	db := setupTestDB()
-	userHandler := handlers.NewUserHandler(db)
+	userHandler := handlers.NewUserHandler(db, config.Load())
 
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
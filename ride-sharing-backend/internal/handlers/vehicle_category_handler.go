@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type VehicleCategoryHandler struct {
+	db         *gorm.DB
+	categories *services.VehicleCategoryService
+}
+
+func NewVehicleCategoryHandler(db *gorm.DB) *VehicleCategoryHandler {
+	return &VehicleCategoryHandler{
+		db:         db,
+		categories: services.NewVehicleCategoryService(db),
+	}
+}
+
+type CreateVehicleCategoryRequest struct {
+	Code          string  `json:"code" binding:"required,max=32"`
+	Name          string  `json:"name" binding:"required"`
+	Seats         int     `json:"seats" binding:"required,min=1"`
+	BaseFare      float64 `json:"base_fare" binding:"gte=0"`
+	PerKmRate     float64 `json:"per_km_rate" binding:"gte=0"`
+	PerMinuteRate float64 `json:"per_minute_rate" binding:"gte=0"`
+	MinimumFare   float64 `json:"minimum_fare" binding:"gte=0"`
+}
+
+type UpdateVehicleCategoryRequest struct {
+	Name          *string  `json:"name"`
+	Seats         *int     `json:"seats" binding:"omitempty,min=1"`
+	BaseFare      *float64 `json:"base_fare" binding:"omitempty,gte=0"`
+	PerKmRate     *float64 `json:"per_km_rate" binding:"omitempty,gte=0"`
+	PerMinuteRate *float64 `json:"per_minute_rate" binding:"omitempty,gte=0"`
+	MinimumFare   *float64 `json:"minimum_fare" binding:"omitempty,gte=0"`
+	IsActive      *bool    `json:"is_active"`
+}
+
+// ListVehicleCategories returns the categories passengers can book. Admins
+// also see inactive ones.
+func (h *VehicleCategoryHandler) ListVehicleCategories(c *gin.Context) {
+	currentUserType := c.GetString("user_type")
+
+	categories, err := h.categories.List(currentUserType != "admin")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch vehicle categories"})
+		return
+	}
+
+	c.JSON(http.StatusOK, categories)
+}
+
+func (h *VehicleCategoryHandler) CreateVehicleCategory(c *gin.Context) {
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can manage vehicle categories"})
+		return
+	}
+
+	var req CreateVehicleCategoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	category := models.VehicleCategory{
+		Code:          req.Code,
+		Name:          req.Name,
+		Seats:         req.Seats,
+		BaseFare:      req.BaseFare,
+		PerKmRate:     req.PerKmRate,
+		PerMinuteRate: req.PerMinuteRate,
+		MinimumFare:   req.MinimumFare,
+		IsActive:      true,
+	}
+	if err := h.categories.Create(&category); err != nil {
+		respondVehicleCategoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, category)
+}
+
+func (h *VehicleCategoryHandler) UpdateVehicleCategory(c *gin.Context) {
+	code := c.Param("code")
+	currentUserType := c.GetString("user_type")
+
+	if currentUserType != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can manage vehicle categories"})
+		return
+	}
+
+	var req UpdateVehicleCategoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := make(map[string]interface{})
+	if req.Name != nil {
+		updates["name"] = *req.Name
+	}
+	if req.Seats != nil {
+		updates["seats"] = *req.Seats
+	}
+	if req.BaseFare != nil {
+		updates["base_fare"] = *req.BaseFare
+	}
+	if req.PerKmRate != nil {
+		updates["per_km_rate"] = *req.PerKmRate
+	}
+	if req.PerMinuteRate != nil {
+		updates["per_minute_rate"] = *req.PerMinuteRate
+	}
+	if req.MinimumFare != nil {
+		updates["minimum_fare"] = *req.MinimumFare
+	}
+	if req.IsActive != nil {
+		updates["is_active"] = *req.IsActive
+	}
+	if len(updates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No changes given"})
+		return
+	}
+
+	category, err := h.categories.Update(code, updates)
+	if err != nil {
+		if errors.Is(err, services.ErrVehicleCategoryNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		respondVehicleCategoryError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, category)
+}
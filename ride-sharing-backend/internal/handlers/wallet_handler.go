@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type WalletHandler struct {
+	db     *gorm.DB
+	ledger *services.LedgerService
+}
+
+func NewWalletHandler(db *gorm.DB) *WalletHandler {
+	return &WalletHandler{
+		db:     db,
+		ledger: services.NewLedgerService(db, services.SystemClock{}),
+	}
+}
+
+// GetWallet returns a user's balance: the wallet of a passenger, or the
+// earnings of a driver. A negative passenger balance is owed for rides.
+func (h *WalletHandler) GetWallet(c *gin.Context) {
+	user, ok := h.walletOwner(c)
+	if !ok {
+		return
+	}
+
+	account := userAccount(user)
+	balance, err := h.ledger.Balance(account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch balance"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":       user.ID,
+		"account_type":  account.Type,
+		"balance_cents": balance,
+		"balance":       services.FromCents(balance),
+		"currency":      "KES",
+	})
+}
+
+// GetWalletStatement lists the latest movements on a user's balance. The
+// optional "limit" query parameter defaults to 50.
+func (h *WalletHandler) GetWalletStatement(c *gin.Context) {
+	user, ok := h.walletOwner(c)
+	if !ok {
+		return
+	}
+
+	limit := 50
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > 500 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = parsed
+	}
+
+	statement, err := h.ledger.Statement(userAccount(user), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch statement"})
+		return
+	}
+
+	c.JSON(http.StatusOK, statement)
+}
+
+// walletOwner loads the user in the path. Users can only see their own
+// balance unless they are an admin.
+func (h *WalletHandler) walletOwner(c *gin.Context) (*models.User, bool) {
+	userID := c.Param("id")
+	currentUserID := c.GetString("user_id")
+	currentUserType := c.GetString("user_type")
+
+	if userID != currentUserID && currentUserType != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only view your own wallet"})
+		return nil, false
+	}
+
+	var user models.User
+	if err := h.db.Where("id = ?", userID).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	return &user, true
+}
+
+// userAccount is the ledger account holding a user's balance
+func userAccount(user *models.User) services.Account {
+	if user.UserType == "driver" {
+		return services.DriverEarnings(user.ID)
+	}
+	return services.PassengerWallet(user.ID)
+}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+
+	"kenyan-ride-share-backend/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MpesaCallbackMiddleware only lets through M-Pesa callbacks posted to the
+// secret token in the callback URL from an allowed address. The address is
+// gin's ClientIP, so the router must only trust our own proxies, see
+// Config.TrustedProxies.
+func MpesaCallbackMiddleware(cfg *config.Config) gin.HandlerFunc {
+	return ProviderCallbackMiddleware("M-Pesa", cfg.MpesaCallbackToken, cfg.MpesaCallbackIPs)
+}
+
+// ProviderCallbackMiddleware does the same for the callbacks of any payment
+// provider, given its token and comma-separated allowed addresses
+func ProviderCallbackMiddleware(provider, callbackToken, allowedIPs string) gin.HandlerFunc {
+	allowed := map[string]bool{}
+	for _, ip := range strings.Split(allowedIPs, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			allowed[ip] = true
+		}
+	}
+
+	return func(c *gin.Context) {
+		token := c.Param("token")
+		if callbackToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(callbackToken)) != 1 {
+			log.Printf("Rejected %s callback with an invalid token from %s", provider, c.ClientIP())
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			c.Abort()
+			return
+		}
+
+		if !allowed["*"] && !allowed[c.ClientIP()] {
+			log.Printf("Rejected %s callback from %s", provider, c.ClientIP())
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
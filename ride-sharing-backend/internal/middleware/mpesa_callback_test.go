@@ -0,0 +1,49 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kenyan-ride-share-backend/internal/middleware"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderCallbackMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	require.NoError(t, router.SetTrustedProxies(nil))
+	router.POST("/callback/:token", middleware.ProviderCallbackMiddleware("M-Pesa", "secret", "196.201.214.200"), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	post := func(token, remoteAddr, forwardedFor string) int {
+		req, _ := http.NewRequest("POST", "/callback/"+token, nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("secret", "196.201.214.200:443", ""))
+	assert.Equal(t, http.StatusNotFound, post("wrong", "196.201.214.200:443", ""))
+	assert.Equal(t, http.StatusForbidden, post("secret", "10.0.0.1:443", ""))
+	// A forged X-Forwarded-For from an untrusted address is ignored
+	assert.Equal(t, http.StatusForbidden, post("secret", "10.0.0.1:443", "196.201.214.200"))
+
+	// No allowed addresses lets nothing through
+	router.POST("/airtel/:token", middleware.ProviderCallbackMiddleware("Airtel Money", "secret", ""), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	req, _ := http.NewRequest("POST", "/airtel/secret", nil)
+	req.RemoteAddr = "196.201.214.200:443"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -7,6 +7,50 @@ import (
 	"gorm.io/gorm"
 )
 
+// Ride request lifecycle statuses. A request starts out pending (requested)
+// and is moved along by services.RideLifecycleService only.
+const (
+	RideRequestStatusPending   = "pending"
+	RideRequestStatusAccepted  = "accepted"
+	RideRequestStatusCancelled = "cancelled"
+	RideRequestStatusCompleted = "completed"
+	RideRequestStatusExpired   = "expired"
+	RideRequestStatusScheduled = "scheduled"
+)
+
+// Ride lifecycle statuses, in the order a ride normally moves through them.
+const (
+	RideStatusAccepted       = "accepted"
+	RideStatusDriverArriving = "driver_arriving"
+	RideStatusArrived        = "arrived"
+	RideStatusInProgress     = "in_progress"
+	RideStatusCompleted      = "completed"
+	RideStatusCancelled      = "cancelled"
+)
+
+// Ride event types recorded on the ride timeline.
+const (
+	RideEventStatusChanged = "status_changed"
+	RideEventStopReached   = "stop_reached"
+	RideEventPoolJoined    = "pool_joined"
+	RideEventWaypointDone  = "waypoint_completed"
+	RideEventPINFailed     = "pin_failed"
+	RideEventFlagged       = "flagged"
+)
+
+// Ride types
+const (
+	RideTypeStandard = "standard"
+	RideTypePool     = "pool" // shared with other passengers going the same way
+)
+
+// Payment methods a passenger can choose when requesting a ride
+const (
+	PaymentMethodMpesa       = "mpesa"
+	PaymentMethodAirtelMoney = "airtel_money"
+	PaymentMethodCash        = "cash" // collected by the driver at the end of the ride
+)
+
 type User struct {
 	ID                    uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
 	UserType              string     `json:"user_type" gorm:"not null"` // 'driver' or 'passenger'
@@ -21,6 +65,8 @@ type User struct {
 	PasswordResetToken     *string   `json:"-" gorm:"unique"`
 	PasswordResetExpiry    *time.Time `json:"-"`
 	Rating                float64    `json:"rating" gorm:"default:0.0"`
+	ReferralCode          *string    `json:"referral_code" gorm:"unique"` // code others sign up with to be referred by this user
+	DeviceID              *string    `json:"-" gorm:"index"`              // device registered from, used to spot self-referrals
 	CreatedAt             time.Time  `json:"created_at"`
 	UpdatedAt             time.Time  `json:"updated_at"`
 }
@@ -32,8 +78,11 @@ type Driver struct {
 	LicensePlate          string     `json:"license_plate" gorm:"unique;not null"`
 	DriverLicenseNumber   string     `json:"driver_license_number" gorm:"unique;not null"`
 	InsuranceDetails      string     `json:"insurance_details"`
+	VehicleCategory       string     `json:"vehicle_category" gorm:"not null;default:'economy';index"` // code of a VehicleCategory
 	IsApproved            bool       `json:"is_approved" gorm:"default:false"`
 	IsAvailable           bool       `json:"is_available" gorm:"default:false"`
+	AvailableSince        *time.Time `json:"available_since"` // when the driver last became free for a new ride
+	CancellationCount     int        `json:"cancellation_count" gorm:"default:0"`
 	CurrentLatitude       *float64   `json:"current_latitude"`
 	CurrentLongitude      *float64   `json:"current_longitude"`
 	LastLocationUpdate    *time.Time `json:"last_location_update"`
@@ -51,17 +100,29 @@ type RideRequest struct {
 	PickupAddress           string    `json:"pickup_address"`
 	DropoffAddress          string    `json:"dropoff_address"`
 	RequestedAt             time.Time `json:"requested_at" gorm:"default:CURRENT_TIMESTAMP"`
-	Status                  string    `json:"status" gorm:"not null"` // 'pending', 'accepted', 'rejected', 'cancelled', 'completed'
+	Status                  string    `json:"status" gorm:"not null"` // see RideRequestStatus* constants
 	EstimatedFare           *float64  `json:"estimated_fare"`
 	EstimatedDistanceKm     *float64  `json:"estimated_distance_km"`
 	EstimatedDurationMinutes *int     `json:"estimated_duration_minutes"`
+	DispatchRadiusKm        *float64  `json:"dispatch_radius_km"` // current driver search radius
+	ScheduledFor            *time.Time `json:"scheduled_for" gorm:"index"` // pickup time for advance bookings
+	LockedFare              *float64   `json:"locked_fare"`                // fare quoted at booking, charged regardless of later pricing
+	ReminderSentAt          *time.Time `json:"reminder_sent_at"`
+	Stops                   []RideStop `json:"stops,omitempty" gorm:"foreignKey:RequestID"` // intermediate stops in order
+	RideType                string     `json:"ride_type" gorm:"not null;default:'standard'"`
+	Seats                   int        `json:"seats" gorm:"not null;default:1"`
+	RideID                  *uuid.UUID `json:"ride_id" gorm:"index"` // ride serving this request once accepted
+	SurgeMultiplier         float64    `json:"surge_multiplier" gorm:"not null;default:1"` // surge at the pickup when requested
+	VehicleCategory         string     `json:"vehicle_category" gorm:"not null;default:'economy'"`
+	PromoCodeID             *uuid.UUID `json:"promo_code_id"` // promo reserved for this request
+	PaymentMethod           string     `json:"payment_method" gorm:"not null;default:'mpesa'"` // see PaymentMethod* constants
 	CreatedAt               time.Time `json:"created_at"`
 	UpdatedAt               time.Time `json:"updated_at"`
 }
 
 type Ride struct {
 	ID                     uuid.UUID    `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
-	RequestID              uuid.UUID    `json:"request_id" gorm:"unique;not null"`
+	RequestID              uuid.UUID    `json:"request_id" gorm:"not null;index"`
 	DriverID               uuid.UUID    `json:"driver_id" gorm:"not null"`
 	PassengerID            uuid.UUID    `json:"passenger_id" gorm:"not null"`
 	StartTime              *time.Time   `json:"start_time"`
@@ -70,19 +131,45 @@ type Ride struct {
 	ActualDistanceKm       *float64     `json:"actual_distance_km"`
 	ActualDurationMinutes  *int         `json:"actual_duration_minutes"`
 	RouteGeoJSON           string       `json:"route_geojson"`
-	Status                 string       `json:"status" gorm:"not null"` // 'in_progress', 'completed', 'cancelled'
+	RoutePolyline          string       `json:"route_polyline"` // encoded polyline of the recorded trace
+	RideType               string       `json:"ride_type" gorm:"not null;default:'standard'"`
+	VehicleCategory        string       `json:"vehicle_category" gorm:"not null;default:'economy'"`
+	ArrivedAt              *time.Time   `json:"arrived_at"` // when the driver reached the pickup
+	WaitingMinutes         int          `json:"waiting_minutes" gorm:"default:0"` // chargeable minutes after the grace period
+	WaitingCharge          float64      `json:"waiting_charge" gorm:"default:0"`
+	StartPIN               string       `json:"-"` // shown only to the passenger
+	PINFailedAttempts      int          `json:"pin_failed_attempts" gorm:"default:0"`
+	FlaggedAt              *time.Time   `json:"flagged_at"` // set when too many wrong PINs were entered
+	FareBreakdowns         []FareBreakdown `json:"fare_breakdowns,omitempty" gorm:"foreignKey:RideID"` // one per passenger once completed
+	Status                 string       `json:"status" gorm:"not null"` // see RideStatus* constants
 	CreatedAt              time.Time    `json:"created_at"`
 	UpdatedAt              time.Time    `json:"updated_at"`
 }
 
 type Payment struct {
 	ID            uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
-	RideID        uuid.UUID  `json:"ride_id" gorm:"unique;not null"`
-	Amount        float64    `json:"amount" gorm:"not null"`
+	RideID        uuid.UUID  `json:"ride_id" gorm:"not null;index"`
+	PassengerID   *uuid.UUID `json:"passenger_id" gorm:"index"` // payer; pooled rides have one payment per passenger
+	Amount        float64    `json:"amount" gorm:"not null"` // fare the passenger owes for the ride
+	Discount      float64    `json:"discount"`      // promo discount already taken off the amount
+	WalletCredit  float64    `json:"wallet_credit"` // wallet credit taken off the amount when the ride ended
+	WalletDebt    float64    `json:"wallet_debt"`   // fees owed from earlier rides added to the amount when the ride ended
+	AmountPaid    float64    `json:"amount_paid"`   // collected so far, in cash or through the payment provider
+	// RequestedAmount is what the latest provider request asked for. Anything
+	// paid beyond what is owed stays in the passenger's wallet as credit.
+	RequestedAmount float64 `json:"requested_amount"`
+	PromoCodeID   *uuid.UUID `json:"promo_code_id"` // promo the discount came from
 	Currency      string     `json:"currency" gorm:"default:'KES'"`
-	PaymentMethod string     `json:"payment_method" gorm:"not null"` // 'mpesa', 'card', 'cash'
+	PaymentMethod string     `json:"payment_method" gorm:"not null"` // see PaymentMethod* constants
 	TransactionID *string    `json:"transaction_id" gorm:"unique"`   // M-Pesa transaction ID
-	PaymentStatus string     `json:"payment_status" gorm:"not null"` // 'pending', 'completed', 'failed'
+	PaymentStatus string     `json:"payment_status" gorm:"not null"` // 'pending', 'partially_paid', 'completed', 'failed', 'refunded'
+	FailureReason string     `json:"failure_reason"`
+	PhoneNumber   string     `json:"phone_number"` // phone the STK Push was sent to
+	// CheckoutRequestID identifies the latest request sent to the payment
+	// provider, e.g. the CheckoutRequestID of an M-Pesa STK Push
+	CheckoutRequestID *string    `json:"checkout_request_id" gorm:"uniqueIndex"`
+	InitiatedAt       *time.Time `json:"initiated_at"`    // when the STK Push was sent
+	LastCheckedAt     *time.Time `json:"last_checked_at"` // when M-Pesa was last asked for the outcome
 	PaymentDate   time.Time  `json:"payment_date" gorm:"default:CURRENT_TIMESTAMP"`
 	CreatedAt     time.Time  `json:"created_at"`
 	UpdatedAt     time.Time  `json:"updated_at"`
@@ -99,6 +186,501 @@ type Review struct {
 	UpdatedAt  time.Time `json:"updated_at"`
 }
 
+// RideEvent is a single entry on the ride timeline. Events are keyed by the
+// ride request so the timeline also covers what happened before a driver
+// was assigned.
+type RideEvent struct {
+	ID         uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	RequestID  uuid.UUID  `json:"request_id" gorm:"not null;index"`
+	RideID     *uuid.UUID `json:"ride_id" gorm:"index"`
+	EventType  string     `json:"event_type" gorm:"not null"`
+	Entity     string     `json:"entity" gorm:"not null"` // 'ride_request' or 'ride'
+	FromStatus string     `json:"from_status"`
+	ToStatus   string     `json:"to_status"`
+	ActorID    *uuid.UUID `json:"actor_id"`
+	Note       string     `json:"note"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Ride offer statuses
+const (
+	RideOfferStatusOffered  = "offered"
+	RideOfferStatusAccepted = "accepted"
+	RideOfferStatusDeclined = "declined"
+	RideOfferStatusExpired  = "expired"
+)
+
+// RideOffer is a ride request offered to a single driver by the dispatcher.
+// A request has at most one open offer at a time.
+type RideOffer struct {
+	ID          uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	RequestID   uuid.UUID  `json:"request_id" gorm:"not null;index;uniqueIndex:idx_ride_offers_open_request,where:status = 'offered'"`
+	DriverID    uuid.UUID  `json:"driver_id" gorm:"not null;index"`
+	Status      string     `json:"status" gorm:"not null"` // 'offered', 'accepted', 'declined', 'expired'
+	RadiusKm    float64    `json:"radius_km"`
+	DistanceKm  float64    `json:"distance_km"`
+	Score       float64    `json:"score"`
+	OfferedAt   time.Time  `json:"offered_at"`
+	ExpiresAt   time.Time  `json:"expires_at" gorm:"index"`
+	RespondedAt *time.Time `json:"responded_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// RideStop is an intermediate stop between pickup and dropoff. Stops are
+// visited in Sequence order, starting at 1.
+type RideStop struct {
+	ID        uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	RequestID uuid.UUID  `json:"request_id" gorm:"not null;uniqueIndex:idx_ride_stops_request_sequence"`
+	Sequence  int        `json:"sequence" gorm:"not null;uniqueIndex:idx_ride_stops_request_sequence"`
+	Latitude  float64    `json:"latitude" gorm:"not null"`
+	Longitude float64    `json:"longitude" gorm:"not null"`
+	Address   string     `json:"address"`
+	ReachedAt *time.Time `json:"reached_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Waypoint kinds
+const (
+	WaypointPickup  = "pickup"
+	WaypointDropoff = "dropoff"
+)
+
+// RideWaypoint is a pickup or dropoff on a pooled ride's route. Waypoints are
+// visited in Sequence order; new passengers are inserted between them.
+type RideWaypoint struct {
+	ID          uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	RideID      uuid.UUID  `json:"ride_id" gorm:"not null;index"`
+	RequestID   uuid.UUID  `json:"request_id" gorm:"not null;index"`
+	Sequence    int        `json:"sequence" gorm:"not null"`
+	Kind        string     `json:"kind" gorm:"not null"` // 'pickup' or 'dropoff'
+	Latitude    float64    `json:"latitude" gorm:"not null"`
+	Longitude   float64    `json:"longitude" gorm:"not null"`
+	Address     string     `json:"address"`
+	CompletedAt *time.Time `json:"completed_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// FareBreakdown itemises the final fare one passenger pays for a ride. The
+// components add up to Total.
+type FareBreakdown struct {
+	ID                   uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	RideID               uuid.UUID `json:"ride_id" gorm:"not null;uniqueIndex:idx_fare_breakdowns_ride_request"`
+	RequestID            uuid.UUID `json:"request_id" gorm:"not null;uniqueIndex:idx_fare_breakdowns_ride_request"`
+	PassengerID          uuid.UUID `json:"passenger_id" gorm:"not null;index"`
+	DistanceKm           float64   `json:"distance_km"`
+	DurationMinutes      int       `json:"duration_minutes"`
+	BaseFare             float64   `json:"base_fare"`
+	DistanceFare         float64   `json:"distance_fare"`
+	TimeFare             float64   `json:"time_fare"`
+	SurgeAmount          float64   `json:"surge_amount"`
+	MinimumFareTopUp     float64   `json:"minimum_fare_top_up"`
+	Discount             float64   `json:"discount"`               // pooled ride discount, subtracted
+	LockedFareAdjustment float64   `json:"locked_fare_adjustment"` // brings the trip fare to the fare locked at booking
+	PromoDiscount        float64   `json:"promo_discount"`         // promo code discount, subtracted
+	WaitingCharge        float64   `json:"waiting_charge"`
+	Total                float64   `json:"total"`
+	Currency             string    `json:"currency" gorm:"default:'KES'"`
+	CreatedAt            time.Time `json:"created_at"`
+}
+
+// Vehicle category codes
+const (
+	VehicleCategoryBodaBoda = "boda_boda"
+	VehicleCategoryTukTuk   = "tuk_tuk"
+	VehicleCategoryEconomy  = "economy"
+	VehicleCategoryComfort  = "comfort"
+	VehicleCategoryXL       = "xl"
+)
+
+// VehicleCategory is a class of vehicle with its own fare table. Drivers
+// belong to one category and passengers request a category.
+type VehicleCategory struct {
+	ID            uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	Code          string    `json:"code" gorm:"uniqueIndex;not null"` // see VehicleCategory* constants
+	Name          string    `json:"name" gorm:"not null"`
+	Seats         int       `json:"seats" gorm:"not null"`
+	BaseFare      float64   `json:"base_fare" gorm:"not null"`
+	PerKmRate     float64   `json:"per_km_rate" gorm:"not null"`
+	PerMinuteRate float64   `json:"per_minute_rate" gorm:"not null"`
+	MinimumFare   float64   `json:"minimum_fare" gorm:"not null"`
+	IsActive      bool      `json:"is_active" gorm:"default:true"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Promo code discount types
+const (
+	PromoDiscountPercentage = "percentage"
+	PromoDiscountFlat       = "flat"
+)
+
+// Promo redemption statuses
+const (
+	PromoRedemptionReserved = "reserved" // held by an open ride request
+	PromoRedemptionApplied  = "applied"  // discount given on the completed ride
+	PromoRedemptionReleased = "released" // request cancelled or expired, the use is given back
+)
+
+// PromoCode is a marketing discount passengers apply to a quote or ride
+// request
+type PromoCode struct {
+	ID                uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	Code              string     `json:"code" gorm:"uniqueIndex;not null"` // stored in upper case
+	Description       string     `json:"description"`
+	DiscountType      string     `json:"discount_type" gorm:"not null"`  // see PromoDiscount* constants
+	DiscountValue     float64    `json:"discount_value" gorm:"not null"` // percent off, or KES off for flat codes
+	MaxDiscount       *float64   `json:"max_discount"`                   // caps a percentage discount
+	UsageLimit        *int       `json:"usage_limit"`                    // redemptions across all passengers, nil for unlimited
+	PerUserLimit      int        `json:"per_user_limit" gorm:"not null;default:1"`
+	UsedCount         int        `json:"used_count" gorm:"not null;default:0"`
+	FirstRideOnly     bool       `json:"first_ride_only" gorm:"default:false"`
+	VehicleCategories string     `json:"vehicle_categories"` // comma-separated codes the promo is valid for, empty for all
+	ValidFrom         *time.Time `json:"valid_from"`
+	ValidUntil        *time.Time `json:"valid_until"`
+	OwnerID           *uuid.UUID `json:"owner_id" gorm:"index"` // only this passenger may use the code, e.g. a referral reward
+	IsActive          bool       `json:"is_active" gorm:"default:true"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// PromoRedemption is one use of a promo code by a ride request
+type PromoRedemption struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	PromoCodeID uuid.UUID `json:"promo_code_id" gorm:"not null;index"`
+	PassengerID uuid.UUID `json:"passenger_id" gorm:"not null;index"`
+	RequestID   uuid.UUID `json:"request_id" gorm:"not null;uniqueIndex"`
+	Status      string    `json:"status" gorm:"not null"` // see PromoRedemption* constants
+	Discount    float64   `json:"discount"`               // amount taken off once the ride is completed
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Referral statuses
+const (
+	ReferralStatusPending   = "pending"   // referee has not completed enough rides yet
+	ReferralStatusQualified = "qualified" // both sides have been rewarded
+	ReferralStatusRejected  = "rejected"  // looks like a self-referral, no rewards
+)
+
+// Referral reward statuses
+const (
+	ReferralRewardIssued   = "issued"   // given to a passenger as a promo code
+	ReferralRewardOwed     = "owed"     // owed to a driver from before rewards were credited
+	ReferralRewardCredited = "credited" // credited to a driver's earnings on the ledger
+)
+
+// Referral links a new user to the user whose code they signed up with
+type Referral struct {
+	ID           uuid.UUID        `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	ReferrerID   uuid.UUID        `json:"referrer_id" gorm:"not null;index"`
+	RefereeID    uuid.UUID        `json:"referee_id" gorm:"not null;uniqueIndex"` // a user can only be referred once
+	Code         string           `json:"code" gorm:"not null"`
+	Status       string           `json:"status" gorm:"not null"` // see ReferralStatus* constants
+	RejectReason string           `json:"reject_reason,omitempty"`
+	QualifiedAt  *time.Time       `json:"qualified_at"`
+	Rewards      []ReferralReward `json:"rewards,omitempty" gorm:"foreignKey:ReferralID"`
+	CreatedAt    time.Time        `json:"created_at"`
+	UpdatedAt    time.Time        `json:"updated_at"`
+}
+
+// ReferralReward is what one side of a qualified referral receives
+type ReferralReward struct {
+	ID          uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	ReferralID  uuid.UUID  `json:"referral_id" gorm:"not null;index"`
+	UserID      uuid.UUID  `json:"user_id" gorm:"not null;index"`
+	Amount      float64    `json:"amount" gorm:"not null"`
+	Status      string     `json:"status" gorm:"not null"` // see ReferralReward* constants
+	PromoCodeID *uuid.UUID `json:"promo_code_id"`          // promo code the reward was issued as
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Ledger account types
+const (
+	LedgerAccountPassengerWallet     = "passenger_wallet"      // money a passenger holds with us, negative while they owe for rides
+	LedgerAccountDriverEarnings      = "driver_earnings"       // money owed to a driver
+	LedgerAccountPlatformCommission  = "platform_commission"   // our share of fares
+	LedgerAccountPromoExpense        = "promo_expense"         // cost of promo discounts and referral rewards
+	LedgerAccountMpesaClearing       = "mpesa_clearing"        // money moving in and out through M-Pesa
+	LedgerAccountPayoutFees          = "payout_fees"           // fees charged to drivers on payouts
+	LedgerAccountRefundExpense       = "refund_expense"        // money given back to passengers
+	LedgerAccountAirtelMoneyClearing = "airtel_money_clearing" // money moving in and out through Airtel Money
+	LedgerAccountPendingEarnings     = "pending_earnings"      // a driver's share of fares the passenger has not paid yet
+)
+
+// Ledger entry directions
+const (
+	LedgerDebit  = "debit"
+	LedgerCredit = "credit"
+)
+
+// Journal entry kinds
+const (
+	JournalRideFare        = "ride_fare"        // fare owed by a passenger, split between driver and platform
+	JournalPayment         = "payment"          // passenger paid towards their rides
+	JournalReferralReward  = "referral_reward"  // referral reward credited to a driver
+	JournalPayout          = "payout"           // driver earnings paid out through M-Pesa
+	JournalPayoutReversal  = "payout_reversal"  // failed payout returned to a driver's earnings
+	JournalRefund          = "refund"           // money given back to a passenger
+	JournalRefundReversal  = "refund_reversal"  // failed M-Pesa refund taken back
+	JournalCashCollection  = "cash_collection"  // fare a driver collected in cash from a passenger
+	JournalCancellationFee = "cancellation_fee" // fee charged to a passenger for a late cancellation or no-show
+	JournalEarningsRelease = "earnings_release" // driver's share of a fare released to their earnings once it was paid
+)
+
+// LedgerAccount holds a balance on the double-entry ledger. Amounts on the
+// ledger are whole cents.
+type LedgerAccount struct {
+	ID            uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	Code          string     `json:"code" gorm:"uniqueIndex;not null"` // type, and owner for per-user accounts, e.g. "driver_earnings:<id>"
+	Type          string     `json:"type" gorm:"not null"`             // see LedgerAccount* constants
+	OwnerID       *uuid.UUID `json:"owner_id" gorm:"index"`            // user the account belongs to, nil for platform accounts
+	NormalBalance string     `json:"normal_balance" gorm:"not null"`   // side that increases the balance, see Ledger* directions
+	BalanceCents  int64      `json:"balance_cents" gorm:"not null;default:0"`
+	Currency      string     `json:"currency" gorm:"default:'KES'"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// JournalEntry is one balanced movement of money between ledger accounts.
+// Each business event is posted once, keyed by its kind and reference.
+type JournalEntry struct {
+	ID          uuid.UUID     `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	Kind        string        `json:"kind" gorm:"not null;uniqueIndex:idx_journal_entries_kind_reference"` // see Journal* constants
+	Reference   string        `json:"reference" gorm:"not null;uniqueIndex:idx_journal_entries_kind_reference"`
+	Description string        `json:"description"`
+	Lines       []LedgerEntry `json:"lines,omitempty" gorm:"foreignKey:JournalEntryID"`
+	PostedAt    time.Time     `json:"posted_at" gorm:"not null"`
+}
+
+// LedgerEntry is one side of a journal entry on one account
+type LedgerEntry struct {
+	ID                uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	JournalEntryID    uuid.UUID `json:"journal_entry_id" gorm:"not null;index"`
+	AccountID         uuid.UUID `json:"account_id" gorm:"not null;index"`
+	Direction         string    `json:"direction" gorm:"not null"` // see Ledger* directions
+	AmountCents       int64     `json:"amount_cents" gorm:"not null"`
+	BalanceAfterCents int64     `json:"balance_after_cents"` // account balance once this entry was posted
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+// M-Pesa callback kinds
+const (
+	MpesaCallbackSTKPush       = "stk_push"
+	MpesaCallbackB2CResult     = "b2c_result"
+	MpesaCallbackB2CTimeout    = "b2c_timeout"
+	MpesaCallbackAirtelPayment = "airtel_payment" // Airtel Money collection callback
+)
+
+// M-Pesa callback statuses
+const (
+	MpesaCallbackReceived  = "received"  // stored, not processed yet
+	MpesaCallbackProcessed = "processed" // settled a payment or payout
+	MpesaCallbackDuplicate = "duplicate" // what it reports was already settled
+	MpesaCallbackRejected  = "rejected"  // did not match what we asked M-Pesa for
+	MpesaCallbackFailed    = "failed"    // could not be processed
+)
+
+// MpesaCallback is the raw body of a callback M-Pesa, or another payment
+// provider, posted to us, kept for audit along with what we did with it
+type MpesaCallback struct {
+	ID          uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	Kind        string     `json:"kind" gorm:"not null"`   // see MpesaCallback* kinds
+	Reference   string     `json:"reference" gorm:"index"` // checkout request or conversation ID
+	SourceIP    string     `json:"source_ip"`
+	Body        string     `json:"body" gorm:"type:text;not null"`
+	Status      string     `json:"status" gorm:"not null;index"` // see MpesaCallback* statuses
+	Reason      string     `json:"reason"`
+	ReceivedAt  time.Time  `json:"received_at" gorm:"not null"`
+	ProcessedAt *time.Time `json:"processed_at"`
+}
+
+// Payout statuses
+const (
+	PayoutStatusPending     = "pending"     // earnings debited, waiting for the M-Pesa result
+	PayoutStatusCompleted   = "completed"   // M-Pesa confirmed the transfer
+	PayoutStatusFailed      = "failed"      // transfer failed and the earnings were returned
+	PayoutStatusUnconfirmed = "unconfirmed" // no result from M-Pesa, needs resolving by an admin
+)
+
+// Payout triggers
+const (
+	PayoutTriggerOnDemand  = "on_demand"
+	PayoutTriggerScheduled = "scheduled"
+)
+
+// Payout sends a driver's earnings to their phone through M-Pesa B2C. The
+// amount and fee are debited from their earnings when the payout is created.
+type Payout struct {
+	ID                       uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	DriverID                 uuid.UUID  `json:"driver_id" gorm:"not null;index"`
+	AmountCents              int64      `json:"amount_cents" gorm:"not null"` // sent to the driver
+	FeeCents                 int64      `json:"fee_cents" gorm:"not null;default:0"`
+	PhoneNumber              string     `json:"phone_number" gorm:"not null"`
+	Trigger                  string     `json:"trigger" gorm:"not null"`      // see PayoutTrigger* constants
+	Status                   string     `json:"status" gorm:"not null;index"` // see PayoutStatus* constants
+	ConversationID           *string    `json:"conversation_id" gorm:"uniqueIndex"`
+	OriginatorConversationID *string    `json:"originator_conversation_id" gorm:"uniqueIndex"`
+	TransactionID            *string    `json:"transaction_id"` // M-Pesa receipt
+	FailureReason            string     `json:"failure_reason"`
+	CompletedAt              *time.Time `json:"completed_at"`
+	CreatedAt                time.Time  `json:"created_at"`
+	UpdatedAt                time.Time  `json:"updated_at"`
+}
+
+// Refund destinations
+const (
+	RefundToWallet = "wallet" // credited to the passenger's wallet
+	// Any other destination is the payment method of the payment, refunded
+	// through its provider
+)
+
+// Refund statuses
+const (
+	RefundStatusPendingApproval = "pending_approval" // above the approval threshold, waiting for an admin
+	RefundStatusProcessing      = "processing"       // sent to M-Pesa, waiting for the result
+	RefundStatusCompleted       = "completed"
+	RefundStatusFailed          = "failed"   // M-Pesa could not send it, nothing was refunded
+	RefundStatusRejected        = "rejected" // an admin turned it down
+)
+
+// Refund gives some or all of a completed payment back to the passenger
+type Refund struct {
+	ID                       uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	PaymentID                uuid.UUID  `json:"payment_id" gorm:"not null;index"`
+	RideID                   uuid.UUID  `json:"ride_id" gorm:"not null;index"`
+	PassengerID              uuid.UUID  `json:"passenger_id" gorm:"not null;index"`
+	AmountCents              int64      `json:"amount_cents" gorm:"not null"`
+	Destination              string     `json:"destination" gorm:"not null"` // RefundToWallet or the payment method
+	Reason                   string     `json:"reason" gorm:"not null"`
+	Status                   string     `json:"status" gorm:"not null;index"` // see RefundStatus* constants
+	RequestedBy              uuid.UUID  `json:"requested_by" gorm:"not null"`
+	ReviewedBy               *uuid.UUID `json:"reviewed_by"` // admin who approved or rejected it
+	ReviewNote               string     `json:"review_note"`
+	ConversationID           *string    `json:"conversation_id" gorm:"uniqueIndex"`
+	OriginatorConversationID *string    `json:"originator_conversation_id" gorm:"uniqueIndex"`
+	TransactionID            *string    `json:"transaction_id"` // M-Pesa receipt
+	FailureReason            string     `json:"failure_reason"`
+	CompletedAt              *time.Time `json:"completed_at"`
+	CreatedAt                time.Time  `json:"created_at"`
+	UpdatedAt                time.Time  `json:"updated_at"`
+}
+
+// FareQuote is a price shown to a passenger before requesting a ride. The
+// price of each option is locked until ExpiresAt and can be used once.
+type FareQuote struct {
+	ID               uuid.UUID         `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	PassengerID      uuid.UUID         `json:"passenger_id" gorm:"not null;index"`
+	PickupLatitude   float64           `json:"pickup_latitude" gorm:"not null"`
+	PickupLongitude  float64           `json:"pickup_longitude" gorm:"not null"`
+	DropoffLatitude  float64           `json:"dropoff_latitude" gorm:"not null"`
+	DropoffLongitude float64           `json:"dropoff_longitude" gorm:"not null"`
+	DistanceKm       float64           `json:"distance_km"`
+	DurationMinutes  int               `json:"duration_minutes"`
+	SurgeMultiplier  float64           `json:"surge_multiplier" gorm:"not null;default:1"`
+	PromoCodeID      *uuid.UUID        `json:"promo_code_id"` // promo applied to the quoted prices
+	Options          []FareQuoteOption `json:"options" gorm:"foreignKey:QuoteID"`
+	ExpiresAt        time.Time         `json:"expires_at" gorm:"not null"`
+	UsedAt           *time.Time        `json:"used_at"`
+	RequestID        *uuid.UUID        `json:"request_id"` // ride request that used the quote
+	CreatedAt        time.Time         `json:"created_at"`
+}
+
+// FareQuoteOption is the itemised estimate for one kind of ride on a quote
+type FareQuoteOption struct {
+	ID               uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	QuoteID          uuid.UUID `json:"quote_id" gorm:"not null;index"`
+	RideType         string    `json:"ride_type" gorm:"not null"`
+	VehicleCategory  string    `json:"vehicle_category" gorm:"not null"`
+	BaseFare         float64   `json:"base_fare"`
+	DistanceFare     float64   `json:"distance_fare"`
+	TimeFare         float64   `json:"time_fare"`
+	SurgeAmount      float64   `json:"surge_amount"`
+	MinimumFareTopUp float64   `json:"minimum_fare_top_up"`
+	Discount         float64   `json:"discount"`
+	PromoDiscount    float64   `json:"promo_discount"`
+	Total            float64   `json:"total"`
+	Currency         string    `json:"currency" gorm:"default:'KES'"`
+}
+
+// SurgeCell is a square of the service area with its current surge. Cells
+// are only stored while they have demand or are cooling off from a surge.
+type SurgeCell struct {
+	ID               uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	CellKey          string    `json:"cell_key" gorm:"uniqueIndex;not null"` // "row:col" on the surge grid
+	Row              int       `json:"row" gorm:"not null"`
+	Col              int       `json:"col" gorm:"not null"`
+	CenterLatitude   float64   `json:"center_latitude"`
+	CenterLongitude  float64   `json:"center_longitude"`
+	OpenRequests     int       `json:"open_requests"`
+	AvailableDrivers int       `json:"available_drivers"`
+	DemandRatio      float64   `json:"demand_ratio"`
+	Multiplier       float64   `json:"multiplier" gorm:"not null;default:1"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// RideLocationPoint is a driver location recorded while a ride is in
+// progress. Together the points form the route actually driven.
+type RideLocationPoint struct {
+	ID         uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	RideID     uuid.UUID `json:"ride_id" gorm:"not null;index"`
+	Latitude   float64   `json:"latitude" gorm:"not null"`
+	Longitude  float64   `json:"longitude" gorm:"not null"`
+	Accuracy   *float64  `json:"accuracy"` // reported GPS accuracy in meters
+	RecordedAt time.Time `json:"recorded_at" gorm:"not null;index"`
+}
+
+// RideRequestDecline records that a driver declined a ride request. The
+// request is hidden from that driver but stays open for everyone else.
+type RideRequestDecline struct {
+	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	RequestID uuid.UUID `json:"request_id" gorm:"not null;uniqueIndex:idx_ride_request_declines_request_driver"`
+	DriverID  uuid.UUID `json:"driver_id" gorm:"not null;uniqueIndex:idx_ride_request_declines_request_driver;index"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Who cancelled a ride or ride request
+const (
+	CancelledByPassenger = "passenger"
+	CancelledByDriver    = "driver"
+)
+
+// RideCancellation records why a ride request or ride was cancelled and any
+// fee charged under the cancellation policy.
+type RideCancellation struct {
+	ID              uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	RequestID       uuid.UUID  `json:"request_id" gorm:"not null;index"`
+	RideID          *uuid.UUID `json:"ride_id" gorm:"index"`
+	CancelledBy     uuid.UUID  `json:"cancelled_by" gorm:"not null"`
+	CancelledByType string     `json:"cancelled_by_type" gorm:"not null"` // 'passenger' or 'driver'
+	ReasonCode      string     `json:"reason_code" gorm:"not null"`
+	Note            string     `json:"note"`
+	FeeAmount       float64    `json:"fee_amount" gorm:"default:0"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// Notification types
+const (
+	NotificationRideRequestExpired    = "ride_request_expired"
+	NotificationScheduledRideReminder = "scheduled_ride_reminder"
+	NotificationDriverArrived         = "driver_arrived"
+)
+
+// Notification is a message delivered to a user. Each one is stored so the
+// app can list it, and is also sent by email.
+type Notification struct {
+	ID        uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID    uuid.UUID  `json:"user_id" gorm:"not null;index"`
+	Type      string     `json:"type" gorm:"not null"`
+	Title     string     `json:"title" gorm:"not null"`
+	Message   string     `json:"message" gorm:"not null"`
+	RequestID *uuid.UUID `json:"request_id"`
+	RideID    *uuid.UUID `json:"ride_id"`
+	ReadAt    *time.Time `json:"read_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
 // BeforeCreate hook to generate UUID for models
 func (u *User) BeforeCreate(tx *gorm.DB) error {
 	if u.ID == uuid.Nil {
@@ -142,3 +724,164 @@ func (r *Review) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+
+func (e *RideEvent) BeforeCreate(tx *gorm.DB) error {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	return nil
+}
+
+func (rc *RideCancellation) BeforeCreate(tx *gorm.DB) error {
+	if rc.ID == uuid.Nil {
+		rc.ID = uuid.New()
+	}
+	return nil
+}
+
+func (o *RideOffer) BeforeCreate(tx *gorm.DB) error {
+	if o.ID == uuid.Nil {
+		o.ID = uuid.New()
+	}
+	return nil
+}
+
+func (d *RideRequestDecline) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	return nil
+}
+
+func (n *Notification) BeforeCreate(tx *gorm.DB) error {
+	if n.ID == uuid.Nil {
+		n.ID = uuid.New()
+	}
+	return nil
+}
+
+func (rs *RideStop) BeforeCreate(tx *gorm.DB) error {
+	if rs.ID == uuid.Nil {
+		rs.ID = uuid.New()
+	}
+	return nil
+}
+
+func (w *RideWaypoint) BeforeCreate(tx *gorm.DB) error {
+	if w.ID == uuid.Nil {
+		w.ID = uuid.New()
+	}
+	return nil
+}
+
+func (p *RideLocationPoint) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
+	return nil
+}
+
+func (f *FareBreakdown) BeforeCreate(tx *gorm.DB) error {
+	if f.ID == uuid.Nil {
+		f.ID = uuid.New()
+	}
+	return nil
+}
+
+func (q *FareQuote) BeforeCreate(tx *gorm.DB) error {
+	if q.ID == uuid.Nil {
+		q.ID = uuid.New()
+	}
+	return nil
+}
+
+func (o *FareQuoteOption) BeforeCreate(tx *gorm.DB) error {
+	if o.ID == uuid.Nil {
+		o.ID = uuid.New()
+	}
+	return nil
+}
+
+func (c *SurgeCell) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	return nil
+}
+
+func (vc *VehicleCategory) BeforeCreate(tx *gorm.DB) error {
+	if vc.ID == uuid.Nil {
+		vc.ID = uuid.New()
+	}
+	return nil
+}
+
+func (p *PromoCode) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
+	return nil
+}
+
+func (r *PromoRedemption) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+func (r *Referral) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+func (r *ReferralReward) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+func (a *LedgerAccount) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = uuid.New()
+	}
+	return nil
+}
+
+func (j *JournalEntry) BeforeCreate(tx *gorm.DB) error {
+	if j.ID == uuid.Nil {
+		j.ID = uuid.New()
+	}
+	return nil
+}
+
+func (e *LedgerEntry) BeforeCreate(tx *gorm.DB) error {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	return nil
+}
+
+func (p *Payout) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
+	return nil
+}
+
+func (c *MpesaCallback) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	return nil
+}
+
+func (r *Refund) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"github.com/google/uuid"
+)
+
+// AirtelMoneyService collects payments through the Airtel Money Open API
+// and is the PaymentProvider for Airtel Money
+type AirtelMoneyService struct {
+	clientID     string
+	clientSecret string
+	environment  string // "sandbox" or "production"
+	baseURL      string // overrides the Airtel API host, e.g. for a local mock
+}
+
+func NewAirtelMoneyService() *AirtelMoneyService {
+	return &AirtelMoneyService{
+		clientID:     os.Getenv("AIRTEL_CLIENT_ID"),
+		clientSecret: os.Getenv("AIRTEL_CLIENT_SECRET"),
+		environment:  os.Getenv("ENVIRONMENT"),
+		baseURL:      os.Getenv("AIRTEL_BASE_URL"),
+	}
+}
+
+type AirtelAccessTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   string `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// AirtelStatus is the status every Airtel API response carries
+type AirtelStatus struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	ResultCode string `json:"result_code"`
+	Success    bool   `json:"success"`
+}
+
+// AirtelTransaction is a transaction as the Airtel API reports it
+type AirtelTransaction struct {
+	ID            string `json:"id"`
+	AirtelMoneyID string `json:"airtel_money_id"`
+	Message       string `json:"message"`
+	Status        string `json:"status"`
+	StatusCode    string `json:"status_code"` // on callbacks
+}
+
+type AirtelResponse struct {
+	Data struct {
+		Transaction AirtelTransaction `json:"transaction"`
+	} `json:"data"`
+	Status AirtelStatus `json:"status"`
+}
+
+// AirtelCallback is the body Airtel posts once a collection is settled
+type AirtelCallback struct {
+	Transaction AirtelTransaction `json:"transaction"`
+}
+
+// Airtel transaction statuses
+const (
+	airtelSuccess    = "TS"
+	airtelFailed     = "TF"
+	airtelInProgress = "TIP"
+	airtelAmbiguous  = "TA"
+)
+
+// apiURL returns the Airtel API URL for path
+func (a *AirtelMoneyService) apiURL(path string) string {
+	if a.baseURL != "" {
+		return strings.TrimRight(a.baseURL, "/") + path
+	}
+	if a.environment == "production" {
+		return "https://openapi.airtel.africa" + path
+	}
+	return "https://openapiuat.airtel.africa" + path
+}
+
+func (a *AirtelMoneyService) getAccessToken() (string, error) {
+	payload, err := json.Marshal(map[string]string{
+		"client_id":     a.clientID,
+		"client_secret": a.clientSecret,
+		"grant_type":    "client_credentials",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", a.apiURL("/auth/oauth2/token"), strings.NewReader(string(payload)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tokenResp AirtelAccessTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", err
+	}
+	if tokenResp.AccessToken == "" {
+		return "", fmt.Errorf("Airtel authentication failed with status %d", resp.StatusCode)
+	}
+	return tokenResp.AccessToken, nil
+}
+
+// call sends a request to the Airtel API and decodes its response
+func (a *AirtelMoneyService) call(method, path string, payload interface{}) (*AirtelResponse, error) {
+	accessToken, err := a.getAccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var body *strings.Reader
+	if payload != nil {
+		jsonPayload, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = strings.NewReader(string(jsonPayload))
+	} else {
+		body = strings.NewReader("")
+	}
+
+	req, err := http.NewRequest(method, a.apiURL(path), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Country", "KE")
+	req.Header.Set("X-Currency", "KES")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var airtelResp AirtelResponse
+	if err := json.NewDecoder(resp.Body).Decode(&airtelResp); err != nil {
+		return nil, err
+	}
+	if !airtelResp.Status.Success {
+		return nil, fmt.Errorf("Airtel request failed: %s %s", airtelResp.Status.ResultCode, airtelResp.Status.Message)
+	}
+	return &airtelResp, nil
+}
+
+func (a *AirtelMoneyService) Method() string {
+	return models.PaymentMethodAirtelMoney
+}
+
+func (a *AirtelMoneyService) CallbackKind() string {
+	return models.MpesaCallbackAirtelPayment
+}
+
+// Initiate sends a USSD push asking the payer to pay
+func (a *AirtelMoneyService) Initiate(phoneNumber string, amount float64, accountReference string) (*PaymentRequest, error) {
+	// Airtel expects our own unique ID for every collection
+	transactionID := strings.ReplaceAll(uuid.NewString(), "-", "")[:20]
+	if a.environment == "development" {
+		// Return mock response for development
+		return &PaymentRequest{Reference: transactionID, CustomerMessage: "Enter your Airtel Money PIN to pay"}, nil
+	}
+
+	_, err := a.call("POST", "/merchant/v1/payments/", map[string]interface{}{
+		"reference": accountReference,
+		"subscriber": map[string]string{
+			"country":  "KE",
+			"currency": "KES",
+			"msisdn":   strings.TrimPrefix(utils.FormatKenyanPhoneNumber(phoneNumber), "254"),
+		},
+		"transaction": map[string]interface{}{
+			"amount":   int(amount),
+			"country":  "KE",
+			"currency": "KES",
+			"id":       transactionID,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PaymentRequest{Reference: transactionID, CustomerMessage: "Enter your Airtel Money PIN to pay"}, nil
+}
+
+// Query asks Airtel for the outcome of a collection. In development it
+// always reports the collection as still processing unless AIRTEL_BASE_URL
+// is set.
+func (a *AirtelMoneyService) Query(reference string) (*PaymentResult, error) {
+	if a.environment == "development" && a.baseURL == "" {
+		// Mock collections never reach a customer, so there is no outcome
+		// to report. Point AIRTEL_BASE_URL at a mock Airtel API to query one.
+		return nil, ErrPaymentStillProcessing
+	}
+
+	airtelResp, err := a.call("GET", "/standard/v1/payments/"+reference, nil)
+	if err != nil {
+		return nil, err
+	}
+	return airtelResult(reference, airtelResp.Data.Transaction.Status, &airtelResp.Data.Transaction)
+}
+
+// ParseCallback reads the outcome of a collection from its callback. Airtel
+// does not report the amount or payer, so callbacks only settle what the
+// collection asked for.
+func (a *AirtelMoneyService) ParseCallback(body []byte) (*PaymentResult, error) {
+	var callback AirtelCallback
+	if err := json.Unmarshal(body, &callback); err != nil {
+		return nil, errors.New("invalid JSON")
+	}
+	if callback.Transaction.ID == "" {
+		return nil, errors.New("invalid callback format")
+	}
+	return airtelResult(callback.Transaction.ID, callback.Transaction.StatusCode, &callback.Transaction)
+}
+
+// airtelResult turns the status of an Airtel transaction into a payment
+// result
+func airtelResult(reference, status string, transaction *AirtelTransaction) (*PaymentResult, error) {
+	switch status {
+	case airtelSuccess:
+		receipt := transaction.AirtelMoneyID
+		return &PaymentResult{Reference: reference, Completed: true, Receipt: &receipt}, nil
+	case airtelFailed:
+		return &PaymentResult{Reference: reference, Reason: transaction.Message}, nil
+	case airtelInProgress, airtelAmbiguous:
+		return nil, ErrPaymentStillProcessing
+	default:
+		return nil, fmt.Errorf("unknown Airtel transaction status %q", status)
+	}
+}
+
+// Refund reverses an Airtel Money collection. Airtel only reverses whole
+// transactions, so payments made in parts cannot be refunded through it.
+func (a *AirtelMoneyService) Refund(payment *models.Payment, amountCents int64, phoneNumber, reference string) (*ProviderRefund, error) {
+	if payment.TransactionID == nil {
+		return nil, errors.New("payment has no Airtel Money ID to refund")
+	}
+	if ToCents(payment.RequestedAmount) != ToCents(payment.AmountPaid) {
+		return nil, fmt.Errorf("%w: the payment was made in several Airtel Money transactions", ErrProviderRefund)
+	}
+	if amountCents != ToCents(payment.AmountPaid) {
+		return nil, fmt.Errorf("%w: Airtel Money only refunds whole payments", ErrProviderRefund)
+	}
+	if a.environment == "development" {
+		// Return mock response for development
+		return &ProviderRefund{Reference: "mock_refund_" + reference, Completed: true, TransactionID: payment.TransactionID}, nil
+	}
+
+	airtelResp, err := a.call("POST", "/standard/v1/payments/refund", map[string]interface{}{
+		"transaction": map[string]string{"airtel_money_id": *payment.TransactionID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	transactionID := airtelResp.Data.Transaction.AirtelMoneyID
+	return &ProviderRefund{Reference: reference, Completed: true, TransactionID: &transactionID}, nil
+}
@@ -0,0 +1,405 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrNotRideParticipant = errors.New("only the passenger or the assigned driver can cancel this ride")
+	ErrInvalidReasonCode  = errors.New("invalid cancellation reason code")
+	ErrTripAlreadyStarted = errors.New("trip has already started and can no longer be cancelled")
+	ErrNotArrived         = errors.New("driver has not arrived at the pickup")
+	ErrNoShowTooEarly     = errors.New("passenger can only be marked as a no-show once the waiting threshold has passed")
+	ErrNoShowSharedRide   = errors.New("a no-show cannot be marked on a pooled ride carrying other passengers")
+)
+
+// Cancellation reason codes accepted from each party
+var cancellationReasonCodes = map[string][]string{
+	models.CancelledByPassenger: {"change_of_plans", "driver_too_far", "wrong_pickup_location", "driver_asked_to_cancel", "found_other_transport", "other"},
+	models.CancelledByDriver:    {"passenger_unreachable", "passenger_no_show", "vehicle_issue", "unsafe_pickup", "too_far", "other"},
+}
+
+// CancellationPolicy decides which cancellations are charged
+type CancellationPolicy struct {
+	// FreeWindow is how long after a driver is assigned the passenger may cancel for free
+	FreeWindow time.Duration
+	// PassengerFee is charged for a passenger cancellation after the free window
+	PassengerFee float64
+	// NoShowAfter is how long after arriving the driver may mark a no-show
+	NoShowAfter time.Duration
+	// NoShowFee is charged to a passenger who never turned up
+	NoShowFee float64
+}
+
+// PassengerFeeFor returns the fee for a passenger cancelling at cancelledAt a
+// ride whose driver was assigned at assignedAt. A nil assignedAt means no
+// driver had been assigned yet.
+func (p CancellationPolicy) PassengerFeeFor(assignedAt *time.Time, cancelledAt time.Time) float64 {
+	if assignedAt == nil {
+		return 0
+	}
+	if cancelledAt.Sub(*assignedAt) <= p.FreeWindow {
+		return 0
+	}
+	return p.PassengerFee
+}
+
+// ValidReasonCode reports whether a reason code may be used by the given party
+func ValidReasonCode(cancelledByType, reasonCode string) bool {
+	for _, code := range cancellationReasonCodes[cancelledByType] {
+		if code == reasonCode {
+			return true
+		}
+	}
+	return false
+}
+
+// CancellationRequest describes who is cancelling and why
+type CancellationRequest struct {
+	ActorID    uuid.UUID
+	ReasonCode string
+	Note       string
+}
+
+type CancellationService struct {
+	db        *gorm.DB
+	lifecycle *RideLifecycleService
+	ledger    *LedgerService
+	policy    CancellationPolicy
+	clock     Clock
+}
+
+func NewCancellationService(db *gorm.DB, lifecycle *RideLifecycleService, policy CancellationPolicy, clock Clock) *CancellationService {
+	return &CancellationService{
+		db:        db,
+		lifecycle: lifecycle,
+		ledger:    NewLedgerService(db, clock),
+		policy:    policy,
+		clock:     clock,
+	}
+}
+
+// CancelRideRequest cancels a ride request. Once a driver has been assigned
+// this cancels the active ride instead, or for a pooled ride that carries
+// other passengers, takes just this passenger off it.
+func (s *CancellationService) CancelRideRequest(rideRequest *models.RideRequest, req CancellationRequest) (*models.RideCancellation, error) {
+	if rideRequest.Status == models.RideRequestStatusAccepted {
+		var ride models.Ride
+		query := s.db.Where("status NOT IN ?", []string{models.RideStatusCancelled, models.RideStatusCompleted})
+		if rideRequest.RideID != nil {
+			query = query.Where("id = ?", *rideRequest.RideID)
+		} else {
+			query = query.Where("request_id = ?", rideRequest.ID)
+		}
+		if err := query.First(&ride).Error; err != nil {
+			return nil, err
+		}
+		return s.CancelRide(&ride, req)
+	}
+
+	if rideRequest.PassengerID != req.ActorID {
+		return nil, ErrNotRideParticipant
+	}
+	if !ValidReasonCode(models.CancelledByPassenger, req.ReasonCode) {
+		return nil, ErrInvalidReasonCode
+	}
+
+	cancellation := models.RideCancellation{
+		RequestID:       rideRequest.ID,
+		CancelledBy:     req.ActorID,
+		CancelledByType: models.CancelledByPassenger,
+		ReasonCode:      req.ReasonCode,
+		Note:            req.Note,
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.lifecycle.TransitionRideRequest(tx, rideRequest, Transition{
+			To:      models.RideRequestStatusCancelled,
+			ActorID: &req.ActorID,
+			Note:    req.ReasonCode,
+		}); err != nil {
+			return err
+		}
+
+		// Release any driver still holding an offer for the request
+		if err := tx.Model(&models.RideOffer{}).
+			Where("request_id = ? AND status = ?", rideRequest.ID, models.RideOfferStatusOffered).
+			Updates(map[string]interface{}{"status": models.RideOfferStatusExpired, "responded_at": s.clock.Now()}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&cancellation).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &cancellation, nil
+}
+
+// CancelRide cancels a ride that has not started yet. A passenger
+// cancellation ends the request and may be charged; a driver cancellation
+// counts against the driver and sends every request on the ride back for
+// matching. A passenger leaving a pooled ride that carries others only takes
+// themselves off it.
+func (s *CancellationService) CancelRide(ride *models.Ride, req CancellationRequest) (*models.RideCancellation, error) {
+	riders, err := s.ridersOf(ride)
+	if err != nil {
+		return nil, err
+	}
+
+	var cancelledByType string
+	var actorRequest *models.RideRequest
+	if req.ActorID == ride.DriverID {
+		cancelledByType = models.CancelledByDriver
+	} else {
+		for i := range riders {
+			if riders[i].PassengerID == req.ActorID {
+				cancelledByType = models.CancelledByPassenger
+				actorRequest = &riders[i]
+			}
+		}
+	}
+	if cancelledByType == "" {
+		return nil, ErrNotRideParticipant
+	}
+
+	if !ValidReasonCode(cancelledByType, req.ReasonCode) {
+		return nil, ErrInvalidReasonCode
+	}
+
+	if actorRequest != nil && len(riders) > 1 {
+		return s.leavePool(ride, actorRequest, req)
+	}
+	if ride.Status == models.RideStatusInProgress {
+		return nil, ErrTripAlreadyStarted
+	}
+
+	now := s.clock.Now()
+	rideID := ride.ID
+	cancellation := models.RideCancellation{
+		RequestID:       ride.RequestID,
+		RideID:          &rideID,
+		CancelledBy:     req.ActorID,
+		CancelledByType: cancelledByType,
+		ReasonCode:      req.ReasonCode,
+		Note:            req.Note,
+	}
+	if actorRequest != nil {
+		cancellation.RequestID = actorRequest.ID
+		cancellation.FeeAmount = s.policy.PassengerFeeFor(&ride.CreatedAt, now)
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.lifecycle.TransitionRide(tx, ride, Transition{
+			To:      models.RideStatusCancelled,
+			ActorID: &req.ActorID,
+			Note:    req.ReasonCode,
+		}); err != nil {
+			return err
+		}
+
+		// A driver cancellation puts the requests back up for matching. The
+		// expiry TTL starts again so the passenger gets a full search.
+		for i := range riders {
+			t := Transition{
+				To:      models.RideRequestStatusCancelled,
+				ActorID: &req.ActorID,
+				Note:    req.ReasonCode,
+			}
+			if cancelledByType == models.CancelledByDriver {
+				t.To = models.RideRequestStatusPending
+				t.Updates = map[string]interface{}{"ride_id": nil, "requested_at": now}
+			}
+			if err := s.lifecycle.TransitionRideRequest(tx, &riders[i], t); err != nil {
+				return err
+			}
+		}
+
+		driverUpdates := map[string]interface{}{"is_available": true, "available_since": now}
+		if cancelledByType == models.CancelledByDriver {
+			driverUpdates["cancellation_count"] = gorm.Expr("cancellation_count + ?", 1)
+		}
+		if err := tx.Model(&models.Driver{}).Where("driver_id = ?", ride.DriverID).Updates(driverUpdates).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Create(&cancellation).Error; err != nil {
+			return err
+		}
+
+		if cancellation.FeeAmount > 0 {
+			if err := s.chargeFee(tx, ride, &cancellation, actorRequest); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &cancellation, nil
+}
+
+// MarkNoShow cancels a ride whose passenger did not turn up at the pickup.
+// The driver must have waited at least NoShowAfter since arriving; the
+// passenger is charged the no-show fee and the driver is not penalised.
+func (s *CancellationService) MarkNoShow(ride *models.Ride, driverID uuid.UUID, note string) (*models.RideCancellation, error) {
+	if ride.DriverID != driverID {
+		return nil, ErrNotRideParticipant
+	}
+	if ride.Status != models.RideStatusArrived || ride.ArrivedAt == nil {
+		return nil, ErrNotArrived
+	}
+	now := s.clock.Now()
+	if now.Sub(*ride.ArrivedAt) < s.policy.NoShowAfter {
+		return nil, ErrNoShowTooEarly
+	}
+
+	riders, err := s.ridersOf(ride)
+	if err != nil {
+		return nil, err
+	}
+	if len(riders) != 1 {
+		return nil, ErrNoShowSharedRide
+	}
+	rideRequest := riders[0]
+
+	rideID := ride.ID
+	cancellation := models.RideCancellation{
+		RequestID:       rideRequest.ID,
+		RideID:          &rideID,
+		CancelledBy:     driverID,
+		CancelledByType: models.CancelledByDriver,
+		ReasonCode:      "passenger_no_show",
+		Note:            note,
+	}
+	cancellation.FeeAmount = s.policy.NoShowFee
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.lifecycle.TransitionRide(tx, ride, Transition{
+			To:      models.RideStatusCancelled,
+			ActorID: &driverID,
+			Note:    cancellation.ReasonCode,
+		}); err != nil {
+			return err
+		}
+		if err := s.lifecycle.TransitionRideRequest(tx, &rideRequest, Transition{
+			To:      models.RideRequestStatusCancelled,
+			ActorID: &driverID,
+			Note:    cancellation.ReasonCode,
+		}); err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.Driver{}).Where("driver_id = ?", ride.DriverID).
+			Updates(map[string]interface{}{"is_available": true, "available_since": now}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Create(&cancellation).Error; err != nil {
+			return err
+		}
+
+		if cancellation.FeeAmount > 0 {
+			if err := s.chargeFee(tx, ride, &cancellation, &rideRequest); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &cancellation, nil
+}
+
+// chargeFee bills a passenger the fee of a cancellation within tx. The fee
+// is posted to their wallet and a payment is created to collect it through
+// the method they chose for the ride. Cash riders pay the driver at the end
+// of a trip, so their fee stays owed in the wallet and is added to the
+// payment for their next ride.
+func (s *CancellationService) chargeFee(tx *gorm.DB, ride *models.Ride, cancellation *models.RideCancellation, rideRequest *models.RideRequest) error {
+	if err := s.ledger.PostCancellationFee(tx, cancellation, rideRequest.PassengerID); err != nil {
+		return err
+	}
+	method := rideRequest.PaymentMethod
+	if method == models.PaymentMethodCash {
+		return nil
+	}
+	if method == "" {
+		method = models.PaymentMethodMpesa
+	}
+	passengerID := rideRequest.PassengerID
+	payment := models.Payment{
+		RideID:        ride.ID,
+		PassengerID:   &passengerID,
+		Amount:        cancellation.FeeAmount,
+		Currency:      "KES",
+		PaymentMethod: method,
+		PaymentStatus: "pending",
+	}
+	return tx.Create(&payment).Error
+}
+
+// leavePool takes one passenger off a pooled ride that carries others. The
+// ride carries on for everyone else and the passenger is not charged.
+func (s *CancellationService) leavePool(ride *models.Ride, rideRequest *models.RideRequest, req CancellationRequest) (*models.RideCancellation, error) {
+	var pickedUp int64
+	if err := s.db.Model(&models.RideWaypoint{}).
+		Where("ride_id = ? AND request_id = ? AND kind = ? AND completed_at IS NOT NULL", ride.ID, rideRequest.ID, models.WaypointPickup).
+		Count(&pickedUp).Error; err != nil {
+		return nil, err
+	}
+	if pickedUp > 0 {
+		return nil, ErrTripAlreadyStarted
+	}
+
+	rideID := ride.ID
+	cancellation := models.RideCancellation{
+		RequestID:       rideRequest.ID,
+		RideID:          &rideID,
+		CancelledBy:     req.ActorID,
+		CancelledByType: models.CancelledByPassenger,
+		ReasonCode:      req.ReasonCode,
+		Note:            req.Note,
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.lifecycle.TransitionRideRequest(tx, rideRequest, Transition{
+			To:      models.RideRequestStatusCancelled,
+			ActorID: &req.ActorID,
+			Note:    req.ReasonCode,
+		}); err != nil {
+			return err
+		}
+		if err := removeWaypoints(tx, ride.ID, rideRequest.ID); err != nil {
+			return err
+		}
+		return tx.Create(&cancellation).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &cancellation, nil
+}
+
+// ridersOf returns the accepted requests being served by a ride. Rides
+// created before requests recorded their ride only have the one request.
+func (s *CancellationService) ridersOf(ride *models.Ride) ([]models.RideRequest, error) {
+	var riders []models.RideRequest
+	err := s.db.Where("status = ?", models.RideRequestStatusAccepted).
+		Where("ride_id = ? OR (ride_id IS NULL AND id = ?)", ride.ID, ride.RequestID).
+		Find(&riders).Error
+	return riders, err
+}
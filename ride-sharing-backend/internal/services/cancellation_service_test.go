@@ -0,0 +1,160 @@
+package services_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+	"kenyan-ride-share-backend/internal/services/paymenttest"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancellationPolicy(t *testing.T) {
+	policy := services.CancellationPolicy{FreeWindow: 3 * time.Minute, PassengerFee: 100}
+	assignedAt := time.Date(2025, 1, 15, 8, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 0.0, policy.PassengerFeeFor(nil, assignedAt.Add(time.Hour)))
+	assert.Equal(t, 0.0, policy.PassengerFeeFor(&assignedAt, assignedAt.Add(2*time.Minute)))
+	assert.Equal(t, 100.0, policy.PassengerFeeFor(&assignedAt, assignedAt.Add(5*time.Minute)))
+
+	assert.True(t, services.ValidReasonCode(models.CancelledByDriver, "vehicle_issue"))
+	assert.False(t, services.ValidReasonCode(models.CancelledByPassenger, "vehicle_issue"))
+}
+
+func TestCancellationService(t *testing.T) {
+	db := setupTestDB()
+	lifecycle := services.NewRideLifecycleService(db)
+	clock := &fakeClock{now: time.Date(2025, 1, 15, 8, 0, 0, 0, time.UTC)}
+	cancellations := services.NewCancellationService(db, lifecycle, services.CancellationPolicy{FreeWindow: 3 * time.Minute, PassengerFee: 100}, clock)
+	mpesa := paymenttest.NewFakeProvider(models.PaymentMethodMpesa)
+	payments := services.NewPaymentService(db, services.NewPaymentProviders(mpesa, paymenttest.NewFakeProvider(models.PaymentMethodAirtelMoney), services.CashProvider{}), clock)
+	ledger := services.NewLedgerService(db, clock)
+
+	createRide := func(t *testing.T, assignedAt time.Time) (models.RideRequest, models.Ride, models.Driver) {
+		driver := models.Driver{DriverID: uuid.New(), LicensePlate: uuid.NewString(), DriverLicenseNumber: uuid.NewString()}
+		require.NoError(t, db.Create(&driver).Error)
+		rideRequest := models.RideRequest{PassengerID: uuid.New(), Status: models.RideRequestStatusAccepted}
+		require.NoError(t, db.Create(&rideRequest).Error)
+		ride := models.Ride{RequestID: rideRequest.ID, DriverID: driver.DriverID, PassengerID: rideRequest.PassengerID, Status: models.RideStatusDriverArriving, CreatedAt: assignedAt}
+		require.NoError(t, db.Create(&ride).Error)
+		return rideRequest, ride, driver
+	}
+
+	t.Run("DriverCancellationRematchesRequest", func(t *testing.T) {
+		rideRequest, ride, driver := createRide(t, clock.now)
+
+		cancellation, err := cancellations.CancelRide(&ride, services.CancellationRequest{ActorID: driver.DriverID, ReasonCode: "vehicle_issue"})
+		require.NoError(t, err)
+		assert.Equal(t, models.CancelledByDriver, cancellation.CancelledByType)
+		assert.Equal(t, 0.0, cancellation.FeeAmount)
+
+		require.NoError(t, db.First(&rideRequest, "id = ?", rideRequest.ID).Error)
+		assert.Equal(t, models.RideRequestStatusPending, rideRequest.Status)
+		require.NoError(t, db.First(&driver, "driver_id = ?", driver.DriverID).Error)
+		assert.True(t, driver.IsAvailable)
+		assert.Equal(t, 1, driver.CancellationCount)
+	})
+
+	t.Run("CancellationInFreeWindowIsFree", func(t *testing.T) {
+		rideRequest, _, _ := createRide(t, clock.now)
+		clock.now = clock.now.Add(3 * time.Minute)
+
+		cancellation, err := cancellations.CancelRideRequest(&rideRequest, services.CancellationRequest{ActorID: rideRequest.PassengerID, ReasonCode: "change_of_plans"})
+		require.NoError(t, err)
+		assert.Equal(t, 0.0, cancellation.FeeAmount)
+	})
+
+	t.Run("LatePassengerCancellationIsCharged", func(t *testing.T) {
+		rideRequest, ride, _ := createRide(t, clock.now)
+		clock.now = clock.now.Add(3*time.Minute + time.Second)
+
+		cancellation, err := cancellations.CancelRideRequest(&rideRequest, services.CancellationRequest{ActorID: rideRequest.PassengerID, ReasonCode: "change_of_plans"})
+		require.NoError(t, err)
+		assert.Equal(t, 100.0, cancellation.FeeAmount)
+
+		var payment models.Payment
+		require.NoError(t, db.First(&payment, "ride_id = ?", ride.ID).Error)
+		assert.Equal(t, 100.0, payment.Amount)
+		require.NoError(t, db.First(&rideRequest, "id = ?", rideRequest.ID).Error)
+		assert.Equal(t, models.RideRequestStatusCancelled, rideRequest.Status)
+
+		// The fee is owed from the wallet until the passenger pays it
+		wallet := services.PassengerWallet(rideRequest.PassengerID)
+		balance, err := ledger.Balance(wallet)
+		require.NoError(t, err)
+		assert.Equal(t, int64(-10000), balance)
+
+		_, request, err := payments.Initiate(&ride, rideRequest.PassengerID, "254712345678", 100)
+		require.NoError(t, err)
+		receipt := "RKF100"
+		paid := 100.0
+		body, err := json.Marshal(services.PaymentResult{Reference: request.Reference, Completed: true, Receipt: &receipt, Amount: &paid, Phone: "254712345678"})
+		require.NoError(t, err)
+		recorded, err := payments.RecordCallback(models.PaymentMethodMpesa, "10.0.0.1", body)
+		require.NoError(t, err)
+		require.NoError(t, payments.ProcessCallback(models.PaymentMethodMpesa, recorded))
+
+		require.NoError(t, db.First(&payment, "id = ?", payment.ID).Error)
+		assert.Equal(t, "completed", payment.PaymentStatus)
+		balance, err = ledger.Balance(wallet)
+		require.NoError(t, err)
+		assert.Zero(t, balance)
+		commission, err := ledger.Balance(services.PlatformCommission)
+		require.NoError(t, err)
+		assert.Equal(t, int64(10000), commission)
+	})
+
+	t.Run("FeeIsCollectedThroughTheRideMethod", func(t *testing.T) {
+		rideRequest, ride, _ := createRide(t, clock.now)
+		rideRequest.PaymentMethod = models.PaymentMethodAirtelMoney
+		require.NoError(t, db.Save(&rideRequest).Error)
+		clock.now = clock.now.Add(5 * time.Minute)
+
+		_, err := cancellations.CancelRideRequest(&rideRequest, services.CancellationRequest{ActorID: rideRequest.PassengerID, ReasonCode: "change_of_plans"})
+		require.NoError(t, err)
+		var payment models.Payment
+		require.NoError(t, db.First(&payment, "ride_id = ?", ride.ID).Error)
+		assert.Equal(t, models.PaymentMethodAirtelMoney, payment.PaymentMethod)
+	})
+
+	t.Run("CashRidersOweTheFeeInTheirWallet", func(t *testing.T) {
+		rideRequest, ride, _ := createRide(t, clock.now)
+		rideRequest.PaymentMethod = models.PaymentMethodCash
+		require.NoError(t, db.Save(&rideRequest).Error)
+		clock.now = clock.now.Add(5 * time.Minute)
+
+		cancellation, err := cancellations.CancelRideRequest(&rideRequest, services.CancellationRequest{ActorID: rideRequest.PassengerID, ReasonCode: "change_of_plans"})
+		require.NoError(t, err)
+		assert.Equal(t, 100.0, cancellation.FeeAmount)
+		// There is nothing to collect it through until the next ride
+		var count int64
+		require.NoError(t, db.Model(&models.Payment{}).Where("ride_id = ?", ride.ID).Count(&count).Error)
+		assert.Zero(t, count)
+		balance, err := ledger.Balance(services.PassengerWallet(rideRequest.PassengerID))
+		require.NoError(t, err)
+		assert.Equal(t, int64(-10000), balance)
+	})
+
+	t.Run("PendingCancellationReleasesOffers", func(t *testing.T) {
+		rideRequest := models.RideRequest{PassengerID: uuid.New(), Status: models.RideRequestStatusPending}
+		require.NoError(t, db.Create(&rideRequest).Error)
+		offer := models.RideOffer{RequestID: rideRequest.ID, DriverID: uuid.New(), Status: models.RideOfferStatusOffered, OfferedAt: clock.now, ExpiresAt: clock.now.Add(time.Minute)}
+		require.NoError(t, db.Create(&offer).Error)
+
+		_, err := cancellations.CancelRideRequest(&rideRequest, services.CancellationRequest{ActorID: rideRequest.PassengerID, ReasonCode: "change_of_plans"})
+		require.NoError(t, err)
+		require.NoError(t, db.First(&offer, "id = ?", offer.ID).Error)
+		assert.Equal(t, models.RideOfferStatusExpired, offer.Status)
+	})
+
+	t.Run("OutsiderCannotCancel", func(t *testing.T) {
+		_, ride, _ := createRide(t, clock.now)
+		_, err := cancellations.CancelRide(&ride, services.CancellationRequest{ActorID: uuid.New(), ReasonCode: "other"})
+		assert.ErrorIs(t, err, services.ErrNotRideParticipant)
+	})
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"kenyan-ride-share-backend/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrDriverDebtLimit = errors.New("driver owes more commission than allowed")
+
+// CashService records fares drivers collect in cash. The driver keeps the
+// cash, so the platform's commission on it becomes a debt the driver owes.
+// The debt lives on the driver's earnings account as a negative balance and
+// is paid off by their next digital earnings.
+type CashService struct {
+	db             *gorm.DB
+	ledger         *LedgerService
+	debtLimitCents int64
+}
+
+// NewCashService returns a cash service that keeps drivers owing more than
+// debtLimit KES in commission from going online
+func NewCashService(db *gorm.DB, clock Clock, debtLimit float64) *CashService {
+	return &CashService{
+		db:             db,
+		ledger:         NewLedgerService(db, clock),
+		debtLimitCents: ToCents(debtLimit),
+	}
+}
+
+// Collect records within tx that a driver collected a cash payment from the
+// passenger: the fare and any earlier debt added to it. The ride fare must
+// already be posted.
+func (s *CashService) Collect(tx *gorm.DB, payment *models.Payment, passengerID, driverID uuid.UUID) error {
+	collected := ToCents(payment.Amount) + ToCents(payment.WalletDebt)
+	_, err := s.ledger.Post(tx, models.JournalCashCollection, payment.ID.String(),
+		fmt.Sprintf("Cash collected for ride %s", payment.RideID),
+		Debit(DriverEarnings(driverID), collected),
+		Credit(PassengerWallet(passengerID), collected),
+	)
+	return err
+}
+
+// Debt returns the commission a driver owes in cents, read through db
+func (s *CashService) Debt(db *gorm.DB, driverID uuid.UUID) (int64, error) {
+	earnings, err := s.ledger.balance(db, DriverEarnings(driverID))
+	if err != nil || earnings >= 0 {
+		return 0, err
+	}
+	return -earnings, nil
+}
+
+// CheckDebt returns ErrDriverDebtLimit when a driver owes more commission
+// than they may to go online
+func (s *CashService) CheckDebt(db *gorm.DB, driverID uuid.UUID) error {
+	debt, err := s.Debt(db, driverID)
+	if err != nil {
+		return err
+	}
+	if debt > s.debtLimitCents {
+		return fmt.Errorf("%w: KES %.2f owed", ErrDriverDebtLimit, FromCents(debt))
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCashService(t *testing.T) {
+	db := setupTestDB()
+	clock := &fakeClock{now: time.Now()}
+	ledger := services.NewLedgerService(db, clock)
+	cash := services.NewCashService(db, clock, 200)
+	driverID := uuid.New()
+
+	// Posts a completed ride and returns the passenger
+	completeRide := func(t *testing.T, fare float64, method string) uuid.UUID {
+		passengerID := uuid.New()
+		breakdown := models.FareBreakdown{RideID: uuid.New(), RequestID: uuid.New(), PassengerID: passengerID, Total: fare}
+		require.NoError(t, db.Create(&breakdown).Error)
+		require.NoError(t, ledger.PostRideFare(db, &breakdown, driverID))
+
+		payment := models.Payment{RideID: breakdown.RideID, PassengerID: &passengerID, Amount: fare, PaymentMethod: method, PaymentStatus: "completed"}
+		require.NoError(t, db.Create(&payment).Error)
+		require.NoError(t, ledger.ReleaseEarnings(db, &payment))
+		if method == models.PaymentMethodCash {
+			require.NoError(t, cash.Collect(db, &payment, passengerID, driverID))
+		} else {
+			require.NoError(t, ledger.PostPayment(db, &payment, passengerID))
+		}
+		return passengerID
+	}
+	debt := func(t *testing.T) int64 {
+		cents, err := cash.Debt(db, driverID)
+		require.NoError(t, err)
+		return cents
+	}
+
+	t.Run("CommissionOnCashIsOwed", func(t *testing.T) {
+		passengerID := completeRide(t, 1000, models.PaymentMethodCash)
+		// 18% of KES 1000
+		assert.Equal(t, int64(18000), debt(t))
+		wallet, err := ledger.Balance(services.PassengerWallet(passengerID))
+		require.NoError(t, err)
+		assert.Zero(t, wallet)
+		assert.NoError(t, cash.CheckDebt(db, driverID))
+	})
+
+	t.Run("DebtAboveLimitBlocksDriver", func(t *testing.T) {
+		completeRide(t, 500, models.PaymentMethodCash)
+		assert.Equal(t, int64(27000), debt(t))
+		assert.ErrorIs(t, cash.CheckDebt(db, driverID), services.ErrDriverDebtLimit)
+	})
+
+	t.Run("DigitalEarningsPayOffDebt", func(t *testing.T) {
+		// KES 820 of a KES 1000 M-Pesa fare goes to the driver
+		completeRide(t, 1000, models.PaymentMethodMpesa)
+		assert.Zero(t, debt(t))
+		earnings, err := ledger.Balance(services.DriverEarnings(driverID))
+		require.NoError(t, err)
+		assert.Equal(t, int64(55000), earnings)
+		assert.NoError(t, cash.CheckDebt(db, driverID))
+	})
+}
@@ -0,0 +1,16 @@
+package services
+
+import "time"
+
+// Clock tells the current time. Services take a Clock so tests can control
+// time.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock backed by time.Now
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,388 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ErrNoActiveOffer is returned when a driver responds to a request they do
+// not currently hold an offer for.
+var ErrNoActiveOffer = errors.New("ride request is not currently offered to this driver")
+
+// Ranking weights. Distance matters most, then rating, then how long the
+// driver has been waiting for a trip.
+const (
+	dispatchDistanceWeight = 0.6
+	dispatchRatingWeight   = 0.25
+	dispatchIdleWeight     = 0.15
+	// Idle time stops improving a driver's rank after this long
+	dispatchMaxIdle = 30 * time.Minute
+)
+
+type DispatchConfig struct {
+	InitialRadiusKm float64
+	RadiusStepKm    float64
+	MaxRadiusKm     float64
+	OfferTimeout    time.Duration
+	SweepInterval   time.Duration
+}
+
+// DriverResponseStats summarises how a driver responds to ride offers
+type DriverResponseStats struct {
+	DriverID       uuid.UUID `json:"driver_id"`
+	OffersReceived int64     `json:"offers_received"`
+	Accepted       int64     `json:"accepted"`
+	Declined       int64     `json:"declined"`
+	Expired        int64     `json:"expired"`
+	AcceptanceRate float64   `json:"acceptance_rate"`
+	DeclineRate    float64   `json:"decline_rate"`
+}
+
+// DispatchCandidate is a driver considered for a ride request
+type DispatchCandidate struct {
+	Driver     models.Driver
+	DistanceKm float64
+	Rating     float64
+	IdleTime   time.Duration
+	Score      float64
+}
+
+// DispatchService offers pending ride requests to one driver at a time,
+// moving on to the next best driver when an offer is declined or times out
+// and widening the search radius when nobody nearby is left.
+type DispatchService struct {
+	db     *gorm.DB
+	config DispatchConfig
+	clock  Clock
+	// mu serialises dispatch decisions so a driver is never offered two
+	// requests at once by this process
+	mu sync.Mutex
+}
+
+func NewDispatchService(db *gorm.DB, config DispatchConfig, clock Clock) *DispatchService {
+	return &DispatchService{
+		db:     db,
+		config: config,
+		clock:  clock,
+	}
+}
+
+// RankCandidates scores candidates found within radiusKm and sorts them best
+// first. Lower scores are better.
+func RankCandidates(candidates []DispatchCandidate, radiusKm float64) []DispatchCandidate {
+	for i := range candidates {
+		distanceScore := 1.0
+		if radiusKm > 0 {
+			distanceScore = candidates[i].DistanceKm / radiusKm
+		}
+		ratingScore := candidates[i].Rating / 5.0
+		idleScore := float64(candidates[i].IdleTime) / float64(dispatchMaxIdle)
+		if idleScore > 1 {
+			idleScore = 1
+		}
+
+		candidates[i].Score = dispatchDistanceWeight*distanceScore - dispatchRatingWeight*ratingScore - dispatchIdleWeight*idleScore
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score < candidates[j].Score
+	})
+	return candidates
+}
+
+// Dispatch offers a pending ride request to the best available driver. It
+// does nothing if the request already has an open offer or is no longer
+// pending.
+func (s *DispatchService) Dispatch(requestID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rideRequest models.RideRequest
+	if err := s.db.Where("id = ?", requestID).First(&rideRequest).Error; err != nil {
+		return err
+	}
+	if rideRequest.Status != models.RideRequestStatusPending {
+		return nil
+	}
+
+	var openOffers int64
+	if err := s.db.Model(&models.RideOffer{}).Where("request_id = ? AND status = ?", requestID, models.RideOfferStatusOffered).Count(&openOffers).Error; err != nil {
+		return err
+	}
+	if openOffers > 0 {
+		return nil
+	}
+
+	radius := s.config.InitialRadiusKm
+	if rideRequest.DispatchRadiusKm != nil {
+		radius = *rideRequest.DispatchRadiusKm
+	}
+
+	now := s.clock.Now()
+	for {
+		candidates, err := s.findCandidates(&rideRequest, radius, now)
+		if err != nil {
+			return err
+		}
+
+		if len(candidates) > 0 {
+			best := RankCandidates(candidates, radius)[0]
+			offer := models.RideOffer{
+				RequestID:  requestID,
+				DriverID:   best.Driver.DriverID,
+				Status:     models.RideOfferStatusOffered,
+				RadiusKm:   radius,
+				DistanceKm: best.DistanceKm,
+				Score:      best.Score,
+				OfferedAt:  now,
+				ExpiresAt:  now.Add(s.config.OfferTimeout),
+			}
+			return s.db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Model(&rideRequest).Update("dispatch_radius_km", radius).Error; err != nil {
+					return err
+				}
+				return tx.Create(&offer).Error
+			})
+		}
+
+		// Nobody left to ask at this radius, so widen the search
+		if radius >= s.config.MaxRadiusKm || s.config.RadiusStepKm <= 0 {
+			return s.db.Model(&rideRequest).Update("dispatch_radius_km", radius).Error
+		}
+		radius += s.config.RadiusStepKm
+		if radius > s.config.MaxRadiusKm {
+			radius = s.config.MaxRadiusKm
+		}
+	}
+}
+
+// findCandidates returns approved, available drivers within radiusKm of the
+// pickup who have not been offered or declined this request before and are
+// not holding another offer.
+func (s *DispatchService) findCandidates(rideRequest *models.RideRequest, radiusKm float64, now time.Time) ([]DispatchCandidate, error) {
+	alreadyOffered := s.db.Model(&models.RideOffer{}).Select("driver_id").Where("request_id = ?", rideRequest.ID)
+	declined := s.db.Model(&models.RideRequestDecline{}).Select("driver_id").Where("request_id = ?", rideRequest.ID)
+	holdingOffer := s.db.Model(&models.RideOffer{}).Select("driver_id").Where("status = ?", models.RideOfferStatusOffered)
+
+	query := s.db.Where("is_available = ? AND is_approved = ? AND current_latitude IS NOT NULL AND current_longitude IS NOT NULL", true, true).
+		Where("driver_id NOT IN (?) AND driver_id NOT IN (?) AND driver_id NOT IN (?)", alreadyOffered, declined, holdingOffer)
+	// Only drivers of the requested vehicle category are offered the ride
+	if rideRequest.VehicleCategory != "" {
+		query = query.Where("vehicle_category = ?", rideRequest.VehicleCategory)
+	}
+
+	var drivers []models.Driver
+	if err := query.Find(&drivers).Error; err != nil {
+		return nil, err
+	}
+
+	var candidates []DispatchCandidate
+	var driverIDs []uuid.UUID
+	for _, driver := range drivers {
+		distance := utils.CalculateDistance(rideRequest.PickupLatitude, rideRequest.PickupLongitude, *driver.CurrentLatitude, *driver.CurrentLongitude)
+		if distance > radiusKm {
+			continue
+		}
+
+		var idle time.Duration
+		if driver.AvailableSince != nil {
+			idle = now.Sub(*driver.AvailableSince)
+		}
+		candidates = append(candidates, DispatchCandidate{Driver: driver, DistanceKm: distance, IdleTime: idle})
+		driverIDs = append(driverIDs, driver.DriverID)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	var users []models.User
+	if err := s.db.Where("id IN ?", driverIDs).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	ratings := make(map[uuid.UUID]float64, len(users))
+	for _, user := range users {
+		ratings[user.ID] = user.Rating
+	}
+	for i := range candidates {
+		candidates[i].Rating = ratings[candidates[i].Driver.DriverID]
+	}
+
+	return candidates, nil
+}
+
+// AcceptOffer marks the driver's open offer for the request as accepted
+// within tx. It fails with ErrNoActiveOffer unless the driver holds the
+// current, unexpired offer.
+func (s *DispatchService) AcceptOffer(tx *gorm.DB, requestID, driverID uuid.UUID) error {
+	return s.respond(tx, requestID, driverID, models.RideOfferStatusAccepted)
+}
+
+// DeclineRequest records that the driver declined the request so it is not
+// shown or offered to them again. If the driver held the current offer it is
+// declined and the request is offered to the next candidate.
+func (s *DispatchService) DeclineRequest(requestID, driverID uuid.UUID, reason string) error {
+	heldOffer := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		decline := models.RideRequestDecline{
+			RequestID: requestID,
+			DriverID:  driverID,
+			Reason:    reason,
+			CreatedAt: s.clock.Now(),
+		}
+		if err := tx.Where("request_id = ? AND driver_id = ?", requestID, driverID).FirstOrCreate(&decline).Error; err != nil {
+			return err
+		}
+
+		err := s.respond(tx, requestID, driverID, models.RideOfferStatusDeclined)
+		if errors.Is(err, ErrNoActiveOffer) {
+			return nil
+		}
+		heldOffer = err == nil
+		return err
+	})
+	if err != nil || !heldOffer {
+		return err
+	}
+	return s.Dispatch(requestID)
+}
+
+// HasDeclined reports whether the driver has declined the request
+func (s *DispatchService) HasDeclined(requestID, driverID uuid.UUID) (bool, error) {
+	var count int64
+	err := s.db.Model(&models.RideRequestDecline{}).Where("request_id = ? AND driver_id = ?", requestID, driverID).Count(&count).Error
+	return count > 0, err
+}
+
+// GetDriverResponseStats returns offer response counts and rates since the
+// given time. A nil driverID returns stats for every driver offered a request.
+func (s *DispatchService) GetDriverResponseStats(driverID *uuid.UUID, since time.Time) ([]DriverResponseStats, error) {
+	type statusCount struct {
+		DriverID uuid.UUID
+		Status   string
+		Count    int64
+	}
+
+	offerQuery := s.db.Model(&models.RideOffer{}).
+		Select("driver_id, status, COUNT(*) AS count").
+		Where("offered_at >= ?", since).
+		Group("driver_id, status")
+	if driverID != nil {
+		offerQuery = offerQuery.Where("driver_id = ?", *driverID)
+	}
+
+	var offerCounts []statusCount
+	if err := offerQuery.Scan(&offerCounts).Error; err != nil {
+		return nil, err
+	}
+
+	statsByDriver := make(map[uuid.UUID]*DriverResponseStats)
+	for _, row := range offerCounts {
+		stats := statsByDriver[row.DriverID]
+		if stats == nil {
+			stats = &DriverResponseStats{DriverID: row.DriverID}
+			statsByDriver[row.DriverID] = stats
+		}
+		stats.OffersReceived += row.Count
+		switch row.Status {
+		case models.RideOfferStatusAccepted:
+			stats.Accepted += row.Count
+		case models.RideOfferStatusDeclined:
+			stats.Declined += row.Count
+		case models.RideOfferStatusExpired:
+			stats.Expired += row.Count
+		}
+	}
+
+	results := make([]DriverResponseStats, 0, len(statsByDriver))
+	for _, stats := range statsByDriver {
+		stats.AcceptanceRate = float64(stats.Accepted) / float64(stats.OffersReceived)
+		// Declines are measured against the offers the driver answered, so
+		// requests declined without an offer do not count
+		if responded := stats.Accepted + stats.Declined; responded > 0 {
+			stats.DeclineRate = float64(stats.Declined) / float64(responded)
+		}
+		results = append(results, *stats)
+	}
+
+	// Highest decline rate first for ops review
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].DeclineRate > results[j].DeclineRate
+	})
+	return results, nil
+}
+
+func (s *DispatchService) respond(tx *gorm.DB, requestID, driverID uuid.UUID, status string) error {
+	now := s.clock.Now()
+	result := tx.Model(&models.RideOffer{}).
+		Where("request_id = ? AND driver_id = ? AND status = ? AND expires_at > ?", requestID, driverID, models.RideOfferStatusOffered, now).
+		Updates(map[string]interface{}{"status": status, "responded_at": now})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoActiveOffer
+	}
+	return nil
+}
+
+// GetDriverOffers returns the open offers held by a driver
+func (s *DispatchService) GetDriverOffers(driverID uuid.UUID) ([]models.RideOffer, error) {
+	var offers []models.RideOffer
+	err := s.db.Where("driver_id = ? AND status = ? AND expires_at > ?", driverID, models.RideOfferStatusOffered, s.clock.Now()).
+		Order("offered_at ASC").
+		Find(&offers).Error
+	return offers, err
+}
+
+// Sweep expires timed out offers and re-dispatches every pending request
+// that is not currently offered to anyone.
+func (s *DispatchService) Sweep() error {
+	now := s.clock.Now()
+	if err := s.db.Model(&models.RideOffer{}).
+		Where("status = ? AND expires_at <= ?", models.RideOfferStatusOffered, now).
+		Updates(map[string]interface{}{"status": models.RideOfferStatusExpired, "responded_at": now}).Error; err != nil {
+		return err
+	}
+
+	var requestIDs []uuid.UUID
+	if err := s.db.Model(&models.RideRequest{}).
+		Where("status = ?", models.RideRequestStatusPending).
+		Where("NOT EXISTS (SELECT 1 FROM ride_offers WHERE ride_offers.request_id = ride_requests.id AND ride_offers.status = ?)", models.RideOfferStatusOffered).
+		Pluck("id", &requestIDs).Error; err != nil {
+		return err
+	}
+
+	for _, requestID := range requestIDs {
+		if err := s.Dispatch(requestID); err != nil {
+			log.Printf("Failed to dispatch ride request %s: %v", requestID, err)
+		}
+	}
+	return nil
+}
+
+// Run sweeps offers every SweepInterval until ctx is cancelled
+func (s *DispatchService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Sweep(); err != nil {
+				log.Printf("Dispatch sweep failed: %v", err)
+			}
+		}
+	}
+}
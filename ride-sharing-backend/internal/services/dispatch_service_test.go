@@ -0,0 +1,163 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRankCandidates(t *testing.T) {
+	near := services.DispatchCandidate{Driver: models.Driver{DriverID: uuid.New()}, DistanceKm: 0.5, Rating: 4.0}
+	far := services.DispatchCandidate{Driver: models.Driver{DriverID: uuid.New()}, DistanceKm: 2.8, Rating: 5.0}
+	idle := services.DispatchCandidate{Driver: models.Driver{DriverID: uuid.New()}, DistanceKm: 0.6, Rating: 4.0, IdleTime: time.Hour}
+
+	ranked := services.RankCandidates([]services.DispatchCandidate{far, near, idle}, 3)
+	assert.Equal(t, idle.Driver.DriverID, ranked[0].Driver.DriverID)
+	assert.Equal(t, near.Driver.DriverID, ranked[1].Driver.DriverID)
+	assert.Equal(t, far.Driver.DriverID, ranked[2].Driver.DriverID)
+}
+
+func TestDispatchService(t *testing.T) {
+	db := setupTestDB()
+	clock := &fakeClock{now: time.Date(2025, 1, 15, 8, 0, 0, 0, time.UTC)}
+	dispatcher := services.NewDispatchService(db, services.DispatchConfig{
+		InitialRadiusKm: 2,
+		RadiusStepKm:    4,
+		MaxRadiusKm:     10,
+		OfferTimeout:    time.Minute,
+	}, clock)
+
+	createDriver := func(lat, lon float64) models.Driver {
+		driver := models.Driver{
+			DriverID:            uuid.New(),
+			LicensePlate:        uuid.NewString(),
+			DriverLicenseNumber: uuid.NewString(),
+			IsApproved:          true,
+			IsAvailable:         true,
+			CurrentLatitude:     &lat,
+			CurrentLongitude:    &lon,
+		}
+		require.NoError(t, db.Create(&driver).Error)
+		return driver
+	}
+
+	// Nairobi CBD pickup; the second driver is about 1km away and the third about 5km
+	nearest := createDriver(-1.2925, 36.8220)
+	second := createDriver(-1.2830, 36.8219)
+	distant := createDriver(-1.2650, 36.8600)
+
+	rideRequest := models.RideRequest{PassengerID: uuid.New(), PickupLatitude: -1.2921, PickupLongitude: 36.8219, Status: models.RideRequestStatusPending}
+	require.NoError(t, db.Create(&rideRequest).Error)
+
+	currentOffer := func() models.RideOffer {
+		var offer models.RideOffer
+		require.NoError(t, db.Where("request_id = ? AND status = ?", rideRequest.ID, models.RideOfferStatusOffered).First(&offer).Error)
+		return offer
+	}
+
+	require.NoError(t, dispatcher.Dispatch(rideRequest.ID))
+	assert.Equal(t, nearest.DriverID, currentOffer().DriverID)
+
+	// Dispatching again keeps the open offer
+	require.NoError(t, dispatcher.Dispatch(rideRequest.ID))
+	assert.Equal(t, nearest.DriverID, currentOffer().DriverID)
+
+	// Only the offer holder may accept
+	assert.ErrorIs(t, dispatcher.AcceptOffer(db, rideRequest.ID, second.DriverID), services.ErrNoActiveOffer)
+
+	// The offer stands until it times out, then moves to the next driver
+	clock.now = clock.now.Add(59 * time.Second)
+	require.NoError(t, dispatcher.Sweep())
+	assert.Equal(t, nearest.DriverID, currentOffer().DriverID)
+	clock.now = clock.now.Add(time.Second)
+	require.NoError(t, dispatcher.Sweep())
+	assert.Equal(t, second.DriverID, currentOffer().DriverID)
+
+	var expired models.RideOffer
+	require.NoError(t, db.Where("request_id = ? AND driver_id = ?", rideRequest.ID, nearest.DriverID).First(&expired).Error)
+	assert.Equal(t, models.RideOfferStatusExpired, expired.Status)
+	assert.ErrorIs(t, dispatcher.AcceptOffer(db, rideRequest.ID, nearest.DriverID), services.ErrNoActiveOffer)
+
+	// Nobody else within 2km, so the radius widens to reach the distant driver
+	require.NoError(t, dispatcher.DeclineRequest(rideRequest.ID, second.DriverID, ""))
+	offer := currentOffer()
+	assert.Equal(t, distant.DriverID, offer.DriverID)
+	assert.Equal(t, 6.0, offer.RadiusKm)
+
+	require.NoError(t, dispatcher.AcceptOffer(db, rideRequest.ID, distant.DriverID))
+}
+
+func TestDeclineRequest(t *testing.T) {
+	db := setupTestDB()
+	clock := &fakeClock{now: time.Date(2025, 1, 15, 8, 0, 0, 0, time.UTC)}
+	dispatcher := services.NewDispatchService(db, services.DispatchConfig{
+		InitialRadiusKm: 5,
+		MaxRadiusKm:     5,
+		OfferTimeout:    time.Minute,
+	}, clock)
+
+	lat, lon := -1.2925, 36.8220
+	offered := models.Driver{DriverID: uuid.New(), LicensePlate: "KDA 001A", DriverLicenseNumber: "DL001", IsApproved: true, IsAvailable: true, CurrentLatitude: &lat, CurrentLongitude: &lon}
+	other := models.Driver{DriverID: uuid.New(), LicensePlate: "KDA 002A", DriverLicenseNumber: "DL002", IsApproved: true, IsAvailable: true, CurrentLatitude: &lat, CurrentLongitude: &lon}
+	require.NoError(t, db.Create(&offered).Error)
+	require.NoError(t, db.Create(&other).Error)
+
+	rideRequest := models.RideRequest{PassengerID: uuid.New(), PickupLatitude: -1.2921, PickupLongitude: 36.8219, Status: models.RideRequestStatusPending}
+	require.NoError(t, db.Create(&rideRequest).Error)
+
+	// A driver can decline a request they were never offered
+	require.NoError(t, dispatcher.DeclineRequest(rideRequest.ID, other.DriverID, "too far"))
+	require.NoError(t, dispatcher.Dispatch(rideRequest.ID))
+
+	var offer models.RideOffer
+	require.NoError(t, db.Where("request_id = ? AND status = ?", rideRequest.ID, models.RideOfferStatusOffered).First(&offer).Error)
+	assert.Equal(t, offered.DriverID, offer.DriverID)
+
+	// Declining twice is a no-op for the decline record
+	require.NoError(t, dispatcher.DeclineRequest(rideRequest.ID, offered.DriverID, ""))
+	require.NoError(t, dispatcher.DeclineRequest(rideRequest.ID, offered.DriverID, ""))
+
+	declined, err := dispatcher.HasDeclined(rideRequest.ID, offered.DriverID)
+	require.NoError(t, err)
+	assert.True(t, declined)
+
+	// Nobody left to offer it to, but the request stays open
+	var openOffers int64
+	db.Model(&models.RideOffer{}).Where("request_id = ? AND status = ?", rideRequest.ID, models.RideOfferStatusOffered).Count(&openOffers)
+	assert.Zero(t, openOffers)
+	require.NoError(t, db.First(&rideRequest, "id = ?", rideRequest.ID).Error)
+	assert.Equal(t, models.RideRequestStatusPending, rideRequest.Status)
+
+	// Only the decline of an offer counts towards the decline rate
+	stats, err := dispatcher.GetDriverResponseStats(nil, clock.now.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, offered.DriverID, stats[0].DriverID)
+	assert.Equal(t, int64(1), stats[0].Declined)
+	assert.Equal(t, 1.0, stats[0].DeclineRate)
+	assert.Zero(t, stats[0].AcceptanceRate)
+
+	stats, err = dispatcher.GetDriverResponseStats(&offered.DriverID, clock.now.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, int64(1), stats[0].OffersReceived)
+
+	// Offers that expired unanswered count as received but not as declined
+	busy := uuid.New()
+	for _, status := range []string{models.RideOfferStatusAccepted, models.RideOfferStatusDeclined, models.RideOfferStatusExpired} {
+		offer := models.RideOffer{RequestID: uuid.New(), DriverID: busy, Status: status, OfferedAt: clock.now, ExpiresAt: clock.now.Add(time.Minute)}
+		require.NoError(t, db.Create(&offer).Error)
+	}
+	stats, err = dispatcher.GetDriverResponseStats(&busy, clock.now.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, int64(3), stats[0].OffersReceived)
+	assert.Equal(t, 0.5, stats[0].DeclineRate)
+	assert.InDelta(t, 1.0/3, stats[0].AcceptanceRate, 1e-9)
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrQuoteNotFound         = errors.New("fare quote not found")
+	ErrQuoteExpired          = errors.New("fare quote has expired")
+	ErrQuoteUsed             = errors.New("fare quote has already been used")
+	ErrQuoteRouteMismatch    = errors.New("ride request does not match the quoted route")
+	ErrQuoteOptionNotOffered = errors.New("fare quote has no price for this ride type and vehicle category")
+)
+
+const (
+	// quoteMatchRadiusKm is how far the requested pickup and dropoff may be
+	// from the quoted ones
+	quoteMatchRadiusKm = 0.2
+	// quoteDistanceToleranceKm is how much the requested route may differ
+	// in length from the quoted one, e.g. through changed stops
+	quoteDistanceToleranceKm = 0.5
+)
+
+// QuoteRoute is the trip a fare quote is for
+type QuoteRoute struct {
+	Pickup  utils.Coordinate
+	Dropoff utils.Coordinate
+	// Stops are visited in order between pickup and dropoff
+	Stops []utils.Coordinate
+}
+
+// Points returns every point of the route in visiting order
+func (r QuoteRoute) Points() []utils.Coordinate {
+	points := append([]utils.Coordinate{r.Pickup}, r.Stops...)
+	return append(points, r.Dropoff)
+}
+
+type FareQuoteService struct {
+	db         *gorm.DB
+	surge      *SurgeService
+	categories *VehicleCategoryService
+	pool       PoolConfig
+	ttl        time.Duration
+	clock      Clock
+}
+
+func NewFareQuoteService(db *gorm.DB, surge *SurgeService, pool PoolConfig, ttl time.Duration, clock Clock) *FareQuoteService {
+	return &FareQuoteService{
+		db:         db,
+		surge:      surge,
+		categories: NewVehicleCategoryService(db),
+		pool:       pool,
+		ttl:        ttl,
+		clock:      clock,
+	}
+}
+
+// EstimateDuration is the rough trip time used for estimates: 3 minutes per km
+func EstimateDuration(distanceKm float64) int {
+	return int(distanceKm * 3)
+}
+
+// CreateQuote prices a route in every bookable vehicle category, and for a
+// pooled ride where one is possible, and stores the quote so the prices can
+// be honoured until it expires. A promo, if given, is taken off the options
+// in the categories it is valid for.
+func (s *FareQuoteService) CreateQuote(passengerID uuid.UUID, route QuoteRoute, promo *models.PromoCode) (*models.FareQuote, error) {
+	now := s.clock.Now()
+	distance := utils.CalculateRouteDistance(route.Points())
+	duration := EstimateDuration(distance)
+	surge, err := s.surge.MultiplierAt(route.Pickup.Latitude, route.Pickup.Longitude)
+	if err != nil {
+		return nil, err
+	}
+	categories, err := s.categories.List(true)
+	if err != nil {
+		return nil, err
+	}
+
+	quote := models.FareQuote{
+		PassengerID:      passengerID,
+		PickupLatitude:   route.Pickup.Latitude,
+		PickupLongitude:  route.Pickup.Longitude,
+		DropoffLatitude:  route.Dropoff.Latitude,
+		DropoffLongitude: route.Dropoff.Longitude,
+		DistanceKm:       roundAmount(distance),
+		DurationMinutes:  duration,
+		SurgeMultiplier:  surge,
+		ExpiresAt:        now.Add(s.ttl),
+	}
+	if promo != nil {
+		quote.PromoCodeID = &promo.ID
+	}
+
+	for i := range categories {
+		category := &categories[i]
+		input := FareInput{Rates: CategoryRates(category), DistanceKm: distance, DurationMinutes: duration, SurgeMultiplier: surge}
+		if promo != nil && PromoAllowsCategory(promo, category.Code) {
+			input.Promo = promo
+		}
+		quote.Options = append(quote.Options, quoteOption(models.RideTypeStandard, category.Code, CalculateFinalFare(input)))
+		// Pooled rides cannot have intermediate stops
+		if category.Code == PoolVehicleCategory && len(route.Stops) == 0 {
+			input.Discount = s.pool.Discount
+			quote.Options = append(quote.Options, quoteOption(models.RideTypePool, category.Code, CalculateFinalFare(input)))
+		}
+	}
+
+	if err := s.db.Create(&quote).Error; err != nil {
+		return nil, err
+	}
+	return &quote, nil
+}
+
+// ValidateQuote checks that a passenger's quote can still be used for the
+// given route, ride type and vehicle category and returns the quote with the
+// locked option.
+func (s *FareQuoteService) ValidateQuote(quoteID, passengerID uuid.UUID, rideType, vehicleCategory string, route QuoteRoute) (*models.FareQuote, *models.FareQuoteOption, error) {
+	var quote models.FareQuote
+	if err := s.db.Preload("Options").Where("id = ? AND passenger_id = ?", quoteID, passengerID).First(&quote).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrQuoteNotFound
+		}
+		return nil, nil, err
+	}
+	if quote.UsedAt != nil {
+		return nil, nil, ErrQuoteUsed
+	}
+	if !s.clock.Now().Before(quote.ExpiresAt) {
+		return nil, nil, ErrQuoteExpired
+	}
+
+	pickupOffset := utils.CalculateDistance(quote.PickupLatitude, quote.PickupLongitude, route.Pickup.Latitude, route.Pickup.Longitude)
+	dropoffOffset := utils.CalculateDistance(quote.DropoffLatitude, quote.DropoffLongitude, route.Dropoff.Latitude, route.Dropoff.Longitude)
+	distance := utils.CalculateRouteDistance(route.Points())
+	if pickupOffset > quoteMatchRadiusKm || dropoffOffset > quoteMatchRadiusKm ||
+		math.Abs(distance-quote.DistanceKm) > quoteDistanceToleranceKm {
+		return nil, nil, ErrQuoteRouteMismatch
+	}
+
+	for i := range quote.Options {
+		if quote.Options[i].RideType == rideType && quote.Options[i].VehicleCategory == vehicleCategory {
+			return &quote, &quote.Options[i], nil
+		}
+	}
+	return nil, nil, ErrQuoteOptionNotOffered
+}
+
+// RedeemQuote marks a quote as used by a ride request within tx. It fails
+// if another request used the quote first.
+func (s *FareQuoteService) RedeemQuote(tx *gorm.DB, quoteID, requestID uuid.UUID) error {
+	result := tx.Model(&models.FareQuote{}).
+		Where("id = ? AND used_at IS NULL", quoteID).
+		Updates(map[string]interface{}{"used_at": s.clock.Now(), "request_id": requestID})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrQuoteUsed
+	}
+	return nil
+}
+
+func quoteOption(rideType, vehicleCategory string, breakdown models.FareBreakdown) models.FareQuoteOption {
+	return models.FareQuoteOption{
+		RideType:         rideType,
+		VehicleCategory:  vehicleCategory,
+		BaseFare:         breakdown.BaseFare,
+		DistanceFare:     breakdown.DistanceFare,
+		TimeFare:         breakdown.TimeFare,
+		SurgeAmount:      breakdown.SurgeAmount,
+		MinimumFareTopUp: breakdown.MinimumFareTopUp,
+		Discount:         breakdown.Discount,
+		PromoDiscount:    breakdown.PromoDiscount,
+		Total:            breakdown.Total,
+		Currency:         breakdown.Currency,
+	}
+}
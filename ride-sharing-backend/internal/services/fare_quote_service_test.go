@@ -0,0 +1,84 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFareQuotes(t *testing.T) {
+	db := setupTestDB()
+	clock := &fakeClock{now: time.Date(2025, 3, 4, 8, 0, 0, 0, time.UTC)}
+	surge := services.NewSurgeService(db, clock, services.SurgeConfig{CellSizeKm: 1})
+	quotes := services.NewFareQuoteService(db, surge, services.PoolConfig{Discount: 0.25}, 5*time.Minute, clock)
+
+	passengerID := uuid.New()
+	route := services.QuoteRoute{
+		Pickup:  utils.Coordinate{Latitude: -1.2921, Longitude: 36.8219},
+		Dropoff: utils.Coordinate{Latitude: -1.2621, Longitude: 36.8219},
+	}
+
+	quote, err := quotes.CreateQuote(passengerID, route, nil)
+	require.NoError(t, err)
+	assert.Equal(t, clock.now.Add(5*time.Minute), quote.ExpiresAt)
+	assert.Equal(t, 1.0, quote.SurgeMultiplier)
+	// One option per vehicle category plus pooling in economy
+	require.Len(t, quote.Options, 6)
+	options := make(map[string]models.FareQuoteOption)
+	for _, option := range quote.Options {
+		options[option.RideType+"/"+option.VehicleCategory] = option
+	}
+	standard, pool := options["standard/economy"], options["pool/economy"]
+	assert.Greater(t, standard.DistanceFare, 0.0)
+	assert.InDelta(t, standard.Total*0.75, pool.Total, 0.01)
+	assert.Less(t, options["standard/boda_boda"].Total, standard.Total)
+	assert.Greater(t, options["standard/xl"].Total, options["standard/comfort"].Total)
+
+	t.Run("Route must match", func(t *testing.T) {
+		moved := route
+		moved.Dropoff = utils.Coordinate{Latitude: -1.2521, Longitude: 36.8219}
+		_, _, err := quotes.ValidateQuote(quote.ID, passengerID, models.RideTypeStandard, models.VehicleCategoryEconomy, moved)
+		assert.ErrorIs(t, err, services.ErrQuoteRouteMismatch)
+	})
+
+	t.Run("Quotes belong to the passenger", func(t *testing.T) {
+		_, _, err := quotes.ValidateQuote(quote.ID, uuid.New(), models.RideTypeStandard, models.VehicleCategoryEconomy, route)
+		assert.ErrorIs(t, err, services.ErrQuoteNotFound)
+	})
+
+	t.Run("Locked price is used once", func(t *testing.T) {
+		_, option, err := quotes.ValidateQuote(quote.ID, passengerID, models.RideTypePool, models.VehicleCategoryEconomy, route)
+		require.NoError(t, err)
+		assert.Equal(t, pool.Total, option.Total)
+
+		require.NoError(t, quotes.RedeemQuote(db, quote.ID, uuid.New()))
+		assert.ErrorIs(t, quotes.RedeemQuote(db, quote.ID, uuid.New()), services.ErrQuoteUsed)
+		_, _, err = quotes.ValidateQuote(quote.ID, passengerID, models.RideTypePool, models.VehicleCategoryEconomy, route)
+		assert.ErrorIs(t, err, services.ErrQuoteUsed)
+	})
+
+	t.Run("Quotes expire", func(t *testing.T) {
+		fresh, err := quotes.CreateQuote(passengerID, route, nil)
+		require.NoError(t, err)
+		clock.now = clock.now.Add(6 * time.Minute)
+		_, _, err = quotes.ValidateQuote(fresh.ID, passengerID, models.RideTypeStandard, models.VehicleCategoryEconomy, route)
+		assert.ErrorIs(t, err, services.ErrQuoteExpired)
+	})
+
+	t.Run("Routes with stops cannot pool", func(t *testing.T) {
+		withStop := route
+		withStop.Stops = []utils.Coordinate{{Latitude: -1.2800, Longitude: 36.8300}}
+		quote, err := quotes.CreateQuote(passengerID, withStop, nil)
+		require.NoError(t, err)
+		require.Len(t, quote.Options, 5)
+		_, _, err = quotes.ValidateQuote(quote.ID, passengerID, models.RideTypePool, models.VehicleCategoryEconomy, withStop)
+		assert.ErrorIs(t, err, services.ErrQuoteOptionNotOffered)
+	})
+}
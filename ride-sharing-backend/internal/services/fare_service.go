@@ -0,0 +1,167 @@
+package services
+
+import (
+	"math"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// FareInput is the measured trip a final fare is calculated from
+type FareInput struct {
+	// Rates is the fare table of the vehicle category; zero means the
+	// default rates
+	Rates           utils.FareRates
+	DistanceKm      float64
+	DurationMinutes int
+	// SurgeMultiplier scales the trip fare; 0 and 1 mean no surge
+	SurgeMultiplier float64
+	// Discount is the fraction taken off the trip fare, e.g. for pooling
+	Discount float64
+	// LockedFare replaces the trip fare when it was quoted at booking
+	LockedFare *float64
+	// Promo is taken off the trip fare, after any locked price
+	Promo         *models.PromoCode
+	WaitingCharge float64
+}
+
+// CalculateFinalFare itemises the fare for a measured trip. Waiting time is
+// added on top of the trip fare, after the minimum fare and any discounts.
+func CalculateFinalFare(input FareInput) models.FareBreakdown {
+	rates := input.Rates
+	if rates == (utils.FareRates{}) {
+		rates = utils.DefaultFareRates
+	}
+	components := utils.CalculateFareBreakdown(rates, input.DistanceKm, input.DurationMinutes, input.SurgeMultiplier)
+
+	breakdown := models.FareBreakdown{
+		DistanceKm:       roundAmount(input.DistanceKm),
+		DurationMinutes:  input.DurationMinutes,
+		BaseFare:         roundAmount(components.Base),
+		DistanceFare:     roundAmount(components.Distance),
+		TimeFare:         roundAmount(components.Time),
+		SurgeAmount:      roundAmount(components.Surge),
+		MinimumFareTopUp: roundAmount(components.MinimumFareTopUp),
+		WaitingCharge:    roundAmount(input.WaitingCharge),
+		Currency:         "KES",
+	}
+	tripFare := breakdown.BaseFare + breakdown.DistanceFare + breakdown.TimeFare + breakdown.SurgeAmount + breakdown.MinimumFareTopUp
+
+	if input.Discount > 0 {
+		breakdown.Discount = roundAmount(tripFare * input.Discount)
+		tripFare -= breakdown.Discount
+	}
+	if input.LockedFare != nil {
+		breakdown.LockedFareAdjustment = roundAmount(*input.LockedFare - tripFare)
+		tripFare += breakdown.LockedFareAdjustment
+	}
+	if input.Promo != nil {
+		breakdown.PromoDiscount = PromoDiscount(input.Promo, tripFare)
+		tripFare -= breakdown.PromoDiscount
+	}
+
+	breakdown.Total = roundAmount(tripFare + breakdown.WaitingCharge)
+	return breakdown
+}
+
+func roundAmount(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+type FareService struct {
+	db         *gorm.DB
+	categories *VehicleCategoryService
+	pool       PoolConfig
+}
+
+func NewFareService(db *gorm.DB, pool PoolConfig) *FareService {
+	return &FareService{
+		db:         db,
+		categories: NewVehicleCategoryService(db),
+		pool:       pool,
+	}
+}
+
+// CalculateRideFares works out each rider's final fare for a ride ending at
+// endTime. distanceKm is the distance measured for the whole ride. Pooled
+// riders pay for their own leg: their booked distance and the time between
+// their pickup and dropoff, less the pool discount.
+func (s *FareService) CalculateRideFares(ride *models.Ride, riders []models.RideRequest, distanceKm float64, endTime time.Time) ([]models.FareBreakdown, error) {
+	var waypoints []models.RideWaypoint
+	if ride.RideType == models.RideTypePool {
+		if err := s.db.Where("ride_id = ?", ride.ID).Find(&waypoints).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	breakdowns := make([]models.FareBreakdown, 0, len(riders))
+	for _, rider := range riders {
+		rates, err := s.categories.RatesFor(rider.VehicleCategory)
+		if err != nil {
+			return nil, err
+		}
+		input := FareInput{
+			Rates:           rates,
+			DistanceKm:      distanceKm,
+			DurationMinutes: int(endTime.Sub(*ride.StartTime).Minutes()),
+			SurgeMultiplier: rider.SurgeMultiplier,
+			LockedFare:      rider.LockedFare,
+		}
+		if rider.PromoCodeID != nil {
+			var promo models.PromoCode
+			if err := s.db.First(&promo, "id = ?", *rider.PromoCodeID).Error; err != nil {
+				return nil, err
+			}
+			input.Promo = &promo
+		}
+		// Waiting at the first pickup is charged to the booking passenger
+		if rider.ID == ride.RequestID {
+			input.WaitingCharge = ride.WaitingCharge
+		}
+		if ride.RideType == models.RideTypePool {
+			if rider.EstimatedDistanceKm != nil {
+				input.DistanceKm = *rider.EstimatedDistanceKm
+			}
+			input.DurationMinutes = legDuration(waypoints, rider.ID, *ride.StartTime, endTime)
+			input.Discount = s.pool.Discount
+		}
+
+		breakdown := CalculateFinalFare(input)
+		breakdown.RideID = ride.ID
+		breakdown.RequestID = rider.ID
+		breakdown.PassengerID = rider.PassengerID
+		breakdowns = append(breakdowns, breakdown)
+	}
+	return breakdowns, nil
+}
+
+// GetBreakdown returns the fare breakdown of one rider on a ride
+func (s *FareService) GetBreakdown(rideID, requestID uuid.UUID) (*models.FareBreakdown, error) {
+	var breakdown models.FareBreakdown
+	if err := s.db.Where("ride_id = ? AND request_id = ?", rideID, requestID).First(&breakdown).Error; err != nil {
+		return nil, err
+	}
+	return &breakdown, nil
+}
+
+// legDuration returns the minutes between a pooled rider's pickup and
+// dropoff, falling back to the ride's start and end for waypoints that were
+// not marked completed.
+func legDuration(waypoints []models.RideWaypoint, requestID uuid.UUID, start, end time.Time) int {
+	for _, waypoint := range waypoints {
+		if waypoint.RequestID != requestID || waypoint.CompletedAt == nil {
+			continue
+		}
+		switch waypoint.Kind {
+		case models.WaypointPickup:
+			start = *waypoint.CompletedAt
+		case models.WaypointDropoff:
+			end = *waypoint.CompletedAt
+		}
+	}
+	return int(end.Sub(start).Minutes())
+}
@@ -0,0 +1,79 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalculateFinalFare(t *testing.T) {
+	t.Run("Measured trip", func(t *testing.T) {
+		breakdown := services.CalculateFinalFare(services.FareInput{DistanceKm: 8, DurationMinutes: 20, WaitingCharge: 10})
+		assert.Equal(t, 50.0, breakdown.BaseFare)
+		assert.Equal(t, 200.0, breakdown.DistanceFare)
+		assert.Equal(t, 40.0, breakdown.TimeFare)
+		assert.Zero(t, breakdown.SurgeAmount)
+		assert.Equal(t, 300.0, breakdown.Total)
+	})
+
+	t.Run("Surge", func(t *testing.T) {
+		breakdown := services.CalculateFinalFare(services.FareInput{DistanceKm: 8, DurationMinutes: 20, SurgeMultiplier: 1.5})
+		assert.Equal(t, 145.0, breakdown.SurgeAmount)
+		assert.Equal(t, 435.0, breakdown.Total)
+	})
+
+	t.Run("Minimum fare", func(t *testing.T) {
+		breakdown := services.CalculateFinalFare(services.FareInput{DistanceKm: 1, DurationMinutes: 3})
+		assert.Equal(t, 19.0, breakdown.MinimumFareTopUp)
+		assert.Equal(t, 100.0, breakdown.Total)
+	})
+
+	t.Run("Locked fare", func(t *testing.T) {
+		locked := 250.0
+		breakdown := services.CalculateFinalFare(services.FareInput{DistanceKm: 8, DurationMinutes: 20, LockedFare: &locked, WaitingCharge: 15})
+		assert.Equal(t, -40.0, breakdown.LockedFareAdjustment)
+		assert.Equal(t, 265.0, breakdown.Total)
+	})
+}
+
+func TestCalculateRideFares(t *testing.T) {
+	db := setupTestDB()
+	fares := services.NewFareService(db, services.PoolConfig{Discount: 0.25})
+
+	start := time.Date(2025, 3, 4, 8, 0, 0, 0, time.UTC)
+	end := start.Add(40 * time.Minute)
+	firstDistance, secondDistance := 10.0, 4.0
+	first := models.RideRequest{ID: uuid.New(), PassengerID: uuid.New(), EstimatedDistanceKm: &firstDistance}
+	second := models.RideRequest{ID: uuid.New(), PassengerID: uuid.New(), EstimatedDistanceKm: &secondDistance}
+	ride := models.Ride{RequestID: first.ID, DriverID: uuid.New(), PassengerID: first.PassengerID, RideType: models.RideTypePool, StartTime: &start, WaitingCharge: 10, Status: models.RideStatusInProgress}
+	require.NoError(t, db.Create(&ride).Error)
+
+	// The second passenger rode from minute 10 to minute 25
+	pickedUp, droppedOff := start.Add(10*time.Minute), start.Add(25*time.Minute)
+	require.NoError(t, db.Create(&[]models.RideWaypoint{
+		{RideID: ride.ID, RequestID: second.ID, Sequence: 2, Kind: models.WaypointPickup, CompletedAt: &pickedUp},
+		{RideID: ride.ID, RequestID: second.ID, Sequence: 3, Kind: models.WaypointDropoff, CompletedAt: &droppedOff},
+	}).Error)
+
+	breakdowns, err := fares.CalculateRideFares(&ride, []models.RideRequest{first, second}, 12.5, end)
+	require.NoError(t, err)
+	require.Len(t, breakdowns, 2)
+
+	// (50 + 250 + 80) less 25%, plus waiting at the first pickup
+	assert.Equal(t, first.ID, breakdowns[0].RequestID)
+	assert.Equal(t, 40, breakdowns[0].DurationMinutes)
+	assert.Equal(t, 95.0, breakdowns[0].Discount)
+	assert.Equal(t, 295.0, breakdowns[0].Total)
+
+	// (50 + 100 + 30) less 25%
+	assert.Equal(t, second.PassengerID, breakdowns[1].PassengerID)
+	assert.Equal(t, 15, breakdowns[1].DurationMinutes)
+	assert.Zero(t, breakdowns[1].WaitingCharge)
+	assert.Equal(t, 135.0, breakdowns[1].Total)
+}
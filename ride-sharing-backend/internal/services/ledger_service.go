@@ -0,0 +1,381 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUnbalancedEntry = errors.New("journal entry debits and credits do not balance")
+	ErrAlreadyPosted   = errors.New("journal entry has already been posted")
+)
+
+// normalBalances is the side that increases the balance of each account
+// type. Balances we owe to users and our revenue grow with credits; money in
+// clearing and what promos and refunds cost us grow with debits.
+var normalBalances = map[string]string{
+	models.LedgerAccountPassengerWallet:     models.LedgerCredit,
+	models.LedgerAccountDriverEarnings:      models.LedgerCredit,
+	models.LedgerAccountPlatformCommission:  models.LedgerCredit,
+	models.LedgerAccountPromoExpense:        models.LedgerDebit,
+	models.LedgerAccountMpesaClearing:       models.LedgerDebit,
+	models.LedgerAccountPayoutFees:          models.LedgerCredit,
+	models.LedgerAccountRefundExpense:       models.LedgerDebit,
+	models.LedgerAccountAirtelMoneyClearing: models.LedgerDebit,
+	models.LedgerAccountPendingEarnings:     models.LedgerCredit,
+}
+
+// ToCents converts a KES amount to whole cents
+func ToCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// FromCents converts cents to a KES amount
+func FromCents(cents int64) float64 {
+	return float64(cents) / 100
+}
+
+// Account identifies a ledger account by type and, for per-user accounts,
+// owner
+type Account struct {
+	Type    string
+	OwnerID *uuid.UUID
+}
+
+// Code is the unique code the account is stored under
+func (a Account) Code() string {
+	if a.OwnerID == nil {
+		return a.Type
+	}
+	return fmt.Sprintf("%s:%s", a.Type, a.OwnerID)
+}
+
+// PassengerWallet is the wallet account of a passenger
+func PassengerWallet(passengerID uuid.UUID) Account {
+	return Account{Type: models.LedgerAccountPassengerWallet, OwnerID: &passengerID}
+}
+
+// DriverEarnings is the earnings account of a driver
+func DriverEarnings(driverID uuid.UUID) Account {
+	return Account{Type: models.LedgerAccountDriverEarnings, OwnerID: &driverID}
+}
+
+// PendingEarnings holds a driver's share of fares until the passenger pays
+// them
+func PendingEarnings(driverID uuid.UUID) Account {
+	return Account{Type: models.LedgerAccountPendingEarnings, OwnerID: &driverID}
+}
+
+// Platform accounts
+var (
+	PlatformCommission  = Account{Type: models.LedgerAccountPlatformCommission}
+	PromoExpense        = Account{Type: models.LedgerAccountPromoExpense}
+	MpesaClearing       = Account{Type: models.LedgerAccountMpesaClearing}
+	PayoutFees          = Account{Type: models.LedgerAccountPayoutFees}
+	RefundExpense       = Account{Type: models.LedgerAccountRefundExpense}
+	AirtelMoneyClearing = Account{Type: models.LedgerAccountAirtelMoneyClearing}
+)
+
+// clearingAccounts hold the money each payment method brings in until it is
+// paid out again
+var clearingAccounts = map[string]Account{
+	models.PaymentMethodMpesa:       MpesaClearing,
+	models.PaymentMethodAirtelMoney: AirtelMoneyClearing,
+}
+
+// ClearingAccount returns the clearing account of a payment method
+func ClearingAccount(method string) (Account, error) {
+	account, ok := clearingAccounts[method]
+	if !ok {
+		return Account{}, fmt.Errorf("no clearing account for %s payments", method)
+	}
+	return account, nil
+}
+
+// LedgerLine is one side of a journal entry to post
+type LedgerLine struct {
+	Account     Account
+	Direction   string
+	AmountCents int64
+}
+
+// Debit returns a debit line
+func Debit(account Account, cents int64) LedgerLine {
+	return LedgerLine{Account: account, Direction: models.LedgerDebit, AmountCents: cents}
+}
+
+// Credit returns a credit line
+func Credit(account Account, cents int64) LedgerLine {
+	return LedgerLine{Account: account, Direction: models.LedgerCredit, AmountCents: cents}
+}
+
+// Statement is the recent movements on a user's account
+type Statement struct {
+	Account models.LedgerAccount `json:"account"`
+	Balance float64              `json:"balance"`
+	Entries []StatementEntry     `json:"entries"`
+}
+
+// StatementEntry is one movement on a statement
+type StatementEntry struct {
+	PostedAt          time.Time `json:"posted_at"`
+	Kind              string    `json:"kind"`
+	Reference         string    `json:"reference"`
+	Description       string    `json:"description"`
+	Direction         string    `json:"direction"`
+	AmountCents       int64     `json:"amount_cents"`
+	BalanceAfterCents int64     `json:"balance_after_cents"`
+}
+
+// LedgerService posts balanced journal entries and keeps account balances
+type LedgerService struct {
+	db          *gorm.DB
+	commissions *ComplianceService
+	clock       Clock
+}
+
+func NewLedgerService(db *gorm.DB, clock Clock) *LedgerService {
+	return &LedgerService{
+		db:          db,
+		commissions: NewComplianceService(db),
+		clock:       clock,
+	}
+}
+
+// Post records a journal entry within tx and updates the balance of every
+// account it touches. Zero lines are dropped; what is left must balance.
+// Posting the same kind and reference twice returns ErrAlreadyPosted.
+func (s *LedgerService) Post(tx *gorm.DB, kind, reference, description string, lines ...LedgerLine) (*models.JournalEntry, error) {
+	var debits, credits int64
+	kept := make([]LedgerLine, 0, len(lines))
+	for _, line := range lines {
+		if line.AmountCents < 0 {
+			return nil, fmt.Errorf("negative amount on %s", line.Account.Code())
+		}
+		if line.AmountCents == 0 {
+			continue
+		}
+		if line.Direction == models.LedgerDebit {
+			debits += line.AmountCents
+		} else {
+			credits += line.AmountCents
+		}
+		kept = append(kept, line)
+	}
+	if debits != credits || len(kept) < 2 {
+		return nil, ErrUnbalancedEntry
+	}
+
+	var count int64
+	if err := tx.Model(&models.JournalEntry{}).Where("kind = ? AND reference = ?", kind, reference).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrAlreadyPosted
+	}
+
+	journal := models.JournalEntry{
+		Kind:        kind,
+		Reference:   reference,
+		Description: description,
+		PostedAt:    s.clock.Now(),
+	}
+	if err := tx.Create(&journal).Error; err != nil {
+		return nil, err
+	}
+
+	for _, line := range kept {
+		account, err := s.account(tx, line.Account)
+		if err != nil {
+			return nil, err
+		}
+		delta := line.AmountCents
+		if line.Direction != account.NormalBalance {
+			delta = -delta
+		}
+		// Updating the balance in the database keeps concurrent postings
+		// to the same account from overwriting each other
+		if err := tx.Model(&models.LedgerAccount{}).Where("id = ?", account.ID).
+			Update("balance_cents", gorm.Expr("balance_cents + ?", delta)).Error; err != nil {
+			return nil, err
+		}
+		if err := tx.Select("balance_cents").First(account, "id = ?", account.ID).Error; err != nil {
+			return nil, err
+		}
+
+		entry := models.LedgerEntry{
+			JournalEntryID:    journal.ID,
+			AccountID:         account.ID,
+			Direction:         line.Direction,
+			AmountCents:       line.AmountCents,
+			BalanceAfterCents: account.BalanceCents,
+		}
+		if err := tx.Create(&entry).Error; err != nil {
+			return nil, err
+		}
+		journal.Lines = append(journal.Lines, entry)
+	}
+	return &journal, nil
+}
+
+// account returns a ledger account, opening it on first use
+func (s *LedgerService) account(tx *gorm.DB, ref Account) (*models.LedgerAccount, error) {
+	account := models.LedgerAccount{
+		Code:          ref.Code(),
+		Type:          ref.Type,
+		OwnerID:       ref.OwnerID,
+		NormalBalance: normalBalances[ref.Type],
+		Currency:      "KES",
+	}
+	if err := tx.Where("code = ?", account.Code).FirstOrCreate(&account).Error; err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// Balance returns the balance of an account in cents, zero if it was never
+// used
+func (s *LedgerService) Balance(ref Account) (int64, error) {
+	return s.balance(s.db, ref)
+}
+
+// balance reads the balance of an account through db, so it can be read
+// within a transaction
+func (s *LedgerService) balance(db *gorm.DB, ref Account) (int64, error) {
+	var account models.LedgerAccount
+	if err := db.Where("code = ?", ref.Code()).First(&account).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return account.BalanceCents, nil
+}
+
+// PostRideFare records what a passenger owes for a completed ride and splits
+// the fare before any promo between the driver and the platform commission.
+// The promo discount is paid for by the platform. The driver's share is held
+// as pending earnings until ReleaseEarnings.
+func (s *LedgerService) PostRideFare(tx *gorm.DB, breakdown *models.FareBreakdown, driverID uuid.UUID) error {
+	payable := ToCents(breakdown.Total)
+	promo := ToCents(breakdown.PromoDiscount)
+	commission := ToCents(s.commissions.CalculateCommission(FromCents(payable + promo)).CommissionAmount)
+
+	_, err := s.Post(tx, models.JournalRideFare, breakdown.ID.String(),
+		fmt.Sprintf("Fare for ride %s", breakdown.RideID),
+		Debit(PassengerWallet(breakdown.PassengerID), payable),
+		Debit(PromoExpense, promo),
+		Credit(PendingEarnings(driverID), payable+promo-commission),
+		Credit(PlatformCommission, commission),
+	)
+	return err
+}
+
+// ReleaseEarnings moves the driver's share of the fare a payment is for from
+// pending to their earnings once the payment is completed, so payouts only
+// draw on fares that were collected. Payments with no fare held for the
+// driver, such as cancellation fees, release nothing.
+func (s *LedgerService) ReleaseEarnings(tx *gorm.DB, payment *models.Payment) error {
+	passengerID, err := paymentPassenger(tx, payment)
+	if err != nil {
+		return err
+	}
+	var breakdown models.FareBreakdown
+	err = tx.Where("ride_id = ? AND passenger_id = ?", payment.RideID, passengerID).First(&breakdown).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var held struct {
+		OwnerID     uuid.UUID
+		AmountCents int64
+	}
+	err = tx.Table("ledger_entries").
+		Select("ledger_accounts.owner_id, ledger_entries.amount_cents").
+		Joins("JOIN journal_entries ON journal_entries.id = ledger_entries.journal_entry_id").
+		Joins("JOIN ledger_accounts ON ledger_accounts.id = ledger_entries.account_id").
+		Where("journal_entries.kind = ? AND journal_entries.reference = ? AND ledger_accounts.type = ?",
+			models.JournalRideFare, breakdown.ID.String(), models.LedgerAccountPendingEarnings).
+		Scan(&held).Error
+	if err != nil || held.AmountCents == 0 {
+		return err
+	}
+
+	_, err = s.Post(tx, models.JournalEarningsRelease, breakdown.ID.String(),
+		fmt.Sprintf("Fare collected for ride %s", breakdown.RideID),
+		Debit(PendingEarnings(held.OwnerID), held.AmountCents),
+		Credit(DriverEarnings(held.OwnerID), held.AmountCents),
+	)
+	return err
+}
+
+// PostPayment records a payment a passenger made in full through a payment
+// provider
+func (s *LedgerService) PostPayment(tx *gorm.DB, payment *models.Payment, passengerID uuid.UUID) error {
+	return s.PostCollection(tx, payment, passengerID, payment.ID.String(), ToCents(payment.Amount))
+}
+
+// PostCollection records amountCents a passenger paid towards a payment
+// through its provider. Every collection has its own reference, so a ride
+// can be paid for in parts.
+func (s *LedgerService) PostCollection(tx *gorm.DB, payment *models.Payment, passengerID uuid.UUID, reference string, amountCents int64) error {
+	clearing, err := ClearingAccount(payment.PaymentMethod)
+	if err != nil {
+		return err
+	}
+	_, err = s.Post(tx, models.JournalPayment, reference,
+		fmt.Sprintf("%s payment for ride %s", payment.PaymentMethod, payment.RideID),
+		Debit(clearing, amountCents),
+		Credit(PassengerWallet(passengerID), amountCents),
+	)
+	return err
+}
+
+// PostCancellationFee records a cancellation or no-show fee a passenger owes
+// the platform
+func (s *LedgerService) PostCancellationFee(tx *gorm.DB, cancellation *models.RideCancellation, passengerID uuid.UUID) error {
+	_, err := s.Post(tx, models.JournalCancellationFee, cancellation.ID.String(),
+		fmt.Sprintf("Cancellation fee (%s)", cancellation.ReasonCode),
+		Debit(PassengerWallet(passengerID), ToCents(cancellation.FeeAmount)),
+		Credit(PlatformCommission, ToCents(cancellation.FeeAmount)),
+	)
+	return err
+}
+
+// Statement returns the latest movements on an account, newest first
+func (s *LedgerService) Statement(ref Account, limit int) (*Statement, error) {
+	statement := Statement{
+		Account: models.LedgerAccount{Code: ref.Code(), Type: ref.Type, OwnerID: ref.OwnerID, NormalBalance: normalBalances[ref.Type], Currency: "KES"},
+		Entries: []StatementEntry{},
+	}
+	if err := s.db.Where("code = ?", ref.Code()).First(&statement.Account).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &statement, nil
+		}
+		return nil, err
+	}
+	statement.Balance = FromCents(statement.Account.BalanceCents)
+
+	err := s.db.Table("ledger_entries").
+		Select("journal_entries.posted_at, journal_entries.kind, journal_entries.reference, journal_entries.description, "+
+			"ledger_entries.direction, ledger_entries.amount_cents, ledger_entries.balance_after_cents").
+		Joins("JOIN journal_entries ON journal_entries.id = ledger_entries.journal_entry_id").
+		Where("ledger_entries.account_id = ?", statement.Account.ID).
+		Order("journal_entries.posted_at DESC, ledger_entries.created_at DESC").
+		Limit(limit).
+		Scan(&statement.Entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return &statement, nil
+}
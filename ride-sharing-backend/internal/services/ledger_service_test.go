@@ -0,0 +1,80 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLedgerService(t *testing.T) {
+	db := setupTestDB()
+	ledger := services.NewLedgerService(db, &fakeClock{now: time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)})
+	passengerID, driverID := uuid.New(), uuid.New()
+
+	assert.Equal(t, int64(123457), services.ToCents(1234.565))
+
+	balance := func(t *testing.T, account services.Account) int64 {
+		cents, err := ledger.Balance(account)
+		require.NoError(t, err)
+		return cents
+	}
+
+	t.Run("RejectsUnbalancedEntries", func(t *testing.T) {
+		_, err := ledger.Post(db, "test", uuid.NewString(), "",
+			services.Debit(services.MpesaClearing, 100),
+			services.Credit(services.PassengerWallet(passengerID), 99))
+		assert.ErrorIs(t, err, services.ErrUnbalancedEntry)
+	})
+
+	t.Run("RideFareAndPayment", func(t *testing.T) {
+		// KES 400 trip with a KES 50 promo: the passenger owes 350, the
+		// platform takes 18% of 400 and the driver gets the rest
+		breakdown := models.FareBreakdown{ID: uuid.New(), RideID: uuid.New(), RequestID: uuid.New(), PassengerID: passengerID, Total: 350, PromoDiscount: 50}
+		require.NoError(t, db.Create(&breakdown).Error)
+		require.NoError(t, ledger.PostRideFare(db, &breakdown, driverID))
+		assert.ErrorIs(t, ledger.PostRideFare(db, &breakdown, driverID), services.ErrAlreadyPosted)
+
+		assert.Equal(t, int64(-35000), balance(t, services.PassengerWallet(passengerID)))
+		assert.Equal(t, int64(32800), balance(t, services.PendingEarnings(driverID)))
+		assert.Equal(t, int64(7200), balance(t, services.PlatformCommission))
+		assert.Equal(t, int64(5000), balance(t, services.PromoExpense))
+		// Nothing can be paid out before the passenger pays
+		assert.Zero(t, balance(t, services.DriverEarnings(driverID)))
+
+		payment := models.Payment{ID: uuid.New(), RideID: breakdown.RideID, PassengerID: &passengerID, Amount: 350, PaymentMethod: "mpesa"}
+		require.NoError(t, ledger.PostPayment(db, &payment, passengerID))
+		require.NoError(t, ledger.ReleaseEarnings(db, &payment))
+		assert.Equal(t, int64(0), balance(t, services.PassengerWallet(passengerID)))
+		assert.Equal(t, int64(35000), balance(t, services.MpesaClearing))
+		assert.Zero(t, balance(t, services.PendingEarnings(driverID)))
+		assert.Equal(t, int64(32800), balance(t, services.DriverEarnings(driverID)))
+	})
+
+	t.Run("Statement", func(t *testing.T) {
+		statement, err := ledger.Statement(services.PassengerWallet(passengerID), 10)
+		require.NoError(t, err)
+		require.Len(t, statement.Entries, 2)
+		assert.Equal(t, 0.0, statement.Balance)
+		assert.Equal(t, models.JournalPayment, statement.Entries[0].Kind)
+		assert.Equal(t, int64(0), statement.Entries[0].BalanceAfterCents)
+		assert.Equal(t, models.JournalRideFare, statement.Entries[1].Kind)
+		assert.Equal(t, int64(-35000), statement.Entries[1].BalanceAfterCents)
+
+		empty, err := ledger.Statement(services.PassengerWallet(uuid.New()), 10)
+		require.NoError(t, err)
+		assert.Empty(t, empty.Entries)
+	})
+
+	t.Run("BooksBalance", func(t *testing.T) {
+		var debits, credits int64
+		db.Model(&models.LedgerEntry{}).Where("direction = ?", models.LedgerDebit).Select("COALESCE(SUM(amount_cents), 0)").Scan(&debits)
+		db.Model(&models.LedgerEntry{}).Where("direction = ?", models.LedgerCredit).Select("COALESCE(SUM(amount_cents), 0)").Scan(&credits)
+		assert.Equal(t, debits, credits)
+	})
+}
@@ -0,0 +1,121 @@
+package services_test
+
+import (
+	"fmt"
+	"testing"
+
+	"kenyan-ride-share-backend/internal/config"
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMpesaCallback(t *testing.T) {
+	db := setupTestDB()
+	payments := services.NewPaymentService(db, services.NewPaymentProviders(services.NewMpesaService(db, config.Load())), services.SystemClock{})
+
+	createPayment := func(t *testing.T) *models.Payment {
+		passengerID := uuid.New()
+		checkoutRequestID := "ws_CO_" + uuid.NewString()
+		payment := models.Payment{
+			RideID:            uuid.New(),
+			PassengerID:       &passengerID,
+			Amount:            450,
+			RequestedAmount:   450,
+			PaymentMethod:     "mpesa",
+			PaymentStatus:     "pending",
+			PhoneNumber:       "254712345678",
+			CheckoutRequestID: &checkoutRequestID,
+		}
+		require.NoError(t, db.Create(&payment).Error)
+		return &payment
+	}
+	successBody := func(payment *models.Payment, amount float64, phone string) []byte {
+		return []byte(fmt.Sprintf(`{"Body":{"stkCallback":{"MerchantRequestID":"29115-34620561-1","CheckoutRequestID":%q,"ResultCode":0,"ResultDesc":"The service request is processed successfully.",`+
+			`"CallbackMetadata":{"Item":[{"Name":"Amount","Value":%v},{"Name":"MpesaReceiptNumber","Value":%q},{"Name":"TransactionDate","Value":20191219102115},{"Name":"PhoneNumber","Value":%s}]}}}}`,
+			*payment.CheckoutRequestID, amount, "NLJ"+payment.ID.String()[:7], phone))
+	}
+	process := func(t *testing.T, body []byte) (*models.MpesaCallback, error) {
+		callback, err := payments.RecordCallback(models.PaymentMethodMpesa, "196.201.214.200", body)
+		require.NoError(t, err)
+		return callback, payments.ProcessCallback(models.PaymentMethodMpesa, callback)
+	}
+	reload := func(t *testing.T, payment *models.Payment) *models.Payment {
+		var fresh models.Payment
+		require.NoError(t, db.First(&fresh, "id = ?", payment.ID).Error)
+		return &fresh
+	}
+
+	t.Run("SettlesOnceAndRecordsReplays", func(t *testing.T) {
+		payment := createPayment(t)
+		callback, err := process(t, successBody(payment, 450, "254712345678"))
+		require.NoError(t, err)
+		assert.Equal(t, models.MpesaCallbackProcessed, callback.Status)
+		assert.Equal(t, *payment.CheckoutRequestID, callback.Reference)
+
+		settled := reload(t, payment)
+		assert.Equal(t, "completed", settled.PaymentStatus)
+		assert.Equal(t, "NLJ"+payment.ID.String()[:7], *settled.TransactionID)
+		wallet, err := services.NewLedgerService(db, services.SystemClock{}).Balance(services.PassengerWallet(*payment.PassengerID))
+		require.NoError(t, err)
+		assert.Equal(t, int64(45000), wallet)
+
+		// Replaying the callback leaves the payment and ledger alone
+		callback, err = process(t, successBody(payment, 450, "254712345678"))
+		require.NoError(t, err)
+		assert.Equal(t, models.MpesaCallbackDuplicate, callback.Status)
+		wallet, err = services.NewLedgerService(db, services.SystemClock{}).Balance(services.PassengerWallet(*payment.PassengerID))
+		require.NoError(t, err)
+		assert.Equal(t, int64(45000), wallet)
+
+		var stored []models.MpesaCallback
+		require.NoError(t, db.Where("reference = ?", *payment.CheckoutRequestID).Find(&stored).Error)
+		assert.Len(t, stored, 2)
+	})
+
+	t.Run("MaskedPhoneNumber", func(t *testing.T) {
+		payment := createPayment(t)
+		callback, err := process(t, successBody(payment, 450, `"2547*****678"`))
+		require.NoError(t, err)
+		assert.Equal(t, models.MpesaCallbackProcessed, callback.Status)
+	})
+
+	t.Run("RejectsMismatches", func(t *testing.T) {
+		payment := createPayment(t)
+
+		callback, err := process(t, successBody(payment, 1, "254712345678"))
+		assert.ErrorIs(t, err, services.ErrCallbackRejected)
+		assert.Equal(t, models.MpesaCallbackRejected, callback.Status)
+		assert.Equal(t, "amount 1.00 does not match the 450.00 requested", callback.Reason)
+
+		// Cents count, not just whole shillings
+		callback, err = process(t, successBody(payment, 450.5, "254712345678"))
+		assert.ErrorIs(t, err, services.ErrCallbackRejected)
+		assert.Equal(t, "amount 450.50 does not match the 450.00 requested", callback.Reason)
+
+		callback, err = process(t, successBody(payment, 450, "254799999999"))
+		assert.ErrorIs(t, err, services.ErrCallbackRejected)
+		assert.Equal(t, "phone number does not match the one requested", callback.Reason)
+
+		// A rejected callback leaves the payment for the reconciler
+		assert.Equal(t, "pending", reload(t, payment).PaymentStatus)
+
+		_, err = process(t, []byte(`{"Body":{"stkCallback":{"CheckoutRequestID":"ws_CO_forged","ResultCode":0}}}`))
+		assert.ErrorIs(t, err, services.ErrCallbackRejected)
+		callback, err = process(t, []byte(`not json`))
+		assert.ErrorIs(t, err, services.ErrCallbackRejected)
+		assert.Equal(t, "not json", callback.Body)
+	})
+
+	t.Run("FailedPayment", func(t *testing.T) {
+		payment := createPayment(t)
+		_, err := process(t, []byte(fmt.Sprintf(`{"Body":{"stkCallback":{"CheckoutRequestID":%q,"ResultCode":1032,"ResultDesc":"Request cancelled by user"}}}`, *payment.CheckoutRequestID)))
+		require.NoError(t, err)
+		failed := reload(t, payment)
+		assert.Equal(t, "failed", failed.PaymentStatus)
+		assert.Equal(t, "Request cancelled by user", failed.FailureReason)
+	})
+}
@@ -3,36 +3,58 @@ package services
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"kenyan-ride-share-backend/internal/config"
 	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/pkg/utils"
 
 	"gorm.io/gorm"
 )
 
+var ErrSTKStillProcessing = errors.New("M-Pesa is still processing the payment")
+
 type MpesaService struct {
 	db           *gorm.DB
+	clock        Clock
 	consumerKey  string
 	consumerSecret string
 	passkey      string
 	shortcode    string
 	callbackURL  string
 	environment  string // "sandbox" or "production"
+	baseURL      string // overrides the Daraja API host, e.g. for a local mock
+	// B2C payouts to drivers
+	b2cShortcode       string
+	initiatorName      string
+	securityCredential string
+	b2cResultURL       string
+	b2cTimeoutURL      string
 }
 
-func NewMpesaService(db *gorm.DB) *MpesaService {
+// NewMpesaService returns an M-Pesa client configured from cfg. Every
+// callback URL it hands to M-Pesa ends in the secret callback token.
+func NewMpesaService(db *gorm.DB, cfg *config.Config) *MpesaService {
 	return &MpesaService{
 		db:             db,
-		consumerKey:    os.Getenv("MPESA_CONSUMER_KEY"),
-		consumerSecret: os.Getenv("MPESA_CONSUMER_SECRET"),
-		passkey:        os.Getenv("MPESA_PASSKEY"),
-		shortcode:      os.Getenv("MPESA_SHORTCODE"),
-		callbackURL:    os.Getenv("MPESA_CALLBACK_URL"),
-		environment:    os.Getenv("ENVIRONMENT"),
+		clock:          SystemClock{},
+		consumerKey:    cfg.MpesaConsumerKey,
+		consumerSecret: cfg.MpesaConsumerSecret,
+		passkey:        cfg.MpesaPasskey,
+		shortcode:      cfg.MpesaShortcode,
+		callbackURL:    cfg.GetMpesaCallbackURL(),
+		environment:    cfg.Environment,
+		baseURL:        cfg.MpesaBaseURL,
+		b2cShortcode:       cfg.MpesaB2CShortcode,
+		initiatorName:      cfg.MpesaB2CInitiatorName,
+		securityCredential: cfg.MpesaB2CSecurityCredential,
+		b2cResultURL:       cfg.GetMpesaB2CResultURL(),
+		b2cTimeoutURL:      cfg.GetMpesaB2CTimeoutURL(),
 	}
 }
 
@@ -63,6 +85,77 @@ type MpesaSTKPushResponse struct {
 	CustomerMessage     string `json:"CustomerMessage"`
 }
 
+// MpesaB2CRequest pays money from the business to a customer's M-Pesa
+type MpesaB2CRequest struct {
+	InitiatorName      string `json:"InitiatorName"`
+	SecurityCredential string `json:"SecurityCredential"`
+	CommandID          string `json:"CommandID"`
+	Amount             int    `json:"Amount"`
+	PartyA             string `json:"PartyA"`
+	PartyB             string `json:"PartyB"`
+	Remarks            string `json:"Remarks"`
+	QueueTimeOutURL    string `json:"QueueTimeOutURL"`
+	ResultURL          string `json:"ResultURL"`
+	Occasion           string `json:"Occasion"`
+}
+
+type MpesaB2CResponse struct {
+	ConversationID           string `json:"ConversationID"`
+	OriginatorConversationID string `json:"OriginatorConversationID"`
+	ResponseCode             string `json:"ResponseCode"`
+	ResponseDescription      string `json:"ResponseDescription"`
+}
+
+// MpesaB2CCallback is the body M-Pesa posts to the B2C result URL, or to
+// the timeout URL when it could not process the request in time
+type MpesaB2CCallback struct {
+	Result MpesaB2CResult `json:"Result"`
+}
+
+// MpesaB2CResult is the outcome of a B2C request
+type MpesaB2CResult struct {
+	ResultType               int    `json:"ResultType"`
+	ResultCode               int    `json:"ResultCode"`
+	ResultDesc               string `json:"ResultDesc"`
+	OriginatorConversationID string `json:"OriginatorConversationID"`
+	ConversationID           string `json:"ConversationID"`
+	TransactionID            string `json:"TransactionID"`
+}
+
+// MpesaSTKQueryRequest asks for the outcome of an STK Push
+type MpesaSTKQueryRequest struct {
+	BusinessShortCode string `json:"BusinessShortCode"`
+	Password          string `json:"Password"`
+	Timestamp         string `json:"Timestamp"`
+	CheckoutRequestID string `json:"CheckoutRequestID"`
+}
+
+type MpesaSTKQueryResponse struct {
+	ResponseCode        string `json:"ResponseCode"`
+	ResponseDescription string `json:"ResponseDescription"`
+	MerchantRequestID   string `json:"MerchantRequestID"`
+	CheckoutRequestID   string `json:"CheckoutRequestID"`
+	ResultCode          string `json:"ResultCode"`
+	ResultDesc          string `json:"ResultDesc"`
+	ErrorCode           string `json:"errorCode"`
+	ErrorMessage        string `json:"errorMessage"`
+}
+
+// stkStillProcessing is the error code Daraja answers a query with while
+// the customer has not yet responded to the STK Push
+const stkStillProcessing = "500.001.1001"
+
+// apiURL returns the Daraja API URL for path
+func (m *MpesaService) apiURL(path string) string {
+	if m.baseURL != "" {
+		return strings.TrimRight(m.baseURL, "/") + path
+	}
+	if m.environment == "sandbox" {
+		return "https://sandbox.safaricom.co.ke" + path
+	}
+	return "https://api.safaricom.co.ke" + path
+}
+
 func (m *MpesaService) GetAccessToken() (string, error) {
 	if m.environment == "development" {
 		// Return mock token for development
@@ -72,12 +165,7 @@ func (m *MpesaService) GetAccessToken() (string, error) {
 	// Production implementation
 	auth := base64.StdEncoding.EncodeToString([]byte(m.consumerKey + ":" + m.consumerSecret))
 	
-	baseURL := "https://api.safaricom.co.ke"
-	if m.environment == "sandbox" {
-		baseURL = "https://sandbox.safaricom.co.ke"
-	}
-
-	req, err := http.NewRequest("GET", baseURL+"/oauth/v1/generate?grant_type=client_credentials", nil)
+	req, err := http.NewRequest("GET", m.apiURL("/oauth/v1/generate?grant_type=client_credentials"), nil)
 	if err != nil {
 		return "", err
 	}
@@ -148,12 +236,7 @@ func (m *MpesaService) InitiateSTKPush(phoneNumber string, amount float64, accou
 		return nil, err
 	}
 
-	baseURL := "https://api.safaricom.co.ke"
-	if m.environment == "sandbox" {
-		baseURL = "https://sandbox.safaricom.co.ke"
-	}
-
-	req, err := http.NewRequest("POST", baseURL+"/mpesa/stkpush/v1/processrequest", strings.NewReader(string(jsonPayload)))
+	req, err := http.NewRequest("POST", m.apiURL("/mpesa/stkpush/v1/processrequest"), strings.NewReader(string(jsonPayload)))
 	if err != nil {
 		return nil, err
 	}
@@ -176,49 +259,268 @@ func (m *MpesaService) InitiateSTKPush(phoneNumber string, amount float64, accou
 	return &stkResp, nil
 }
 
-func (m *MpesaService) ProcessCallback(callbackData map[string]interface{}) error {
+// InitiateB2C sends money to a phone number. The outcome arrives later on
+// the B2C result or timeout URL.
+func (m *MpesaService) InitiateB2C(phoneNumber string, amount int, remarks, occasion string) (*MpesaB2CResponse, error) {
+	if m.environment == "development" {
+		// Return mock response for development
+		return &MpesaB2CResponse{
+			ConversationID:           "mock_conversation_" + fmt.Sprintf("%d", time.Now().UnixNano()),
+			OriginatorConversationID: "mock_originator_conversation_" + fmt.Sprintf("%d", time.Now().UnixNano()),
+			ResponseCode:             "0",
+			ResponseDescription:      "Accept the service request successfully.",
+		}, nil
+	}
+
+	accessToken, err := m.GetAccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	payload := MpesaB2CRequest{
+		InitiatorName:      m.initiatorName,
+		SecurityCredential: m.securityCredential,
+		CommandID:          "BusinessPayment",
+		Amount:             amount,
+		PartyA:             m.b2cShortcode,
+		PartyB:             utils.FormatKenyanPhoneNumber(phoneNumber),
+		Remarks:            remarks,
+		QueueTimeOutURL:    m.b2cTimeoutURL,
+		ResultURL:          m.b2cResultURL,
+		Occasion:           occasion,
+	}
+
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", m.apiURL("/mpesa/b2c/v1/paymentrequest"), strings.NewReader(string(jsonPayload)))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var b2cResp MpesaB2CResponse
+	if err := json.NewDecoder(resp.Body).Decode(&b2cResp); err != nil {
+		return nil, err
+	}
+
+	return &b2cResp, nil
+}
+
+// QuerySTKStatus asks M-Pesa for the outcome of an STK Push. It returns
+// ErrSTKStillProcessing while the customer has not yet responded, and always
+// in development unless MPESA_BASE_URL is set.
+func (m *MpesaService) QuerySTKStatus(checkoutRequestID string) (*MpesaSTKQueryResponse, error) {
+	if m.environment == "development" && m.baseURL == "" {
+		// Mock pushes never reach a customer, so there is no outcome to
+		// report. Point MPESA_BASE_URL at a mock Daraja to query one.
+		return nil, ErrSTKStillProcessing
+	}
+
+	accessToken, err := m.GetAccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := time.Now().Format("20060102150405")
+	payload := MpesaSTKQueryRequest{
+		BusinessShortCode: m.shortcode,
+		Password:          base64.StdEncoding.EncodeToString([]byte(m.shortcode + m.passkey + timestamp)),
+		Timestamp:         timestamp,
+		CheckoutRequestID: checkoutRequestID,
+	}
+
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", m.apiURL("/mpesa/stkpushquery/v1/query"), strings.NewReader(string(jsonPayload)))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var queryResp MpesaSTKQueryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&queryResp); err != nil {
+		return nil, err
+	}
+	if queryResp.ErrorCode == stkStillProcessing {
+		return nil, ErrSTKStillProcessing
+	}
+	if queryResp.ErrorCode != "" || resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("STK Push query failed: %s %s", queryResp.ErrorCode, queryResp.ErrorMessage)
+	}
+
+	return &queryResp, nil
+}
+
+// RecordCallback stores the raw body of a callback before it is processed
+func (m *MpesaService) RecordCallback(kind, sourceIP string, body []byte) (*models.MpesaCallback, error) {
+	return recordCallback(m.db, m.clock, kind, sourceIP, body)
+}
+
+// FinishCallback records what was done with a callback
+func (m *MpesaService) FinishCallback(callback *models.MpesaCallback, status, reason string) error {
+	return finishCallback(m.db, m.clock, callback, status, reason)
+}
+
+func recordCallback(db *gorm.DB, clock Clock, kind, sourceIP string, body []byte) (*models.MpesaCallback, error) {
+	callback := models.MpesaCallback{
+		Kind:       kind,
+		SourceIP:   sourceIP,
+		Body:       string(body),
+		Status:     models.MpesaCallbackReceived,
+		ReceivedAt: clock.Now(),
+	}
+	if err := db.Create(&callback).Error; err != nil {
+		return nil, err
+	}
+	return &callback, nil
+}
+
+func finishCallback(db *gorm.DB, clock Clock, callback *models.MpesaCallback, status, reason string) error {
+	now := clock.Now()
+	callback.Status = status
+	callback.Reason = reason
+	callback.ProcessedAt = &now
+	return db.Model(callback).Updates(map[string]interface{}{
+		"reference":    callback.Reference,
+		"status":       status,
+		"reason":       reason,
+		"processed_at": now,
+	}).Error
+}
+
+// Method makes MpesaService the PaymentProvider for M-Pesa
+func (m *MpesaService) Method() string {
+	return models.PaymentMethodMpesa
+}
+
+func (m *MpesaService) CallbackKind() string {
+	return models.MpesaCallbackSTKPush
+}
+
+// Initiate sends an STK Push asking the payer to pay
+func (m *MpesaService) Initiate(phoneNumber string, amount float64, accountReference string) (*PaymentRequest, error) {
+	stkResp, err := m.InitiateSTKPush(phoneNumber, amount, accountReference)
+	if err != nil {
+		return nil, err
+	}
+	if stkResp.CheckoutRequestID == "" {
+		return nil, fmt.Errorf("STK Push failed: %s", stkResp.ResponseDescription)
+	}
+	return &PaymentRequest{
+		Reference:       stkResp.CheckoutRequestID,
+		CustomerMessage: stkResp.CustomerMessage,
+	}, nil
+}
+
+// Query asks M-Pesa for the outcome of an STK Push
+func (m *MpesaService) Query(reference string) (*PaymentResult, error) {
+	queryResp, err := m.QuerySTKStatus(reference)
+	if errors.Is(err, ErrSTKStillProcessing) {
+		return nil, ErrPaymentStillProcessing
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PaymentResult{Reference: reference, Completed: queryResp.ResultCode == "0"}
+	if !result.Completed {
+		result.Reason = queryResp.ResultDesc
+	}
+	return result, nil
+}
+
+// ParseCallback reads the outcome of an STK Push from its callback
+func (m *MpesaService) ParseCallback(body []byte) (*PaymentResult, error) {
+	var callbackData map[string]interface{}
+	if err := json.Unmarshal(body, &callbackData); err != nil {
+		return nil, errors.New("invalid JSON")
+	}
+
 	// Extract callback information
-	body, ok := callbackData["Body"].(map[string]interface{})
+	callbackBody, ok := callbackData["Body"].(map[string]interface{})
 	if !ok {
-		return fmt.Errorf("invalid callback format")
+		return nil, errors.New("invalid callback format")
 	}
 
-	stkCallback, ok := body["stkCallback"].(map[string]interface{})
+	stkCallback, ok := callbackBody["stkCallback"].(map[string]interface{})
 	if !ok {
-		return fmt.Errorf("invalid stk callback format")
+		return nil, errors.New("invalid stk callback format")
 	}
 
 	checkoutRequestID, _ := stkCallback["CheckoutRequestID"].(string)
 	resultCode, _ := stkCallback["ResultCode"].(float64)
+	resultDesc, _ := stkCallback["ResultDesc"].(string)
+	result := &PaymentResult{Reference: checkoutRequestID, Completed: resultCode == 0}
+	if !result.Completed {
+		result.Reason = resultDesc
+		return result, nil
+	}
 
-	// Find payment by checkout request ID
-	var payment models.Payment
-	if err := m.db.Where("transaction_id = ?", checkoutRequestID).First(&payment).Error; err != nil {
-		return fmt.Errorf("payment not found: %v", err)
-	}
-
-	// Update payment status
-	if resultCode == 0 {
-		payment.PaymentStatus = "completed"
-		
-		// Extract M-Pesa receipt number if available
-		if callbackMetadata, ok := stkCallback["CallbackMetadata"].(map[string]interface{}); ok {
-			if items, ok := callbackMetadata["Item"].([]interface{}); ok {
-				for _, item := range items {
-					if itemMap, ok := item.(map[string]interface{}); ok {
-						if name, ok := itemMap["Name"].(string); ok && name == "MpesaReceiptNumber" {
-							if receiptNumber, ok := itemMap["Value"].(string); ok {
-								payment.TransactionID = &receiptNumber
-							}
+	// Extract the M-Pesa receipt, amount and phone number
+	if callbackMetadata, ok := stkCallback["CallbackMetadata"].(map[string]interface{}); ok {
+		if items, ok := callbackMetadata["Item"].([]interface{}); ok {
+			for _, item := range items {
+				if itemMap, ok := item.(map[string]interface{}); ok {
+					switch value := itemMap["Value"].(type) {
+					case string:
+						switch itemMap["Name"] {
+						case "MpesaReceiptNumber":
+							result.Receipt = &value
+						case "PhoneNumber":
+							result.Phone = value
+						}
+					case float64:
+						switch itemMap["Name"] {
+						case "Amount":
+							result.Amount = &value
+						case "PhoneNumber":
+							result.Phone = strconv.FormatFloat(value, 'f', 0, 64)
 						}
 					}
 				}
 			}
 		}
-	} else {
-		payment.PaymentStatus = "failed"
 	}
-
-	return m.db.Save(&payment).Error
+	return result, nil
 }
 
+// Refund sends money back to the payer through B2C. B2C only sends whole
+// shillings, so any cents are rounded up in the payer's favour. The outcome
+// arrives on the B2C result or timeout URL.
+func (m *MpesaService) Refund(payment *models.Payment, amountCents int64, phoneNumber, reference string) (*ProviderRefund, error) {
+	b2cResp, err := m.InitiateB2C(phoneNumber, int((amountCents+99)/100), "Ride refund", reference)
+	if err != nil {
+		return nil, err
+	}
+	if b2cResp.ResponseCode != "0" {
+		return nil, errors.New(b2cResp.ResponseDescription)
+	}
+	return &ProviderRefund{
+		Reference:           b2cResp.ConversationID,
+		OriginatorReference: b2cResp.OriginatorConversationID,
+	}, nil
+}
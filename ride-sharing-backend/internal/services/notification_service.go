@@ -0,0 +1,57 @@
+package services
+
+import (
+	"log"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/pkg/email"
+
+	"gorm.io/gorm"
+)
+
+// Notifier delivers notifications to users
+type Notifier interface {
+	Notify(notification *models.Notification) error
+}
+
+// NotificationService stores notifications and emails them to the user
+type NotificationService struct {
+	db           *gorm.DB
+	emailService *email.EmailService
+}
+
+func NewNotificationService(db *gorm.DB, emailService *email.EmailService) *NotificationService {
+	return &NotificationService{
+		db:           db,
+		emailService: emailService,
+	}
+}
+
+// Notify saves the notification and emails it to the user. Email failures are
+// logged rather than returned since the notification is already stored.
+func (s *NotificationService) Notify(notification *models.Notification) error {
+	if err := s.db.Create(notification).Error; err != nil {
+		return err
+	}
+
+	if s.emailService == nil {
+		return nil
+	}
+
+	var user models.User
+	if err := s.db.Where("id = ?", notification.UserID).First(&user).Error; err != nil {
+		log.Printf("Failed to load user %s for notification email: %v", notification.UserID, err)
+		return nil
+	}
+	if err := s.emailService.SendNotificationEmail(user.Email, user.FirstName, notification.Title, notification.Message); err != nil {
+		log.Printf("Failed to email notification %s: %v", notification.ID, err)
+	}
+	return nil
+}
+
+// GetUserNotifications returns a user's notifications, newest first
+func (s *NotificationService) GetUserNotifications(userID string) ([]models.Notification, error) {
+	var notifications []models.Notification
+	err := s.db.Where("user_id = ?", userID).Order("created_at DESC").Find(&notifications).Error
+	return notifications, err
+}
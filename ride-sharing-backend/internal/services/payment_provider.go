@@ -0,0 +1,126 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"kenyan-ride-share-backend/internal/models"
+)
+
+var (
+	ErrPaymentStillProcessing = errors.New("the provider is still processing the payment")
+	ErrUnsupportedPayment     = errors.New("payment method is not supported")
+	ErrProviderRefund         = errors.New("payment method cannot refund payments")
+	ErrCollectedByDriver      = errors.New("cash is collected by the driver")
+)
+
+// PaymentProvider collects ride payments through one payment method and
+// refunds them
+type PaymentProvider interface {
+	// Method is the payment method the provider collects, e.g. "mpesa"
+	Method() string
+	// CallbackKind is the kind the provider's payment callbacks are stored
+	// under
+	CallbackKind() string
+	// Initiate asks the payer to pay amount KES from phoneNumber
+	Initiate(phoneNumber string, amount float64, accountReference string) (*PaymentRequest, error)
+	// Query asks for the outcome of a payment request. It returns
+	// ErrPaymentStillProcessing while the payer has not yet responded.
+	Query(reference string) (*PaymentResult, error)
+	// ParseCallback reads the outcome of a payment request from the body of
+	// a callback the provider posted
+	ParseCallback(body []byte) (*PaymentResult, error)
+	// Refund sends amountCents of a completed payment back to the payer
+	Refund(payment *models.Payment, amountCents int64, phoneNumber, reference string) (*ProviderRefund, error)
+}
+
+// PaymentRequest is a payment a provider was asked to collect
+type PaymentRequest struct {
+	// Reference identifies the request with the provider, e.g. the
+	// CheckoutRequestID of an M-Pesa STK Push
+	Reference       string
+	CustomerMessage string
+}
+
+// PaymentResult is a provider's outcome of a payment request
+type PaymentResult struct {
+	Reference string   `json:"reference"`
+	Completed bool     `json:"completed"`
+	Receipt   *string  `json:"receipt"`
+	Reason    string   `json:"reason"`       // why the payment failed
+	Amount    *float64 `json:"amount"`       // amount paid, when the provider reports it
+	Phone     string   `json:"phone_number"` // who paid, possibly masked, when the provider reports it
+}
+
+// ProviderRefund is a refund a provider was asked to send
+type ProviderRefund struct {
+	// Reference and OriginatorReference identify the refund with the
+	// provider, e.g. the conversation IDs of an M-Pesa B2C request
+	Reference           string
+	OriginatorReference string
+	// Completed refunds were sent straight away; the rest are settled when
+	// the provider reports back
+	Completed     bool
+	TransactionID *string
+}
+
+// PaymentProviders picks the provider for a payment method
+type PaymentProviders struct {
+	providers map[string]PaymentProvider
+}
+
+func NewPaymentProviders(providers ...PaymentProvider) *PaymentProviders {
+	registry := &PaymentProviders{providers: make(map[string]PaymentProvider, len(providers))}
+	for _, provider := range providers {
+		registry.providers[provider.Method()] = provider
+	}
+	return registry
+}
+
+// Get returns the provider for a payment method
+func (p *PaymentProviders) Get(method string) (PaymentProvider, error) {
+	provider, ok := p.providers[method]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedPayment, method)
+	}
+	return provider, nil
+}
+
+// Methods lists the payment methods passengers can choose from
+func (p *PaymentProviders) Methods() []string {
+	methods := make([]string, 0, len(p.providers))
+	for method := range p.providers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// CashProvider stands for cash paid to the driver at the end of a ride.
+// Nothing is collected through it; the ride flow records the cash.
+type CashProvider struct{}
+
+func (CashProvider) Method() string {
+	return models.PaymentMethodCash
+}
+
+func (CashProvider) CallbackKind() string {
+	return ""
+}
+
+func (CashProvider) Initiate(phoneNumber string, amount float64, accountReference string) (*PaymentRequest, error) {
+	return nil, ErrCollectedByDriver
+}
+
+func (CashProvider) Query(reference string) (*PaymentResult, error) {
+	return nil, ErrCollectedByDriver
+}
+
+func (CashProvider) ParseCallback(body []byte) (*PaymentResult, error) {
+	return nil, ErrCollectedByDriver
+}
+
+func (CashProvider) Refund(payment *models.Payment, amountCents int64, phoneNumber, reference string) (*ProviderRefund, error) {
+	return nil, ErrProviderRefund
+}
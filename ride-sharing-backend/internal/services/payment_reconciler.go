@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// PaymentReconciler settles payments whose callback never arrived by asking
+// their provider for the outcome, e.g. of an M-Pesa STK Push.
+type PaymentReconciler struct {
+	db       *gorm.DB
+	payments *PaymentService
+	clock    Clock
+	after    time.Duration
+	interval time.Duration
+}
+
+// NewPaymentReconciler returns a reconciler that rechecks payments still
+// pending after they were asked for longer ago than after, at most once per
+// after
+func NewPaymentReconciler(db *gorm.DB, payments *PaymentService, clock Clock, after, interval time.Duration) *PaymentReconciler {
+	return &PaymentReconciler{
+		db:       db,
+		payments: payments,
+		clock:    clock,
+		after:    after,
+		interval: interval,
+	}
+}
+
+// ReconcilePending rechecks every stale pending payment and returns how many
+// were settled
+func (r *PaymentReconciler) ReconcilePending() (int, error) {
+	cutoff := r.clock.Now().Add(-r.after)
+
+	var payments []models.Payment
+	if err := r.db.Where("payment_status = ? AND checkout_request_id IS NOT NULL AND initiated_at <= ?", "pending", cutoff).
+		Where("last_checked_at IS NULL OR last_checked_at <= ?", cutoff).
+		Find(&payments).Error; err != nil {
+		return 0, err
+	}
+
+	settled := 0
+	for i := range payments {
+		payment := &payments[i]
+		if err := r.payments.Recheck(payment); err != nil {
+			log.Printf("Failed to recheck payment %s: %v", payment.ID, err)
+			continue
+		}
+		if payment.PaymentStatus != "pending" {
+			settled++
+		}
+	}
+
+	return settled, nil
+}
+
+// Run reconciles pending payments every interval until ctx is cancelled
+func (r *PaymentReconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.ReconcilePending(); err != nil {
+				log.Printf("Payment reconciliation failed: %v", err)
+			}
+		}
+	}
+}
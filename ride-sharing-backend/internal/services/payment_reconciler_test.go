@@ -0,0 +1,217 @@
+package services_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/config"
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockDaraja stands in for the Daraja API. STK Pushes without a result are
+// reported as still being processed.
+type mockDaraja struct {
+	mu      sync.Mutex
+	results map[string]services.MpesaSTKQueryResponse
+	queries int
+	// callbackURLs are the URLs requests asked M-Pesa to call back on
+	callbackURLs []string
+}
+
+func newMockDaraja(t *testing.T) *mockDaraja {
+	daraja := &mockDaraja{results: map[string]services.MpesaSTKQueryResponse{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/v1/generate", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(services.MpesaAccessTokenResponse{AccessToken: "mock-token", ExpiresIn: "3599"})
+	})
+	mux.HandleFunc("/mpesa/stkpushquery/v1/query", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer mock-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var query services.MpesaSTKQueryRequest
+		if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		daraja.mu.Lock()
+		defer daraja.mu.Unlock()
+		daraja.queries++
+		result, ok := daraja.results[query.CheckoutRequestID]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"errorCode": "500.001.1001", "errorMessage": "The transaction is being processed"})
+			return
+		}
+		result.ResponseCode = "0"
+		result.CheckoutRequestID = query.CheckoutRequestID
+		json.NewEncoder(w).Encode(result)
+	})
+
+	mux.HandleFunc("/mpesa/stkpush/v1/processrequest", func(w http.ResponseWriter, r *http.Request) {
+		var push services.MpesaSTKPushRequest
+		json.NewDecoder(r.Body).Decode(&push)
+		daraja.mu.Lock()
+		defer daraja.mu.Unlock()
+		daraja.callbackURLs = append(daraja.callbackURLs, push.CallBackURL)
+		json.NewEncoder(w).Encode(services.MpesaSTKPushResponse{CheckoutRequestID: "ws_CO_1", ResponseCode: "0"})
+	})
+	mux.HandleFunc("/mpesa/b2c/v1/paymentrequest", func(w http.ResponseWriter, r *http.Request) {
+		var payment services.MpesaB2CRequest
+		json.NewDecoder(r.Body).Decode(&payment)
+		daraja.mu.Lock()
+		defer daraja.mu.Unlock()
+		daraja.callbackURLs = append(daraja.callbackURLs, payment.ResultURL, payment.QueueTimeOutURL)
+		json.NewEncoder(w).Encode(services.MpesaB2CResponse{ConversationID: "AG_1", ResponseCode: "0"})
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	t.Setenv("ENVIRONMENT", "sandbox")
+	t.Setenv("MPESA_BASE_URL", server.URL)
+	t.Setenv("MPESA_SHORTCODE", "174379")
+	t.Setenv("MPESA_PASSKEY", "passkey")
+	return daraja
+}
+
+func (d *mockDaraja) setResult(checkoutRequestID, resultCode, resultDesc string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.results[checkoutRequestID] = services.MpesaSTKQueryResponse{ResultCode: resultCode, ResultDesc: resultDesc}
+}
+
+func (d *mockDaraja) queryCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queries
+}
+
+func TestPaymentReconciler(t *testing.T) {
+	db := setupTestDB()
+	daraja := newMockDaraja(t)
+	mpesa := services.NewMpesaService(db, config.Load())
+	clock := &fakeClock{now: time.Now()}
+	payments := services.NewPaymentService(db, services.NewPaymentProviders(mpesa), clock)
+	reconciler := services.NewPaymentReconciler(db, payments, clock, 5*time.Minute, time.Second)
+
+	createPayment := func(t *testing.T, checkoutRequestID string, initiatedAgo time.Duration) *models.Payment {
+		passengerID := uuid.New()
+		initiatedAt := clock.now.Add(-initiatedAgo)
+		payment := models.Payment{
+			RideID:          uuid.New(),
+			PassengerID:     &passengerID,
+			Amount:          450,
+			RequestedAmount: 450,
+			PaymentMethod:   "mpesa",
+			PaymentStatus:   "pending",
+			InitiatedAt:     &initiatedAt,
+		}
+		if checkoutRequestID != "" {
+			payment.CheckoutRequestID = &checkoutRequestID
+		}
+		require.NoError(t, db.Create(&payment).Error)
+		return &payment
+	}
+	reload := func(t *testing.T, payment *models.Payment) *models.Payment {
+		var fresh models.Payment
+		require.NoError(t, db.First(&fresh, "id = ?", payment.ID).Error)
+		return &fresh
+	}
+
+	t.Run("QuerySTKStatus", func(t *testing.T) {
+		daraja.setResult("ws_CO_query", "1032", "Request cancelled by user")
+		result, err := mpesa.QuerySTKStatus("ws_CO_query")
+		require.NoError(t, err)
+		assert.Equal(t, "1032", result.ResultCode)
+
+		_, err = mpesa.QuerySTKStatus("ws_CO_unknown")
+		assert.ErrorIs(t, err, services.ErrSTKStillProcessing)
+	})
+
+	paid := createPayment(t, "ws_CO_paid", 10*time.Minute)
+	cancelled := createPayment(t, "ws_CO_cancelled", 10*time.Minute)
+	processing := createPayment(t, "ws_CO_processing", 10*time.Minute)
+	recent := createPayment(t, "ws_CO_recent", time.Minute)
+	notSent := createPayment(t, "", 10*time.Minute)
+	daraja.setResult("ws_CO_paid", "0", "The service request is processed successfully.")
+	daraja.setResult("ws_CO_cancelled", "1032", "Request cancelled by user")
+	daraja.setResult("ws_CO_recent", "0", "The service request is processed successfully.")
+
+	t.Run("SettlesStalePayments", func(t *testing.T) {
+		queriesBefore := daraja.queryCount()
+		settled, err := reconciler.ReconcilePending()
+		require.NoError(t, err)
+		assert.Equal(t, 2, settled)
+		assert.Equal(t, queriesBefore+3, daraja.queryCount())
+
+		assert.Equal(t, "completed", reload(t, paid).PaymentStatus)
+		wallet, err := services.NewLedgerService(db, clock).Balance(services.PassengerWallet(*paid.PassengerID))
+		require.NoError(t, err)
+		assert.Equal(t, int64(45000), wallet)
+
+		assert.Equal(t, "failed", reload(t, cancelled).PaymentStatus)
+		assert.Equal(t, "Request cancelled by user", reload(t, cancelled).FailureReason)
+
+		stillPending := reload(t, processing)
+		assert.Equal(t, "pending", stillPending.PaymentStatus)
+		assert.NotNil(t, stillPending.LastCheckedAt)
+		assert.Equal(t, "pending", reload(t, recent).PaymentStatus)
+		assert.Equal(t, "pending", reload(t, notSent).PaymentStatus)
+
+		// A payment that was just checked waits before it is checked again
+		queriesBefore = daraja.queryCount()
+		_, err = reconciler.ReconcilePending()
+		require.NoError(t, err)
+		assert.Equal(t, queriesBefore, daraja.queryCount())
+	})
+
+	t.Run("LateCallbackIsIgnored", func(t *testing.T) {
+		callback, err := payments.RecordCallback(models.PaymentMethodMpesa, "196.201.214.200",
+			[]byte(`{"Body":{"stkCallback":{"CheckoutRequestID":"ws_CO_paid","ResultCode":1,"ResultDesc":"The balance is insufficient for the transaction"}}}`))
+		require.NoError(t, err)
+		require.NoError(t, payments.ProcessCallback(models.PaymentMethodMpesa, callback))
+		assert.Equal(t, models.MpesaCallbackDuplicate, callback.Status)
+		assert.Equal(t, "completed", reload(t, paid).PaymentStatus)
+	})
+
+	t.Run("Recheck", func(t *testing.T) {
+		assert.ErrorIs(t, payments.Recheck(reload(t, paid)), services.ErrPaymentNotPending)
+		assert.ErrorIs(t, payments.Recheck(notSent), services.ErrPaymentNotPending)
+
+		// An admin recheck does not wait for the reconciler
+		daraja.setResult("ws_CO_processing", "0", "The service request is processed successfully.")
+		payment := reload(t, processing)
+		require.NoError(t, payments.Recheck(payment))
+		assert.Equal(t, "completed", payment.PaymentStatus)
+		assert.Equal(t, "completed", reload(t, processing).PaymentStatus)
+	})
+}
+
+func TestMpesaCallbackURLs(t *testing.T) {
+	daraja := newMockDaraja(t)
+	t.Setenv("BASE_URL", "https://api.example.co.ke")
+	t.Setenv("MPESA_CALLBACK_TOKEN", "s3cret")
+	mpesa := services.NewMpesaService(setupTestDB(), config.Load())
+
+	_, err := mpesa.InitiateSTKPush("254712345678", 100, "RIDE-1")
+	require.NoError(t, err)
+	_, err = mpesa.InitiateB2C("254712345678", 500, "Payout", "")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"https://api.example.co.ke/api/v1/payments/mpesa/callback/s3cret",
+		"https://api.example.co.ke/api/v1/payouts/mpesa/result/s3cret",
+		"https://api.example.co.ke/api/v1/payouts/mpesa/timeout/s3cret",
+	}, daraja.callbackURLs)
+}
@@ -0,0 +1,453 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrPaymentCompleted  = errors.New("payment already completed")
+	ErrPaymentNotPending = errors.New("payment is not awaiting a provider result")
+	ErrCallbackRejected  = errors.New("callback rejected")
+	ErrPaymentInProgress = errors.New("a payment request is still awaiting the passenger")
+	ErrNoFare            = errors.New("ride has no fare to pay")
+	ErrAmountExceedsDue  = errors.New("amount is more than is owed for the ride")
+)
+
+// PaymentService collects ride payments through the provider for each
+// payment's method and settles them with what the provider reports
+type PaymentService struct {
+	db        *gorm.DB
+	ledger    *LedgerService
+	providers *PaymentProviders
+	clock     Clock
+}
+
+func NewPaymentService(db *gorm.DB, providers *PaymentProviders, clock Clock) *PaymentService {
+	return &PaymentService{
+		db:        db,
+		ledger:    NewLedgerService(db, clock),
+		providers: providers,
+		clock:     clock,
+	}
+}
+
+// AmountDue is what is still owed on a payment in cents: the fare and any
+// earlier debt added to it, less the wallet credit taken off it and what
+// was paid so far
+func AmountDue(payment *models.Payment) int64 {
+	due := ToCents(payment.Amount) + ToCents(payment.WalletDebt) - ToCents(payment.WalletCredit) - ToCents(payment.AmountPaid)
+	if due < 0 {
+		return 0
+	}
+	return due
+}
+
+// wholeShillings rounds cents up to whole shillings, the smallest amount
+// providers collect
+func wholeShillings(cents int64) int64 {
+	return (cents + 99) / 100 * 100
+}
+
+// ApplyWalletCredit settles a passenger's wallet with a new payment for a
+// ride whose fare was just posted. Credit in the wallet is taken off the
+// payment, and a payment the credit covers in full is completed. Cash is
+// paid in full to the driver, so cash payments keep the credit for a later
+// ride. Debt no other payment collects, such as the cancellation fee of a
+// cash rider, is added to the payment instead.
+func (s *PaymentService) ApplyWalletCredit(tx *gorm.DB, payment *models.Payment, passengerID uuid.UUID) error {
+	balance, err := s.ledger.balance(tx, PassengerWallet(passengerID))
+	if err != nil {
+		return err
+	}
+	// The fare is already posted, so what the wallet held before the ride
+	// is its balance with the fare added back
+	fare := ToCents(payment.Amount)
+	credit := balance + fare
+	if credit < 0 {
+		billed, err := openAmountDue(tx, passengerID)
+		if err != nil {
+			return err
+		}
+		if unbilled := -credit - billed; unbilled > 0 {
+			payment.WalletDebt = FromCents(unbilled)
+		}
+		return nil
+	}
+	if credit == 0 || payment.PaymentMethod == models.PaymentMethodCash {
+		return nil
+	}
+	if credit > fare {
+		credit = fare
+	}
+	payment.WalletCredit = FromCents(credit)
+	if AmountDue(payment) == 0 {
+		payment.PaymentStatus = "completed"
+	}
+	return nil
+}
+
+// openAmountDue is what a passenger's unsettled payments still collect, in
+// cents
+func openAmountDue(db *gorm.DB, passengerID uuid.UUID) (int64, error) {
+	var open []models.Payment
+	if err := db.Where("passenger_id = ? AND payment_status NOT IN ?", passengerID, []string{"completed", "refunded"}).
+		Find(&open).Error; err != nil {
+		return 0, err
+	}
+	var due int64
+	for i := range open {
+		due += AmountDue(&open[i])
+	}
+	return due, nil
+}
+
+// Bill returns the payment for what a passenger owes for a completed ride.
+// Rides that ended before payments were created with them get an unsaved
+// payment for their fare.
+func (s *PaymentService) Bill(ride *models.Ride, passengerID uuid.UUID) (*models.Payment, error) {
+	var payment models.Payment
+	err := s.db.Where("ride_id = ? AND (passenger_id = ? OR passenger_id IS NULL)", ride.ID, passengerID).First(&payment).Error
+	if err == nil {
+		return &payment, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	var breakdown models.FareBreakdown
+	err = s.db.Where("ride_id = ? AND passenger_id = ?", ride.ID, passengerID).First(&breakdown).Error
+	switch {
+	case err == nil:
+		payment.Amount = breakdown.Total
+		payment.Discount = breakdown.PromoDiscount
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, err
+	case ride.ActualFare != nil:
+		payment.Amount = *ride.ActualFare
+	default:
+		return nil, ErrNoFare
+	}
+
+	method, err := s.rideRequestMethod(ride.ID, passengerID)
+	if err != nil {
+		return nil, err
+	}
+	payment.RideID = ride.ID
+	payment.PassengerID = &passengerID
+	payment.Currency = "KES"
+	payment.PaymentMethod = method
+	payment.PaymentStatus = "pending"
+	return &payment, nil
+}
+
+// Initiate asks a passenger to pay for a completed ride through the payment
+// method they chose for it. The passenger is asked for all they still owe,
+// or for amount KES when it is set, which pays part of the fare and leaves
+// the rest owing. Amounts are rounded up to whole shillings, and anything
+// the rounding adds is kept in their wallet as credit.
+func (s *PaymentService) Initiate(ride *models.Ride, passengerID uuid.UUID, phoneNumber string, amount float64) (*models.Payment, *PaymentRequest, error) {
+	payment, err := s.Bill(ride, passengerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if payment.PaymentStatus == "completed" || payment.PaymentStatus == "refunded" || AmountDue(payment) == 0 {
+		return nil, nil, ErrPaymentCompleted
+	}
+	// A new request would leave the passenger able to pay the old one
+	// without it counting
+	if payment.PaymentStatus == "pending" && payment.CheckoutRequestID != nil {
+		return nil, nil, ErrPaymentInProgress
+	}
+	provider, err := s.providers.Get(payment.PaymentMethod)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	requested := wholeShillings(AmountDue(payment))
+	if amount > 0 {
+		if ToCents(amount) > requested {
+			return nil, nil, ErrAmountExceedsDue
+		}
+		requested = wholeShillings(ToCents(amount))
+	}
+	request, err := provider.Initiate(phoneNumber, FromCents(requested), "RIDE-"+ride.ID.String()[:8])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	initiatedAt := s.clock.Now()
+	payment.PhoneNumber = phoneNumber
+	payment.CheckoutRequestID = &request.Reference
+	payment.RequestedAmount = FromCents(requested)
+	payment.InitiatedAt = &initiatedAt
+	payment.LastCheckedAt = nil
+	payment.FailureReason = ""
+	payment.PaymentStatus = "pending"
+
+	if payment.ID == uuid.Nil {
+		if err := s.db.Create(payment).Error; err != nil {
+			return nil, nil, err
+		}
+		return payment, request, nil
+	}
+
+	// Forget the outcome of an earlier attempt
+	err = s.db.Model(payment).Updates(map[string]interface{}{
+		"phone_number":        payment.PhoneNumber,
+		"checkout_request_id": request.Reference,
+		"requested_amount":    payment.RequestedAmount,
+		"initiated_at":        initiatedAt,
+		"last_checked_at":     nil,
+		"failure_reason":      "",
+		"payment_status":      "pending",
+	}).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	return payment, request, nil
+}
+
+// rideRequestMethod is the payment method a passenger chose when requesting
+// a ride. Rides from before passengers could choose are paid with M-Pesa.
+func (s *PaymentService) rideRequestMethod(rideID, passengerID uuid.UUID) (string, error) {
+	var rideRequest models.RideRequest
+	err := s.db.Select("payment_method").Where("ride_id = ? AND passenger_id = ?", rideID, passengerID).First(&rideRequest).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && rideRequest.PaymentMethod == "") {
+		return models.PaymentMethodMpesa, nil
+	}
+	return rideRequest.PaymentMethod, err
+}
+
+// Recheck asks the provider for the outcome of a pending payment and
+// settles the payment if the provider has one. A payment the provider is
+// still processing is left pending.
+func (s *PaymentService) Recheck(payment *models.Payment) error {
+	if payment.PaymentStatus != "pending" || payment.CheckoutRequestID == nil {
+		return ErrPaymentNotPending
+	}
+	provider, err := s.providers.Get(payment.PaymentMethod)
+	if err != nil {
+		return err
+	}
+
+	result, err := provider.Query(*payment.CheckoutRequestID)
+	now := s.clock.Now()
+	payment.LastCheckedAt = &now
+	if updateErr := s.db.Model(payment).Update("last_checked_at", now).Error; updateErr != nil {
+		return updateErr
+	}
+	if errors.Is(err, ErrPaymentStillProcessing) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = s.settle(payment, result.Completed, result.Receipt, result.Reason)
+	return err
+}
+
+// RecordCallback stores the raw body of a payment callback from the
+// provider for method before it is processed
+func (s *PaymentService) RecordCallback(method, sourceIP string, body []byte) (*models.MpesaCallback, error) {
+	provider, err := s.providers.Get(method)
+	if err != nil {
+		return nil, err
+	}
+	return recordCallback(s.db, s.clock, provider.CallbackKind(), sourceIP, body)
+}
+
+// ProcessCallback settles the payment a callback from the provider for
+// method reports on. A successful callback must match the amount and phone
+// the payment asked for, or be confirmed by the provider when it does not
+// report them; one that does not is rejected and the payment is left
+// pending for the reconciler to query. Callbacks for payments already
+// settled are recorded as duplicates.
+func (s *PaymentService) ProcessCallback(method string, callback *models.MpesaCallback) error {
+	status, reason, err := s.processCallback(method, callback)
+	if err != nil {
+		status, reason = models.MpesaCallbackFailed, err.Error()
+	}
+	if finishErr := finishCallback(s.db, s.clock, callback, status, reason); finishErr != nil {
+		return finishErr
+	}
+	if err != nil {
+		return err
+	}
+	if status == models.MpesaCallbackRejected {
+		return fmt.Errorf("%w: %s", ErrCallbackRejected, reason)
+	}
+	return nil
+}
+
+func (s *PaymentService) processCallback(method string, callback *models.MpesaCallback) (string, string, error) {
+	provider, err := s.providers.Get(method)
+	if err != nil {
+		return "", "", err
+	}
+	result, err := provider.ParseCallback([]byte(callback.Body))
+	if err != nil {
+		return models.MpesaCallbackRejected, err.Error(), nil
+	}
+	callback.Reference = result.Reference
+
+	var payment models.Payment
+	if err := s.db.Where("checkout_request_id = ? AND payment_method = ?", result.Reference, method).First(&payment).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.MpesaCallbackRejected, "no payment for this request", nil
+		}
+		return "", "", err
+	}
+
+	if !result.Completed {
+		settled, err := s.settle(&payment, false, nil, result.Reason)
+		return callbackOutcome(settled, err)
+	}
+
+	// Payments are asked for in whole shillings. Providers that do not
+	// report what was paid are asked to confirm the payment instead.
+	if result.Amount == nil {
+		confirmed, err := provider.Query(result.Reference)
+		if err != nil {
+			return models.MpesaCallbackRejected, fmt.Sprintf("provider could not confirm the payment: %v", err), nil
+		}
+		if !confirmed.Completed {
+			return models.MpesaCallbackRejected, "provider does not confirm the payment", nil
+		}
+		if result.Receipt == nil {
+			result.Receipt = confirmed.Receipt
+		}
+	} else {
+		if ToCents(*result.Amount) != ToCents(payment.RequestedAmount) {
+			return models.MpesaCallbackRejected, fmt.Sprintf("amount %.2f does not match the %.2f requested", *result.Amount, payment.RequestedAmount), nil
+		}
+		if payment.PhoneNumber != "" && !phoneMatches(result.Phone, payment.PhoneNumber) {
+			return models.MpesaCallbackRejected, "phone number does not match the one requested", nil
+		}
+	}
+
+	settled, err := s.settle(&payment, true, result.Receipt, "")
+	return callbackOutcome(settled, err)
+}
+
+// phoneMatches reports whether the phone number in a callback is the one a
+// payment was asked from. Providers may mask some digits with asterisks;
+// only the digits shown are compared.
+func phoneMatches(phone, requested string) bool {
+	requested = utils.FormatKenyanPhoneNumber(requested)
+	if !strings.Contains(phone, "*") {
+		return utils.FormatKenyanPhoneNumber(phone) == requested
+	}
+	if len(phone) != len(requested) {
+		return false
+	}
+	for i := range phone {
+		if phone[i] != '*' && phone[i] != requested[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// callbackOutcome is the callback status for an attempt to settle what it
+// reports on
+func callbackOutcome(settled bool, err error) (string, string, error) {
+	if err != nil {
+		return "", "", err
+	}
+	if !settled {
+		return models.MpesaCallbackDuplicate, "already settled", nil
+	}
+	return models.MpesaCallbackProcessed, "", nil
+}
+
+// settle records the outcome of the latest request for a payment and
+// reports whether it did. The callback and a recheck can both report the
+// outcome, so only the first one counts. What a completed request collected
+// counts towards the payment, which is completed once nothing is owed.
+func (s *PaymentService) settle(payment *models.Payment, completed bool, receiptNumber *string, reason string) (bool, error) {
+	settled := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Locking the payment keeps a concurrent outcome for the same
+		// request from counting it twice
+		result := tx.Model(&models.Payment{}).
+			Where("id = ? AND payment_status = ? AND checkout_request_id = ?", payment.ID, "pending", *payment.CheckoutRequestID).
+			Update("payment_status", gorm.Expr("payment_status"))
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		if err := tx.First(payment, "id = ?", payment.ID).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{"failure_reason": reason}
+		if completed {
+			payment.AmountPaid = FromCents(ToCents(payment.AmountPaid) + ToCents(payment.RequestedAmount))
+			updates["amount_paid"] = payment.AmountPaid
+			if receiptNumber != nil {
+				updates["transaction_id"] = *receiptNumber
+				payment.TransactionID = receiptNumber
+			}
+		}
+		// A payment that failed after part of it was paid still has that
+		// part paid
+		status := "failed"
+		switch {
+		case AmountDue(payment) == 0:
+			status = "completed"
+		case payment.AmountPaid > 0:
+			status = "partially_paid"
+		}
+		updates["payment_status"] = status
+		if err := tx.Model(payment).Updates(updates).Error; err != nil {
+			return err
+		}
+		settled = true
+		payment.PaymentStatus = status
+		payment.FailureReason = reason
+		if !completed {
+			return nil
+		}
+
+		// The money received goes to the passenger's wallet, settling what
+		// they owe for the ride
+		passengerID, err := paymentPassenger(tx, payment)
+		if err != nil {
+			return err
+		}
+		err = s.ledger.PostCollection(tx, payment, passengerID, *payment.CheckoutRequestID, ToCents(payment.RequestedAmount))
+		if err != nil && !errors.Is(err, ErrAlreadyPosted) {
+			return err
+		}
+		if status != "completed" {
+			return nil
+		}
+		err = s.ledger.ReleaseEarnings(tx, payment)
+		if err != nil && !errors.Is(err, ErrAlreadyPosted) {
+			return err
+		}
+		return nil
+	})
+	return settled && err == nil, err
+}
+
+// paymentPassenger returns who made a payment. Payments from before pooled
+// rides have no passenger and belong to the ride's passenger.
+func paymentPassenger(db *gorm.DB, payment *models.Payment) (uuid.UUID, error) {
+	if payment.PassengerID != nil {
+		return *payment.PassengerID, nil
+	}
+	var ride models.Ride
+	if err := db.Select("passenger_id").First(&ride, "id = ?", payment.RideID).Error; err != nil {
+		return uuid.Nil, err
+	}
+	return ride.PassengerID, nil
+}
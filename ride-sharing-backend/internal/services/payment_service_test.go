@@ -0,0 +1,289 @@
+package services_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+	"kenyan-ride-share-backend/internal/services/paymenttest"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaymentService(t *testing.T) {
+	db := setupTestDB()
+	clock := &fakeClock{now: time.Now()}
+	mpesa := paymenttest.NewFakeProvider(models.PaymentMethodMpesa)
+	airtel := paymenttest.NewFakeProvider(models.PaymentMethodAirtelMoney)
+	payments := services.NewPaymentService(db, services.NewPaymentProviders(mpesa, airtel, services.CashProvider{}), clock)
+	ledger := services.NewLedgerService(db, clock)
+
+	// Completes a ride with a fare requested with method and returns it with
+	// its passenger
+	completeRide := func(t *testing.T, method string, fare float64) (*models.Ride, uuid.UUID) {
+		passengerID := uuid.New()
+		ride := models.Ride{ID: uuid.New(), RequestID: uuid.New(), DriverID: uuid.New(), PassengerID: passengerID, Status: "completed"}
+		require.NoError(t, db.Create(&ride).Error)
+		rideRequest := models.RideRequest{ID: ride.RequestID, PassengerID: passengerID, RideID: &ride.ID, Status: "completed", PaymentMethod: method}
+		require.NoError(t, db.Create(&rideRequest).Error)
+		breakdown := models.FareBreakdown{RideID: ride.ID, RequestID: ride.RequestID, PassengerID: passengerID, Total: fare}
+		require.NoError(t, db.Create(&breakdown).Error)
+		return &ride, passengerID
+	}
+	callback := func(t *testing.T, method string, result services.PaymentResult) (*models.MpesaCallback, error) {
+		body, err := json.Marshal(result)
+		require.NoError(t, err)
+		recorded, err := payments.RecordCallback(method, "10.0.0.1", body)
+		require.NoError(t, err)
+		return recorded, payments.ProcessCallback(method, recorded)
+	}
+	reload := func(t *testing.T, payment *models.Payment) *models.Payment {
+		var fresh models.Payment
+		require.NoError(t, db.First(&fresh, "id = ?", payment.ID).Error)
+		return &fresh
+	}
+	walletBalance := func(t *testing.T, passengerID uuid.UUID) int64 {
+		cents, err := ledger.Balance(services.PassengerWallet(passengerID))
+		require.NoError(t, err)
+		return cents
+	}
+
+	t.Run("UsesTheRideRequestMethod", func(t *testing.T) {
+		ride, passengerID := completeRide(t, models.PaymentMethodAirtelMoney, 450)
+		payment, request, err := payments.Initiate(ride, passengerID, "254733123456", 0)
+		require.NoError(t, err)
+		assert.Equal(t, models.PaymentMethodAirtelMoney, payment.PaymentMethod)
+		assert.Equal(t, request.Reference, *payment.CheckoutRequestID)
+		assert.Equal(t, []float64{450}, airtel.Initiated)
+		assert.Empty(t, mpesa.Initiated)
+	})
+
+	t.Run("CashIsNotCollected", func(t *testing.T) {
+		ride, passengerID := completeRide(t, models.PaymentMethodCash, 450)
+		_, _, err := payments.Initiate(ride, passengerID, "254712345678", 0)
+		assert.ErrorIs(t, err, services.ErrCollectedByDriver)
+	})
+
+	t.Run("AmountComesFromTheFare", func(t *testing.T) {
+		ride, passengerID := completeRide(t, models.PaymentMethodMpesa, 799.40)
+		bill, err := payments.Bill(ride, passengerID)
+		require.NoError(t, err)
+		assert.Equal(t, int64(79940), services.AmountDue(bill))
+
+		// Rounded up to whole shillings; the extra is kept as credit
+		payment, _, err := payments.Initiate(ride, passengerID, "254712345678", 0)
+		require.NoError(t, err)
+		assert.Equal(t, 800.0, payment.RequestedAmount)
+		assert.Equal(t, 799.40, reload(t, payment).Amount)
+	})
+
+	t.Run("PartialPaymentThenTopUp", func(t *testing.T) {
+		ride, passengerID := completeRide(t, models.PaymentMethodMpesa, 800)
+		payment, request, err := payments.Initiate(ride, passengerID, "254712345678", 300)
+		require.NoError(t, err)
+		assert.Equal(t, 300.0, payment.RequestedAmount)
+
+		// Only one request at a time can be awaiting the passenger
+		_, _, err = payments.Initiate(ride, passengerID, "254712345678", 0)
+		assert.ErrorIs(t, err, services.ErrPaymentInProgress)
+
+		receipt := "RKT300"
+		paid := 300.0
+		_, err = callback(t, models.PaymentMethodMpesa, services.PaymentResult{Reference: request.Reference, Completed: true, Receipt: &receipt, Amount: &paid, Phone: "254712345678"})
+		require.NoError(t, err)
+		fresh := reload(t, payment)
+		assert.Equal(t, "partially_paid", fresh.PaymentStatus)
+		assert.Equal(t, 300.0, fresh.AmountPaid)
+		assert.Equal(t, int64(50000), services.AmountDue(fresh))
+
+		// A failed top-up keeps what was already paid
+		_, request, err = payments.Initiate(ride, passengerID, "254712345678", 0)
+		require.NoError(t, err)
+		_, err = callback(t, models.PaymentMethodMpesa, services.PaymentResult{Reference: request.Reference, Reason: "Request cancelled by user"})
+		require.NoError(t, err)
+		assert.Equal(t, "partially_paid", reload(t, payment).PaymentStatus)
+
+		payment, request, err = payments.Initiate(ride, passengerID, "254712345678", 0)
+		require.NoError(t, err)
+		assert.Equal(t, 500.0, payment.RequestedAmount)
+		receipt = "RKT500"
+		paid = 500.0
+		_, err = callback(t, models.PaymentMethodMpesa, services.PaymentResult{Reference: request.Reference, Completed: true, Receipt: &receipt, Amount: &paid, Phone: "254712345678"})
+		require.NoError(t, err)
+		fresh = reload(t, payment)
+		assert.Equal(t, "completed", fresh.PaymentStatus)
+		assert.Equal(t, 800.0, fresh.AmountPaid)
+		assert.Equal(t, int64(80000), walletBalance(t, passengerID))
+
+		_, _, err = payments.Initiate(ride, passengerID, "254712345678", 0)
+		assert.ErrorIs(t, err, services.ErrPaymentCompleted)
+	})
+
+	t.Run("AmountCannotExceedWhatIsOwed", func(t *testing.T) {
+		ride, passengerID := completeRide(t, models.PaymentMethodAirtelMoney, 199.50)
+		_, _, err := payments.Initiate(ride, passengerID, "254733123456", 500)
+		assert.ErrorIs(t, err, services.ErrAmountExceedsDue)
+
+		// The whole shilling the fare rounds up to is allowed
+		payment, _, err := payments.Initiate(ride, passengerID, "254733123456", 200)
+		require.NoError(t, err)
+		assert.Equal(t, 200.0, payment.RequestedAmount)
+	})
+
+	t.Run("WalletCredit", func(t *testing.T) {
+		passengerID := uuid.New()
+		// KES 150 of credit from an earlier refund
+		_, err := ledger.Post(db, models.JournalRefund, uuid.NewString(), "Refund",
+			services.Debit(services.RefundExpense, 15000), services.Credit(services.PassengerWallet(passengerID), 15000))
+		require.NoError(t, err)
+
+		postFare := func(t *testing.T, fare float64) *models.Payment {
+			breakdown := models.FareBreakdown{RideID: uuid.New(), RequestID: uuid.New(), PassengerID: passengerID, Total: fare}
+			require.NoError(t, db.Create(&breakdown).Error)
+			require.NoError(t, ledger.PostRideFare(db, &breakdown, uuid.New()))
+			payment := models.Payment{RideID: breakdown.RideID, PassengerID: &passengerID, Amount: fare, PaymentMethod: models.PaymentMethodMpesa, PaymentStatus: "pending"}
+			require.NoError(t, payments.ApplyWalletCredit(db, &payment, passengerID))
+			require.NoError(t, db.Create(&payment).Error)
+			return &payment
+		}
+
+		covered := postFare(t, 100)
+		assert.Equal(t, 100.0, covered.WalletCredit)
+		assert.Equal(t, "completed", covered.PaymentStatus)
+
+		partly := postFare(t, 400)
+		assert.Equal(t, 50.0, partly.WalletCredit)
+		assert.Equal(t, int64(35000), services.AmountDue(partly))
+		assert.Equal(t, "pending", partly.PaymentStatus)
+
+		// The credit is used up
+		none := postFare(t, 300)
+		assert.Zero(t, none.WalletCredit)
+		// What is owed is already collected by the unpaid payments
+		assert.Zero(t, none.WalletDebt)
+	})
+
+	t.Run("WalletDebt", func(t *testing.T) {
+		passengerID := uuid.New()
+		// A KES 100 cash cancellation fee with no payment to collect it, and
+		// a KES 150 no-show fee with one
+		for _, fee := range []float64{100, 150} {
+			cancellation := models.RideCancellation{ID: uuid.New(), ReasonCode: "passenger_no_show", FeeAmount: fee}
+			require.NoError(t, ledger.PostCancellationFee(db, &cancellation, passengerID))
+		}
+		require.NoError(t, db.Create(&models.Payment{RideID: uuid.New(), PassengerID: &passengerID, Amount: 150, PaymentMethod: models.PaymentMethodMpesa, PaymentStatus: "pending"}).Error)
+
+		breakdown := models.FareBreakdown{RideID: uuid.New(), RequestID: uuid.New(), PassengerID: passengerID, Total: 400}
+		require.NoError(t, db.Create(&breakdown).Error)
+		require.NoError(t, ledger.PostRideFare(db, &breakdown, uuid.New()))
+		payment := models.Payment{RideID: breakdown.RideID, PassengerID: &passengerID, Amount: 400, PaymentMethod: models.PaymentMethodCash, PaymentStatus: "pending"}
+		require.NoError(t, payments.ApplyWalletCredit(db, &payment, passengerID))
+
+		// Only the fee nothing else collects is added to the next ride
+		assert.Equal(t, 100.0, payment.WalletDebt)
+		assert.Zero(t, payment.WalletCredit)
+		assert.Equal(t, int64(50000), services.AmountDue(&payment))
+	})
+
+	t.Run("CallbackSettlesOnce", func(t *testing.T) {
+		ride, passengerID := completeRide(t, models.PaymentMethodMpesa, 450)
+		payment, request, err := payments.Initiate(ride, passengerID, "254712345678", 0)
+		require.NoError(t, err)
+
+		receipt := "RKT123"
+		wrongAmount := 45.0
+		recorded, err := callback(t, models.PaymentMethodMpesa, services.PaymentResult{Reference: request.Reference, Completed: true, Receipt: &receipt, Amount: &wrongAmount, Phone: "254712345678"})
+		assert.ErrorIs(t, err, services.ErrCallbackRejected)
+		assert.Equal(t, models.MpesaCallbackRejected, recorded.Status)
+		assert.Equal(t, "pending", reload(t, payment).PaymentStatus)
+
+		// A callback for another method's payment does not settle it
+		_, err = callback(t, models.PaymentMethodAirtelMoney, services.PaymentResult{Reference: request.Reference, Completed: true, Receipt: &receipt})
+		assert.ErrorIs(t, err, services.ErrCallbackRejected)
+
+		amount := 450.0
+		paid := services.PaymentResult{Reference: request.Reference, Completed: true, Receipt: &receipt, Amount: &amount, Phone: "2547****5678"}
+		recorded, err = callback(t, models.PaymentMethodMpesa, paid)
+		require.NoError(t, err)
+		assert.Equal(t, models.MpesaCallbackProcessed, recorded.Status)
+		assert.Equal(t, "completed", reload(t, payment).PaymentStatus)
+		assert.Equal(t, int64(45000), walletBalance(t, passengerID))
+
+		recorded, err = callback(t, models.PaymentMethodMpesa, paid)
+		require.NoError(t, err)
+		assert.Equal(t, models.MpesaCallbackDuplicate, recorded.Status)
+		assert.Equal(t, int64(45000), walletBalance(t, passengerID))
+	})
+
+	t.Run("PaymentReleasesDriverEarnings", func(t *testing.T) {
+		ride, passengerID := completeRide(t, models.PaymentMethodMpesa, 1000)
+		var breakdown models.FareBreakdown
+		require.NoError(t, db.First(&breakdown, "ride_id = ?", ride.ID).Error)
+		require.NoError(t, ledger.PostRideFare(db, &breakdown, ride.DriverID))
+		earnings := func(t *testing.T) int64 {
+			cents, err := ledger.Balance(services.DriverEarnings(ride.DriverID))
+			require.NoError(t, err)
+			return cents
+		}
+
+		// Part of the fare paid leaves the driver's share pending
+		payment, request, err := payments.Initiate(ride, passengerID, "254712345678", 400)
+		require.NoError(t, err)
+		mpesa.Settle(request.Reference, true, "")
+		require.NoError(t, payments.Recheck(payment))
+		assert.Zero(t, earnings(t))
+
+		payment, request, err = payments.Initiate(ride, passengerID, "254712345678", 0)
+		require.NoError(t, err)
+		mpesa.Settle(request.Reference, true, "")
+		require.NoError(t, payments.Recheck(payment))
+		assert.Equal(t, "completed", reload(t, payment).PaymentStatus)
+		// KES 820 of a KES 1000 fare goes to the driver
+		assert.Equal(t, int64(82000), earnings(t))
+	})
+
+	t.Run("UnreportedAmountsAreConfirmed", func(t *testing.T) {
+		ride, passengerID := completeRide(t, models.PaymentMethodAirtelMoney, 300)
+		payment, request, err := payments.Initiate(ride, passengerID, "254733123456", 0)
+		require.NoError(t, err)
+
+		recorded, err := callback(t, models.PaymentMethodAirtelMoney, services.PaymentResult{Reference: request.Reference, Completed: true})
+		assert.ErrorIs(t, err, services.ErrCallbackRejected)
+		assert.Equal(t, models.MpesaCallbackRejected, recorded.Status)
+
+		airtel.Settle(request.Reference, true, "")
+		_, err = callback(t, models.PaymentMethodAirtelMoney, services.PaymentResult{Reference: request.Reference, Completed: true})
+		require.NoError(t, err)
+		fresh := reload(t, payment)
+		assert.Equal(t, "completed", fresh.PaymentStatus)
+		assert.Equal(t, "FAKE"+request.Reference, *fresh.TransactionID)
+	})
+
+	t.Run("Recheck", func(t *testing.T) {
+		ride, passengerID := completeRide(t, models.PaymentMethodMpesa, 450)
+		payment, request, err := payments.Initiate(ride, passengerID, "254712345678", 0)
+		require.NoError(t, err)
+
+		require.NoError(t, payments.Recheck(payment))
+		assert.Equal(t, "pending", reload(t, payment).PaymentStatus)
+		assert.NotNil(t, reload(t, payment).LastCheckedAt)
+
+		mpesa.Settle(request.Reference, false, "Request cancelled by user")
+		require.NoError(t, payments.Recheck(payment))
+		fresh := reload(t, payment)
+		assert.Equal(t, "failed", fresh.PaymentStatus)
+		assert.Equal(t, "Request cancelled by user", fresh.FailureReason)
+
+		// A failed payment can be asked for again
+		_, retry, err := payments.Initiate(ride, passengerID, "254712345678", 0)
+		require.NoError(t, err)
+		fresh = reload(t, payment)
+		assert.Equal(t, "pending", fresh.PaymentStatus)
+		assert.Empty(t, fresh.FailureReason)
+		assert.Equal(t, retry.Reference, *fresh.CheckoutRequestID)
+	})
+}
@@ -0,0 +1,112 @@
+// Package paymenttest provides a fake payment provider for tests.
+package paymenttest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+)
+
+// FakeProvider is a deterministic services.PaymentProvider for tests. Its
+// references are numbered in order, payments stay processing until Settle
+// is called, and its callbacks are PaymentResults as JSON.
+type FakeProvider struct {
+	method string
+
+	mu      sync.Mutex
+	count   int
+	results map[string]*services.PaymentResult
+	// Initiated and Refunded record the amounts asked for, in order
+	Initiated []float64
+	Refunded  []int64
+	// Err fails every request while set
+	Err error
+	// InstantRefunds completes refunds straight away instead of leaving them
+	// for a result callback
+	InstantRefunds bool
+}
+
+// NewFakeProvider returns a fake provider standing in for method
+func NewFakeProvider(method string) *FakeProvider {
+	return &FakeProvider{method: method, results: map[string]*services.PaymentResult{}}
+}
+
+func (f *FakeProvider) Method() string {
+	return f.method
+}
+
+func (f *FakeProvider) CallbackKind() string {
+	return "fake_" + f.method
+}
+
+func (f *FakeProvider) next(prefix string) string {
+	f.count++
+	return fmt.Sprintf("%s_%s_%d", prefix, f.method, f.count)
+}
+
+func (f *FakeProvider) Initiate(phoneNumber string, amount float64, accountReference string) (*services.PaymentRequest, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	f.Initiated = append(f.Initiated, amount)
+	return &services.PaymentRequest{Reference: f.next("fake_payment"), CustomerMessage: "Fake payment requested"}, nil
+}
+
+// Settle sets the outcome Query reports for a payment request
+func (f *FakeProvider) Settle(reference string, completed bool, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := &services.PaymentResult{Reference: reference, Completed: completed, Reason: reason}
+	if completed {
+		receipt := "FAKE" + reference
+		result.Receipt = &receipt
+	}
+	f.results[reference] = result
+}
+
+func (f *FakeProvider) Query(reference string) (*services.PaymentResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	result, ok := f.results[reference]
+	if !ok {
+		return nil, services.ErrPaymentStillProcessing
+	}
+	copied := *result
+	return &copied, nil
+}
+
+func (f *FakeProvider) ParseCallback(body []byte) (*services.PaymentResult, error) {
+	var result services.PaymentResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, errors.New("invalid JSON")
+	}
+	return &result, nil
+}
+
+func (f *FakeProvider) Refund(payment *models.Payment, amountCents int64, phoneNumber, reference string) (*services.ProviderRefund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	f.Refunded = append(f.Refunded, amountCents)
+	refund := &services.ProviderRefund{
+		Reference:           f.next("fake_refund"),
+		OriginatorReference: "originator_" + reference,
+		Completed:           f.InstantRefunds,
+	}
+	if refund.Completed {
+		transactionID := "FAKE" + refund.Reference
+		refund.TransactionID = &transactionID
+	}
+	return refund, nil
+}
@@ -0,0 +1,343 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrPayoutBelowMinimum        = errors.New("earnings are below the minimum payout balance")
+	ErrPayoutInsufficientBalance = errors.New("earnings do not cover the payout and its fee")
+	ErrPayoutInProgress          = errors.New("a payout is already in progress")
+	ErrPayoutNotFound            = errors.New("payout not found")
+	ErrPayoutNotResolvable       = errors.New("payout is not awaiting resolution")
+	ErrPayoutSettled             = errors.New("payout has already been settled")
+)
+
+// B2CSender sends money to a phone number through M-Pesa B2C
+type B2CSender interface {
+	InitiateB2C(phoneNumber string, amount int, remarks, occasion string) (*MpesaB2CResponse, error)
+}
+
+// PayoutConfig controls when and how much drivers are paid out
+type PayoutConfig struct {
+	// MinimumBalance is the smallest earnings balance that can be paid out
+	MinimumBalance float64
+	// Fee is charged on every payout on top of the amount sent
+	Fee float64
+	// ScheduleHour is the hour of the day, in Kenyan time, after which
+	// scheduled payouts are made
+	ScheduleHour int
+	// ResultTimeout is how long to wait for the M-Pesa result before a
+	// payout needs resolving by an admin
+	ResultTimeout time.Duration
+	Interval      time.Duration
+}
+
+// PayoutService pays driver earnings out through M-Pesa B2C, either on
+// demand or once a day. The payout and its fee leave the driver's earnings
+// as soon as it is requested and are returned if M-Pesa reports a failure.
+type PayoutService struct {
+	db     *gorm.DB
+	ledger *LedgerService
+	sender B2CSender
+	config PayoutConfig
+	clock  Clock
+}
+
+func NewPayoutService(db *gorm.DB, sender B2CSender, config PayoutConfig, clock Clock) *PayoutService {
+	return &PayoutService{
+		db:     db,
+		ledger: NewLedgerService(db, clock),
+		sender: sender,
+		config: config,
+		clock:  clock,
+	}
+}
+
+// RequestPayout pays a driver amountCents of their earnings, or everything
+// left after the fee when amountCents is zero. M-Pesa only sends whole
+// shillings, so the amount is rounded down.
+func (s *PayoutService) RequestPayout(driverID uuid.UUID, amountCents int64, trigger string) (*models.Payout, error) {
+	var driver models.User
+	if err := s.db.First(&driver, "id = ?", driverID).Error; err != nil {
+		return nil, err
+	}
+
+	var payout models.Payout
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		account, err := s.ledger.account(tx, DriverEarnings(driverID))
+		if err != nil {
+			return err
+		}
+		// Locking the earnings account keeps two payouts for the same
+		// driver from both passing the checks below
+		if err := tx.Model(&models.LedgerAccount{}).Where("id = ?", account.ID).
+			Update("balance_cents", gorm.Expr("balance_cents")).Error; err != nil {
+			return err
+		}
+		if err := tx.Select("balance_cents").First(account, "id = ?", account.ID).Error; err != nil {
+			return err
+		}
+
+		var inProgress int64
+		if err := tx.Model(&models.Payout{}).
+			Where("driver_id = ? AND status IN ?", driverID, []string{models.PayoutStatusPending, models.PayoutStatusUnconfirmed}).
+			Count(&inProgress).Error; err != nil {
+			return err
+		}
+		if inProgress > 0 {
+			return ErrPayoutInProgress
+		}
+
+		balance := account.BalanceCents
+		if balance < ToCents(s.config.MinimumBalance) {
+			return ErrPayoutBelowMinimum
+		}
+		fee := ToCents(s.config.Fee)
+		if amountCents == 0 {
+			amountCents = balance - fee
+		}
+		amountCents -= amountCents % 100
+		if amountCents <= 0 {
+			return ErrPayoutBelowMinimum
+		}
+		if amountCents+fee > balance {
+			return ErrPayoutInsufficientBalance
+		}
+
+		payout = models.Payout{
+			DriverID:    driverID,
+			AmountCents: amountCents,
+			FeeCents:    fee,
+			PhoneNumber: driver.PhoneNumber,
+			Trigger:     trigger,
+			Status:      models.PayoutStatusPending,
+			CreatedAt:   s.clock.Now(),
+		}
+		if err := tx.Create(&payout).Error; err != nil {
+			return err
+		}
+		_, err = s.ledger.Post(tx, models.JournalPayout, payout.ID.String(), "Payout to M-Pesa",
+			Debit(DriverEarnings(driverID), amountCents+fee),
+			Credit(MpesaClearing, amountCents),
+			Credit(PayoutFees, fee),
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.sender.InitiateB2C(payout.PhoneNumber, int(payout.AmountCents/100), "Driver earnings payout", payout.ID.String())
+	if err == nil && response.ResponseCode != "0" {
+		err = errors.New(response.ResponseDescription)
+	}
+	if err != nil {
+		if settleErr := s.settle(&payout, false, nil, fmt.Sprintf("M-Pesa rejected the request: %v", err)); settleErr != nil {
+			return nil, settleErr
+		}
+		return &payout, nil
+	}
+
+	payout.ConversationID = &response.ConversationID
+	payout.OriginatorConversationID = &response.OriginatorConversationID
+	if err := s.db.Model(&payout).Updates(map[string]interface{}{
+		"conversation_id":            payout.ConversationID,
+		"originator_conversation_id": payout.OriginatorConversationID,
+	}).Error; err != nil {
+		return nil, err
+	}
+	return &payout, nil
+}
+
+// HandleResult settles a payout with the result M-Pesa posted for it.
+// Results for payouts that are already settled change nothing and return
+// ErrPayoutSettled.
+func (s *PayoutService) HandleResult(result *MpesaB2CResult) error {
+	payout, err := s.findByConversation(result)
+	if err != nil {
+		return err
+	}
+	if result.ResultCode == 0 {
+		return s.settle(payout, true, &result.TransactionID, "")
+	}
+	return s.settle(payout, false, nil, result.ResultDesc)
+}
+
+// HandleTimeout fails a payout M-Pesa could not process in time
+func (s *PayoutService) HandleTimeout(result *MpesaB2CResult) error {
+	payout, err := s.findByConversation(result)
+	if err != nil {
+		return err
+	}
+	return s.settle(payout, false, nil, "M-Pesa request timed out")
+}
+
+func (s *PayoutService) findByConversation(result *MpesaB2CResult) (*models.Payout, error) {
+	var payout models.Payout
+	if err := s.db.Where("conversation_id = ? OR originator_conversation_id = ?", result.ConversationID, result.OriginatorConversationID).
+		First(&payout).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPayoutNotFound
+		}
+		return nil, err
+	}
+	return &payout, nil
+}
+
+// Resolve settles a payout M-Pesa never reported back on, once an admin has
+// checked whether the money reached the driver
+func (s *PayoutService) Resolve(id uuid.UUID, completed bool, transactionID *string, reason string) (*models.Payout, error) {
+	var payout models.Payout
+	if err := s.db.First(&payout, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPayoutNotFound
+		}
+		return nil, err
+	}
+	if payout.Status != models.PayoutStatusUnconfirmed {
+		return nil, ErrPayoutNotResolvable
+	}
+	if err := s.settle(&payout, completed, transactionID, reason); err != nil {
+		return nil, err
+	}
+	if err := s.db.First(&payout, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &payout, nil
+}
+
+// settle completes or fails a payout that is still open. A failed payout is
+// returned to the driver's earnings, fee included. It returns
+// ErrPayoutSettled if the payout was settled already.
+func (s *PayoutService) settle(payout *models.Payout, completed bool, transactionID *string, reason string) error {
+	now := s.clock.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{"status": models.PayoutStatusFailed, "failure_reason": reason}
+		if completed {
+			updates = map[string]interface{}{"status": models.PayoutStatusCompleted, "transaction_id": transactionID, "completed_at": now}
+		}
+		// Only one result may settle the payout
+		result := tx.Model(&models.Payout{}).
+			Where("id = ? AND status IN ?", payout.ID, []string{models.PayoutStatusPending, models.PayoutStatusUnconfirmed}).
+			Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrPayoutSettled
+		}
+
+		if completed {
+			payout.Status = models.PayoutStatusCompleted
+			payout.TransactionID = transactionID
+			payout.CompletedAt = &now
+			return nil
+		}
+		payout.Status = models.PayoutStatusFailed
+		payout.FailureReason = reason
+		_, err := s.ledger.Post(tx, models.JournalPayoutReversal, payout.ID.String(), "Failed payout returned",
+			Debit(MpesaClearing, payout.AmountCents),
+			Debit(PayoutFees, payout.FeeCents),
+			Credit(DriverEarnings(payout.DriverID), payout.AmountCents+payout.FeeCents),
+		)
+		return err
+	})
+}
+
+// Reconcile marks payouts that have waited longer than the result timeout
+// as unconfirmed and returns how many were marked. They are not reversed
+// since the money may still have reached the driver.
+func (s *PayoutService) Reconcile() (int, error) {
+	result := s.db.Model(&models.Payout{}).
+		Where("status = ? AND created_at <= ?", models.PayoutStatusPending, s.clock.Now().Add(-s.config.ResultTimeout)).
+		Update("status", models.PayoutStatusUnconfirmed)
+	return int(result.RowsAffected), result.Error
+}
+
+// RunScheduled pays out every driver whose earnings reach the minimum
+// balance, once a day after the scheduled hour. It returns how many payouts
+// were requested.
+func (s *PayoutService) RunScheduled() (int, error) {
+	now := s.clock.Now().In(utils.GetKenyanTimezone())
+	if now.Hour() < s.config.ScheduleHour {
+		return 0, nil
+	}
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	var accounts []models.LedgerAccount
+	if err := s.db.Where("type = ? AND balance_cents >= ?", models.LedgerAccountDriverEarnings, ToCents(s.config.MinimumBalance)).
+		Find(&accounts).Error; err != nil {
+		return 0, err
+	}
+
+	requested := 0
+	for _, account := range accounts {
+		if account.OwnerID == nil {
+			continue
+		}
+		var today int64
+		if err := s.db.Model(&models.Payout{}).
+			Where("driver_id = ? AND trigger = ? AND created_at >= ?", *account.OwnerID, models.PayoutTriggerScheduled, startOfDay).
+			Count(&today).Error; err != nil {
+			return requested, err
+		}
+		if today > 0 {
+			continue
+		}
+
+		_, err := s.RequestPayout(*account.OwnerID, 0, models.PayoutTriggerScheduled)
+		if errors.Is(err, ErrPayoutInProgress) || errors.Is(err, ErrPayoutBelowMinimum) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Scheduled payout for driver %s failed: %v", *account.OwnerID, err)
+			continue
+		}
+		requested++
+	}
+	return requested, nil
+}
+
+// List returns a driver's payouts, or every payout when driverID is nil,
+// newest first
+func (s *PayoutService) List(driverID *uuid.UUID) ([]models.Payout, error) {
+	query := s.db.Order("created_at DESC")
+	if driverID != nil {
+		query = query.Where("driver_id = ?", *driverID)
+	}
+	var payouts []models.Payout
+	err := query.Find(&payouts).Error
+	return payouts, err
+}
+
+// Run reconciles stale payouts and makes scheduled payouts every interval
+// until ctx is cancelled
+func (s *PayoutService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Reconcile(); err != nil {
+				log.Printf("Payout reconciliation failed: %v", err)
+			}
+			if _, err := s.RunScheduled(); err != nil {
+				log.Printf("Scheduled payouts failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package services_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeB2CSender struct {
+	sent []int
+	err  error
+}
+
+func (s *fakeB2CSender) InitiateB2C(phoneNumber string, amount int, remarks, occasion string) (*services.MpesaB2CResponse, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.sent = append(s.sent, amount)
+	return &services.MpesaB2CResponse{
+		ConversationID:           fmt.Sprintf("AG_%s", occasion),
+		OriginatorConversationID: fmt.Sprintf("OC_%s", occasion),
+		ResponseCode:             "0",
+	}, nil
+}
+
+func TestPayoutService(t *testing.T) {
+	db := setupTestDB()
+	// 16:00 in Nairobi
+	clock := &fakeClock{now: time.Date(2025, 3, 1, 13, 0, 0, 0, time.UTC)}
+	sender := &fakeB2CSender{}
+	ledger := services.NewLedgerService(db, clock)
+	payouts := services.NewPayoutService(db, sender, services.PayoutConfig{
+		MinimumBalance: 500,
+		Fee:            15,
+		ScheduleHour:   18,
+		ResultTimeout:  30 * time.Minute,
+	}, clock)
+
+	createDriver := func(t *testing.T, earningsCents int64) uuid.UUID {
+		driver := models.User{UserType: "driver", FirstName: "Otieno", LastName: "Odhiambo", Email: uuid.NewString() + "@example.com", PhoneNumber: uuid.NewString()[:12], PasswordHash: "hash"}
+		require.NoError(t, db.Create(&driver).Error)
+		_, err := ledger.Post(db, models.JournalRideFare, uuid.NewString(), "",
+			services.Debit(services.MpesaClearing, earningsCents),
+			services.Credit(services.DriverEarnings(driver.ID), earningsCents))
+		require.NoError(t, err)
+		return driver.ID
+	}
+	earnings := func(t *testing.T, driverID uuid.UUID) int64 {
+		cents, err := ledger.Balance(services.DriverEarnings(driverID))
+		require.NoError(t, err)
+		return cents
+	}
+	result := func(payout *models.Payout, code int) *services.MpesaB2CResult {
+		return &services.MpesaB2CResult{ResultCode: code, ResultDesc: "The balance is insufficient", ConversationID: *payout.ConversationID, TransactionID: "RKT1234ABC"}
+	}
+
+	t.Run("PaysOutBalanceLessFee", func(t *testing.T) {
+		driverID := createDriver(t, 123456)
+		payout, err := payouts.RequestPayout(driverID, 0, models.PayoutTriggerOnDemand)
+		require.NoError(t, err)
+		// KES 1234.56 less the KES 15 fee, rounded down to whole shillings
+		assert.Equal(t, int64(121900), payout.AmountCents)
+		assert.Equal(t, 1219, sender.sent[len(sender.sent)-1])
+		assert.Equal(t, int64(56), earnings(t, driverID))
+
+		_, err = payouts.RequestPayout(driverID, 0, models.PayoutTriggerOnDemand)
+		assert.ErrorIs(t, err, services.ErrPayoutInProgress)
+
+		require.NoError(t, payouts.HandleResult(result(payout, 0)))
+		require.NoError(t, db.First(payout, "id = ?", payout.ID).Error)
+		assert.Equal(t, models.PayoutStatusCompleted, payout.Status)
+		assert.Equal(t, "RKT1234ABC", *payout.TransactionID)
+
+		// A late failure for a completed payout changes nothing
+		assert.ErrorIs(t, payouts.HandleResult(result(payout, 1)), services.ErrPayoutSettled)
+		assert.Equal(t, int64(56), earnings(t, driverID))
+		fees, err := ledger.Balance(services.PayoutFees)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1500), fees)
+	})
+
+	t.Run("ChecksBalance", func(t *testing.T) {
+		driverID := createDriver(t, 40000)
+		_, err := payouts.RequestPayout(driverID, 0, models.PayoutTriggerOnDemand)
+		assert.ErrorIs(t, err, services.ErrPayoutBelowMinimum)
+
+		driverID = createDriver(t, 60000)
+		_, err = payouts.RequestPayout(driverID, 59000, models.PayoutTriggerOnDemand)
+		assert.ErrorIs(t, err, services.ErrPayoutInsufficientBalance)
+	})
+
+	t.Run("FailuresAreReversed", func(t *testing.T) {
+		driverID := createDriver(t, 100000)
+		payout, err := payouts.RequestPayout(driverID, 50000, models.PayoutTriggerOnDemand)
+		require.NoError(t, err)
+		assert.Equal(t, int64(48500), earnings(t, driverID))
+
+		require.NoError(t, payouts.HandleResult(result(payout, 1)))
+		assert.Equal(t, int64(100000), earnings(t, driverID))
+		require.NoError(t, db.First(payout, "id = ?", payout.ID).Error)
+		assert.Equal(t, models.PayoutStatusFailed, payout.Status)
+		assert.Equal(t, "The balance is insufficient", payout.FailureReason)
+
+		// Requests M-Pesa rejects straight away are reversed too
+		sender.err = errors.New("connection refused")
+		payout, err = payouts.RequestPayout(driverID, 0, models.PayoutTriggerOnDemand)
+		sender.err = nil
+		require.NoError(t, err)
+		assert.Equal(t, models.PayoutStatusFailed, payout.Status)
+		assert.Equal(t, int64(100000), earnings(t, driverID))
+
+		payout, err = payouts.RequestPayout(driverID, 0, models.PayoutTriggerOnDemand)
+		require.NoError(t, err)
+		require.NoError(t, payouts.HandleTimeout(result(payout, 0)))
+		assert.Equal(t, int64(100000), earnings(t, driverID))
+	})
+
+	t.Run("ReconcilesPayoutsWithoutResult", func(t *testing.T) {
+		driverID := createDriver(t, 80000)
+		payout, err := payouts.RequestPayout(driverID, 0, models.PayoutTriggerOnDemand)
+		require.NoError(t, err)
+
+		_, err = payouts.Resolve(payout.ID, false, nil, "not sent")
+		assert.ErrorIs(t, err, services.ErrPayoutNotResolvable)
+
+		clock.now = clock.now.Add(31 * time.Minute)
+		defer func() { clock.now = clock.now.Add(-31 * time.Minute) }()
+		reconciled, err := payouts.Reconcile()
+		require.NoError(t, err)
+		assert.Equal(t, 1, reconciled)
+
+		resolved, err := payouts.Resolve(payout.ID, false, nil, "Not found on the M-Pesa statement")
+		require.NoError(t, err)
+		assert.Equal(t, models.PayoutStatusFailed, resolved.Status)
+		assert.Equal(t, int64(80000), earnings(t, driverID))
+	})
+
+	t.Run("ScheduledPayouts", func(t *testing.T) {
+		driverID := createDriver(t, 70000)
+
+		// Before the scheduled hour nothing is paid out
+		requested, err := payouts.RunScheduled()
+		require.NoError(t, err)
+		assert.Zero(t, requested)
+
+		clock.now = time.Date(2025, 3, 1, 15, 30, 0, 0, time.UTC)
+		requested, err = payouts.RunScheduled()
+		require.NoError(t, err)
+		// Every driver from the earlier tests with KES 500 or more
+		assert.Equal(t, 4, requested)
+		assert.Less(t, earnings(t, driverID), int64(100))
+
+		// Once a day only, even once the earlier payout is settled
+		var payout models.Payout
+		require.NoError(t, db.First(&payout, "driver_id = ?", driverID).Error)
+		require.NoError(t, payouts.HandleResult(result(&payout, 1)))
+		requested, err = payouts.RunScheduled()
+		require.NoError(t, err)
+		assert.Zero(t, requested)
+	})
+}
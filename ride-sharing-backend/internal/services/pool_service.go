@@ -0,0 +1,368 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrWaypointNotFound      = errors.New("waypoint not found")
+	ErrWaypointAlreadyDone   = errors.New("waypoint has already been completed")
+	ErrWaypointOutOfOrder    = errors.New("earlier waypoints must be completed first")
+	ErrNotPoolRide           = errors.New("ride is not a pooled ride")
+	ErrPoolRequestNotPending = errors.New("only pending pool requests can be matched")
+)
+
+// Rides that can still take on pooled passengers
+var activeRideStatuses = []string{
+	models.RideStatusAccepted,
+	models.RideStatusDriverArriving,
+	models.RideStatusArrived,
+	models.RideStatusInProgress,
+}
+
+type PoolConfig struct {
+	// SeatCapacity is how many passenger seats a pooled ride can fill
+	SeatCapacity int
+	// MaxDetourKm is how far out of its way a pooled ride may go to pick up
+	// and drop off another passenger
+	MaxDetourKm float64
+	// Discount is the fraction taken off a passenger's solo fare
+	Discount float64
+}
+
+// DiscountedFare returns a pooled passenger's fare for a leg that would cost
+// soloFare on a standard ride.
+func (c PoolConfig) DiscountedFare(soloFare float64) float64 {
+	return soloFare * (1 - c.Discount)
+}
+
+// PoolInsertion is where a new passenger's pickup and dropoff go in a pooled
+// ride's remaining route.
+type PoolInsertion struct {
+	// PickupIndex is the position of the pickup in the new route
+	PickupIndex int
+	// DropoffIndex is the position of the dropoff in the new route
+	DropoffIndex int
+	// DetourKm is the extra distance beyond the new passenger's own leg
+	DetourKm float64
+}
+
+// BestInsertion finds the cheapest place to insert a pickup and a later
+// dropoff into the remaining route of a ride whose driver is at start.
+func BestInsertion(start utils.Coordinate, route []utils.Coordinate, pickup, dropoff utils.Coordinate) PoolInsertion {
+	baseDistance := utils.CalculateRouteDistance(append([]utils.Coordinate{start}, route...))
+	legDistance := utils.CalculateDistance(pickup.Latitude, pickup.Longitude, dropoff.Latitude, dropoff.Longitude)
+
+	best := PoolInsertion{DetourKm: -1}
+	for i := 0; i <= len(route); i++ {
+		for j := i; j <= len(route); j++ {
+			candidate := make([]utils.Coordinate, 0, len(route)+3)
+			candidate = append(candidate, start)
+			candidate = append(candidate, route[:i]...)
+			candidate = append(candidate, pickup)
+			candidate = append(candidate, route[i:j]...)
+			candidate = append(candidate, dropoff)
+			candidate = append(candidate, route[j:]...)
+
+			detour := utils.CalculateRouteDistance(candidate) - baseDistance - legDistance
+			if detour < 0 {
+				detour = 0
+			}
+			if best.DetourKm < 0 || detour < best.DetourKm {
+				best = PoolInsertion{PickupIndex: i, DropoffIndex: j + 1, DetourKm: detour}
+			}
+		}
+	}
+	return best
+}
+
+// PoolService matches pool requests onto active pooled rides and keeps each
+// pooled ride's route of pickups and dropoffs.
+type PoolService struct {
+	db        *gorm.DB
+	lifecycle *RideLifecycleService
+	config    PoolConfig
+	// mu serialises matching so two passengers cannot take the last seat
+	mu sync.Mutex
+}
+
+func NewPoolService(db *gorm.DB, lifecycle *RideLifecycleService, config PoolConfig) *PoolService {
+	return &PoolService{
+		db:        db,
+		lifecycle: lifecycle,
+		config:    config,
+	}
+}
+
+// Config returns the pooling configuration
+func (s *PoolService) Config() PoolConfig {
+	return s.config
+}
+
+// CreateInitialWaypoints adds the first passenger's pickup and dropoff to a
+// newly created pooled ride within tx.
+func (s *PoolService) CreateInitialWaypoints(tx *gorm.DB, ride *models.Ride, rideRequest *models.RideRequest) error {
+	waypoints := []models.RideWaypoint{
+		requestWaypoint(ride.ID, rideRequest, models.WaypointPickup, 1),
+		requestWaypoint(ride.ID, rideRequest, models.WaypointDropoff, 2),
+	}
+	return tx.Create(&waypoints).Error
+}
+
+// MatchRequest adds a pending pool request to the active pooled ride where it
+// causes the smallest detour. It returns nil when no ride has a free seat
+// within the detour limit, in which case the request is dispatched normally.
+func (s *PoolService) MatchRequest(rideRequest *models.RideRequest) (*models.Ride, error) {
+	if rideRequest.RideType != models.RideTypePool || rideRequest.Status != models.RideRequestStatusPending {
+		return nil, ErrPoolRequestNotPending
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rides []models.Ride
+	if err := s.db.Where("ride_type = ? AND vehicle_category = ? AND status IN ?", models.RideTypePool, rideRequest.VehicleCategory, activeRideStatuses).Find(&rides).Error; err != nil {
+		return nil, err
+	}
+
+	pickup := utils.Coordinate{Latitude: rideRequest.PickupLatitude, Longitude: rideRequest.PickupLongitude}
+	dropoff := utils.Coordinate{Latitude: rideRequest.DropoffLatitude, Longitude: rideRequest.DropoffLongitude}
+
+	var bestRide *models.Ride
+	var bestRoute []models.RideWaypoint
+	var bestInsertion PoolInsertion
+	for i := range rides {
+		seatsTaken, err := s.seatsTaken(rides[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		if seatsTaken+rideRequest.Seats > s.config.SeatCapacity {
+			continue
+		}
+
+		pending, err := s.pendingWaypoints(rides[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		start, ok, err := s.routeStart(&rides[i], pending)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		route := make([]utils.Coordinate, 0, len(pending))
+		for _, waypoint := range pending {
+			route = append(route, utils.Coordinate{Latitude: waypoint.Latitude, Longitude: waypoint.Longitude})
+		}
+
+		insertion := BestInsertion(start, route, pickup, dropoff)
+		if insertion.DetourKm > s.config.MaxDetourKm {
+			continue
+		}
+		if bestRide == nil || insertion.DetourKm < bestInsertion.DetourKm {
+			bestRide = &rides[i]
+			bestRoute = pending
+			bestInsertion = insertion
+		}
+	}
+	if bestRide == nil {
+		return nil, nil
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		rideID := bestRide.ID
+		if err := s.lifecycle.TransitionRideRequest(tx, rideRequest, Transition{
+			To:      models.RideRequestStatusAccepted,
+			Note:    "matched to pooled ride",
+			Updates: map[string]interface{}{"ride_id": rideID},
+		}); err != nil {
+			return err
+		}
+		rideRequest.RideID = &rideID
+
+		// The request no longer needs a driver of its own
+		if err := tx.Model(&models.RideOffer{}).
+			Where("request_id = ? AND status = ?", rideRequest.ID, models.RideOfferStatusOffered).
+			Updates(map[string]interface{}{"status": models.RideOfferStatusExpired, "responded_at": time.Now()}).Error; err != nil {
+			return err
+		}
+
+		if err := s.insertWaypoints(tx, bestRide.ID, rideRequest, bestRoute, bestInsertion); err != nil {
+			return err
+		}
+
+		return s.lifecycle.RecordEvent(tx, &models.RideEvent{
+			RequestID: bestRide.RequestID,
+			RideID:    &rideID,
+			EventType: models.RideEventPoolJoined,
+			Entity:    "ride",
+			ActorID:   &rideRequest.PassengerID,
+			Note:      rideRequest.PickupAddress,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bestRide, nil
+}
+
+// insertWaypoints rewrites the sequence numbers of the ride's pending
+// waypoints with the new pickup and dropoff inserted.
+func (s *PoolService) insertWaypoints(tx *gorm.DB, rideID uuid.UUID, rideRequest *models.RideRequest, pending []models.RideWaypoint, insertion PoolInsertion) error {
+	var lastDone int
+	if err := tx.Model(&models.RideWaypoint{}).
+		Where("ride_id = ? AND completed_at IS NOT NULL", rideID).
+		Select("COALESCE(MAX(sequence), 0)").Scan(&lastDone).Error; err != nil {
+		return err
+	}
+
+	route := make([]models.RideWaypoint, 0, len(pending)+2)
+	route = append(route, pending[:insertion.PickupIndex]...)
+	route = append(route, requestWaypoint(rideID, rideRequest, models.WaypointPickup, 0))
+	route = append(route, pending[insertion.PickupIndex:insertion.DropoffIndex-1]...)
+	route = append(route, requestWaypoint(rideID, rideRequest, models.WaypointDropoff, 0))
+	route = append(route, pending[insertion.DropoffIndex-1:]...)
+
+	for i := range route {
+		route[i].Sequence = lastDone + i + 1
+		if route[i].ID == uuid.Nil {
+			if err := tx.Create(&route[i]).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if err := tx.Model(&models.RideWaypoint{}).Where("id = ?", route[i].ID).Update("sequence", route[i].Sequence).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seatsTaken returns the seats booked by passengers still on the ride
+func (s *PoolService) seatsTaken(rideID uuid.UUID) (int, error) {
+	var seats int
+	err := s.db.Model(&models.RideRequest{}).
+		Where("ride_id = ? AND status = ?", rideID, models.RideRequestStatusAccepted).
+		Select("COALESCE(SUM(seats), 0)").Scan(&seats).Error
+	return seats, err
+}
+
+// routeStart is where the remaining route begins: the driver's last known
+// location, or the next waypoint if the driver has not reported one.
+func (s *PoolService) routeStart(ride *models.Ride, pending []models.RideWaypoint) (utils.Coordinate, bool, error) {
+	var driver models.Driver
+	if err := s.db.Where("driver_id = ?", ride.DriverID).First(&driver).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return utils.Coordinate{}, false, err
+	}
+	if driver.CurrentLatitude != nil && driver.CurrentLongitude != nil {
+		return utils.Coordinate{Latitude: *driver.CurrentLatitude, Longitude: *driver.CurrentLongitude}, true, nil
+	}
+	if len(pending) > 0 {
+		return utils.Coordinate{Latitude: pending[0].Latitude, Longitude: pending[0].Longitude}, true, nil
+	}
+	return utils.Coordinate{}, false, nil
+}
+
+func (s *PoolService) pendingWaypoints(rideID uuid.UUID) ([]models.RideWaypoint, error) {
+	var waypoints []models.RideWaypoint
+	err := s.db.Where("ride_id = ? AND completed_at IS NULL", rideID).Order("sequence ASC").Find(&waypoints).Error
+	return waypoints, err
+}
+
+// GetWaypoints returns a pooled ride's waypoints in visiting order
+func (s *PoolService) GetWaypoints(rideID uuid.UUID) ([]models.RideWaypoint, error) {
+	var waypoints []models.RideWaypoint
+	err := s.db.Where("ride_id = ?", rideID).Order("sequence ASC").Find(&waypoints).Error
+	return waypoints, err
+}
+
+// CompleteWaypoint marks the next pickup or dropoff on a pooled ride as done
+// and records it on the timeline.
+func (s *PoolService) CompleteWaypoint(ride *models.Ride, sequence int, actorID uuid.UUID) (*models.RideWaypoint, error) {
+	if ride.RideType != models.RideTypePool {
+		return nil, ErrNotPoolRide
+	}
+
+	var waypoint models.RideWaypoint
+	if err := s.db.Where("ride_id = ? AND sequence = ?", ride.ID, sequence).First(&waypoint).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrWaypointNotFound
+		}
+		return nil, err
+	}
+	if waypoint.CompletedAt != nil {
+		return nil, ErrWaypointAlreadyDone
+	}
+
+	var earlierPending int64
+	if err := s.db.Model(&models.RideWaypoint{}).
+		Where("ride_id = ? AND sequence < ? AND completed_at IS NULL", ride.ID, sequence).
+		Count(&earlierPending).Error; err != nil {
+		return nil, err
+	}
+	if earlierPending > 0 {
+		return nil, ErrWaypointOutOfOrder
+	}
+
+	now := time.Now()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.RideWaypoint{}).Where("id = ? AND completed_at IS NULL", waypoint.ID).Update("completed_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrWaypointAlreadyDone
+		}
+
+		rideID := ride.ID
+		return s.lifecycle.RecordEvent(tx, &models.RideEvent{
+			RequestID: waypoint.RequestID,
+			RideID:    &rideID,
+			EventType: models.RideEventWaypointDone,
+			Entity:    "ride",
+			ActorID:   &actorID,
+			Note:      waypoint.Kind + " " + waypoint.Address,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	waypoint.CompletedAt = &now
+	return &waypoint, nil
+}
+
+// removeWaypoints drops a passenger's outstanding waypoints from a pooled
+// ride within tx, for example when they cancel.
+func removeWaypoints(tx *gorm.DB, rideID, requestID uuid.UUID) error {
+	return tx.Where("ride_id = ? AND request_id = ? AND completed_at IS NULL", rideID, requestID).Delete(&models.RideWaypoint{}).Error
+}
+
+func requestWaypoint(rideID uuid.UUID, rideRequest *models.RideRequest, kind string, sequence int) models.RideWaypoint {
+	waypoint := models.RideWaypoint{
+		RideID:    rideID,
+		RequestID: rideRequest.ID,
+		Sequence:  sequence,
+		Kind:      kind,
+		Latitude:  rideRequest.PickupLatitude,
+		Longitude: rideRequest.PickupLongitude,
+		Address:   rideRequest.PickupAddress,
+	}
+	if kind == models.WaypointDropoff {
+		waypoint.Latitude = rideRequest.DropoffLatitude
+		waypoint.Longitude = rideRequest.DropoffLongitude
+		waypoint.Address = rideRequest.DropoffAddress
+	}
+	return waypoint
+}
@@ -0,0 +1,113 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBestInsertion(t *testing.T) {
+	// A ride heading east along a straight road
+	start := utils.Coordinate{Latitude: -1.30, Longitude: 36.80}
+	route := []utils.Coordinate{{Latitude: -1.30, Longitude: 36.82}, {Latitude: -1.30, Longitude: 36.86}}
+
+	// A passenger going from just after the pickup to just before the dropoff
+	// fits in between with no detour
+	insertion := services.BestInsertion(start, route, utils.Coordinate{Latitude: -1.30, Longitude: 36.83}, utils.Coordinate{Latitude: -1.30, Longitude: 36.85})
+	assert.Equal(t, 1, insertion.PickupIndex)
+	assert.Equal(t, 2, insertion.DropoffIndex)
+	assert.InDelta(t, 0, insertion.DetourKm, 0.01)
+
+	// One heading north costs a detour
+	insertion = services.BestInsertion(start, route, utils.Coordinate{Latitude: -1.30, Longitude: 36.81}, utils.Coordinate{Latitude: -1.25, Longitude: 36.81})
+	assert.Greater(t, insertion.DetourKm, 1.0)
+}
+
+func TestPoolMatching(t *testing.T) {
+	db := setupTestDB()
+	lifecycle := services.NewRideLifecycleService(db)
+	pool := services.NewPoolService(db, lifecycle, services.PoolConfig{SeatCapacity: 2, MaxDetourKm: 1, Discount: 0.25})
+	cancellations := services.NewCancellationService(db, lifecycle, services.CancellationPolicy{FreeWindow: time.Minute, PassengerFee: 100}, services.SystemClock{})
+
+	assert.Equal(t, 75.0, pool.Config().DiscountedFare(100))
+
+	lat, lon := -1.30, 36.80
+	driver := models.Driver{DriverID: uuid.New(), LicensePlate: "KDB 100P", DriverLicenseNumber: "DL100", CurrentLatitude: &lat, CurrentLongitude: &lon}
+	require.NoError(t, db.Create(&driver).Error)
+
+	poolRequest := func(pickupLon, dropoffLat, dropoffLon float64) *models.RideRequest {
+		rideRequest := &models.RideRequest{
+			PassengerID:      uuid.New(),
+			PickupLatitude:   -1.30,
+			PickupLongitude:  pickupLon,
+			DropoffLatitude:  dropoffLat,
+			DropoffLongitude: dropoffLon,
+			Status:           models.RideRequestStatusPending,
+			RideType:         models.RideTypePool,
+			Seats:            1,
+		}
+		require.NoError(t, db.Create(rideRequest).Error)
+		return rideRequest
+	}
+
+	// The first passenger's ride is already on its way east
+	first := poolRequest(36.82, -1.30, 36.86)
+	ride := models.Ride{RequestID: first.ID, DriverID: driver.DriverID, PassengerID: first.PassengerID, RideType: models.RideTypePool, Status: models.RideStatusInProgress}
+	require.NoError(t, db.Create(&ride).Error)
+	require.NoError(t, db.Model(first).Updates(map[string]interface{}{"status": models.RideRequestStatusAccepted, "ride_id": ride.ID}).Error)
+	require.NoError(t, pool.CreateInitialWaypoints(db, &ride, first))
+
+	// Too far out of the way
+	northbound := poolRequest(36.81, -1.25, 36.81)
+	matched, err := pool.MatchRequest(northbound)
+	require.NoError(t, err)
+	assert.Nil(t, matched)
+
+	// On the way, so it is slotted in between
+	onTheWay := poolRequest(36.83, -1.30, 36.85)
+	matched, err = pool.MatchRequest(onTheWay)
+	require.NoError(t, err)
+	require.NotNil(t, matched)
+	assert.Equal(t, ride.ID, matched.ID)
+	assert.Equal(t, models.RideRequestStatusAccepted, onTheWay.Status)
+
+	waypoints, err := pool.GetWaypoints(ride.ID)
+	require.NoError(t, err)
+	require.Len(t, waypoints, 4)
+	order := []uuid.UUID{first.ID, onTheWay.ID, onTheWay.ID, first.ID}
+	for i, waypoint := range waypoints {
+		assert.Equal(t, i+1, waypoint.Sequence)
+		assert.Equal(t, order[i], waypoint.RequestID)
+	}
+
+	// The ride is now full
+	full := poolRequest(36.83, -1.30, 36.85)
+	matched, err = pool.MatchRequest(full)
+	require.NoError(t, err)
+	assert.Nil(t, matched)
+
+	// Waypoints are completed in order
+	_, err = pool.CompleteWaypoint(&ride, 2, driver.DriverID)
+	assert.ErrorIs(t, err, services.ErrWaypointOutOfOrder)
+	_, err = pool.CompleteWaypoint(&ride, 1, driver.DriverID)
+	require.NoError(t, err)
+
+	// The second passenger can still leave before pickup without ending the ride
+	cancellation, err := cancellations.CancelRide(&ride, services.CancellationRequest{ActorID: onTheWay.PassengerID, ReasonCode: "change_of_plans"})
+	require.NoError(t, err)
+	assert.Equal(t, onTheWay.ID, cancellation.RequestID)
+	assert.Zero(t, cancellation.FeeAmount)
+
+	require.NoError(t, db.First(&ride, "id = ?", ride.ID).Error)
+	assert.Equal(t, models.RideStatusInProgress, ride.Status)
+	waypoints, err = pool.GetWaypoints(ride.ID)
+	require.NoError(t, err)
+	assert.Len(t, waypoints, 2)
+}
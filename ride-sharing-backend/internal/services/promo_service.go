@@ -0,0 +1,251 @@
+package services
+
+import (
+	"errors"
+	"math"
+	"strings"
+
+	"kenyan-ride-share-backend/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrPromoNotFound      = errors.New("promo code not found")
+	ErrPromoExists        = errors.New("promo code already exists")
+	ErrPromoInactive      = errors.New("promo code is not active")
+	ErrPromoNotValidNow   = errors.New("promo code is not valid at this time")
+	ErrPromoExhausted     = errors.New("promo code has reached its usage limit")
+	ErrPromoUserLimit     = errors.New("promo code has already been used the maximum number of times")
+	ErrPromoFirstRideOnly = errors.New("promo code is only valid on a first ride")
+	ErrPromoCategory      = errors.New("promo code is not valid for this vehicle category")
+	ErrPromoNotOwner      = errors.New("promo code belongs to another passenger")
+)
+
+// PromoService validates promo codes and tracks their redemptions. A code is
+// reserved when a ride request uses it and given back if the request is
+// cancelled or expires.
+type PromoService struct {
+	db    *gorm.DB
+	clock Clock
+}
+
+func NewPromoService(db *gorm.DB, clock Clock) *PromoService {
+	return &PromoService{
+		db:    db,
+		clock: clock,
+	}
+}
+
+// NormalizePromoCode returns a code the way it is stored
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Get returns a promo code by its code, in any case
+func (s *PromoService) Get(code string) (*models.PromoCode, error) {
+	return s.find("code = ?", NormalizePromoCode(code))
+}
+
+// GetByID returns a promo code by ID
+func (s *PromoService) GetByID(id uuid.UUID) (*models.PromoCode, error) {
+	return s.find("id = ?", id)
+}
+
+func (s *PromoService) find(query string, arg interface{}) (*models.PromoCode, error) {
+	var promo models.PromoCode
+	if err := s.db.Where(query, arg).First(&promo).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPromoNotFound
+		}
+		return nil, err
+	}
+	return &promo, nil
+}
+
+// List returns every promo code, newest first
+func (s *PromoService) List() ([]models.PromoCode, error) {
+	var promos []models.PromoCode
+	err := s.db.Order("created_at DESC").Find(&promos).Error
+	return promos, err
+}
+
+// Create adds a new promo code
+func (s *PromoService) Create(promo *models.PromoCode) error {
+	promo.Code = NormalizePromoCode(promo.Code)
+	if _, err := s.Get(promo.Code); err == nil {
+		return ErrPromoExists
+	} else if !errors.Is(err, ErrPromoNotFound) {
+		return err
+	}
+	return s.db.Create(promo).Error
+}
+
+// Update changes the given columns of a promo code
+func (s *PromoService) Update(id uuid.UUID, updates map[string]interface{}) (*models.PromoCode, error) {
+	promo, err := s.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(promo).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	return s.GetByID(id)
+}
+
+// Check returns a promo code the passenger can use on a ride in the given
+// vehicle category. An empty category skips the category rule, for quotes
+// that price every category.
+func (s *PromoService) Check(code string, passengerID uuid.UUID, vehicleCategory string) (*models.PromoCode, error) {
+	promo, err := s.Get(code)
+	if err != nil {
+		return nil, err
+	}
+	return promo, s.check(promo, passengerID, vehicleCategory)
+}
+
+// CheckByID is Check for a promo code already applied to a quote
+func (s *PromoService) CheckByID(id, passengerID uuid.UUID, vehicleCategory string) (*models.PromoCode, error) {
+	promo, err := s.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	return promo, s.check(promo, passengerID, vehicleCategory)
+}
+
+func (s *PromoService) check(promo *models.PromoCode, passengerID uuid.UUID, vehicleCategory string) error {
+	if !promo.IsActive {
+		return ErrPromoInactive
+	}
+	if promo.OwnerID != nil && *promo.OwnerID != passengerID {
+		return ErrPromoNotOwner
+	}
+	now := s.clock.Now()
+	if (promo.ValidFrom != nil && now.Before(*promo.ValidFrom)) || (promo.ValidUntil != nil && !now.Before(*promo.ValidUntil)) {
+		return ErrPromoNotValidNow
+	}
+	if vehicleCategory != "" && !PromoAllowsCategory(promo, vehicleCategory) {
+		return ErrPromoCategory
+	}
+	if promo.UsageLimit != nil && promo.UsedCount >= *promo.UsageLimit {
+		return ErrPromoExhausted
+	}
+	return checkPassengerPromoUse(s.db, promo, passengerID)
+}
+
+// checkPassengerPromoUse applies the per-passenger limit and the first ride
+// rule
+func checkPassengerPromoUse(db *gorm.DB, promo *models.PromoCode, passengerID uuid.UUID) error {
+	if promo.PerUserLimit > 0 {
+		var used int64
+		if err := db.Model(&models.PromoRedemption{}).
+			Where("promo_code_id = ? AND passenger_id = ? AND status <> ?", promo.ID, passengerID, models.PromoRedemptionReleased).
+			Count(&used).Error; err != nil {
+			return err
+		}
+		if used >= int64(promo.PerUserLimit) {
+			return ErrPromoUserLimit
+		}
+	}
+	if promo.FirstRideOnly {
+		var completed int64
+		if err := db.Model(&models.RideRequest{}).
+			Where("passenger_id = ? AND status = ?", passengerID, models.RideRequestStatusCompleted).
+			Count(&completed).Error; err != nil {
+			return err
+		}
+		if completed > 0 {
+			return ErrPromoFirstRideOnly
+		}
+	}
+	return nil
+}
+
+// Reserve uses a promo code for a ride request within tx. The usage limits
+// are checked again here since they may have been reached after Check.
+func (s *PromoService) Reserve(tx *gorm.DB, promo *models.PromoCode, passengerID, requestID uuid.UUID) error {
+	// Counting the use in the same statement that checks the global limit
+	// means concurrent requests cannot take the last use twice. The update
+	// also locks the promo row until tx ends, so the per-passenger checks
+	// below see every other redemption of the code.
+	result := tx.Model(&models.PromoCode{}).
+		Where("id = ? AND (usage_limit IS NULL OR used_count < usage_limit)", promo.ID).
+		Update("used_count", gorm.Expr("used_count + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrPromoExhausted
+	}
+
+	if err := checkPassengerPromoUse(tx, promo, passengerID); err != nil {
+		return err
+	}
+
+	redemption := models.PromoRedemption{
+		PromoCodeID: promo.ID,
+		PassengerID: passengerID,
+		RequestID:   requestID,
+		Status:      models.PromoRedemptionReserved,
+	}
+	return tx.Create(&redemption).Error
+}
+
+// Apply records the discount a request's promo gave on the completed ride
+func (s *PromoService) Apply(tx *gorm.DB, requestID uuid.UUID, discount float64) error {
+	return tx.Model(&models.PromoRedemption{}).
+		Where("request_id = ? AND status = ?", requestID, models.PromoRedemptionReserved).
+		Updates(map[string]interface{}{"status": models.PromoRedemptionApplied, "discount": discount}).Error
+}
+
+// releasePromoRedemption gives back the use of a promo reserved by a
+// request that will not be completed
+func releasePromoRedemption(tx *gorm.DB, requestID uuid.UUID) error {
+	var redemption models.PromoRedemption
+	if err := tx.Where("request_id = ? AND status = ?", requestID, models.PromoRedemptionReserved).First(&redemption).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	result := tx.Model(&models.PromoRedemption{}).
+		Where("id = ? AND status = ?", redemption.ID, models.PromoRedemptionReserved).
+		Update("status", models.PromoRedemptionReleased)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	return tx.Model(&models.PromoCode{}).Where("id = ? AND used_count > 0", redemption.PromoCodeID).
+		Update("used_count", gorm.Expr("used_count - 1")).Error
+}
+
+// PromoAllowsCategory reports whether a promo code can be used on a ride in
+// the given vehicle category
+func PromoAllowsCategory(promo *models.PromoCode, vehicleCategory string) bool {
+	if promo.VehicleCategories == "" {
+		return true
+	}
+	for _, code := range strings.Split(promo.VehicleCategories, ",") {
+		if strings.TrimSpace(code) == vehicleCategory {
+			return true
+		}
+	}
+	return false
+}
+
+// PromoDiscount returns the amount a promo code takes off a fare. It never
+// exceeds the fare.
+func PromoDiscount(promo *models.PromoCode, fare float64) float64 {
+	var discount float64
+	switch promo.DiscountType {
+	case models.PromoDiscountPercentage:
+		discount = fare * promo.DiscountValue / 100
+		if promo.MaxDiscount != nil {
+			discount = math.Min(discount, *promo.MaxDiscount)
+		}
+	case models.PromoDiscountFlat:
+		discount = promo.DiscountValue
+	}
+	return roundAmount(math.Max(math.Min(discount, fare), 0))
+}
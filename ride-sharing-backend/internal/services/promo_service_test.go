@@ -0,0 +1,151 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestPromoDiscount(t *testing.T) {
+	maxDiscount := 100.0
+	percentage := &models.PromoCode{DiscountType: models.PromoDiscountPercentage, DiscountValue: 20, MaxDiscount: &maxDiscount}
+	assert.Equal(t, 60.0, services.PromoDiscount(percentage, 300))
+	assert.Equal(t, 100.0, services.PromoDiscount(percentage, 1000))
+
+	flat := &models.PromoCode{DiscountType: models.PromoDiscountFlat, DiscountValue: 150}
+	assert.Equal(t, 150.0, services.PromoDiscount(flat, 400))
+	assert.Equal(t, 120.0, services.PromoDiscount(flat, 120))
+
+	restricted := &models.PromoCode{VehicleCategories: "boda_boda,tuk_tuk"}
+	assert.True(t, services.PromoAllowsCategory(restricted, models.VehicleCategoryTukTuk))
+	assert.False(t, services.PromoAllowsCategory(restricted, models.VehicleCategoryEconomy))
+
+	// The promo comes off the trip fare, not the waiting charge
+	breakdown := services.CalculateFinalFare(services.FareInput{DistanceKm: 10, DurationMinutes: 20, Promo: flat, WaitingCharge: 30})
+	assert.Equal(t, 150.0, breakdown.PromoDiscount)
+	assert.Equal(t, 50.0+250+40-150+30, breakdown.Total)
+}
+
+func TestPromoService(t *testing.T) {
+	db := setupTestDB()
+	now := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	promos := services.NewPromoService(db, &fakeClock{now: now})
+	lifecycle := services.NewRideLifecycleService(db)
+
+	createPromo := func(t *testing.T, promo models.PromoCode) *models.PromoCode {
+		promo.Code = uuid.NewString()[:8]
+		if promo.DiscountType == "" {
+			promo.DiscountType = models.PromoDiscountFlat
+			promo.DiscountValue = 50
+		}
+		promo.IsActive = true
+		require.NoError(t, promos.Create(&promo))
+		return &promo
+	}
+	redeem := func(t *testing.T, promo *models.PromoCode, passengerID uuid.UUID) (*models.RideRequest, error) {
+		rideRequest := models.RideRequest{PassengerID: passengerID, Status: models.RideRequestStatusPending}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&rideRequest).Error; err != nil {
+				return err
+			}
+			return promos.Reserve(tx, promo, passengerID, rideRequest.ID)
+		})
+		return &rideRequest, err
+	}
+
+	t.Run("CodesAreCaseInsensitive", func(t *testing.T) {
+		promo := models.PromoCode{Code: "karibu25", DiscountType: models.PromoDiscountPercentage, DiscountValue: 25, PerUserLimit: 1, IsActive: true}
+		require.NoError(t, promos.Create(&promo))
+		assert.Equal(t, "KARIBU25", promo.Code)
+
+		found, err := promos.Check(" Karibu25 ", uuid.New(), models.VehicleCategoryEconomy)
+		require.NoError(t, err)
+		assert.Equal(t, promo.ID, found.ID)
+		assert.ErrorIs(t, promos.Create(&models.PromoCode{Code: "KARIBU25", DiscountType: models.PromoDiscountFlat, DiscountValue: 10}), services.ErrPromoExists)
+	})
+
+	t.Run("ValidityRules", func(t *testing.T) {
+		passengerID := uuid.New()
+		later := now.Add(time.Hour)
+		notStarted := createPromo(t, models.PromoCode{ValidFrom: &later})
+		_, err := promos.Check(notStarted.Code, passengerID, "")
+		assert.ErrorIs(t, err, services.ErrPromoNotValidNow)
+
+		restricted := createPromo(t, models.PromoCode{VehicleCategories: models.VehicleCategoryBodaBoda})
+		_, err = promos.Check(restricted.Code, passengerID, models.VehicleCategoryComfort)
+		assert.ErrorIs(t, err, services.ErrPromoCategory)
+
+		inactive := createPromo(t, models.PromoCode{})
+		_, err = promos.Update(inactive.ID, map[string]interface{}{"is_active": false})
+		require.NoError(t, err)
+		_, err = promos.Check(inactive.Code, passengerID, "")
+		assert.ErrorIs(t, err, services.ErrPromoInactive)
+
+		firstRide := createPromo(t, models.PromoCode{FirstRideOnly: true})
+		require.NoError(t, db.Create(&models.RideRequest{PassengerID: passengerID, Status: models.RideRequestStatusCompleted}).Error)
+		_, err = promos.Check(firstRide.Code, passengerID, "")
+		assert.ErrorIs(t, err, services.ErrPromoFirstRideOnly)
+		_, err = promos.Check(firstRide.Code, uuid.New(), "")
+		assert.NoError(t, err)
+	})
+
+	t.Run("UsageLimits", func(t *testing.T) {
+		limit := 2
+		promo := createPromo(t, models.PromoCode{UsageLimit: &limit, PerUserLimit: 1})
+		first, second := uuid.New(), uuid.New()
+
+		_, err := redeem(t, promo, first)
+		require.NoError(t, err)
+		// A passenger cannot use the code twice, even with a stale check
+		_, err = redeem(t, promo, first)
+		assert.ErrorIs(t, err, services.ErrPromoUserLimit)
+
+		_, err = redeem(t, promo, second)
+		require.NoError(t, err)
+		_, err = redeem(t, promo, uuid.New())
+		assert.ErrorIs(t, err, services.ErrPromoExhausted)
+
+		stored, err := promos.GetByID(promo.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 2, stored.UsedCount)
+	})
+
+	t.Run("CancelledRequestGivesUseBack", func(t *testing.T) {
+		limit := 1
+		promo := createPromo(t, models.PromoCode{UsageLimit: &limit})
+		passengerID := uuid.New()
+		rideRequest, err := redeem(t, promo, passengerID)
+		require.NoError(t, err)
+
+		require.NoError(t, db.Transaction(func(tx *gorm.DB) error {
+			return lifecycle.TransitionRideRequest(tx, rideRequest, services.Transition{To: models.RideRequestStatusCancelled})
+		}))
+
+		var redemption models.PromoRedemption
+		require.NoError(t, db.First(&redemption, "request_id = ?", rideRequest.ID).Error)
+		assert.Equal(t, models.PromoRedemptionReleased, redemption.Status)
+		_, err = promos.Check(promo.Code, passengerID, "")
+		assert.NoError(t, err)
+		_, err = redeem(t, promo, passengerID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("CompletedRideRecordsDiscount", func(t *testing.T) {
+		promo := createPromo(t, models.PromoCode{})
+		rideRequest, err := redeem(t, promo, uuid.New())
+		require.NoError(t, err)
+
+		require.NoError(t, promos.Apply(db, rideRequest.ID, 50))
+		var redemption models.PromoRedemption
+		require.NoError(t, db.First(&redemption, "request_id = ?", rideRequest.ID).Error)
+		assert.Equal(t, models.PromoRedemptionApplied, redemption.Status)
+		assert.Equal(t, 50.0, redemption.Discount)
+	})
+}
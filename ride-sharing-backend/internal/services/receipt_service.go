@@ -0,0 +1,122 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrRideNotCompleted = errors.New("receipt is only available once the ride is completed")
+
+// Receipt summarises a completed ride for the passenger
+type Receipt struct {
+	RideID          uuid.UUID             `json:"ride_id"`
+	RequestID       uuid.UUID             `json:"request_id"`
+	PassengerID     uuid.UUID             `json:"passenger_id"`
+	DriverID        uuid.UUID             `json:"driver_id"`
+	PickupAddress   string                `json:"pickup_address"`
+	DropoffAddress  string                `json:"dropoff_address"`
+	Stops           []models.RideStop     `json:"stops"`
+	StartTime       *time.Time            `json:"start_time"`
+	EndTime         *time.Time            `json:"end_time"`
+	DistanceKm      *float64              `json:"distance_km"`
+	DurationMinutes *int                  `json:"duration_minutes"`
+	WaitingCharge   float64               `json:"waiting_charge"`
+	Fare            *float64              `json:"fare"`
+	FareBreakdown   *models.FareBreakdown `json:"fare_breakdown"`
+	Currency        string                `json:"currency"`
+	PaymentMethod   string                `json:"payment_method,omitempty"`
+	PaymentStatus   string                `json:"payment_status,omitempty"`
+}
+
+type ReceiptService struct {
+	db *gorm.DB
+}
+
+func NewReceiptService(db *gorm.DB) *ReceiptService {
+	return &ReceiptService{db: db}
+}
+
+// GetReceipt builds a passenger's receipt for a completed ride. On a pooled
+// ride each passenger has their own route and fare.
+func (s *ReceiptService) GetReceipt(ride *models.Ride, passengerID uuid.UUID) (*Receipt, error) {
+	if ride.Status != models.RideStatusCompleted {
+		return nil, ErrRideNotCompleted
+	}
+
+	var rideRequest models.RideRequest
+	if err := s.db.Preload("Stops", func(db *gorm.DB) *gorm.DB {
+		return db.Order("sequence ASC")
+	}).Where("passenger_id = ?", passengerID).
+		Where("ride_id = ? OR id = ?", ride.ID, ride.RequestID).
+		First(&rideRequest).Error; err != nil {
+		return nil, err
+	}
+
+	receipt := &Receipt{
+		RideID:          ride.ID,
+		RequestID:       ride.RequestID,
+		PassengerID:     rideRequest.PassengerID,
+		DriverID:        ride.DriverID,
+		PickupAddress:   rideRequest.PickupAddress,
+		DropoffAddress:  rideRequest.DropoffAddress,
+		Stops:           rideRequest.Stops,
+		StartTime:       ride.StartTime,
+		EndTime:         ride.EndTime,
+		DistanceKm:      ride.ActualDistanceKm,
+		DurationMinutes: ride.ActualDurationMinutes,
+		Fare:            ride.ActualFare,
+		Currency:        "KES",
+	}
+	// Waiting at the first pickup is charged to the booking passenger
+	if rideRequest.ID == ride.RequestID {
+		receipt.WaitingCharge = ride.WaitingCharge
+	}
+	if ride.RideType == models.RideTypePool {
+		fare := rideRequest.EstimatedFare
+		if rideRequest.LockedFare != nil {
+			fare = rideRequest.LockedFare
+		}
+		if fare != nil {
+			total := *fare + receipt.WaitingCharge
+			receipt.Fare = &total
+		}
+		receipt.RequestID = rideRequest.ID
+		receipt.DistanceKm = rideRequest.EstimatedDistanceKm
+	}
+
+	// Rides completed since fares are itemised carry a stored breakdown
+	var breakdown models.FareBreakdown
+	err := s.db.Where("ride_id = ? AND request_id = ?", ride.ID, rideRequest.ID).First(&breakdown).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		receipt.FareBreakdown = &breakdown
+		receipt.Fare = &breakdown.Total
+		receipt.WaitingCharge = breakdown.WaitingCharge
+		if ride.RideType == models.RideTypePool {
+			receipt.DistanceKm = &breakdown.DistanceKm
+		}
+	}
+	if receipt.Stops == nil {
+		receipt.Stops = []models.RideStop{}
+	}
+
+	var payment models.Payment
+	err = s.db.Where("ride_id = ? AND (passenger_id = ? OR passenger_id IS NULL)", ride.ID, rideRequest.PassengerID).First(&payment).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		receipt.Currency = payment.Currency
+		receipt.PaymentMethod = payment.PaymentMethod
+		receipt.PaymentStatus = payment.PaymentStatus
+	}
+
+	return receipt, nil
+}
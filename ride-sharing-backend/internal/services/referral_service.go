@@ -0,0 +1,329 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrReferralCodeNotFound = errors.New("referral code not found")
+	ErrReferralCodeTaken    = errors.New("could not generate a unique referral code")
+)
+
+// codeAlphabet leaves out characters that are easily mistaken for each
+// other, such as 0 and O or 1 and I
+const codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// ReferralConfig controls when referrals qualify and what they pay
+type ReferralConfig struct {
+	// RequiredRides is how many rides the referee must complete
+	RequiredRides  int
+	ReferrerReward float64
+	RefereeReward  float64
+	// RewardValidity is how long a reward promo code can be used
+	RewardValidity time.Duration
+}
+
+// ReferralStats summarises the referrals a user has made
+type ReferralStats struct {
+	ReferralCode  string            `json:"referral_code"`
+	Referred      int               `json:"referred"`
+	Pending       int               `json:"pending"`
+	Qualified     int               `json:"qualified"`
+	Rejected      int               `json:"rejected"`
+	RewardsEarned float64           `json:"rewards_earned"`
+	RequiredRides int               `json:"required_rides"`
+	Referrals     []models.Referral `json:"referrals"`
+}
+
+// ReferralService gives users referral codes and rewards both sides once a
+// referred user has completed enough rides.
+type ReferralService struct {
+	db     *gorm.DB
+	ledger *LedgerService
+	config ReferralConfig
+	clock  Clock
+}
+
+func NewReferralService(db *gorm.DB, config ReferralConfig, clock Clock) *ReferralService {
+	return &ReferralService{
+		db:     db,
+		ledger: NewLedgerService(db, clock),
+		config: config,
+		clock:  clock,
+	}
+}
+
+// randomCode returns n random characters of codeAlphabet
+func randomCode(n int) (string, error) {
+	code := make([]byte, n)
+	for i := range code {
+		index, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = codeAlphabet[index.Int64()]
+	}
+	return string(code), nil
+}
+
+// AssignCode gives a new user a unique referral code made of the start of
+// their first name and random characters, e.g. WANJ7K2P
+func (s *ReferralService) AssignCode(user *models.User) error {
+	prefix := ""
+	for _, char := range strings.ToUpper(user.FirstName) {
+		if char >= 'A' && char <= 'Z' && len(prefix) < 4 {
+			prefix += string(char)
+		}
+	}
+	if prefix == "" {
+		prefix = "RIDE"
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		suffix, err := randomCode(4)
+		if err != nil {
+			return err
+		}
+		code := prefix + suffix
+		var count int64
+		if err := s.db.Model(&models.User{}).Where("referral_code = ?", code).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			user.ReferralCode = &code
+			return nil
+		}
+	}
+	return ErrReferralCodeTaken
+}
+
+// FindReferrer returns the user a referral code belongs to
+func (s *ReferralService) FindReferrer(code string) (*models.User, error) {
+	var referrer models.User
+	if err := s.db.Where("referral_code = ?", strings.ToUpper(strings.TrimSpace(code))).First(&referrer).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrReferralCodeNotFound
+		}
+		return nil, err
+	}
+	return &referrer, nil
+}
+
+// Refer records within tx that referee signed up with referrer's code. A
+// referral that looks like someone referring themselves is kept for review
+// but rejected, so it never pays out.
+func (s *ReferralService) Refer(tx *gorm.DB, referrer, referee *models.User) (*models.Referral, error) {
+	referral := models.Referral{
+		ReferrerID: referrer.ID,
+		RefereeID:  referee.ID,
+		Code:       *referrer.ReferralCode,
+		Status:     models.ReferralStatusPending,
+	}
+
+	reason, err := abuseReason(tx, referrer, referee)
+	if err != nil {
+		return nil, err
+	}
+	if reason != "" {
+		referral.Status = models.ReferralStatusRejected
+		referral.RejectReason = reason
+	}
+
+	if err := tx.Create(&referral).Error; err != nil {
+		return nil, err
+	}
+	return &referral, nil
+}
+
+// abuseReason explains why a referral looks like a self-referral, or returns
+// an empty string if it does not
+func abuseReason(db *gorm.DB, referrer, referee *models.User) (string, error) {
+	if referrer.ID == referee.ID {
+		return "self referral", nil
+	}
+
+	phone := utils.FormatKenyanPhoneNumber(referee.PhoneNumber)
+	if phone == utils.FormatKenyanPhoneNumber(referrer.PhoneNumber) {
+		return "same phone number as the referrer", nil
+	}
+	// Phone numbers are stored as entered, so match on the subscriber
+	// number to catch 07.., 254.. and +254.. forms of the same number
+	if len(phone) == 12 {
+		var count int64
+		if err := db.Model(&models.User{}).
+			Where("id <> ? AND phone_number LIKE ?", referee.ID, "%"+phone[3:]).
+			Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count > 0 {
+			return "phone number is registered to another account", nil
+		}
+	}
+
+	if referee.DeviceID != nil && *referee.DeviceID != "" {
+		if referrer.DeviceID != nil && *referrer.DeviceID == *referee.DeviceID {
+			return "same device as the referrer", nil
+		}
+		var count int64
+		if err := db.Model(&models.User{}).
+			Where("id <> ? AND device_id = ?", referee.ID, *referee.DeviceID).
+			Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count > 0 {
+			return "device is registered to another account", nil
+		}
+	}
+	return "", nil
+}
+
+// RecordCompletedRide rewards both sides of a user's pending referral once
+// the user has completed enough rides. It is safe to call after every ride.
+func (s *ReferralService) RecordCompletedRide(userID uuid.UUID) error {
+	var referral models.Referral
+	if err := s.db.Where("referee_id = ? AND status = ?", userID, models.ReferralStatusPending).First(&referral).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	var referee, referrer models.User
+	if err := s.db.First(&referee, "id = ?", referral.RefereeID).Error; err != nil {
+		return err
+	}
+	if err := s.db.First(&referrer, "id = ?", referral.ReferrerID).Error; err != nil {
+		return err
+	}
+
+	completed, err := s.completedRides(&referee)
+	if err != nil {
+		return err
+	}
+	if completed < int64(s.config.RequiredRides) {
+		return nil
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// Only one caller may qualify the referral and hand out rewards
+		result := tx.Model(&models.Referral{}).
+			Where("id = ? AND status = ?", referral.ID, models.ReferralStatusPending).
+			Updates(map[string]interface{}{"status": models.ReferralStatusQualified, "qualified_at": s.clock.Now()})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		if err := s.reward(tx, &referral, &referrer, s.config.ReferrerReward); err != nil {
+			return err
+		}
+		return s.reward(tx, &referral, &referee, s.config.RefereeReward)
+	})
+}
+
+// completedRides counts the rides a user has completed as a driver or as a
+// passenger
+func (s *ReferralService) completedRides(user *models.User) (int64, error) {
+	var count int64
+	var err error
+	if user.UserType == "driver" {
+		err = s.db.Model(&models.Ride{}).
+			Where("driver_id = ? AND status = ?", user.ID, models.RideStatusCompleted).
+			Count(&count).Error
+	} else {
+		err = s.db.Model(&models.RideRequest{}).
+			Where("passenger_id = ? AND status = ?", user.ID, models.RideRequestStatusCompleted).
+			Count(&count).Error
+	}
+	return count, err
+}
+
+// reward gives one side of a referral their reward. Passengers get a promo
+// code only they can use; drivers have it credited to their earnings.
+func (s *ReferralService) reward(tx *gorm.DB, referral *models.Referral, user *models.User, amount float64) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	reward := models.ReferralReward{
+		ID:         uuid.New(),
+		ReferralID: referral.ID,
+		UserID:     user.ID,
+		Amount:     amount,
+		Status:     models.ReferralRewardCredited,
+	}
+
+	if user.UserType == "passenger" {
+		suffix, err := randomCode(8)
+		if err != nil {
+			return err
+		}
+		usageLimit := 1
+		validUntil := s.clock.Now().Add(s.config.RewardValidity)
+		promo := models.PromoCode{
+			Code:          "REF" + suffix,
+			Description:   "Referral reward",
+			DiscountType:  models.PromoDiscountFlat,
+			DiscountValue: amount,
+			UsageLimit:    &usageLimit,
+			PerUserLimit:  1,
+			OwnerID:       &user.ID,
+			ValidUntil:    &validUntil,
+			IsActive:      true,
+		}
+		if err := tx.Create(&promo).Error; err != nil {
+			return err
+		}
+		reward.Status = models.ReferralRewardIssued
+		reward.PromoCodeID = &promo.ID
+	} else {
+		cents := ToCents(amount)
+		if _, err := s.ledger.Post(tx, models.JournalReferralReward, reward.ID.String(), "Referral reward",
+			Debit(PromoExpense, cents),
+			Credit(DriverEarnings(user.ID), cents),
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Create(&reward).Error
+}
+
+// Stats returns the referrals a user has made and the rewards they earned
+func (s *ReferralService) Stats(user *models.User) (*ReferralStats, error) {
+	stats := ReferralStats{RequiredRides: s.config.RequiredRides}
+	if user.ReferralCode != nil {
+		stats.ReferralCode = *user.ReferralCode
+	}
+
+	if err := s.db.Preload("Rewards", "user_id = ?", user.ID).
+		Where("referrer_id = ?", user.ID).Order("created_at DESC").
+		Find(&stats.Referrals).Error; err != nil {
+		return nil, err
+	}
+
+	stats.Referred = len(stats.Referrals)
+	for _, referral := range stats.Referrals {
+		switch referral.Status {
+		case models.ReferralStatusPending:
+			stats.Pending++
+		case models.ReferralStatusQualified:
+			stats.Qualified++
+		case models.ReferralStatusRejected:
+			stats.Rejected++
+		}
+		for _, reward := range referral.Rewards {
+			stats.RewardsEarned += reward.Amount
+		}
+	}
+	return &stats, nil
+}
@@ -0,0 +1,143 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReferralService(t *testing.T) {
+	db := setupTestDB()
+	now := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	referrals := services.NewReferralService(db, services.ReferralConfig{
+		RequiredRides:  2,
+		ReferrerReward: 200,
+		RefereeReward:  100,
+		RewardValidity: 30 * 24 * time.Hour,
+	}, &fakeClock{now: now})
+
+	createUser := func(t *testing.T, userType, phone string, deviceID *string) *models.User {
+		user := models.User{
+			UserType:     userType,
+			FirstName:    "Wanjiku",
+			LastName:     "Kamau",
+			Email:        uuid.NewString() + "@example.com",
+			PhoneNumber:  phone,
+			PasswordHash: "hash",
+			DeviceID:     deviceID,
+		}
+		require.NoError(t, referrals.AssignCode(&user))
+		require.NoError(t, db.Create(&user).Error)
+		return &user
+	}
+	completeRides := func(t *testing.T, passengerID uuid.UUID, n int) {
+		for i := 0; i < n; i++ {
+			require.NoError(t, db.Create(&models.RideRequest{PassengerID: passengerID, Status: models.RideRequestStatusCompleted}).Error)
+		}
+	}
+
+	referrer := createUser(t, "passenger", "0711000001", nil)
+	require.NotNil(t, referrer.ReferralCode)
+	assert.Regexp(t, `^WANJ[A-Z2-9]{4}$`, *referrer.ReferralCode)
+
+	found, err := referrals.FindReferrer(" " + *referrer.ReferralCode)
+	require.NoError(t, err)
+	assert.Equal(t, referrer.ID, found.ID)
+	_, err = referrals.FindReferrer("NOPE0000")
+	assert.ErrorIs(t, err, services.ErrReferralCodeNotFound)
+
+	t.Run("RewardsBothSidesAfterRequiredRides", func(t *testing.T) {
+		referee := createUser(t, "passenger", "0722000002", nil)
+		referral, err := referrals.Refer(db, referrer, referee)
+		require.NoError(t, err)
+		assert.Equal(t, models.ReferralStatusPending, referral.Status)
+
+		completeRides(t, referee.ID, 1)
+		require.NoError(t, referrals.RecordCompletedRide(referee.ID))
+		require.NoError(t, db.First(referral, "id = ?", referral.ID).Error)
+		assert.Equal(t, models.ReferralStatusPending, referral.Status)
+
+		completeRides(t, referee.ID, 1)
+		require.NoError(t, referrals.RecordCompletedRide(referee.ID))
+		// Calling again must not reward twice
+		require.NoError(t, referrals.RecordCompletedRide(referee.ID))
+
+		require.NoError(t, db.Preload("Rewards").First(referral, "id = ?", referral.ID).Error)
+		assert.Equal(t, models.ReferralStatusQualified, referral.Status)
+		require.Len(t, referral.Rewards, 2)
+
+		var reward models.ReferralReward
+		require.NoError(t, db.First(&reward, "referral_id = ? AND user_id = ?", referral.ID, referee.ID).Error)
+		assert.Equal(t, models.ReferralRewardIssued, reward.Status)
+		var promo models.PromoCode
+		require.NoError(t, db.First(&promo, "id = ?", *reward.PromoCodeID).Error)
+		assert.Equal(t, 100.0, promo.DiscountValue)
+		assert.Equal(t, referee.ID, *promo.OwnerID)
+
+		// The reward promo only works for its owner
+		promos := services.NewPromoService(db, &fakeClock{now: now})
+		_, err = promos.Check(promo.Code, referrer.ID, "")
+		assert.ErrorIs(t, err, services.ErrPromoNotOwner)
+		_, err = promos.Check(promo.Code, referee.ID, "")
+		assert.NoError(t, err)
+	})
+
+	t.Run("DriverRewardIsCredited", func(t *testing.T) {
+		driver := createUser(t, "driver", "0733000003", nil)
+		referral, err := referrals.Refer(db, referrer, driver)
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			require.NoError(t, db.Create(&models.Ride{RequestID: uuid.New(), DriverID: driver.ID, PassengerID: uuid.New(), Status: models.RideStatusCompleted}).Error)
+		}
+		require.NoError(t, referrals.RecordCompletedRide(driver.ID))
+
+		var reward models.ReferralReward
+		require.NoError(t, db.First(&reward, "referral_id = ? AND user_id = ?", referral.ID, driver.ID).Error)
+		assert.Equal(t, models.ReferralRewardCredited, reward.Status)
+		assert.Nil(t, reward.PromoCodeID)
+
+		earnings, err := services.NewLedgerService(db, &fakeClock{now: now}).Balance(services.DriverEarnings(driver.ID))
+		require.NoError(t, err)
+		assert.Equal(t, int64(10000), earnings)
+	})
+
+	t.Run("RejectsSelfReferrals", func(t *testing.T) {
+		device := "device-123"
+		deviceReferrer := createUser(t, "passenger", "0744000004", &device)
+
+		samePhone := createUser(t, "passenger", "+254 711 000001", nil)
+		referral, err := referrals.Refer(db, referrer, samePhone)
+		require.NoError(t, err)
+		assert.Equal(t, models.ReferralStatusRejected, referral.Status)
+		assert.Equal(t, "same phone number as the referrer", referral.RejectReason)
+
+		sameDevice := createUser(t, "passenger", "0755000005", &device)
+		referral, err = referrals.Refer(db, deviceReferrer, sameDevice)
+		require.NoError(t, err)
+		assert.Equal(t, models.ReferralStatusRejected, referral.Status)
+		assert.Equal(t, "same device as the referrer", referral.RejectReason)
+
+		// Rejected referrals never pay out
+		completeRides(t, sameDevice.ID, 2)
+		require.NoError(t, referrals.RecordCompletedRide(sameDevice.ID))
+		var rewards int64
+		db.Model(&models.ReferralReward{}).Where("referral_id = ?", referral.ID).Count(&rewards)
+		assert.Zero(t, rewards)
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		stats, err := referrals.Stats(referrer)
+		require.NoError(t, err)
+		assert.Equal(t, *referrer.ReferralCode, stats.ReferralCode)
+		assert.Equal(t, 3, stats.Referred)
+		assert.Equal(t, 2, stats.Qualified)
+		assert.Equal(t, 1, stats.Rejected)
+		assert.Equal(t, 400.0, stats.RewardsEarned)
+	})
+}
@@ -0,0 +1,377 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"kenyan-ride-share-backend/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRefundNotFound          = errors.New("refund not found")
+	ErrRefundNotRefundable     = errors.New("only completed payments can be refunded")
+	ErrRefundExceedsPayment    = errors.New("refund is more than what is left of the payment")
+	ErrRefundDestination       = errors.New("refunds go to the wallet or back through the payment method paid with")
+	ErrRefundSelfApproval      = errors.New("a refund cannot be approved by the person who requested it")
+	ErrRefundNotAwaitingReview = errors.New("refund is not awaiting approval")
+	ErrRefundSettled           = errors.New("refund has already been settled")
+)
+
+// RefundConfig controls which refunds need approval
+type RefundConfig struct {
+	// ApprovalThreshold is the largest refund, in KES, that goes through
+	// without an admin's approval
+	ApprovalThreshold float64
+}
+
+// RefundService gives completed payments back to passengers, in part or in
+// full, to their wallet or through the provider they paid with. The platform
+// bears the cost of every refund.
+type RefundService struct {
+	db        *gorm.DB
+	ledger    *LedgerService
+	providers *PaymentProviders
+	config    RefundConfig
+	clock     Clock
+}
+
+func NewRefundService(db *gorm.DB, providers *PaymentProviders, config RefundConfig, clock Clock) *RefundService {
+	return &RefundService{
+		db:        db,
+		ledger:    NewLedgerService(db, clock),
+		providers: providers,
+		config:    config,
+		clock:     clock,
+	}
+}
+
+// Request refunds amountCents of a payment, or all that is left of it when
+// amountCents is zero. Refunds above the approval threshold wait for an
+// admin; the rest are made straight away.
+func (s *RefundService) Request(paymentID uuid.UUID, amountCents int64, destination, reason string, requestedBy uuid.UUID) (*models.Refund, error) {
+	var refund models.Refund
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Locking the payment keeps concurrent refunds from together
+		// giving back more than was paid
+		result := tx.Model(&models.Payment{}).Where("id = ?", paymentID).Update("payment_status", gorm.Expr("payment_status"))
+		if result.Error != nil {
+			return result.Error
+		}
+		var payment models.Payment
+		if err := tx.First(&payment, "id = ?", paymentID).Error; err != nil {
+			return err
+		}
+		if payment.PaymentStatus != "completed" && payment.PaymentStatus != "partially_paid" {
+			return ErrRefundNotRefundable
+		}
+		// Refunds through a provider go back the way the money came in;
+		// cash never came in through one
+		if destination != models.RefundToWallet {
+			if _, err := ClearingAccount(payment.PaymentMethod); destination != payment.PaymentMethod || err != nil {
+				return ErrRefundDestination
+			}
+		}
+
+		refunded, err := refundedCents(tx, payment.ID)
+		if err != nil {
+			return err
+		}
+		// Wallet credit taken off the fare can only go back to the wallet
+		remaining := settledCents(&payment) - refunded
+		if destination != models.RefundToWallet {
+			remaining = ToCents(payment.AmountPaid) - refunded
+		}
+		if amountCents == 0 {
+			amountCents = remaining
+		}
+		if amountCents <= 0 || amountCents > remaining {
+			return ErrRefundExceedsPayment
+		}
+
+		passengerID, err := paymentPassenger(tx, &payment)
+		if err != nil {
+			return err
+		}
+		refund = models.Refund{
+			PaymentID:   payment.ID,
+			RideID:      payment.RideID,
+			PassengerID: passengerID,
+			AmountCents: amountCents,
+			Destination: destination,
+			Reason:      reason,
+			Status:      models.RefundStatusPendingApproval,
+			RequestedBy: requestedBy,
+		}
+		if amountCents <= ToCents(s.config.ApprovalThreshold) {
+			return s.start(tx, &refund)
+		}
+		return tx.Create(&refund).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.send(&refund)
+}
+
+// Approve makes a refund that was waiting for approval
+func (s *RefundService) Approve(id, adminID uuid.UUID, note string) (*models.Refund, error) {
+	refund, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if refund.RequestedBy == adminID {
+		return nil, ErrRefundSelfApproval
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Refund{}).
+			Where("id = ? AND status = ?", refund.ID, models.RefundStatusPendingApproval).
+			Updates(map[string]interface{}{"reviewed_by": adminID, "review_note": note})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRefundNotAwaitingReview
+		}
+		refund.ReviewedBy = &adminID
+		refund.ReviewNote = note
+		return s.start(tx, refund)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.send(refund)
+}
+
+// Reject turns down a refund that was waiting for approval
+func (s *RefundService) Reject(id, adminID uuid.UUID, note string) (*models.Refund, error) {
+	result := s.db.Model(&models.Refund{}).
+		Where("id = ? AND status = ?", id, models.RefundStatusPendingApproval).
+		Updates(map[string]interface{}{"status": models.RefundStatusRejected, "reviewed_by": adminID, "review_note": note})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		if _, err := s.Get(id); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefundNotAwaitingReview
+	}
+	return s.Get(id)
+}
+
+// start books a refund on the ledger within tx. A wallet refund is complete
+// once booked; a refund through a provider still has to be sent.
+func (s *RefundService) start(tx *gorm.DB, refund *models.Refund) error {
+	now := s.clock.Now()
+	refund.Status = models.RefundStatusProcessing
+	if refund.Destination == models.RefundToWallet {
+		refund.Status = models.RefundStatusCompleted
+		refund.CompletedAt = &now
+	}
+	if err := tx.Save(refund).Error; err != nil {
+		return err
+	}
+
+	to := PassengerWallet(refund.PassengerID)
+	if refund.Destination != models.RefundToWallet {
+		clearing, err := ClearingAccount(refund.Destination)
+		if err != nil {
+			return err
+		}
+		to = clearing
+	}
+	if _, err := s.ledger.Post(tx, models.JournalRefund, refund.ID.String(),
+		fmt.Sprintf("Refund for ride %s: %s", refund.RideID, refund.Reason),
+		Debit(RefundExpense, refund.AmountCents),
+		Credit(to, refund.AmountCents),
+	); err != nil {
+		return err
+	}
+
+	if refund.Status == models.RefundStatusCompleted {
+		return markPaymentRefunded(tx, refund.PaymentID)
+	}
+	return nil
+}
+
+// send asks the provider to send a refund that has been booked. A refund the
+// provider rejects is failed straight away.
+func (s *RefundService) send(refund *models.Refund) (*models.Refund, error) {
+	if refund.Status != models.RefundStatusProcessing {
+		return refund, nil
+	}
+
+	var phoneNumber string
+	var payment models.Payment
+	if err := s.db.First(&payment, "id = ?", refund.PaymentID).Error; err != nil {
+		return nil, err
+	}
+	phoneNumber = payment.PhoneNumber
+	if phoneNumber == "" {
+		var passenger models.User
+		if err := s.db.First(&passenger, "id = ?", refund.PassengerID).Error; err != nil {
+			return nil, err
+		}
+		phoneNumber = passenger.PhoneNumber
+	}
+
+	provider, err := s.providers.Get(refund.Destination)
+	var response *ProviderRefund
+	if err == nil {
+		response, err = provider.Refund(&payment, refund.AmountCents, phoneNumber, refund.ID.String())
+	}
+	if err != nil {
+		if settleErr := s.settle(refund, false, nil, fmt.Sprintf("the provider rejected the request: %v", err)); settleErr != nil {
+			return nil, settleErr
+		}
+		return refund, nil
+	}
+
+	refund.ConversationID = &response.Reference
+	updates := map[string]interface{}{"conversation_id": refund.ConversationID}
+	if response.OriginatorReference != "" {
+		refund.OriginatorConversationID = &response.OriginatorReference
+		updates["originator_conversation_id"] = refund.OriginatorConversationID
+	}
+	if err := s.db.Model(refund).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	if response.Completed {
+		if err := s.settle(refund, true, response.TransactionID, ""); err != nil {
+			return nil, err
+		}
+	}
+	return refund, nil
+}
+
+// HandleResult settles a refund sent through M-Pesa with the B2C result
+// M-Pesa posted for it. Results for refunds already settled return ErrRefundSettled.
+func (s *RefundService) HandleResult(result *MpesaB2CResult) error {
+	refund, err := s.findByConversation(result)
+	if err != nil {
+		return err
+	}
+	if result.ResultCode == 0 {
+		return s.settle(refund, true, &result.TransactionID, "")
+	}
+	return s.settle(refund, false, nil, result.ResultDesc)
+}
+
+// HandleTimeout fails a refund M-Pesa could not process in time
+func (s *RefundService) HandleTimeout(result *MpesaB2CResult) error {
+	refund, err := s.findByConversation(result)
+	if err != nil {
+		return err
+	}
+	return s.settle(refund, false, nil, "M-Pesa request timed out")
+}
+
+func (s *RefundService) findByConversation(result *MpesaB2CResult) (*models.Refund, error) {
+	var refund models.Refund
+	if err := s.db.Where("conversation_id = ? OR originator_conversation_id = ?", result.ConversationID, result.OriginatorConversationID).
+		First(&refund).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRefundNotFound
+		}
+		return nil, err
+	}
+	return &refund, nil
+}
+
+// settle completes or fails a refund the provider is processing. A failed
+// refund is taken back off the ledger.
+func (s *RefundService) settle(refund *models.Refund, completed bool, transactionID *string, reason string) error {
+	now := s.clock.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{"status": models.RefundStatusFailed, "failure_reason": reason}
+		if completed {
+			updates = map[string]interface{}{"status": models.RefundStatusCompleted, "transaction_id": transactionID, "completed_at": now}
+		}
+		// Only one result may settle the refund
+		result := tx.Model(&models.Refund{}).
+			Where("id = ? AND status = ?", refund.ID, models.RefundStatusProcessing).
+			Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRefundSettled
+		}
+
+		if completed {
+			refund.Status = models.RefundStatusCompleted
+			refund.TransactionID = transactionID
+			refund.CompletedAt = &now
+			return markPaymentRefunded(tx, refund.PaymentID)
+		}
+		refund.Status = models.RefundStatusFailed
+		refund.FailureReason = reason
+		clearing, err := ClearingAccount(refund.Destination)
+		if err != nil {
+			return err
+		}
+		_, err = s.ledger.Post(tx, models.JournalRefundReversal, refund.ID.String(), "Failed refund taken back",
+			Debit(clearing, refund.AmountCents),
+			Credit(RefundExpense, refund.AmountCents),
+		)
+		return err
+	})
+}
+
+// refundedCents is how much of a payment has been refunded or is being
+// refunded
+func refundedCents(db *gorm.DB, paymentID uuid.UUID) (int64, error) {
+	var total int64
+	err := db.Model(&models.Refund{}).
+		Where("payment_id = ? AND status NOT IN ?", paymentID, []string{models.RefundStatusFailed, models.RefundStatusRejected}).
+		Select("COALESCE(SUM(amount_cents), 0)").Scan(&total).Error
+	return total, err
+}
+
+// settledCents is how much of a payment was settled, in cash, through its
+// provider or with wallet credit
+func settledCents(payment *models.Payment) int64 {
+	return ToCents(payment.AmountPaid) + ToCents(payment.WalletCredit)
+}
+
+// markPaymentRefunded marks a payment refunded once completed refunds add up
+// to all that was settled
+func markPaymentRefunded(tx *gorm.DB, paymentID uuid.UUID) error {
+	var payment models.Payment
+	if err := tx.First(&payment, "id = ?", paymentID).Error; err != nil {
+		return err
+	}
+	var completed int64
+	if err := tx.Model(&models.Refund{}).
+		Where("payment_id = ? AND status = ?", paymentID, models.RefundStatusCompleted).
+		Select("COALESCE(SUM(amount_cents), 0)").Scan(&completed).Error; err != nil {
+		return err
+	}
+	if completed < settledCents(&payment) {
+		return nil
+	}
+	return tx.Model(&payment).Update("payment_status", "refunded").Error
+}
+
+// Get returns a refund by ID
+func (s *RefundService) Get(id uuid.UUID) (*models.Refund, error) {
+	var refund models.Refund
+	if err := s.db.First(&refund, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRefundNotFound
+		}
+		return nil, err
+	}
+	return &refund, nil
+}
+
+// ListForRide returns the refunds of every payment for a ride, newest first
+func (s *RefundService) ListForRide(rideID uuid.UUID) ([]models.Refund, error) {
+	var refunds []models.Refund
+	err := s.db.Where("ride_id = ?", rideID).Order("created_at DESC").Find(&refunds).Error
+	return refunds, err
+}
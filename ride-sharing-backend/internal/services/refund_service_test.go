@@ -0,0 +1,148 @@
+package services_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+	"kenyan-ride-share-backend/internal/services/paymenttest"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefundService(t *testing.T) {
+	db := setupTestDB()
+	clock := &fakeClock{now: time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)}
+	mpesa := paymenttest.NewFakeProvider(models.PaymentMethodMpesa)
+	airtel := paymenttest.NewFakeProvider(models.PaymentMethodAirtelMoney)
+	airtel.InstantRefunds = true
+	providers := services.NewPaymentProviders(mpesa, airtel, services.CashProvider{})
+	ledger := services.NewLedgerService(db, clock)
+	refunds := services.NewRefundService(db, providers, services.RefundConfig{ApprovalThreshold: 1000}, clock)
+	supportID, adminID := uuid.New(), uuid.New()
+
+	createPayment := func(t *testing.T, amount float64, method string) *models.Payment {
+		passengerID := uuid.New()
+		payment := models.Payment{
+			RideID:        uuid.New(),
+			PassengerID:   &passengerID,
+			Amount:        amount,
+			AmountPaid:    amount,
+			PaymentMethod: method,
+			PaymentStatus: "completed",
+			PhoneNumber:   "254712345678",
+		}
+		require.NoError(t, db.Create(&payment).Error)
+		return &payment
+	}
+	balance := func(t *testing.T, account services.Account) int64 {
+		cents, err := ledger.Balance(account)
+		require.NoError(t, err)
+		return cents
+	}
+	paymentStatus := func(t *testing.T, payment *models.Payment) string {
+		var fresh models.Payment
+		require.NoError(t, db.First(&fresh, "id = ?", payment.ID).Error)
+		return fresh.PaymentStatus
+	}
+
+	t.Run("PartialThenFullToWallet", func(t *testing.T) {
+		payment := createPayment(t, 450, "mpesa")
+		wallet := services.PassengerWallet(*payment.PassengerID)
+
+		refund, err := refunds.Request(payment.ID, 15000, models.RefundToWallet, "Driver took a longer route", supportID)
+		require.NoError(t, err)
+		assert.Equal(t, models.RefundStatusCompleted, refund.Status)
+		assert.Equal(t, int64(15000), balance(t, wallet))
+		assert.Equal(t, "completed", paymentStatus(t, payment))
+
+		_, err = refunds.Request(payment.ID, 40000, models.RefundToWallet, "Too much", supportID)
+		assert.ErrorIs(t, err, services.ErrRefundExceedsPayment)
+
+		// No amount refunds what is left
+		refund, err = refunds.Request(payment.ID, 0, models.RefundToWallet, "Ride never happened", supportID)
+		require.NoError(t, err)
+		assert.Equal(t, int64(30000), refund.AmountCents)
+		assert.Equal(t, int64(45000), balance(t, wallet))
+		assert.Equal(t, "refunded", paymentStatus(t, payment))
+
+		_, err = refunds.Request(payment.ID, 0, models.RefundToWallet, "Again", supportID)
+		assert.ErrorIs(t, err, services.ErrRefundNotRefundable)
+
+		list, err := refunds.ListForRide(payment.RideID)
+		require.NoError(t, err)
+		assert.Len(t, list, 2)
+	})
+
+	t.Run("LargeRefundsNeedApproval", func(t *testing.T) {
+		payment := createPayment(t, 2500, "mpesa")
+		wallet := services.PassengerWallet(*payment.PassengerID)
+
+		refund, err := refunds.Request(payment.ID, 0, models.RefundToWallet, "Passenger charged twice", adminID)
+		require.NoError(t, err)
+		assert.Equal(t, models.RefundStatusPendingApproval, refund.Status)
+		assert.Zero(t, balance(t, wallet))
+
+		// A pending refund still counts against what is left
+		_, err = refunds.Request(payment.ID, 100, models.RefundToWallet, "Another", supportID)
+		assert.ErrorIs(t, err, services.ErrRefundExceedsPayment)
+
+		_, err = refunds.Approve(refund.ID, adminID, "")
+		assert.ErrorIs(t, err, services.ErrRefundSelfApproval)
+
+		approved, err := refunds.Approve(refund.ID, uuid.New(), "Checked the M-Pesa statement")
+		require.NoError(t, err)
+		assert.Equal(t, models.RefundStatusCompleted, approved.Status)
+		assert.Equal(t, int64(250000), balance(t, wallet))
+
+		_, err = refunds.Reject(refund.ID, uuid.New(), "")
+		assert.ErrorIs(t, err, services.ErrRefundNotAwaitingReview)
+	})
+
+	t.Run("ProviderRefunds", func(t *testing.T) {
+		_, err := refunds.Request(createPayment(t, 300, "cash").ID, 0, models.PaymentMethodCash, "Overcharged", supportID)
+		assert.ErrorIs(t, err, services.ErrRefundDestination)
+		// Refunds go back the way the payment came
+		_, err = refunds.Request(createPayment(t, 300, "mpesa").ID, 0, models.PaymentMethodAirtelMoney, "Overcharged", supportID)
+		assert.ErrorIs(t, err, services.ErrRefundDestination)
+
+		payment := createPayment(t, 300, "mpesa")
+		refund, err := refunds.Request(payment.ID, 10050, models.PaymentMethodMpesa, "Overcharged", supportID)
+		require.NoError(t, err)
+		assert.Equal(t, models.RefundStatusProcessing, refund.Status)
+		assert.Equal(t, []int64{10050}, mpesa.Refunded)
+
+		result := &services.MpesaB2CResult{ResultCode: 0, ConversationID: *refund.ConversationID, TransactionID: "RKR5678DEF"}
+		require.NoError(t, refunds.HandleResult(result))
+		assert.ErrorIs(t, refunds.HandleResult(result), services.ErrRefundSettled)
+		refund, err = refunds.Get(refund.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.RefundStatusCompleted, refund.Status)
+
+		// Failed refunds come back off the ledger and free up the amount
+		expenseBefore := balance(t, services.RefundExpense)
+		refund, err = refunds.Request(payment.ID, 0, models.PaymentMethodMpesa, "Ride never happened", supportID)
+		require.NoError(t, err)
+		require.NoError(t, refunds.HandleTimeout(&services.MpesaB2CResult{ConversationID: *refund.ConversationID}))
+		assert.Equal(t, expenseBefore, balance(t, services.RefundExpense))
+
+		mpesa.Err = errors.New("connection refused")
+		refund, err = refunds.Request(payment.ID, 0, models.PaymentMethodMpesa, "Ride never happened", supportID)
+		mpesa.Err = nil
+		require.NoError(t, err)
+		assert.Equal(t, models.RefundStatusFailed, refund.Status)
+		assert.Equal(t, expenseBefore, balance(t, services.RefundExpense))
+		assert.Equal(t, "completed", paymentStatus(t, payment))
+
+		// Providers that refund straight away settle without a callback
+		payment = createPayment(t, 300, "airtel_money")
+		refund, err = refunds.Request(payment.ID, 0, models.PaymentMethodAirtelMoney, "Ride never happened", supportID)
+		require.NoError(t, err)
+		assert.Equal(t, models.RefundStatusCompleted, refund.Status)
+		assert.Equal(t, "refunded", paymentStatus(t, payment))
+	})
+}
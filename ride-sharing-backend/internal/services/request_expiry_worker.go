@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// RequestExpiryWorker expires ride requests that have been pending for
+// longer than the TTL and tells the passenger.
+type RequestExpiryWorker struct {
+	db        *gorm.DB
+	lifecycle *RideLifecycleService
+	notifier  Notifier
+	clock     Clock
+	ttl       time.Duration
+	interval  time.Duration
+}
+
+func NewRequestExpiryWorker(db *gorm.DB, lifecycle *RideLifecycleService, notifier Notifier, clock Clock, ttl, interval time.Duration) *RequestExpiryWorker {
+	return &RequestExpiryWorker{
+		db:        db,
+		lifecycle: lifecycle,
+		notifier:  notifier,
+		clock:     clock,
+		ttl:       ttl,
+		interval:  interval,
+	}
+}
+
+// ExpireStale expires every pending request older than the TTL and returns
+// how many were expired.
+func (w *RequestExpiryWorker) ExpireStale() (int, error) {
+	now := w.clock.Now()
+
+	var rideRequests []models.RideRequest
+	if err := w.db.Where("status = ? AND requested_at <= ?", models.RideRequestStatusPending, now.Add(-w.ttl)).
+		Find(&rideRequests).Error; err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for i := range rideRequests {
+		rideRequest := &rideRequests[i]
+		err := w.db.Transaction(func(tx *gorm.DB) error {
+			if err := w.lifecycle.TransitionRideRequest(tx, rideRequest, Transition{
+				To:   models.RideRequestStatusExpired,
+				Note: "no driver accepted in time",
+			}); err != nil {
+				return err
+			}
+
+			// Withdraw any offer still waiting on a driver
+			return tx.Model(&models.RideOffer{}).
+				Where("request_id = ? AND status = ?", rideRequest.ID, models.RideOfferStatusOffered).
+				Updates(map[string]interface{}{"status": models.RideOfferStatusExpired, "responded_at": now}).Error
+		})
+		if errors.Is(err, ErrStatusChanged) {
+			// Accepted or cancelled in the meantime
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+
+		requestID := rideRequest.ID
+		if err := w.notifier.Notify(&models.Notification{
+			UserID:    rideRequest.PassengerID,
+			Type:      models.NotificationRideRequestExpired,
+			Title:     "No driver found",
+			Message:   "Sorry, no driver accepted your ride request in time. Please request a new ride.",
+			RequestID: &requestID,
+		}); err != nil {
+			log.Printf("Failed to notify passenger of expired ride request %s: %v", rideRequest.ID, err)
+		}
+	}
+
+	return expired, nil
+}
+
+// Run expires stale requests every interval until ctx is cancelled. A pass
+// that has started is allowed to finish.
+func (w *RequestExpiryWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := w.ExpireStale(); err != nil {
+				log.Printf("Ride request expiry failed: %v", err)
+			}
+		}
+	}
+}
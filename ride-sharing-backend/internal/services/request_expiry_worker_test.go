@@ -0,0 +1,102 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingNotifier struct {
+	notifications []models.Notification
+}
+
+func (n *recordingNotifier) Notify(notification *models.Notification) error {
+	n.notifications = append(n.notifications, *notification)
+	return nil
+}
+
+func TestRequestExpiryWorker(t *testing.T) {
+	db := setupTestDB()
+	start := time.Now()
+	clock := &fakeClock{now: start}
+	notifier := &recordingNotifier{}
+	worker := services.NewRequestExpiryWorker(db, services.NewRideLifecycleService(db), notifier, clock, 10*time.Minute, time.Second)
+
+	createRequest := func(status string, requestedAt time.Time) models.RideRequest {
+		rideRequest := models.RideRequest{PassengerID: uuid.New(), Status: status, RequestedAt: requestedAt}
+		require.NoError(t, db.Create(&rideRequest).Error)
+		return rideRequest
+	}
+	stale := createRequest(models.RideRequestStatusPending, start.Add(-5*time.Minute))
+	fresh := createRequest(models.RideRequestStatusPending, start)
+	accepted := createRequest(models.RideRequestStatusAccepted, start.Add(-time.Hour))
+
+	offer := models.RideOffer{RequestID: stale.ID, DriverID: uuid.New(), Status: models.RideOfferStatusOffered, OfferedAt: start, ExpiresAt: start.Add(time.Hour)}
+	require.NoError(t, db.Create(&offer).Error)
+
+	// Nothing is past the TTL yet
+	expired, err := worker.ExpireStale()
+	require.NoError(t, err)
+	assert.Zero(t, expired)
+
+	clock.now = start.Add(6 * time.Minute)
+	expired, err = worker.ExpireStale()
+	require.NoError(t, err)
+	assert.Equal(t, 1, expired)
+
+	statusOf := func(id uuid.UUID) string {
+		var rideRequest models.RideRequest
+		require.NoError(t, db.First(&rideRequest, "id = ?", id).Error)
+		return rideRequest.Status
+	}
+	assert.Equal(t, models.RideRequestStatusExpired, statusOf(stale.ID))
+	assert.Equal(t, models.RideRequestStatusPending, statusOf(fresh.ID))
+	assert.Equal(t, models.RideRequestStatusAccepted, statusOf(accepted.ID))
+
+	require.NoError(t, db.First(&offer, "id = ?", offer.ID).Error)
+	assert.Equal(t, models.RideOfferStatusExpired, offer.Status)
+
+	require.Len(t, notifier.notifications, 1)
+	assert.Equal(t, stale.PassengerID, notifier.notifications[0].UserID)
+	assert.Equal(t, models.NotificationRideRequestExpired, notifier.notifications[0].Type)
+}
+
+func TestDriverCancellationRestartsExpiry(t *testing.T) {
+	db := setupTestDB()
+	start := time.Now()
+	clock := &fakeClock{now: start}
+	lifecycle := services.NewRideLifecycleService(db)
+	worker := services.NewRequestExpiryWorker(db, lifecycle, &recordingNotifier{}, clock, 10*time.Minute, time.Second)
+	cancellations := services.NewCancellationService(db, lifecycle, services.CancellationPolicy{}, clock)
+
+	driver := models.Driver{DriverID: uuid.New(), LicensePlate: "KDE 300P", DriverLicenseNumber: "DL300"}
+	require.NoError(t, db.Create(&driver).Error)
+	rideRequest := models.RideRequest{PassengerID: uuid.New(), Status: models.RideRequestStatusAccepted, RequestedAt: start}
+	require.NoError(t, db.Create(&rideRequest).Error)
+	ride := models.Ride{RequestID: rideRequest.ID, DriverID: driver.DriverID, PassengerID: rideRequest.PassengerID, Status: models.RideStatusDriverArriving, CreatedAt: start}
+	require.NoError(t, db.Create(&ride).Error)
+
+	// The driver gives up well after the request's TTL
+	clock.now = start.Add(15 * time.Minute)
+	_, err := cancellations.CancelRide(&ride, services.CancellationRequest{ActorID: driver.DriverID, ReasonCode: "vehicle_issue"})
+	require.NoError(t, err)
+
+	clock.now = clock.now.Add(30 * time.Second)
+	expired, err := worker.ExpireStale()
+	require.NoError(t, err)
+	assert.Zero(t, expired)
+	require.NoError(t, db.First(&rideRequest, "id = ?", rideRequest.ID).Error)
+	assert.Equal(t, models.RideRequestStatusPending, rideRequest.Status)
+
+	// It expires a full TTL after going back for matching
+	clock.now = start.Add(25 * time.Minute)
+	expired, err = worker.ExpireStale()
+	require.NoError(t, err)
+	assert.Equal(t, 1, expired)
+}
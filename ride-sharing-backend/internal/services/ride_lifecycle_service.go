@@ -0,0 +1,181 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"kenyan-ride-share-backend/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ErrStatusChanged is returned when the row was moved to another status by a
+// concurrent request between being loaded and being updated.
+var ErrStatusChanged = errors.New("status was changed by another request")
+
+// InvalidTransitionError is returned when a status change is not allowed by
+// the ride lifecycle.
+type InvalidTransitionError struct {
+	Entity string
+	From   string
+	To     string
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("cannot move %s from '%s' to '%s'", e.Entity, e.From, e.To)
+}
+
+// rideRequestTransitions lists the statuses a ride request may move to from
+// each status. Statuses without an entry are terminal. An accepted request
+// goes back to pending when its driver cancels so it can be matched again.
+// Drivers decline offers rather than rejecting the request for everyone, and
+// a request nobody accepts in time expires. Scheduled requests become
+// pending when dispatch for them starts.
+var rideRequestTransitions = map[string][]string{
+	models.RideRequestStatusScheduled: {models.RideRequestStatusPending, models.RideRequestStatusCancelled},
+	models.RideRequestStatusPending:   {models.RideRequestStatusAccepted, models.RideRequestStatusCancelled, models.RideRequestStatusExpired},
+	models.RideRequestStatusAccepted:  {models.RideRequestStatusCompleted, models.RideRequestStatusCancelled, models.RideRequestStatusPending},
+}
+
+// rideTransitions lists the statuses a ride may move to from each status.
+// The driver must signal arrival at the pickup before starting the trip.
+var rideTransitions = map[string][]string{
+	models.RideStatusAccepted:       {models.RideStatusDriverArriving, models.RideStatusCancelled},
+	models.RideStatusDriverArriving: {models.RideStatusArrived, models.RideStatusCancelled},
+	models.RideStatusArrived:        {models.RideStatusInProgress, models.RideStatusCancelled},
+	models.RideStatusInProgress:     {models.RideStatusCompleted, models.RideStatusCancelled},
+}
+
+// Transition describes a status change and the columns to update with it.
+type Transition struct {
+	To      string
+	ActorID *uuid.UUID
+	Note    string
+	Updates map[string]interface{}
+}
+
+type RideLifecycleService struct {
+	db *gorm.DB
+}
+
+func NewRideLifecycleService(db *gorm.DB) *RideLifecycleService {
+	return &RideLifecycleService{db: db}
+}
+
+// CanTransitionRideRequest reports whether a ride request may move from one status to another
+func CanTransitionRideRequest(from, to string) bool {
+	return allowed(rideRequestTransitions, from, to)
+}
+
+// CanTransitionRide reports whether a ride may move from one status to another
+func CanTransitionRide(from, to string) bool {
+	return allowed(rideTransitions, from, to)
+}
+
+func allowed(transitions map[string][]string, from, to string) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionRideRequest moves a ride request to a new status within tx and
+// records the change on the timeline.
+func (s *RideLifecycleService) TransitionRideRequest(tx *gorm.DB, rideRequest *models.RideRequest, t Transition) error {
+	if !CanTransitionRideRequest(rideRequest.Status, t.To) {
+		return &InvalidTransitionError{Entity: "ride request", From: rideRequest.Status, To: t.To}
+	}
+
+	if err := updateStatus(tx, &models.RideRequest{}, rideRequest.ID, rideRequest.Status, t); err != nil {
+		return err
+	}
+
+	// A promo held by a request that will not be completed can be used again
+	if t.To == models.RideRequestStatusCancelled || t.To == models.RideRequestStatusExpired {
+		if err := releasePromoRedemption(tx, rideRequest.ID); err != nil {
+			return err
+		}
+	}
+
+	event := models.RideEvent{
+		RequestID:  rideRequest.ID,
+		EventType:  models.RideEventStatusChanged,
+		Entity:     "ride_request",
+		FromStatus: rideRequest.Status,
+		ToStatus:   t.To,
+		ActorID:    t.ActorID,
+		Note:       t.Note,
+	}
+	if err := s.RecordEvent(tx, &event); err != nil {
+		return err
+	}
+
+	rideRequest.Status = t.To
+	return nil
+}
+
+// TransitionRide moves a ride to a new status within tx and records the
+// change on the timeline.
+func (s *RideLifecycleService) TransitionRide(tx *gorm.DB, ride *models.Ride, t Transition) error {
+	if !CanTransitionRide(ride.Status, t.To) {
+		return &InvalidTransitionError{Entity: "ride", From: ride.Status, To: t.To}
+	}
+
+	if err := updateStatus(tx, &models.Ride{}, ride.ID, ride.Status, t); err != nil {
+		return err
+	}
+
+	rideID := ride.ID
+	event := models.RideEvent{
+		RequestID:  ride.RequestID,
+		RideID:     &rideID,
+		EventType:  models.RideEventStatusChanged,
+		Entity:     "ride",
+		FromStatus: ride.Status,
+		ToStatus:   t.To,
+		ActorID:    t.ActorID,
+		Note:       t.Note,
+	}
+	if err := s.RecordEvent(tx, &event); err != nil {
+		return err
+	}
+
+	ride.Status = t.To
+	return nil
+}
+
+// RecordEvent appends an event to the ride timeline
+func (s *RideLifecycleService) RecordEvent(tx *gorm.DB, event *models.RideEvent) error {
+	return tx.Create(event).Error
+}
+
+// GetRideTimeline returns the events for a ride together with the events of
+// its ride request that happened before any ride was assigned.
+func (s *RideLifecycleService) GetRideTimeline(ride *models.Ride) ([]models.RideEvent, error) {
+	var events []models.RideEvent
+	err := s.db.Where("ride_id = ? OR (ride_id IS NULL AND request_id = ?)", ride.ID, ride.RequestID).
+		Order("created_at ASC").
+		Find(&events).Error
+	return events, err
+}
+
+// updateStatus performs a compare-and-set on the status column so that two
+// concurrent transitions cannot both succeed.
+func updateStatus(tx *gorm.DB, model interface{}, id uuid.UUID, from string, t Transition) error {
+	updates := map[string]interface{}{"status": t.To}
+	for column, value := range t.Updates {
+		updates[column] = value
+	}
+
+	result := tx.Model(model).Where("id = ? AND status = ?", id, from).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrStatusChanged
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package services_test
+
+import (
+	"errors"
+	"testing"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRideTransitions(t *testing.T) {
+	assert.True(t, services.CanTransitionRide(models.RideStatusAccepted, models.RideStatusDriverArriving))
+	assert.True(t, services.CanTransitionRide(models.RideStatusArrived, models.RideStatusInProgress))
+	assert.True(t, services.CanTransitionRide(models.RideStatusInProgress, models.RideStatusCompleted))
+	assert.False(t, services.CanTransitionRide(models.RideStatusInProgress, models.RideStatusInProgress))
+	assert.False(t, services.CanTransitionRide(models.RideStatusAccepted, models.RideStatusCompleted))
+	assert.False(t, services.CanTransitionRide(models.RideStatusDriverArriving, models.RideStatusInProgress))
+	assert.False(t, services.CanTransitionRide(models.RideStatusCompleted, models.RideStatusCancelled))
+
+	assert.True(t, services.CanTransitionRideRequest(models.RideRequestStatusPending, models.RideRequestStatusAccepted))
+	assert.False(t, services.CanTransitionRideRequest(models.RideRequestStatusCompleted, models.RideRequestStatusPending))
+}
+
+func TestRideLifecycleService(t *testing.T) {
+	db := setupTestDB()
+	lifecycle := services.NewRideLifecycleService(db)
+
+	driverID := uuid.New()
+	rideRequest := models.RideRequest{PassengerID: uuid.New(), Status: models.RideRequestStatusAccepted}
+	require.NoError(t, db.Create(&rideRequest).Error)
+	ride := models.Ride{RequestID: rideRequest.ID, DriverID: driverID, PassengerID: rideRequest.PassengerID, Status: models.RideStatusAccepted}
+	require.NoError(t, db.Create(&ride).Error)
+
+	t.Run("ValidTransitionsAreRecorded", func(t *testing.T) {
+		require.NoError(t, lifecycle.TransitionRide(db, &ride, services.Transition{To: models.RideStatusDriverArriving, ActorID: &driverID}))
+		require.NoError(t, lifecycle.TransitionRide(db, &ride, services.Transition{To: models.RideStatusArrived, ActorID: &driverID}))
+		require.NoError(t, lifecycle.TransitionRide(db, &ride, services.Transition{To: models.RideStatusInProgress, ActorID: &driverID}))
+		assert.Equal(t, models.RideStatusInProgress, ride.Status)
+
+		events, err := lifecycle.GetRideTimeline(&ride)
+		require.NoError(t, err)
+		require.Len(t, events, 3)
+		assert.Equal(t, models.RideStatusAccepted, events[0].FromStatus)
+		assert.Equal(t, models.RideStatusInProgress, events[2].ToStatus)
+	})
+
+	t.Run("IllegalTransitionIsRejected", func(t *testing.T) {
+		err := lifecycle.TransitionRide(db, &ride, services.Transition{To: models.RideStatusInProgress})
+		var transitionErr *services.InvalidTransitionError
+		assert.True(t, errors.As(err, &transitionErr))
+		assert.Equal(t, models.RideStatusInProgress, transitionErr.From)
+	})
+
+	t.Run("StaleStatusIsRejected", func(t *testing.T) {
+		stale := ride
+		stale.Status = models.RideStatusArrived
+		err := lifecycle.TransitionRide(db, &stale, services.Transition{To: models.RideStatusInProgress})
+		assert.ErrorIs(t, err, services.ErrStatusChanged)
+	})
+}
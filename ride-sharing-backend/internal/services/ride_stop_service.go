@@ -0,0 +1,102 @@
+package services
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrStopNotFound       = errors.New("stop not found")
+	ErrStopAlreadyReached = errors.New("stop has already been reached")
+	ErrStopOutOfOrder     = errors.New("earlier stops must be reached first")
+	ErrRideNotInProgress  = errors.New("ride is not in progress")
+)
+
+type RideStopService struct {
+	db        *gorm.DB
+	lifecycle *RideLifecycleService
+}
+
+func NewRideStopService(db *gorm.DB, lifecycle *RideLifecycleService) *RideStopService {
+	return &RideStopService{
+		db:        db,
+		lifecycle: lifecycle,
+	}
+}
+
+// GetStops returns the stops of a ride request in visiting order
+func (s *RideStopService) GetStops(requestID uuid.UUID) ([]models.RideStop, error) {
+	var stops []models.RideStop
+	err := s.db.Where("request_id = ?", requestID).Order("sequence ASC").Find(&stops).Error
+	return stops, err
+}
+
+// MarkStopReached records that the driver reached the stop with the given
+// sequence number and adds it to the ride timeline. Stops must be reached in
+// order while the trip is in progress.
+func (s *RideStopService) MarkStopReached(ride *models.Ride, sequence int, actorID uuid.UUID) (*models.RideStop, error) {
+	if ride.Status != models.RideStatusInProgress {
+		return nil, ErrRideNotInProgress
+	}
+
+	var stop models.RideStop
+	if err := s.db.Where("request_id = ? AND sequence = ?", ride.RequestID, sequence).First(&stop).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrStopNotFound
+		}
+		return nil, err
+	}
+	if stop.ReachedAt != nil {
+		return nil, ErrStopAlreadyReached
+	}
+
+	var earlierPending int64
+	if err := s.db.Model(&models.RideStop{}).
+		Where("request_id = ? AND sequence < ? AND reached_at IS NULL", ride.RequestID, sequence).
+		Count(&earlierPending).Error; err != nil {
+		return nil, err
+	}
+	if earlierPending > 0 {
+		return nil, ErrStopOutOfOrder
+	}
+
+	now := time.Now()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.RideStop{}).Where("id = ? AND reached_at IS NULL", stop.ID).Update("reached_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrStopAlreadyReached
+		}
+
+		rideID := ride.ID
+		return s.lifecycle.RecordEvent(tx, &models.RideEvent{
+			RequestID: ride.RequestID,
+			RideID:    &rideID,
+			EventType: models.RideEventStopReached,
+			Entity:    "ride",
+			ActorID:   &actorID,
+			Note:      stopNote(stop),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stop.ReachedAt = &now
+	return &stop, nil
+}
+
+func stopNote(stop models.RideStop) string {
+	if stop.Address != "" {
+		return stop.Address
+	}
+	return "stop " + strconv.Itoa(stop.Sequence)
+}
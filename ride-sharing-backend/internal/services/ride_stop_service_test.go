@@ -0,0 +1,84 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalculateRouteDistance(t *testing.T) {
+	pickup := utils.Coordinate{Latitude: -1.2921, Longitude: 36.8219}
+	stop := utils.Coordinate{Latitude: -1.3000, Longitude: 36.8000}
+	dropoff := utils.Coordinate{Latitude: -1.3190, Longitude: 36.9270}
+
+	direct := utils.CalculateRouteDistance([]utils.Coordinate{pickup, dropoff})
+	viaStop := utils.CalculateRouteDistance([]utils.Coordinate{pickup, stop, dropoff})
+
+	assert.InDelta(t, utils.CalculateDistance(pickup.Latitude, pickup.Longitude, dropoff.Latitude, dropoff.Longitude), direct, 1e-9)
+	assert.Greater(t, viaStop, direct)
+}
+
+func TestRideStops(t *testing.T) {
+	db := setupTestDB()
+	lifecycle := services.NewRideLifecycleService(db)
+	stopService := services.NewRideStopService(db, lifecycle)
+
+	rideRequest := models.RideRequest{
+		PassengerID: uuid.New(),
+		Status:      models.RideRequestStatusAccepted,
+		Stops: []models.RideStop{
+			{Sequence: 1, Latitude: -1.30, Longitude: 36.80, Address: "Yaya Centre"},
+			{Sequence: 2, Latitude: -1.31, Longitude: 36.81, Address: "Prestige Plaza"},
+		},
+	}
+	require.NoError(t, db.Create(&rideRequest).Error)
+
+	ride := models.Ride{RequestID: rideRequest.ID, DriverID: uuid.New(), PassengerID: rideRequest.PassengerID, Status: models.RideStatusDriverArriving}
+	require.NoError(t, db.Create(&ride).Error)
+
+	// Stops can only be reached during the trip, in order
+	_, err := stopService.MarkStopReached(&ride, 1, ride.DriverID)
+	assert.ErrorIs(t, err, services.ErrRideNotInProgress)
+
+	ride.Status = models.RideStatusInProgress
+	_, err = stopService.MarkStopReached(&ride, 2, ride.DriverID)
+	assert.ErrorIs(t, err, services.ErrStopOutOfOrder)
+	_, err = stopService.MarkStopReached(&ride, 3, ride.DriverID)
+	assert.ErrorIs(t, err, services.ErrStopNotFound)
+
+	stop, err := stopService.MarkStopReached(&ride, 1, ride.DriverID)
+	require.NoError(t, err)
+	assert.NotNil(t, stop.ReachedAt)
+	_, err = stopService.MarkStopReached(&ride, 1, ride.DriverID)
+	assert.ErrorIs(t, err, services.ErrStopAlreadyReached)
+	_, err = stopService.MarkStopReached(&ride, 2, ride.DriverID)
+	require.NoError(t, err)
+
+	timeline, err := lifecycle.GetRideTimeline(&ride)
+	require.NoError(t, err)
+	require.Len(t, timeline, 2)
+	assert.Equal(t, models.RideEventStopReached, timeline[0].EventType)
+	assert.Equal(t, "Yaya Centre", timeline[0].Note)
+
+	// The receipt lists the stops once the ride is completed
+	receipts := services.NewReceiptService(db)
+	_, err = receipts.GetReceipt(&ride, ride.PassengerID)
+	assert.ErrorIs(t, err, services.ErrRideNotCompleted)
+
+	fare := 450.0
+	now := time.Now()
+	require.NoError(t, db.Model(&ride).Updates(map[string]interface{}{"status": models.RideStatusCompleted, "actual_fare": fare, "end_time": now}).Error)
+	receipt, err := receipts.GetReceipt(&ride, ride.PassengerID)
+	require.NoError(t, err)
+	require.Len(t, receipt.Stops, 2)
+	assert.Equal(t, "Prestige Plaza", receipt.Stops[1].Address)
+	assert.NotNil(t, receipt.Stops[1].ReachedAt)
+	assert.Equal(t, fare, *receipt.Fare)
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// TraceConfig controls which driver locations are kept on a ride trace
+type TraceConfig struct {
+	// MinDistanceMeters drops points this close to the previous one, which
+	// are GPS jitter while the car is standing still
+	MinDistanceMeters float64
+	// MaxAccuracyMeters drops points whose reported accuracy is worse
+	MaxAccuracyMeters float64
+	// MaxSpeedKmh drops points that would need an impossible speed to reach
+	// from the previous one
+	MaxSpeedKmh float64
+}
+
+// Trace is the route recorded for a ride
+type Trace struct {
+	GeoJSON    string
+	Polyline   string
+	DistanceKm float64
+	Points     int
+}
+
+type RideTraceService struct {
+	db     *gorm.DB
+	config TraceConfig
+}
+
+func NewRideTraceService(db *gorm.DB, config TraceConfig) *RideTraceService {
+	return &RideTraceService{
+		db:     db,
+		config: config,
+	}
+}
+
+// RecordLocation appends a driver location to the trace of the driver's
+// ride in progress. It reports whether the point was kept; locations sent
+// outside a ride or rejected as noise are ignored.
+func (s *RideTraceService) RecordLocation(driverID uuid.UUID, latitude, longitude float64, accuracy *float64, at time.Time) (bool, error) {
+	if accuracy != nil && s.config.MaxAccuracyMeters > 0 && *accuracy > s.config.MaxAccuracyMeters {
+		return false, nil
+	}
+
+	var ride models.Ride
+	if err := s.db.Where("driver_id = ? AND status = ?", driverID, models.RideStatusInProgress).First(&ride).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	var last models.RideLocationPoint
+	err := s.db.Where("ride_id = ?", ride.ID).Order("recorded_at DESC").First(&last).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, err
+	}
+	if err == nil && !s.accept(last, latitude, longitude, at) {
+		return false, nil
+	}
+
+	point := models.RideLocationPoint{
+		RideID:     ride.ID,
+		Latitude:   latitude,
+		Longitude:  longitude,
+		Accuracy:   accuracy,
+		RecordedAt: at,
+	}
+	if err := s.db.Create(&point).Error; err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// accept applies the jitter and speed filters against the last kept point
+func (s *RideTraceService) accept(last models.RideLocationPoint, latitude, longitude float64, at time.Time) bool {
+	if !at.After(last.RecordedAt) {
+		return false
+	}
+	distanceKm := utils.CalculateDistance(last.Latitude, last.Longitude, latitude, longitude)
+	if distanceKm*1000 < s.config.MinDistanceMeters {
+		return false
+	}
+	if s.config.MaxSpeedKmh > 0 {
+		hours := at.Sub(last.RecordedAt).Hours()
+		if distanceKm/hours > s.config.MaxSpeedKmh {
+			return false
+		}
+	}
+	return true
+}
+
+// GetPoints returns the recorded points of a ride in order
+func (s *RideTraceService) GetPoints(rideID uuid.UUID) ([]models.RideLocationPoint, error) {
+	var points []models.RideLocationPoint
+	err := s.db.Where("ride_id = ?", rideID).Order("recorded_at ASC").Find(&points).Error
+	return points, err
+}
+
+// BuildTrace turns the recorded points of a ride into a GeoJSON LineString,
+// an encoded polyline and the distance travelled.
+func (s *RideTraceService) BuildTrace(rideID uuid.UUID) (*Trace, error) {
+	points, err := s.GetPoints(rideID)
+	if err != nil {
+		return nil, err
+	}
+
+	route := make([]utils.Coordinate, 0, len(points))
+	for _, point := range points {
+		route = append(route, utils.Coordinate{Latitude: point.Latitude, Longitude: point.Longitude})
+	}
+
+	geoJSON, err := lineStringGeoJSON(route)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Trace{
+		GeoJSON:    geoJSON,
+		Polyline:   utils.EncodePolyline(route),
+		DistanceKm: utils.CalculateRouteDistance(route),
+		Points:     len(points),
+	}, nil
+}
+
+// lineStringGeoJSON encodes a route as a GeoJSON LineString. GeoJSON orders
+// positions as longitude, latitude.
+func lineStringGeoJSON(route []utils.Coordinate) (string, error) {
+	coordinates := make([][2]float64, 0, len(route))
+	for _, point := range route {
+		coordinates = append(coordinates, [2]float64{point.Longitude, point.Latitude})
+	}
+	encoded, err := json.Marshal(struct {
+		Type        string       `json:"type"`
+		Coordinates [][2]float64 `json:"coordinates"`
+	}{
+		Type:        "LineString",
+		Coordinates: coordinates,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
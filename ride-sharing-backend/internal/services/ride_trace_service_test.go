@@ -0,0 +1,74 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodePolyline(t *testing.T) {
+	// Example from the polyline algorithm documentation
+	encoded := utils.EncodePolyline([]utils.Coordinate{
+		{Latitude: 38.5, Longitude: -120.2},
+		{Latitude: 40.7, Longitude: -120.95},
+		{Latitude: 43.252, Longitude: -126.453},
+	})
+	assert.Equal(t, "_p~iF~ps|U_ulLnnqC_mqNvxq`@", encoded)
+}
+
+func TestRideTrace(t *testing.T) {
+	db := setupTestDB()
+	traces := services.NewRideTraceService(db, services.TraceConfig{
+		MinDistanceMeters: 10,
+		MaxAccuracyMeters: 50,
+		MaxSpeedKmh:       150,
+	})
+
+	driverID := uuid.New()
+	start := time.Now()
+
+	// Locations outside a ride are not recorded
+	recorded, err := traces.RecordLocation(driverID, -1.2921, 36.8219, nil, start)
+	require.NoError(t, err)
+	assert.False(t, recorded)
+
+	ride := models.Ride{RequestID: uuid.New(), DriverID: driverID, PassengerID: uuid.New(), Status: models.RideStatusInProgress}
+	require.NoError(t, db.Create(&ride).Error)
+
+	poor := 120.0
+	steps := []struct {
+		name      string
+		latitude  float64
+		longitude float64
+		accuracy  *float64
+		after     time.Duration
+		kept      bool
+	}{
+		{"first point", -1.2921, 36.8219, nil, 0, true},
+		{"jitter while stopped", -1.29212, 36.82191, nil, 5 * time.Second, false},
+		{"moving", -1.2881, 36.8219, nil, 30 * time.Second, true},
+		{"poor accuracy", -1.2850, 36.8219, &poor, 40 * time.Second, false},
+		{"impossible jump", -1.1881, 36.8219, nil, 45 * time.Second, false},
+		{"moving again", -1.2841, 36.8219, nil, 60 * time.Second, true},
+	}
+	for _, step := range steps {
+		recorded, err := traces.RecordLocation(driverID, step.latitude, step.longitude, step.accuracy, start.Add(step.after))
+		require.NoError(t, err)
+		assert.Equal(t, step.kept, recorded, step.name)
+	}
+
+	trace, err := traces.BuildTrace(ride.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 3, trace.Points)
+	assert.InDelta(t, 0.89, trace.DistanceKm, 0.01)
+	assert.Contains(t, trace.GeoJSON, `"type":"LineString"`)
+	assert.Contains(t, trace.GeoJSON, `[36.8219,-1.2921]`)
+	assert.NotEmpty(t, trace.Polyline)
+}
@@ -0,0 +1,153 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrScheduleTooSoon = errors.New("scheduled pickup time is too soon")
+	ErrScheduleTooFar  = errors.New("scheduled pickup time is too far in the future")
+)
+
+type ScheduleConfig struct {
+	// MinLead and MaxLead bound how far ahead a ride can be booked
+	MinLead time.Duration
+	MaxLead time.Duration
+	// DispatchLead is how long before pickup dispatch starts
+	DispatchLead time.Duration
+	// ReminderLead is how long before pickup the passenger is reminded
+	ReminderLead time.Duration
+	Interval     time.Duration
+}
+
+// ValidatePickupTime checks that a scheduled pickup time is within the
+// allowed booking window.
+func (c ScheduleConfig) ValidatePickupTime(scheduledFor, now time.Time) error {
+	if scheduledFor.Before(now.Add(c.MinLead)) {
+		return ErrScheduleTooSoon
+	}
+	if scheduledFor.After(now.Add(c.MaxLead)) {
+		return ErrScheduleTooFar
+	}
+	return nil
+}
+
+// ScheduledRideWorker reminds passengers of upcoming scheduled rides and
+// starts dispatch for them shortly before pickup.
+type ScheduledRideWorker struct {
+	db         *gorm.DB
+	lifecycle  *RideLifecycleService
+	dispatcher *DispatchService
+	notifier   Notifier
+	clock      Clock
+	config     ScheduleConfig
+}
+
+func NewScheduledRideWorker(db *gorm.DB, lifecycle *RideLifecycleService, dispatcher *DispatchService, notifier Notifier, clock Clock, config ScheduleConfig) *ScheduledRideWorker {
+	return &ScheduledRideWorker{
+		db:         db,
+		lifecycle:  lifecycle,
+		dispatcher: dispatcher,
+		notifier:   notifier,
+		clock:      clock,
+		config:     config,
+	}
+}
+
+// ProcessDue sends due reminders and moves scheduled requests whose dispatch
+// window has opened to pending.
+func (w *ScheduledRideWorker) ProcessDue() error {
+	now := w.clock.Now()
+	if err := w.sendReminders(now); err != nil {
+		return err
+	}
+
+	var rideRequests []models.RideRequest
+	if err := w.db.Where("status = ? AND scheduled_for <= ?", models.RideRequestStatusScheduled, now.Add(w.config.DispatchLead)).
+		Find(&rideRequests).Error; err != nil {
+		return err
+	}
+
+	for i := range rideRequests {
+		rideRequest := &rideRequests[i]
+		// The expiry TTL counts from the pickup time rather than the booking
+		err := w.db.Transaction(func(tx *gorm.DB) error {
+			return w.lifecycle.TransitionRideRequest(tx, rideRequest, Transition{
+				To:      models.RideRequestStatusPending,
+				Note:    "scheduled dispatch started",
+				Updates: map[string]interface{}{"requested_at": *rideRequest.ScheduledFor},
+			})
+		})
+		if errors.Is(err, ErrStatusChanged) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := w.dispatcher.Dispatch(rideRequest.ID); err != nil {
+			log.Printf("Failed to dispatch scheduled ride request %s: %v", rideRequest.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (w *ScheduledRideWorker) sendReminders(now time.Time) error {
+	var rideRequests []models.RideRequest
+	if err := w.db.Where("status = ? AND reminder_sent_at IS NULL AND scheduled_for <= ?", models.RideRequestStatusScheduled, now.Add(w.config.ReminderLead)).
+		Find(&rideRequests).Error; err != nil {
+		return err
+	}
+
+	for _, rideRequest := range rideRequests {
+		// Claim the reminder so it is only sent once
+		result := w.db.Model(&models.RideRequest{}).
+			Where("id = ? AND reminder_sent_at IS NULL", rideRequest.ID).
+			Update("reminder_sent_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+
+		requestID := rideRequest.ID
+		if err := w.notifier.Notify(&models.Notification{
+			UserID:    rideRequest.PassengerID,
+			Type:      models.NotificationScheduledRideReminder,
+			Title:     "Upcoming ride",
+			Message:   fmt.Sprintf("Your ride from %s is scheduled for %s.", rideRequest.PickupAddress, rideRequest.ScheduledFor.Format("Mon 2 Jan 15:04")),
+			RequestID: &requestID,
+		}); err != nil {
+			log.Printf("Failed to send reminder for scheduled ride request %s: %v", rideRequest.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// Run processes scheduled rides every interval until ctx is cancelled
+func (w *ScheduledRideWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.ProcessDue(); err != nil {
+				log.Printf("Scheduled ride processing failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePickupTime(t *testing.T) {
+	config := services.ScheduleConfig{MinLead: 30 * time.Minute, MaxLead: 7 * 24 * time.Hour}
+	now := time.Now()
+
+	assert.ErrorIs(t, config.ValidatePickupTime(now.Add(10*time.Minute), now), services.ErrScheduleTooSoon)
+	assert.ErrorIs(t, config.ValidatePickupTime(now.Add(8*24*time.Hour), now), services.ErrScheduleTooFar)
+	assert.NoError(t, config.ValidatePickupTime(now.Add(12*time.Hour), now))
+}
+
+func TestScheduledRideWorker(t *testing.T) {
+	db := setupTestDB()
+	start := time.Now()
+	clock := &fakeClock{now: start}
+	notifier := &recordingNotifier{}
+	dispatcher := services.NewDispatchService(db, services.DispatchConfig{InitialRadiusKm: 3, MaxRadiusKm: 3, OfferTimeout: time.Minute}, clock)
+	worker := services.NewScheduledRideWorker(db, services.NewRideLifecycleService(db), dispatcher, notifier, clock, services.ScheduleConfig{
+		DispatchLead: 15 * time.Minute,
+		ReminderLead: time.Hour,
+	})
+
+	// Airport run booked for tomorrow morning
+	pickupAt := start.Add(24 * time.Hour)
+	fare := 1500.0
+	rideRequest := models.RideRequest{
+		PassengerID:   uuid.New(),
+		PickupAddress: "Westlands",
+		Status:        models.RideRequestStatusScheduled,
+		ScheduledFor:  &pickupAt,
+		LockedFare:    &fare,
+	}
+	require.NoError(t, db.Create(&rideRequest).Error)
+
+	reload := func() models.RideRequest {
+		var r models.RideRequest
+		require.NoError(t, db.First(&r, "id = ?", rideRequest.ID).Error)
+		return r
+	}
+
+	require.NoError(t, worker.ProcessDue())
+	assert.Equal(t, models.RideRequestStatusScheduled, reload().Status)
+	assert.Empty(t, notifier.notifications)
+
+	// Reminder goes out once, an hour before pickup
+	clock.now = pickupAt.Add(-50 * time.Minute)
+	require.NoError(t, worker.ProcessDue())
+	require.NoError(t, worker.ProcessDue())
+	require.Len(t, notifier.notifications, 1)
+	assert.Equal(t, models.NotificationScheduledRideReminder, notifier.notifications[0].Type)
+	assert.Equal(t, models.RideRequestStatusScheduled, reload().Status)
+
+	// Dispatch starts fifteen minutes before pickup
+	clock.now = pickupAt.Add(-10 * time.Minute)
+	require.NoError(t, worker.ProcessDue())
+	promoted := reload()
+	assert.Equal(t, models.RideRequestStatusPending, promoted.Status)
+	assert.WithinDuration(t, pickupAt, promoted.RequestedAt, time.Second)
+	require.NotNil(t, promoted.LockedFare)
+	assert.Equal(t, fare, *promoted.LockedFare)
+}
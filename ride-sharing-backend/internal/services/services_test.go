@@ -1,10 +1,14 @@
 package services_test
 
 import (
+	"strings"
 	"testing"
+	"time"
 
+	"kenyan-ride-share-backend/internal/config"
 	"kenyan-ride-share-backend/internal/models"
 	"kenyan-ride-share-backend/internal/services"
+	"kenyan-ride-share-backend/pkg/database"
 
 	"github.com/stretchr/testify/assert"
 	"gorm.io/driver/sqlite"
@@ -16,13 +20,53 @@ func setupTestDB() *gorm.DB {
 	if err != nil {
 		panic("failed to connect database")
 	}
-	db.AutoMigrate(&models.User{}, &models.Driver{}, &models.RideRequest{}, &models.Ride{}, &models.Payment{}, &models.Review{})
+	// A single connection keeps every query on the same in-memory database
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+	migrateTestModels(db, database.Models()...)
+	if err := database.SeedVehicleCategories(db); err != nil {
+		panic(err)
+	}
 	return db
 }
 
+// migrateTestModels auto-migrates models on SQLite, which cannot create the
+// Postgres gen_random_uuid() column default. IDs are still assigned by the
+// BeforeCreate hooks.
+func migrateTestModels(db *gorm.DB, dst ...interface{}) {
+	for _, model := range dst {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			panic(err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if strings.Contains(field.DefaultValue, "gen_random_uuid") {
+				field.HasDefaultValue = false
+				field.DefaultValue = ""
+				field.DefaultValueInterface = nil
+			}
+		}
+	}
+	if err := db.AutoMigrate(dst...); err != nil {
+		panic(err)
+	}
+}
+
+// fakeClock is a Clock tests move by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
 func TestMpesaService(t *testing.T) {
+	// Use the mocked Daraja responses
+	t.Setenv("ENVIRONMENT", "development")
+	t.Setenv("MPESA_BASE_URL", "")
 	db := setupTestDB()
-	mpesaService := services.NewMpesaService(db)
+	mpesaService := services.NewMpesaService(db, config.Load())
 
 	t.Run("GetAccessToken", func(t *testing.T) {
 		token, err := mpesaService.GetAccessToken()
@@ -38,6 +82,12 @@ func TestMpesaService(t *testing.T) {
 		assert.Equal(t, "0", response.ResponseCode)
 		assert.NotEmpty(t, response.CheckoutRequestID)
 	})
+
+	t.Run("QuerySTKStatus", func(t *testing.T) {
+		// Without a mock Daraja there is no outcome to report
+		_, err := mpesaService.QuerySTKStatus("ws_CO_mock")
+		assert.ErrorIs(t, err, services.ErrSTKStillProcessing)
+	})
 }
 
 func TestComplianceService(t *testing.T) {
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// kmPerDegree is the length of a degree of latitude. Kenya straddles the
+// equator, so a degree of longitude is close enough to the same length.
+const kmPerDegree = 111.32
+
+// SurgeConfig controls how demand in each cell turns into a multiplier
+type SurgeConfig struct {
+	// CellSizeKm is the side of a square grid cell
+	CellSizeKm float64
+	// Window is how far back open requests and driver locations count
+	Window time.Duration
+	// Sensitivity is how much the multiplier rises for each open request
+	// per available driver above one
+	Sensitivity float64
+	// Smoothing is the share of the gap to the new target the multiplier
+	// moves each run, between 0 and 1, so prices do not jump around
+	Smoothing float64
+	// MaxMultiplier caps the surge
+	MaxMultiplier float64
+	Interval      time.Duration
+}
+
+// SurgeService divides the service area into cells and prices each cell by
+// the ratio of open ride requests to available drivers in it.
+type SurgeService struct {
+	db     *gorm.DB
+	clock  Clock
+	config SurgeConfig
+}
+
+func NewSurgeService(db *gorm.DB, clock Clock, config SurgeConfig) *SurgeService {
+	return &SurgeService{
+		db:     db,
+		clock:  clock,
+		config: config,
+	}
+}
+
+// cellDegrees is the side of a grid cell in degrees
+func (s *SurgeService) cellDegrees() float64 {
+	return s.config.CellSizeKm / kmPerDegree
+}
+
+// cellOf returns the grid row and column containing a point
+func (s *SurgeService) cellOf(latitude, longitude float64) (int, int) {
+	size := s.cellDegrees()
+	return int(math.Floor(latitude / size)), int(math.Floor(longitude / size))
+}
+
+func cellKey(row, col int) string {
+	return fmt.Sprintf("%d:%d", row, col)
+}
+
+// targetMultiplier is the surge a cell should have for its current demand
+func (s *SurgeService) targetMultiplier(requests, drivers int) (float64, float64) {
+	ratio := float64(requests) / math.Max(float64(drivers), 1)
+	if ratio <= 1 {
+		return ratio, 1
+	}
+	return ratio, math.Min(1+s.config.Sensitivity*(ratio-1), s.config.MaxMultiplier)
+}
+
+// Recompute recounts demand and supply in every cell and moves each cell's
+// multiplier towards its target. It returns how many cells are surging.
+func (s *SurgeService) Recompute() (int, error) {
+	since := s.clock.Now().Add(-s.config.Window)
+
+	type point struct {
+		Latitude  float64
+		Longitude float64
+	}
+	var requests []point
+	if err := s.db.Model(&models.RideRequest{}).
+		Select("pickup_latitude AS latitude, pickup_longitude AS longitude").
+		Where("status = ? AND requested_at >= ?", models.RideRequestStatusPending, since).
+		Scan(&requests).Error; err != nil {
+		return 0, err
+	}
+	var drivers []point
+	if err := s.db.Model(&models.Driver{}).
+		Select("current_latitude AS latitude, current_longitude AS longitude").
+		Where("is_available = ? AND is_approved = ?", true, true).
+		Where("current_latitude IS NOT NULL AND current_longitude IS NOT NULL AND last_location_update >= ?", since).
+		Scan(&drivers).Error; err != nil {
+		return 0, err
+	}
+
+	requestCounts := make(map[string]int)
+	driverCounts := make(map[string]int)
+	cells := make(map[string]*models.SurgeCell)
+	track := func(p point, counts map[string]int) {
+		row, col := s.cellOf(p.Latitude, p.Longitude)
+		key := cellKey(row, col)
+		counts[key]++
+		if _, ok := cells[key]; !ok {
+			cells[key] = &models.SurgeCell{CellKey: key, Row: row, Col: col, Multiplier: 1}
+		}
+	}
+	for _, p := range requests {
+		track(p, requestCounts)
+	}
+	for _, p := range drivers {
+		track(p, driverCounts)
+	}
+
+	surging := 0
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Cells already stored keep their multiplier so it can be smoothed
+		var existing []models.SurgeCell
+		if err := tx.Find(&existing).Error; err != nil {
+			return err
+		}
+		for i := range existing {
+			cells[existing[i].CellKey] = &existing[i]
+		}
+
+		size := s.cellDegrees()
+		for key, cell := range cells {
+			ratio, target := s.targetMultiplier(requestCounts[key], driverCounts[key])
+			multiplier := math.Round((cell.Multiplier+s.config.Smoothing*(target-cell.Multiplier))*100) / 100
+			if multiplier < 1.01 {
+				multiplier = 1
+			}
+
+			// A cell with no demand and no surge left is dropped
+			if multiplier == 1 && requestCounts[key] == 0 {
+				if cell.ID != uuid.Nil {
+					if err := tx.Delete(cell).Error; err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			cell.CenterLatitude = (float64(cell.Row) + 0.5) * size
+			cell.CenterLongitude = (float64(cell.Col) + 0.5) * size
+			cell.OpenRequests = requestCounts[key]
+			cell.AvailableDrivers = driverCounts[key]
+			cell.DemandRatio = math.Round(ratio*100) / 100
+			cell.Multiplier = multiplier
+			if err := tx.Save(cell).Error; err != nil {
+				return err
+			}
+			if multiplier > 1 {
+				surging++
+			}
+		}
+		return nil
+	})
+	return surging, err
+}
+
+// MultiplierAt returns the current surge for a point, 1 when there is none
+func (s *SurgeService) MultiplierAt(latitude, longitude float64) (float64, error) {
+	var cell models.SurgeCell
+	if err := s.db.Where("cell_key = ?", cellKey(s.cellOf(latitude, longitude))).First(&cell).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 1, nil
+		}
+		return 1, err
+	}
+	return cell.Multiplier, nil
+}
+
+// SurgeMap returns every cell that is currently surging, highest first
+func (s *SurgeService) SurgeMap() ([]models.SurgeCell, error) {
+	var cells []models.SurgeCell
+	err := s.db.Where("multiplier > ?", 1).Order("multiplier DESC").Find(&cells).Error
+	return cells, err
+}
+
+func (s *SurgeService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Recompute(); err != nil {
+				log.Printf("Surge recompute failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSurgePricing(t *testing.T) {
+	db := setupTestDB()
+	clock := &fakeClock{now: time.Now()}
+	surge := services.NewSurgeService(db, clock, services.SurgeConfig{
+		CellSizeKm:    1,
+		Window:        10 * time.Minute,
+		Sensitivity:   0.5,
+		Smoothing:     0.5,
+		MaxMultiplier: 2,
+	})
+
+	// Four open requests and one driver in the CBD
+	cbdLat, cbdLon := -1.2864, 36.8172
+	for i := 0; i < 4; i++ {
+		require.NoError(t, db.Create(&models.RideRequest{
+			PassengerID:     uuid.New(),
+			PickupLatitude:  cbdLat,
+			PickupLongitude: cbdLon,
+			RequestedAt:     clock.now.Add(-2 * time.Minute),
+			Status:          models.RideRequestStatusPending,
+		}).Error)
+	}
+	seen := clock.now.Add(-time.Minute)
+	driver := models.Driver{DriverID: uuid.New(), LicensePlate: "KDD 300S", DriverLicenseNumber: "DL300", IsApproved: true, IsAvailable: true,
+		CurrentLatitude: &cbdLat, CurrentLongitude: &cbdLon, LastLocationUpdate: &seen}
+	require.NoError(t, db.Create(&driver).Error)
+
+	// Requests outside the window do not count
+	require.NoError(t, db.Create(&models.RideRequest{
+		PassengerID:     uuid.New(),
+		PickupLatitude:  -1.3000,
+		PickupLongitude: 36.7800,
+		RequestedAt:     clock.now.Add(-time.Hour),
+		Status:          models.RideRequestStatusPending,
+	}).Error)
+
+	// The target is 1 + 0.5 * (4 - 1) = 2.5, capped at 2; smoothing moves
+	// half way there on each run
+	surging, err := surge.Recompute()
+	require.NoError(t, err)
+	assert.Equal(t, 1, surging)
+	multiplier, err := surge.MultiplierAt(cbdLat, cbdLon)
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, multiplier)
+
+	_, err = surge.Recompute()
+	require.NoError(t, err)
+	multiplier, err = surge.MultiplierAt(cbdLat, cbdLon)
+	require.NoError(t, err)
+	assert.Equal(t, 1.75, multiplier)
+
+	cells, err := surge.SurgeMap()
+	require.NoError(t, err)
+	require.Len(t, cells, 1)
+	assert.Equal(t, 4, cells[0].OpenRequests)
+	assert.Equal(t, 1, cells[0].AvailableDrivers)
+
+	multiplier, err = surge.MultiplierAt(-1.3000, 36.7800)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, multiplier)
+
+	// Once demand is gone the surge cools off and the cell is dropped
+	require.NoError(t, db.Model(&models.RideRequest{}).Where("status = ?", models.RideRequestStatusPending).
+		Update("status", models.RideRequestStatusExpired).Error)
+	for i := 0; i < 10; i++ {
+		_, err = surge.Recompute()
+		require.NoError(t, err)
+	}
+	cells, err = surge.SurgeMap()
+	require.NoError(t, err)
+	assert.Empty(t, cells)
+}
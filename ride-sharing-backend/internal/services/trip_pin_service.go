@@ -0,0 +1,122 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidPIN  = errors.New("incorrect trip PIN")
+	ErrRideFlagged = errors.New("ride has been flagged after too many incorrect PINs")
+)
+
+// TripPINService issues the PIN a passenger gives the driver at pickup and
+// checks it before the trip starts.
+type TripPINService struct {
+	db          *gorm.DB
+	lifecycle   *RideLifecycleService
+	maxAttempts int
+}
+
+func NewTripPINService(db *gorm.DB, lifecycle *RideLifecycleService, maxAttempts int) *TripPINService {
+	return &TripPINService{
+		db:          db,
+		lifecycle:   lifecycle,
+		maxAttempts: maxAttempts,
+	}
+}
+
+// GeneratePIN returns a random 4-digit PIN
+func GeneratePIN() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(10000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%04d", n.Int64()), nil
+}
+
+// AttemptsRemaining returns how many more PINs the driver may try
+func (s *TripPINService) AttemptsRemaining(ride *models.Ride) int {
+	if remaining := s.maxAttempts - ride.PINFailedAttempts; remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// VerifyPIN checks the PIN entered by the driver. A wrong PIN is counted and
+// logged on the ride timeline; once the attempts run out the ride is flagged
+// and can no longer be started.
+func (s *TripPINService) VerifyPIN(ride *models.Ride, pin string, driverID uuid.UUID) error {
+	if ride.FlaggedAt != nil {
+		return ErrRideFlagged
+	}
+	if subtle.ConstantTimeCompare([]byte(ride.StartPIN), []byte(pin)) == 1 {
+		return nil
+	}
+
+	flagged := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Count the attempt in the database so concurrent requests cannot
+		// get extra tries
+		if err := tx.Model(&models.Ride{}).Where("id = ?", ride.ID).
+			Update("pin_failed_attempts", gorm.Expr("pin_failed_attempts + 1")).Error; err != nil {
+			return err
+		}
+		var current models.Ride
+		if err := tx.Select("pin_failed_attempts").First(&current, "id = ?", ride.ID).Error; err != nil {
+			return err
+		}
+		ride.PINFailedAttempts = current.PINFailedAttempts
+
+		rideID := ride.ID
+		event := models.RideEvent{
+			RequestID: ride.RequestID,
+			RideID:    &rideID,
+			EventType: models.RideEventPINFailed,
+			Entity:    "ride",
+			ActorID:   &driverID,
+			Note:      fmt.Sprintf("attempt %d of %d", ride.PINFailedAttempts, s.maxAttempts),
+		}
+		if err := s.lifecycle.RecordEvent(tx, &event); err != nil {
+			return err
+		}
+
+		if ride.PINFailedAttempts < s.maxAttempts {
+			return nil
+		}
+
+		now := time.Now()
+		if err := tx.Model(&models.Ride{}).Where("id = ?", ride.ID).Update("flagged_at", now).Error; err != nil {
+			return err
+		}
+		ride.FlaggedAt = &now
+		flagged = true
+
+		flagEvent := models.RideEvent{
+			RequestID: ride.RequestID,
+			RideID:    &rideID,
+			EventType: models.RideEventFlagged,
+			Entity:    "ride",
+			ActorID:   &driverID,
+			Note:      "too many incorrect trip PINs",
+		}
+		return s.lifecycle.RecordEvent(tx, &flagEvent)
+	})
+	if err != nil {
+		return err
+	}
+
+	if flagged {
+		return ErrRideFlagged
+	}
+	return ErrInvalidPIN
+}
@@ -0,0 +1,58 @@
+package services_test
+
+import (
+	"testing"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeneratePIN(t *testing.T) {
+	pin, err := services.GeneratePIN()
+	require.NoError(t, err)
+	assert.Len(t, pin, 4)
+	assert.Regexp(t, `^[0-9]{4}$`, pin)
+}
+
+func TestVerifyPIN(t *testing.T) {
+	db := setupTestDB()
+	lifecycle := services.NewRideLifecycleService(db)
+	pins := services.NewTripPINService(db, lifecycle, 3)
+
+	driverID := uuid.New()
+	ride := models.Ride{RequestID: uuid.New(), DriverID: driverID, PassengerID: uuid.New(), StartPIN: "4821", Status: models.RideStatusArrived}
+	require.NoError(t, db.Create(&ride).Error)
+
+	assert.NoError(t, pins.VerifyPIN(&ride, "4821", driverID))
+
+	assert.ErrorIs(t, pins.VerifyPIN(&ride, "0000", driverID), services.ErrInvalidPIN)
+	assert.ErrorIs(t, pins.VerifyPIN(&ride, "1111", driverID), services.ErrInvalidPIN)
+	assert.Equal(t, 1, pins.AttemptsRemaining(&ride))
+
+	// The last wrong attempt flags the ride, after which even the right PIN is refused
+	assert.ErrorIs(t, pins.VerifyPIN(&ride, "2222", driverID), services.ErrRideFlagged)
+	assert.ErrorIs(t, pins.VerifyPIN(&ride, "4821", driverID), services.ErrRideFlagged)
+
+	var stored models.Ride
+	require.NoError(t, db.First(&stored, "id = ?", ride.ID).Error)
+	assert.Equal(t, 3, stored.PINFailedAttempts)
+	assert.NotNil(t, stored.FlaggedAt)
+
+	events, err := lifecycle.GetRideTimeline(&ride)
+	require.NoError(t, err)
+	var failed, flagged int
+	for _, event := range events {
+		switch event.EventType {
+		case models.RideEventPINFailed:
+			failed++
+		case models.RideEventFlagged:
+			flagged++
+		}
+	}
+	assert.Equal(t, 3, failed)
+	assert.Equal(t, 1, flagged)
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"errors"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrVehicleCategoryNotFound    = errors.New("vehicle category not found")
+	ErrVehicleCategoryUnavailable = errors.New("vehicle category is not available")
+	ErrVehicleCategoryExists      = errors.New("vehicle category already exists")
+)
+
+// PoolVehicleCategory is the only category pooled rides are offered in
+const PoolVehicleCategory = models.VehicleCategoryEconomy
+
+type VehicleCategoryService struct {
+	db *gorm.DB
+}
+
+func NewVehicleCategoryService(db *gorm.DB) *VehicleCategoryService {
+	return &VehicleCategoryService{db: db}
+}
+
+// List returns the vehicle categories ordered by minimum fare, optionally
+// only those passengers can book
+func (s *VehicleCategoryService) List(activeOnly bool) ([]models.VehicleCategory, error) {
+	query := s.db.Order("minimum_fare ASC")
+	if activeOnly {
+		query = query.Where("is_active = ?", true)
+	}
+	var categories []models.VehicleCategory
+	err := query.Find(&categories).Error
+	return categories, err
+}
+
+// Get returns a vehicle category by code
+func (s *VehicleCategoryService) Get(code string) (*models.VehicleCategory, error) {
+	var category models.VehicleCategory
+	if err := s.db.Where("code = ?", code).First(&category).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrVehicleCategoryNotFound
+		}
+		return nil, err
+	}
+	return &category, nil
+}
+
+// GetBookable returns a vehicle category passengers can currently request
+func (s *VehicleCategoryService) GetBookable(code string) (*models.VehicleCategory, error) {
+	category, err := s.Get(code)
+	if err != nil {
+		return nil, err
+	}
+	if !category.IsActive {
+		return nil, ErrVehicleCategoryUnavailable
+	}
+	return category, nil
+}
+
+// Create adds a new vehicle category
+func (s *VehicleCategoryService) Create(category *models.VehicleCategory) error {
+	if _, err := s.Get(category.Code); err == nil {
+		return ErrVehicleCategoryExists
+	} else if !errors.Is(err, ErrVehicleCategoryNotFound) {
+		return err
+	}
+	return s.db.Create(category).Error
+}
+
+// Update changes the given columns of a vehicle category
+func (s *VehicleCategoryService) Update(code string, updates map[string]interface{}) (*models.VehicleCategory, error) {
+	category, err := s.Get(code)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(category).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	return s.Get(code)
+}
+
+// RatesFor returns the fare table of a category. Rides in a category that
+// has since been removed are charged the default rates.
+func (s *VehicleCategoryService) RatesFor(code string) (utils.FareRates, error) {
+	category, err := s.Get(code)
+	if errors.Is(err, ErrVehicleCategoryNotFound) {
+		return utils.DefaultFareRates, nil
+	}
+	if err != nil {
+		return utils.FareRates{}, err
+	}
+	return CategoryRates(category), nil
+}
+
+// CategoryRates returns the fare table of a category
+func CategoryRates(category *models.VehicleCategory) utils.FareRates {
+	return utils.FareRates{
+		BaseFare:      category.BaseFare,
+		PerKmRate:     category.PerKmRate,
+		PerMinuteRate: category.PerMinuteRate,
+		MinimumFare:   category.MinimumFare,
+	}
+}
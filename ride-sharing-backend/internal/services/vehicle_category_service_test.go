@@ -0,0 +1,74 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+	"kenyan-ride-share-backend/pkg/utils"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVehicleCategories(t *testing.T) {
+	db := setupTestDB()
+	categories := services.NewVehicleCategoryService(db)
+
+	bookable, err := categories.List(true)
+	require.NoError(t, err)
+	require.Len(t, bookable, 5)
+	assert.Equal(t, models.VehicleCategoryBodaBoda, bookable[0].Code)
+
+	// Economy keeps the original default rates
+	rates, err := categories.RatesFor(models.VehicleCategoryEconomy)
+	require.NoError(t, err)
+	assert.Equal(t, utils.DefaultFareRates, rates)
+
+	updated, err := categories.Update(models.VehicleCategoryComfort, map[string]interface{}{"per_km_rate": 40.0, "is_active": false})
+	require.NoError(t, err)
+	assert.Equal(t, 40.0, updated.PerKmRate)
+	_, err = categories.GetBookable(models.VehicleCategoryComfort)
+	assert.ErrorIs(t, err, services.ErrVehicleCategoryUnavailable)
+	_, err = categories.GetBookable("helicopter")
+	assert.ErrorIs(t, err, services.ErrVehicleCategoryNotFound)
+
+	assert.ErrorIs(t, categories.Create(&models.VehicleCategory{Code: models.VehicleCategoryXL, Name: "XL", Seats: 6}), services.ErrVehicleCategoryExists)
+
+	// Final fares use the rates of the requested category
+	fares := services.NewFareService(db, services.PoolConfig{})
+	start := time.Now().Add(-10 * time.Minute)
+	rider := models.RideRequest{ID: uuid.New(), PassengerID: uuid.New(), VehicleCategory: models.VehicleCategoryComfort}
+	ride := models.Ride{ID: uuid.New(), RequestID: rider.ID, RideType: models.RideTypeStandard, StartTime: &start}
+	breakdowns, err := fares.CalculateRideFares(&ride, []models.RideRequest{rider}, 5, start.Add(10*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 80.0, breakdowns[0].BaseFare)
+	assert.Equal(t, 200.0, breakdowns[0].DistanceFare)
+	assert.Equal(t, 30.0, breakdowns[0].TimeFare)
+}
+
+func TestDispatchByVehicleCategory(t *testing.T) {
+	db := setupTestDB()
+	dispatcher := services.NewDispatchService(db, services.DispatchConfig{InitialRadiusKm: 2, RadiusStepKm: 2, MaxRadiusKm: 4, OfferTimeout: time.Minute}, services.SystemClock{})
+
+	lat, lon := -1.2925, 36.8220
+	economy := models.Driver{DriverID: uuid.New(), LicensePlate: "KDE 100E", DriverLicenseNumber: "DL-E", IsApproved: true, IsAvailable: true,
+		CurrentLatitude: &lat, CurrentLongitude: &lon, VehicleCategory: models.VehicleCategoryEconomy}
+	farLat := -1.2830
+	boda := models.Driver{DriverID: uuid.New(), LicensePlate: "KMFA 100B", DriverLicenseNumber: "DL-B", IsApproved: true, IsAvailable: true,
+		CurrentLatitude: &farLat, CurrentLongitude: &lon, VehicleCategory: models.VehicleCategoryBodaBoda}
+	require.NoError(t, db.Create(&economy).Error)
+	require.NoError(t, db.Create(&boda).Error)
+
+	rideRequest := models.RideRequest{PassengerID: uuid.New(), PickupLatitude: -1.2921, PickupLongitude: 36.8219,
+		Status: models.RideRequestStatusPending, VehicleCategory: models.VehicleCategoryBodaBoda}
+	require.NoError(t, db.Create(&rideRequest).Error)
+
+	// The closer economy driver is skipped for a boda boda request
+	require.NoError(t, dispatcher.Dispatch(rideRequest.ID))
+	var offer models.RideOffer
+	require.NoError(t, db.Where("request_id = ?", rideRequest.ID).First(&offer).Error)
+	assert.Equal(t, boda.DriverID, offer.DriverID)
+}
@@ -0,0 +1,28 @@
+package services
+
+import (
+	"math"
+	"time"
+)
+
+// WaitingPolicy charges for time the driver waits at the pickup
+type WaitingPolicy struct {
+	// GracePeriod is how long the driver waits for free
+	GracePeriod time.Duration
+	// RatePerMinute is charged for every started minute after the grace period
+	RatePerMinute float64
+}
+
+// ChargeFor returns the chargeable waiting minutes and the charge for a
+// driver who arrived at arrivedAt and started the trip at startedAt.
+func (p WaitingPolicy) ChargeFor(arrivedAt *time.Time, startedAt time.Time) (int, float64) {
+	if arrivedAt == nil {
+		return 0, 0
+	}
+	waited := startedAt.Sub(*arrivedAt) - p.GracePeriod
+	if waited <= 0 {
+		return 0, 0
+	}
+	minutes := int(math.Ceil(waited.Minutes()))
+	return minutes, float64(minutes) * p.RatePerMinute
+}
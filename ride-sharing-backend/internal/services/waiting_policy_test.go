@@ -0,0 +1,73 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"kenyan-ride-share-backend/internal/models"
+	"kenyan-ride-share-backend/internal/services"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitingPolicy(t *testing.T) {
+	policy := services.WaitingPolicy{GracePeriod: 3 * time.Minute, RatePerMinute: 5}
+	arrivedAt := time.Now()
+
+	minutes, charge := policy.ChargeFor(nil, arrivedAt.Add(10*time.Minute))
+	assert.Zero(t, minutes)
+	assert.Zero(t, charge)
+
+	minutes, charge = policy.ChargeFor(&arrivedAt, arrivedAt.Add(2*time.Minute))
+	assert.Zero(t, minutes)
+	assert.Zero(t, charge)
+
+	// Every started minute after the grace period is charged
+	minutes, charge = policy.ChargeFor(&arrivedAt, arrivedAt.Add(7*time.Minute+10*time.Second))
+	assert.Equal(t, 5, minutes)
+	assert.Equal(t, 25.0, charge)
+}
+
+func TestMarkNoShow(t *testing.T) {
+	db := setupTestDB()
+	cancellations := services.NewCancellationService(db, services.NewRideLifecycleService(db), services.CancellationPolicy{
+		NoShowAfter: 5 * time.Minute,
+		NoShowFee:   150,
+	}, services.SystemClock{})
+
+	driver := models.Driver{DriverID: uuid.New(), LicensePlate: "KDC 200N", DriverLicenseNumber: "DL200"}
+	require.NoError(t, db.Create(&driver).Error)
+	rideRequest := models.RideRequest{PassengerID: uuid.New(), Status: models.RideRequestStatusAccepted}
+	require.NoError(t, db.Create(&rideRequest).Error)
+
+	arrivedAt := time.Now().Add(-2 * time.Minute)
+	ride := models.Ride{RequestID: rideRequest.ID, DriverID: driver.DriverID, PassengerID: rideRequest.PassengerID, Status: models.RideStatusArrived, ArrivedAt: &arrivedAt}
+	require.NoError(t, db.Create(&ride).Error)
+
+	_, err := cancellations.MarkNoShow(&ride, driver.DriverID, "")
+	assert.ErrorIs(t, err, services.ErrNoShowTooEarly)
+
+	arrivedAt = time.Now().Add(-6 * time.Minute)
+	ride.ArrivedAt = &arrivedAt
+	cancellation, err := cancellations.MarkNoShow(&ride, driver.DriverID, "waited outside the gate")
+	require.NoError(t, err)
+	assert.Equal(t, "passenger_no_show", cancellation.ReasonCode)
+	assert.Equal(t, 150.0, cancellation.FeeAmount)
+
+	require.NoError(t, db.First(&rideRequest, "id = ?", rideRequest.ID).Error)
+	assert.Equal(t, models.RideRequestStatusCancelled, rideRequest.Status)
+
+	var payment models.Payment
+	require.NoError(t, db.Where("ride_id = ?", ride.ID).First(&payment).Error)
+	assert.Equal(t, rideRequest.PassengerID, *payment.PassengerID)
+	balance, err := services.NewLedgerService(db, services.SystemClock{}).Balance(services.PassengerWallet(rideRequest.PassengerID))
+	require.NoError(t, err)
+	assert.Equal(t, int64(-15000), balance)
+
+	// No-shows do not count against the driver
+	require.NoError(t, db.First(&driver, "driver_id = ?", driver.DriverID).Error)
+	assert.Zero(t, driver.CancellationCount)
+	assert.True(t, driver.IsAvailable)
+}
@@ -0,0 +1,27 @@
+-- Migration: 002_ride_lifecycle.sql
+-- Align status constraints with the ride lifecycle state machine
+ALTER TABLE ride_requests DROP CONSTRAINT IF EXISTS ride_requests_status_check;
+ALTER TABLE ride_requests ADD CONSTRAINT ride_requests_status_check
+    CHECK (status IN ('pending', 'accepted', 'rejected', 'cancelled', 'completed'));
+
+ALTER TABLE rides DROP CONSTRAINT IF EXISTS rides_status_check;
+ALTER TABLE rides ADD CONSTRAINT rides_status_check
+    CHECK (status IN ('accepted', 'driver_arriving', 'arrived', 'in_progress', 'completed', 'cancelled'));
+
+-- Create ride_events table (ride timeline)
+CREATE TABLE ride_events (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    request_id UUID NOT NULL REFERENCES ride_requests(id) ON DELETE CASCADE,
+    ride_id UUID REFERENCES rides(id) ON DELETE CASCADE,
+    event_type VARCHAR(50) NOT NULL,
+    entity VARCHAR(20) NOT NULL CHECK (entity IN ('ride_request', 'ride')),
+    from_status VARCHAR(20),
+    to_status VARCHAR(20),
+    actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    note TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_ride_events_request ON ride_events(request_id);
+CREATE INDEX idx_ride_events_ride ON ride_events(ride_id);
+CREATE INDEX idx_ride_events_created ON ride_events(created_at);
@@ -0,0 +1,31 @@
+-- Migration: 003_ride_cancellations.sql
+-- Track driver cancellations
+ALTER TABLE drivers ADD COLUMN cancellation_count INTEGER DEFAULT 0;
+
+-- 001 named the request column ride_request_id, but the application reads
+-- and writes request_id
+ALTER TABLE rides RENAME COLUMN ride_request_id TO request_id;
+
+-- A ride request may be re-matched after a driver cancels, so drop any
+-- one-ride-per-request constraint: the Postgres default name for a UNIQUE
+-- column and the name AutoMigrate gives it
+ALTER TABLE rides DROP CONSTRAINT IF EXISTS rides_ride_request_id_key;
+ALTER TABLE rides DROP CONSTRAINT IF EXISTS uni_rides_request_id;
+CREATE INDEX idx_rides_request ON rides(request_id);
+
+-- Create ride_cancellations table
+CREATE TABLE ride_cancellations (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    request_id UUID NOT NULL REFERENCES ride_requests(id) ON DELETE CASCADE,
+    ride_id UUID REFERENCES rides(id) ON DELETE CASCADE,
+    cancelled_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    cancelled_by_type VARCHAR(20) NOT NULL CHECK (cancelled_by_type IN ('passenger', 'driver')),
+    reason_code VARCHAR(50) NOT NULL,
+    note TEXT,
+    fee_amount DECIMAL(10, 2) DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_ride_cancellations_request ON ride_cancellations(request_id);
+CREATE INDEX idx_ride_cancellations_ride ON ride_cancellations(ride_id);
+CREATE INDEX idx_ride_cancellations_cancelled_by ON ride_cancellations(cancelled_by);
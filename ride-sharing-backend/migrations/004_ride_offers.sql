@@ -0,0 +1,30 @@
+-- Migration: 004_ride_offers.sql
+-- Track when a driver last became available (used to rank idle drivers)
+ALTER TABLE drivers ADD COLUMN available_since TIMESTAMP WITH TIME ZONE;
+
+-- Current driver search radius for a pending request
+ALTER TABLE ride_requests ADD COLUMN dispatch_radius_km DECIMAL(6, 2);
+
+-- Create ride_offers table
+CREATE TABLE ride_offers (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    request_id UUID NOT NULL REFERENCES ride_requests(id) ON DELETE CASCADE,
+    driver_id UUID NOT NULL REFERENCES drivers(driver_id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('offered', 'accepted', 'declined', 'expired')),
+    radius_km DECIMAL(6, 2),
+    distance_km DECIMAL(8, 2),
+    score DECIMAL(8, 4),
+    offered_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    responded_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- A request is offered to one driver at a time
+CREATE UNIQUE INDEX idx_ride_offers_open_request ON ride_offers(request_id) WHERE status = 'offered';
+CREATE INDEX idx_ride_offers_request ON ride_offers(request_id);
+CREATE INDEX idx_ride_offers_driver ON ride_offers(driver_id);
+CREATE INDEX idx_ride_offers_expires ON ride_offers(expires_at);
+
+CREATE TRIGGER update_ride_offers_updated_at BEFORE UPDATE ON ride_offers FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,13 @@
+-- Migration: 005_ride_request_declines.sql
+-- Create ride_request_declines table
+CREATE TABLE ride_request_declines (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    request_id UUID NOT NULL REFERENCES ride_requests(id) ON DELETE CASCADE,
+    driver_id UUID NOT NULL REFERENCES drivers(driver_id) ON DELETE CASCADE,
+    reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- A driver declines a request at most once
+CREATE UNIQUE INDEX idx_ride_request_declines_request_driver ON ride_request_declines(request_id, driver_id);
+CREATE INDEX idx_ride_request_declines_driver ON ride_request_declines(driver_id);
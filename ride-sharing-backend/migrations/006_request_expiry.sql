@@ -0,0 +1,26 @@
+-- Migration: 006_request_expiry.sql
+-- Pending ride requests nobody accepts in time are expired
+ALTER TABLE ride_requests DROP CONSTRAINT IF EXISTS ride_requests_status_check;
+ALTER TABLE ride_requests ADD CONSTRAINT ride_requests_status_check
+    CHECK (status IN ('pending', 'accepted', 'rejected', 'cancelled', 'completed', 'expired'));
+
+-- When the passenger asked for a ride, which starts the expiry clock
+ALTER TABLE ride_requests ADD COLUMN requested_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+UPDATE ride_requests SET requested_at = created_at WHERE created_at IS NOT NULL;
+
+CREATE INDEX idx_ride_requests_status_requested_at ON ride_requests(status, requested_at);
+
+-- Create notifications table
+CREATE TABLE notifications (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(50) NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    message TEXT NOT NULL,
+    request_id UUID REFERENCES ride_requests(id) ON DELETE SET NULL,
+    ride_id UUID REFERENCES rides(id) ON DELETE SET NULL,
+    read_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_notifications_user ON notifications(user_id, created_at);
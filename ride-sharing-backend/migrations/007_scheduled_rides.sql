@@ -0,0 +1,11 @@
+-- Migration: 007_scheduled_rides.sql
+-- Advance-booked rides wait in 'scheduled' until dispatch starts
+ALTER TABLE ride_requests DROP CONSTRAINT IF EXISTS ride_requests_status_check;
+ALTER TABLE ride_requests ADD CONSTRAINT ride_requests_status_check
+    CHECK (status IN ('scheduled', 'pending', 'accepted', 'rejected', 'cancelled', 'completed', 'expired'));
+
+ALTER TABLE ride_requests ADD COLUMN scheduled_for TIMESTAMP WITH TIME ZONE;
+ALTER TABLE ride_requests ADD COLUMN locked_fare DECIMAL(10, 2);
+ALTER TABLE ride_requests ADD COLUMN reminder_sent_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX idx_ride_requests_scheduled_for ON ride_requests(scheduled_for) WHERE status = 'scheduled';
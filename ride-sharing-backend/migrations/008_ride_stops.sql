@@ -0,0 +1,14 @@
+-- Migration: 008_ride_stops.sql
+-- Create ride_stops table (intermediate stops between pickup and dropoff)
+CREATE TABLE ride_stops (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    request_id UUID NOT NULL REFERENCES ride_requests(id) ON DELETE CASCADE,
+    sequence INTEGER NOT NULL CHECK (sequence > 0),
+    latitude DECIMAL(10, 8) NOT NULL,
+    longitude DECIMAL(11, 8) NOT NULL,
+    address TEXT,
+    reached_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_ride_stops_request_sequence ON ride_stops(request_id, sequence);
@@ -0,0 +1,37 @@
+-- Migration: 009_pooled_rides.sql
+-- Ride type and seats for pooled rides
+ALTER TABLE ride_requests ADD COLUMN ride_type VARCHAR(20) NOT NULL DEFAULT 'standard' CHECK (ride_type IN ('standard', 'pool'));
+ALTER TABLE ride_requests ADD COLUMN seats INTEGER NOT NULL DEFAULT 1 CHECK (seats > 0);
+ALTER TABLE ride_requests ADD COLUMN ride_id UUID REFERENCES rides(id) ON DELETE SET NULL;
+ALTER TABLE rides ADD COLUMN ride_type VARCHAR(20) NOT NULL DEFAULT 'standard' CHECK (ride_type IN ('standard', 'pool'));
+
+CREATE INDEX idx_ride_requests_ride ON ride_requests(ride_id);
+CREATE INDEX idx_rides_type_status ON rides(ride_type, status);
+
+-- Backfill the ride serving each accepted or completed request
+UPDATE ride_requests SET ride_id = rides.id
+FROM rides
+WHERE rides.request_id = ride_requests.id
+  AND rides.status <> 'cancelled'
+  AND ride_requests.ride_id IS NULL;
+
+-- Pooled rides have one payment per passenger
+ALTER TABLE payments ADD COLUMN passenger_id UUID REFERENCES users(id) ON DELETE SET NULL;
+CREATE INDEX idx_payments_passenger ON payments(passenger_id);
+
+-- Create ride_waypoints table (pickups and dropoffs of a pooled ride)
+CREATE TABLE ride_waypoints (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    ride_id UUID NOT NULL REFERENCES rides(id) ON DELETE CASCADE,
+    request_id UUID NOT NULL REFERENCES ride_requests(id) ON DELETE CASCADE,
+    sequence INTEGER NOT NULL,
+    kind VARCHAR(10) NOT NULL CHECK (kind IN ('pickup', 'dropoff')),
+    latitude DECIMAL(10, 8) NOT NULL,
+    longitude DECIMAL(11, 8) NOT NULL,
+    address TEXT,
+    completed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_ride_waypoints_ride ON ride_waypoints(ride_id, sequence);
+CREATE INDEX idx_ride_waypoints_request ON ride_waypoints(request_id);
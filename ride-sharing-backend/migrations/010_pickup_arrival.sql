@@ -0,0 +1,5 @@
+-- Migration: 010_pickup_arrival.sql
+-- Arrival at pickup and waiting time charges
+ALTER TABLE rides ADD COLUMN arrived_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE rides ADD COLUMN waiting_minutes INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE rides ADD COLUMN waiting_charge DECIMAL(10, 2) NOT NULL DEFAULT 0;
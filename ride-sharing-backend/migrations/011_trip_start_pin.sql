@@ -0,0 +1,5 @@
+-- Migration: 011_trip_start_pin.sql
+-- PIN the passenger gives the driver before the trip starts
+ALTER TABLE rides ADD COLUMN start_pin VARCHAR(4);
+ALTER TABLE rides ADD COLUMN pin_failed_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE rides ADD COLUMN flagged_at TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,15 @@
+-- Migration: 012_ride_location_points.sql
+-- Create ride_location_points table (driver locations recorded during a ride)
+CREATE TABLE ride_location_points (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    ride_id UUID NOT NULL REFERENCES rides(id) ON DELETE CASCADE,
+    latitude DECIMAL(10, 8) NOT NULL,
+    longitude DECIMAL(11, 8) NOT NULL,
+    accuracy DECIMAL(8, 2),
+    recorded_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_ride_location_points_ride ON ride_location_points(ride_id, recorded_at);
+
+-- Encoded polyline of the recorded route
+ALTER TABLE rides ADD COLUMN route_polyline TEXT;
@@ -0,0 +1,24 @@
+-- Migration: 013_fare_breakdowns.sql
+-- Create fare_breakdowns table (itemised final fare per passenger)
+CREATE TABLE fare_breakdowns (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    ride_id UUID NOT NULL REFERENCES rides(id) ON DELETE CASCADE,
+    request_id UUID NOT NULL REFERENCES ride_requests(id) ON DELETE CASCADE,
+    passenger_id UUID NOT NULL REFERENCES users(id),
+    distance_km DECIMAL(8, 2) NOT NULL DEFAULT 0,
+    duration_minutes INTEGER NOT NULL DEFAULT 0,
+    base_fare DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    distance_fare DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    time_fare DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    surge_amount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    minimum_fare_top_up DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    discount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    locked_fare_adjustment DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    waiting_charge DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    total DECIMAL(10, 2) NOT NULL,
+    currency VARCHAR(3) DEFAULT 'KES',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_fare_breakdowns_ride_request ON fare_breakdowns(ride_id, request_id);
+CREATE INDEX idx_fare_breakdowns_passenger_id ON fare_breakdowns(passenger_id);
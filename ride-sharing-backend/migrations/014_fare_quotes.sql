@@ -0,0 +1,35 @@
+-- Migration: 014_fare_quotes.sql
+-- Create fare_quotes table (prices shown before requesting, locked until expiry)
+CREATE TABLE fare_quotes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    passenger_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    pickup_latitude DECIMAL(10, 8) NOT NULL,
+    pickup_longitude DECIMAL(11, 8) NOT NULL,
+    dropoff_latitude DECIMAL(10, 8) NOT NULL,
+    dropoff_longitude DECIMAL(11, 8) NOT NULL,
+    distance_km DECIMAL(8, 2),
+    duration_minutes INTEGER,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    request_id UUID REFERENCES ride_requests(id),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_fare_quotes_passenger_id ON fare_quotes(passenger_id);
+
+-- Create fare_quote_options table (itemised estimate per kind of ride)
+CREATE TABLE fare_quote_options (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    quote_id UUID NOT NULL REFERENCES fare_quotes(id) ON DELETE CASCADE,
+    ride_type VARCHAR(20) NOT NULL,
+    base_fare DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    distance_fare DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    time_fare DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    surge_amount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    minimum_fare_top_up DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    discount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    total DECIMAL(10, 2) NOT NULL,
+    currency VARCHAR(3) DEFAULT 'KES'
+);
+
+CREATE INDEX idx_fare_quote_options_quote_id ON fare_quote_options(quote_id);
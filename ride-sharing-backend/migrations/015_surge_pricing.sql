@@ -0,0 +1,19 @@
+-- Migration: 015_surge_pricing.sql
+-- Create surge_cells table (current surge per grid cell of the service area)
+CREATE TABLE surge_cells (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    cell_key VARCHAR(32) UNIQUE NOT NULL,
+    "row" INTEGER NOT NULL,
+    col INTEGER NOT NULL,
+    center_latitude DECIMAL(10, 8),
+    center_longitude DECIMAL(11, 8),
+    open_requests INTEGER NOT NULL DEFAULT 0,
+    available_drivers INTEGER NOT NULL DEFAULT 0,
+    demand_ratio DECIMAL(8, 2) NOT NULL DEFAULT 0,
+    multiplier DECIMAL(4, 2) NOT NULL DEFAULT 1,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Surge in effect when a quote or ride request was priced
+ALTER TABLE fare_quotes ADD COLUMN surge_multiplier DECIMAL(4, 2) NOT NULL DEFAULT 1;
+ALTER TABLE ride_requests ADD COLUMN surge_multiplier DECIMAL(4, 2) NOT NULL DEFAULT 1;
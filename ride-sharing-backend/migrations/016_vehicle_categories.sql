@@ -0,0 +1,30 @@
+-- Migration: 016_vehicle_categories.sql
+-- Create vehicle_categories table (fare table per kind of vehicle, editable by admins)
+CREATE TABLE vehicle_categories (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    code VARCHAR(32) UNIQUE NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    seats INTEGER NOT NULL,
+    base_fare DECIMAL(10, 2) NOT NULL,
+    per_km_rate DECIMAL(10, 2) NOT NULL,
+    per_minute_rate DECIMAL(10, 2) NOT NULL,
+    minimum_fare DECIMAL(10, 2) NOT NULL,
+    is_active BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+INSERT INTO vehicle_categories (code, name, seats, base_fare, per_km_rate, per_minute_rate, minimum_fare) VALUES
+    ('boda_boda', 'Boda Boda', 1, 30, 15, 1, 50),
+    ('tuk_tuk', 'Tuk-Tuk', 3, 40, 18, 1.5, 70),
+    ('economy', 'Economy', 4, 50, 25, 2, 100),
+    ('comfort', 'Comfort', 4, 80, 35, 3, 150),
+    ('xl', 'XL', 6, 100, 45, 3.5, 200);
+
+-- Existing drivers, requests and rides are economy
+ALTER TABLE drivers ADD COLUMN vehicle_category VARCHAR(32) NOT NULL DEFAULT 'economy';
+ALTER TABLE ride_requests ADD COLUMN vehicle_category VARCHAR(32) NOT NULL DEFAULT 'economy';
+ALTER TABLE rides ADD COLUMN vehicle_category VARCHAR(32) NOT NULL DEFAULT 'economy';
+ALTER TABLE fare_quote_options ADD COLUMN vehicle_category VARCHAR(32) NOT NULL DEFAULT 'economy';
+
+CREATE INDEX idx_drivers_vehicle_category ON drivers(vehicle_category);
@@ -0,0 +1,43 @@
+-- Migration: 017_promo_codes.sql
+-- Create promo_codes table (marketing discounts and their limits)
+CREATE TABLE promo_codes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    code VARCHAR(32) UNIQUE NOT NULL,
+    description TEXT,
+    discount_type VARCHAR(20) NOT NULL CHECK (discount_type IN ('percentage', 'flat')),
+    discount_value DECIMAL(10, 2) NOT NULL,
+    max_discount DECIMAL(10, 2),
+    usage_limit INTEGER,
+    per_user_limit INTEGER NOT NULL DEFAULT 1,
+    used_count INTEGER NOT NULL DEFAULT 0,
+    first_ride_only BOOLEAN DEFAULT FALSE,
+    vehicle_categories TEXT,
+    valid_from TIMESTAMP WITH TIME ZONE,
+    valid_until TIMESTAMP WITH TIME ZONE,
+    is_active BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create promo_redemptions table (one use of a promo code by a ride request)
+CREATE TABLE promo_redemptions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    promo_code_id UUID NOT NULL REFERENCES promo_codes(id),
+    passenger_id UUID NOT NULL REFERENCES users(id),
+    request_id UUID UNIQUE NOT NULL REFERENCES ride_requests(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('reserved', 'applied', 'released')),
+    discount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_promo_redemptions_promo_code_id ON promo_redemptions(promo_code_id);
+CREATE INDEX idx_promo_redemptions_passenger_id ON promo_redemptions(passenger_id);
+
+-- Promo applied to a quote or ride request, and the discount it gave
+ALTER TABLE ride_requests ADD COLUMN promo_code_id UUID REFERENCES promo_codes(id);
+ALTER TABLE fare_quotes ADD COLUMN promo_code_id UUID REFERENCES promo_codes(id);
+ALTER TABLE fare_quote_options ADD COLUMN promo_discount DECIMAL(10, 2) NOT NULL DEFAULT 0;
+ALTER TABLE fare_breakdowns ADD COLUMN promo_discount DECIMAL(10, 2) NOT NULL DEFAULT 0;
+ALTER TABLE payments ADD COLUMN discount DECIMAL(10, 2) NOT NULL DEFAULT 0;
+ALTER TABLE payments ADD COLUMN promo_code_id UUID REFERENCES promo_codes(id);
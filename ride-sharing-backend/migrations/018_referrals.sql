@@ -0,0 +1,43 @@
+-- Migration: 018_referrals.sql
+-- Referral codes for every user and the device they registered from
+ALTER TABLE users ADD COLUMN referral_code VARCHAR(16) UNIQUE;
+ALTER TABLE users ADD COLUMN device_id VARCHAR(128);
+
+CREATE INDEX idx_users_device_id ON users(device_id);
+
+-- Existing users get a code derived from their ID
+UPDATE users SET referral_code = UPPER(SUBSTRING(REPLACE(id::text, '-', ''), 1, 8)) WHERE referral_code IS NULL;
+
+-- Promo codes only one passenger may use, such as referral rewards
+ALTER TABLE promo_codes ADD COLUMN owner_id UUID REFERENCES users(id);
+
+CREATE INDEX idx_promo_codes_owner_id ON promo_codes(owner_id);
+
+-- Create referrals table (who signed up with whose code)
+CREATE TABLE referrals (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    referrer_id UUID NOT NULL REFERENCES users(id),
+    referee_id UUID UNIQUE NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code VARCHAR(16) NOT NULL,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('pending', 'qualified', 'rejected')),
+    reject_reason TEXT,
+    qualified_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_referrals_referrer_id ON referrals(referrer_id);
+
+-- Create referral_rewards table (what each side of a qualified referral received)
+CREATE TABLE referral_rewards (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    referral_id UUID NOT NULL REFERENCES referrals(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id),
+    amount DECIMAL(10, 2) NOT NULL,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('issued', 'owed')),
+    promo_code_id UUID REFERENCES promo_codes(id),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_referral_rewards_referral_id ON referral_rewards(referral_id);
+CREATE INDEX idx_referral_rewards_user_id ON referral_rewards(user_id);
@@ -0,0 +1,44 @@
+-- Migration: 019_ledger.sql
+-- Create ledger_accounts table (balances in cents on the double-entry ledger)
+CREATE TABLE ledger_accounts (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    code VARCHAR(100) UNIQUE NOT NULL,
+    type VARCHAR(30) NOT NULL CHECK (type IN ('passenger_wallet', 'driver_earnings', 'platform_commission', 'promo_expense', 'mpesa_clearing')),
+    owner_id UUID REFERENCES users(id),
+    normal_balance VARCHAR(6) NOT NULL CHECK (normal_balance IN ('debit', 'credit')),
+    balance_cents BIGINT NOT NULL DEFAULT 0,
+    currency VARCHAR(3) DEFAULT 'KES',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_ledger_accounts_owner_id ON ledger_accounts(owner_id);
+
+-- Create journal_entries table (one balanced movement per business event)
+CREATE TABLE journal_entries (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    kind VARCHAR(30) NOT NULL,
+    reference VARCHAR(100) NOT NULL,
+    description TEXT,
+    posted_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_journal_entries_kind_reference ON journal_entries(kind, reference);
+
+-- Create ledger_entries table (each side of a journal entry)
+CREATE TABLE ledger_entries (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    journal_entry_id UUID NOT NULL REFERENCES journal_entries(id) ON DELETE CASCADE,
+    account_id UUID NOT NULL REFERENCES ledger_accounts(id),
+    direction VARCHAR(6) NOT NULL CHECK (direction IN ('debit', 'credit')),
+    amount_cents BIGINT NOT NULL CHECK (amount_cents > 0),
+    balance_after_cents BIGINT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_ledger_entries_journal_entry_id ON ledger_entries(journal_entry_id);
+CREATE INDEX idx_ledger_entries_account_id ON ledger_entries(account_id);
+
+-- Driver referral rewards are now credited to their earnings
+ALTER TABLE referral_rewards DROP CONSTRAINT referral_rewards_status_check;
+ALTER TABLE referral_rewards ADD CONSTRAINT referral_rewards_status_check CHECK (status IN ('issued', 'owed', 'credited'));
@@ -0,0 +1,25 @@
+-- Migration: 020_driver_payouts.sql
+-- Create payouts table (driver earnings sent to M-Pesa through B2C)
+CREATE TABLE payouts (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    driver_id UUID NOT NULL REFERENCES users(id),
+    amount_cents BIGINT NOT NULL CHECK (amount_cents > 0),
+    fee_cents BIGINT NOT NULL DEFAULT 0 CHECK (fee_cents >= 0),
+    phone_number VARCHAR(20) NOT NULL,
+    trigger VARCHAR(20) NOT NULL CHECK (trigger IN ('on_demand', 'scheduled')),
+    status VARCHAR(20) NOT NULL CHECK (status IN ('pending', 'completed', 'failed', 'unconfirmed')),
+    conversation_id VARCHAR(100) UNIQUE,
+    originator_conversation_id VARCHAR(100) UNIQUE,
+    transaction_id VARCHAR(50),
+    failure_reason TEXT,
+    completed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_payouts_driver_id ON payouts(driver_id);
+CREATE INDEX idx_payouts_status ON payouts(status);
+
+-- Payout fees are booked to their own ledger account
+ALTER TABLE ledger_accounts DROP CONSTRAINT ledger_accounts_type_check;
+ALTER TABLE ledger_accounts ADD CONSTRAINT ledger_accounts_type_check CHECK (type IN ('passenger_wallet', 'driver_earnings', 'platform_commission', 'promo_expense', 'mpesa_clearing', 'payout_fees'));
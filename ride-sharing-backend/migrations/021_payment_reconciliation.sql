@@ -0,0 +1,13 @@
+-- Migration: 021_payment_reconciliation.sql
+-- Track the STK Push behind each pending payment so its outcome can be queried
+ALTER TABLE payments ADD COLUMN checkout_request_id VARCHAR(100) UNIQUE;
+ALTER TABLE payments ADD COLUMN initiated_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE payments ADD COLUMN last_checked_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE payments ADD COLUMN failure_reason TEXT;
+
+-- Pending payments kept the checkout request ID in place of the receipt
+UPDATE payments
+SET checkout_request_id = transaction_id, initiated_at = updated_at, transaction_id = NULL
+WHERE payment_status = 'pending' AND transaction_id IS NOT NULL;
+
+CREATE INDEX idx_payments_initiated_at ON payments(initiated_at);
@@ -0,0 +1,19 @@
+-- Migration: 022_mpesa_callbacks.sql
+-- Create mpesa_callbacks table (raw body of every M-Pesa callback, for audit)
+CREATE TABLE mpesa_callbacks (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('stk_push', 'b2c_result', 'b2c_timeout')),
+    reference VARCHAR(100),
+    source_ip VARCHAR(45),
+    body TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('received', 'processed', 'duplicate', 'rejected', 'failed')),
+    reason TEXT,
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    processed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_mpesa_callbacks_reference ON mpesa_callbacks(reference);
+CREATE INDEX idx_mpesa_callbacks_status ON mpesa_callbacks(status);
+
+-- Phone number each STK Push was sent to, checked against its callback
+ALTER TABLE payments ADD COLUMN phone_number VARCHAR(20);
@@ -0,0 +1,35 @@
+-- Migration: 023_refunds.sql
+-- Create refunds table (partial and full refunds of completed payments)
+CREATE TABLE refunds (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    payment_id UUID NOT NULL REFERENCES payments(id) ON DELETE CASCADE,
+    ride_id UUID NOT NULL REFERENCES rides(id) ON DELETE CASCADE,
+    passenger_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount_cents BIGINT NOT NULL CHECK (amount_cents > 0),
+    destination VARCHAR(10) NOT NULL CHECK (destination IN ('wallet', 'mpesa')),
+    reason TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('pending_approval', 'processing', 'completed', 'failed', 'rejected')),
+    requested_by UUID NOT NULL REFERENCES users(id),
+    reviewed_by UUID REFERENCES users(id),
+    review_note TEXT,
+    conversation_id VARCHAR(100) UNIQUE,
+    originator_conversation_id VARCHAR(100) UNIQUE,
+    transaction_id VARCHAR(50),
+    failure_reason TEXT,
+    completed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_refunds_payment_id ON refunds(payment_id);
+CREATE INDEX idx_refunds_ride_id ON refunds(ride_id);
+CREATE INDEX idx_refunds_passenger_id ON refunds(passenger_id);
+CREATE INDEX idx_refunds_status ON refunds(status);
+
+-- Refunds are a cost to the platform on the ledger
+ALTER TABLE ledger_accounts DROP CONSTRAINT ledger_accounts_type_check;
+ALTER TABLE ledger_accounts ADD CONSTRAINT ledger_accounts_type_check CHECK (type IN ('passenger_wallet', 'driver_earnings', 'platform_commission', 'promo_expense', 'mpesa_clearing', 'payout_fees', 'refund_expense'));
+
+-- Support staff can issue refunds
+ALTER TABLE users DROP CONSTRAINT users_user_type_check;
+ALTER TABLE users ADD CONSTRAINT users_user_type_check CHECK (user_type IN ('passenger', 'driver', 'admin', 'support'));
@@ -0,0 +1,4 @@
+-- Migration: 024_cash_payments.sql
+-- Passengers choose how they pay when requesting a ride. Commission on cash
+-- rides is owed by the driver as a negative balance on their earnings.
+ALTER TABLE ride_requests ADD COLUMN payment_method VARCHAR(10) NOT NULL DEFAULT 'mpesa' CHECK (payment_method IN ('mpesa', 'cash'));
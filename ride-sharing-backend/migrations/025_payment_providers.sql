@@ -0,0 +1,17 @@
+-- Migration: 025_payment_providers.sql
+-- Passengers can also pay with Airtel Money. Refunds go back to the wallet or
+-- the way the payment came.
+ALTER TABLE ride_requests ALTER COLUMN payment_method TYPE VARCHAR(20);
+ALTER TABLE ride_requests DROP CONSTRAINT ride_requests_payment_method_check;
+ALTER TABLE ride_requests ADD CONSTRAINT ride_requests_payment_method_check CHECK (payment_method IN ('mpesa', 'airtel_money', 'cash'));
+
+ALTER TABLE refunds ALTER COLUMN destination TYPE VARCHAR(20);
+ALTER TABLE refunds DROP CONSTRAINT refunds_destination_check;
+ALTER TABLE refunds ADD CONSTRAINT refunds_destination_check CHECK (destination IN ('wallet', 'mpesa', 'airtel_money'));
+
+ALTER TABLE ledger_accounts DROP CONSTRAINT ledger_accounts_type_check;
+ALTER TABLE ledger_accounts ADD CONSTRAINT ledger_accounts_type_check CHECK (type IN ('passenger_wallet', 'driver_earnings', 'platform_commission', 'promo_expense', 'mpesa_clearing', 'payout_fees', 'refund_expense', 'airtel_money_clearing'));
+
+-- Airtel Money callbacks are stored for audit alongside M-Pesa's
+ALTER TABLE mpesa_callbacks DROP CONSTRAINT mpesa_callbacks_kind_check;
+ALTER TABLE mpesa_callbacks ADD CONSTRAINT mpesa_callbacks_kind_check CHECK (kind IN ('stk_push', 'b2c_result', 'b2c_timeout', 'airtel_payment'));
@@ -0,0 +1,23 @@
+-- Migration: 026_payment_amounts.sql
+-- Payment amounts come from the fare. A ride can be paid for in parts, with
+-- wallet credit taken off the fare and what is still owed tracked per ride.
+ALTER TABLE payments ADD COLUMN wallet_credit DECIMAL(10, 2) NOT NULL DEFAULT 0 CHECK (wallet_credit >= 0);
+ALTER TABLE payments ADD COLUMN amount_paid DECIMAL(10, 2) NOT NULL DEFAULT 0 CHECK (amount_paid >= 0);
+ALTER TABLE payments ADD COLUMN requested_amount DECIMAL(10, 2) NOT NULL DEFAULT 0 CHECK (requested_amount >= 0);
+
+ALTER TABLE payments DROP CONSTRAINT payments_payment_status_check;
+ALTER TABLE payments ADD CONSTRAINT payments_payment_status_check CHECK (payment_status IN ('pending', 'partially_paid', 'completed', 'failed', 'refunded'));
+
+-- Requests still in flight asked for the amount the client sent
+UPDATE payments SET requested_amount = amount WHERE checkout_request_id IS NOT NULL;
+
+-- Settled payments were paid in full
+UPDATE payments SET amount_paid = amount WHERE payment_status IN ('completed', 'refunded');
+
+-- Unpaid rides owe their fare rather than what the client asked to pay
+UPDATE payments
+SET amount = fare_breakdowns.total
+FROM fare_breakdowns
+WHERE fare_breakdowns.ride_id = payments.ride_id
+  AND fare_breakdowns.passenger_id = payments.passenger_id
+  AND payments.payment_status IN ('pending', 'failed');
@@ -0,0 +1,5 @@
+-- Migration: 027_pending_earnings.sql
+-- A driver's share of a fare is held as pending earnings until the passenger
+-- pays it, so payouts only draw on fares that were collected.
+ALTER TABLE ledger_accounts DROP CONSTRAINT ledger_accounts_type_check;
+ALTER TABLE ledger_accounts ADD CONSTRAINT ledger_accounts_type_check CHECK (type IN ('passenger_wallet', 'driver_earnings', 'platform_commission', 'promo_expense', 'mpesa_clearing', 'payout_fees', 'refund_expense', 'airtel_money_clearing', 'pending_earnings'));
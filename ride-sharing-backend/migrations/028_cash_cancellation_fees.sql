@@ -0,0 +1,4 @@
+-- Migration: 028_cash_cancellation_fees.sql
+-- Cancellation fees of cash riders stay owed in their wallet and are added to
+-- the payment for their next ride
+ALTER TABLE payments ADD COLUMN wallet_debt DECIMAL(10, 2) NOT NULL DEFAULT 0 CHECK (wallet_debt >= 0);
@@ -14,18 +14,88 @@ func Initialize(databaseURL string) (*gorm.DB, error) {
 	}
 
 	// Auto-migrate the schema
-	err = db.AutoMigrate(
+	err = db.AutoMigrate(Models()...)
+	if err != nil {
+		return nil, err
+	}
+
+	// A ride request can be matched again after a driver cancels, so rides
+	// are no longer unique per request
+	if db.Migrator().HasConstraint(&models.Ride{}, "uni_rides_request_id") {
+		if err := db.Migrator().DropConstraint(&models.Ride{}, "uni_rides_request_id"); err != nil {
+			return nil, err
+		}
+	}
+
+	// Pooled rides have one payment per passenger
+	if db.Migrator().HasConstraint(&models.Payment{}, "uni_payments_ride_id") {
+		if err := db.Migrator().DropConstraint(&models.Payment{}, "uni_payments_ride_id"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := SeedVehicleCategories(db); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Models lists every model in the schema, in the order they are migrated
+func Models() []interface{} {
+	return []interface{}{
 		&models.User{},
 		&models.Driver{},
 		&models.RideRequest{},
 		&models.Ride{},
 		&models.Payment{},
 		&models.Review{},
-	)
-	if err != nil {
-		return nil, err
+		&models.RideEvent{},
+		&models.RideCancellation{},
+		&models.RideOffer{},
+		&models.RideRequestDecline{},
+		&models.Notification{},
+		&models.RideStop{},
+		&models.RideWaypoint{},
+		&models.RideLocationPoint{},
+		&models.FareBreakdown{},
+		&models.FareQuote{},
+		&models.FareQuoteOption{},
+		&models.SurgeCell{},
+		&models.VehicleCategory{},
+		&models.PromoCode{},
+		&models.PromoRedemption{},
+		&models.Referral{},
+		&models.ReferralReward{},
+		&models.LedgerAccount{},
+		&models.JournalEntry{},
+		&models.LedgerEntry{},
+		&models.Payout{},
+		&models.MpesaCallback{},
+		&models.Refund{},
 	}
+}
 
-	return db, nil
+// DefaultVehicleCategories are the categories the service launches with.
+// Admins can change their fares afterwards.
+var DefaultVehicleCategories = []models.VehicleCategory{
+	{Code: models.VehicleCategoryBodaBoda, Name: "Boda Boda", Seats: 1, BaseFare: 30, PerKmRate: 15, PerMinuteRate: 1, MinimumFare: 50},
+	{Code: models.VehicleCategoryTukTuk, Name: "Tuk-Tuk", Seats: 3, BaseFare: 40, PerKmRate: 18, PerMinuteRate: 1.5, MinimumFare: 70},
+	{Code: models.VehicleCategoryEconomy, Name: "Economy", Seats: 4, BaseFare: 50, PerKmRate: 25, PerMinuteRate: 2, MinimumFare: 100},
+	{Code: models.VehicleCategoryComfort, Name: "Comfort", Seats: 4, BaseFare: 80, PerKmRate: 35, PerMinuteRate: 3, MinimumFare: 150},
+	{Code: models.VehicleCategoryXL, Name: "XL", Seats: 6, BaseFare: 100, PerKmRate: 45, PerMinuteRate: 3.5, MinimumFare: 200},
+}
+
+// SeedVehicleCategories creates any default vehicle category that is
+// missing without touching the fares of existing ones.
+func SeedVehicleCategories(db *gorm.DB) error {
+	for _, category := range DefaultVehicleCategories {
+		category := category
+		category.IsActive = true
+		if err := db.Where("code = ?", category.Code).FirstOrCreate(&category).Error; err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
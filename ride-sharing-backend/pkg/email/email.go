@@ -209,6 +209,43 @@ func (es *EmailService) SendPasswordResetEmail(to, firstName, resetToken string)
 	return es.sendEmail(to, subject, body)
 }
 
+// SendNotificationEmail sends a short plain notification such as a ride
+// status update.
+func (es *EmailService) SendNotificationEmail(to, firstName, title, message string) error {
+	body := fmt.Sprintf(`
+<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <title>%s</title>
+    <style>
+        body { font-family: Arial, sans-serif; line-height: 1.6; color: #333; }
+        .container { max-width: 600px; margin: 0 auto; padding: 20px; }
+        .header { background-color: #FF6B35; color: white; padding: 20px; text-align: center; }
+        .content { padding: 20px; background-color: #f9f9f9; }
+        .footer { text-align: center; padding: 20px; color: #666; font-size: 12px; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="header">
+            <h1>%s</h1>
+        </div>
+        <div class="content">
+            <h2>Hi %s,</h2>
+            <p>%s</p>
+        </div>
+        <div class="footer">
+            <p>© 2024 Kenyan Ride Share. All rights reserved.</p>
+        </div>
+    </div>
+</body>
+</html>
+`, title, title, firstName, message)
+
+	return es.sendEmail(to, title, body)
+}
+
 func (es *EmailService) sendEmail(to, subject, body string) error {
 	// Skip sending emails if SMTP credentials are not configured
 	if es.SMTPUsername == "" || es.SMTPPassword == "" {
@@ -61,25 +61,65 @@ func ValidateKenyanPhoneNumber(phoneNumber string) bool {
 	return fourthDigit == '7' || fourthDigit == '1' || fourthDigit == '0'
 }
 
+// FareRates are the rates a fare is calculated from
+type FareRates struct {
+	BaseFare      float64
+	PerKmRate     float64
+	PerMinuteRate float64
+	MinimumFare   float64
+}
+
+// DefaultFareRates are the Kenya-specific rates for a standard car
+var DefaultFareRates = FareRates{
+	BaseFare:      50.0,  // KES 50 base fare
+	PerKmRate:     25.0,  // KES 25 per km
+	PerMinuteRate: 2.0,   // KES 2 per minute
+	MinimumFare:   100.0, // KES 100 minimum fare
+}
+
+// FareComponents itemises a fare
+type FareComponents struct {
+	Base             float64
+	Distance         float64
+	Time             float64
+	Surge            float64
+	MinimumFareTopUp float64
+	Total            float64
+}
+
 // CalculateFareKenyan calculates fare using Kenya-specific rates
 func CalculateFareKenyan(distanceKm float64, durationMinutes int, isRushHour bool) float64 {
-	baseFare := 50.0  // KES 50 base fare
-	perKmRate := 25.0 // KES 25 per km
-	perMinuteRate := 2.0 // KES 2 per minute
-	
-	fare := baseFare + (distanceKm * perKmRate) + (float64(durationMinutes) * perMinuteRate)
-	
-	// Apply surge pricing during rush hours
+	surgeMultiplier := 1.0
 	if isRushHour {
-		fare *= 1.5 // 50% surge
+		surgeMultiplier = 1.5 // 50% surge
+	}
+	return CalculateFareBreakdown(DefaultFareRates, distanceKm, durationMinutes, surgeMultiplier).Total
+}
+
+// CalculateFareBreakdown calculates fare with the given rates and returns
+// each component of it. A surgeMultiplier of 1 means no surge.
+func CalculateFareBreakdown(rates FareRates, distanceKm float64, durationMinutes int, surgeMultiplier float64) FareComponents {
+	components := FareComponents{
+		Base:     rates.BaseFare,
+		Distance: distanceKm * rates.PerKmRate,
+		Time:     float64(durationMinutes) * rates.PerMinuteRate,
+	}
+	fare := components.Base + components.Distance + components.Time
+	
+	// Apply surge pricing
+	if surgeMultiplier > 1 {
+		components.Surge = fare * (surgeMultiplier - 1)
+		fare += components.Surge
 	}
 	
 	// Minimum fare
-	if fare < 100.0 {
-		fare = 100.0
+	if fare < rates.MinimumFare {
+		components.MinimumFareTopUp = rates.MinimumFare - fare
+		fare = rates.MinimumFare
 	}
 	
-	return fare
+	components.Total = fare
+	return components
 }
 
 // IsRushHour determines if current time is rush hour in Kenya
@@ -91,9 +131,14 @@ func IsRushHour() bool {
 	return (hour >= 7 && hour <= 9) || (hour >= 17 && hour <= 19)
 }
 
-// GetKenyanTimezone returns Kenya timezone
+// GetKenyanTimezone returns Kenya timezone. Kenya keeps East Africa Time
+// all year, so a fixed UTC+3 zone stands in where no tz database is
+// installed.
 func GetKenyanTimezone() *time.Location {
-	loc, _ := time.LoadLocation("Africa/Nairobi")
+	loc, err := time.LoadLocation("Africa/Nairobi")
+	if err != nil {
+		return time.FixedZone("EAT", 3*60*60)
+	}
 	return loc
 }
 
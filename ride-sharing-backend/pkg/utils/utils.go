@@ -3,6 +3,7 @@ package utils
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"math"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -51,38 +52,53 @@ func GenerateRandomString(length int) (string, error) {
 func CalculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
 	const R = 6371 // Earth's radius in kilometers
 
-	dLat := (lat2 - lat1) * (3.14159265359 / 180)
-	dLon := (lon2 - lon1) * (3.14159265359 / 180)
+	dLat := (lat2 - lat1) * (math.Pi / 180)
+	dLon := (lon2 - lon1) * (math.Pi / 180)
 
-	a := 0.5 - 0.5*cos(dLat) + cos(lat1*(3.14159265359/180))*cos(lat2*(3.14159265359/180))*(1-cos(dLon))/2
+	a := 0.5 - 0.5*math.Cos(dLat) + math.Cos(lat1*(math.Pi/180))*math.Cos(lat2*(math.Pi/180))*(1-math.Cos(dLon))/2
 
-	return R * 2 * asin(sqrt(a))
+	return R * 2 * math.Asin(math.Sqrt(a))
 }
 
-func cos(x float64) float64 {
-	// Simple cosine approximation
-	return 1 - x*x/2 + x*x*x*x/24
+// Coordinate is a latitude/longitude pair in degrees
+type Coordinate struct {
+	Latitude  float64
+	Longitude float64
 }
 
-func sin(x float64) float64 {
-	// Simple sine approximation
-	return x - x*x*x/6 + x*x*x*x*x/120
+// CalculateRouteDistance returns the total distance in kilometers of a route
+// that visits the points in order.
+func CalculateRouteDistance(points []Coordinate) float64 {
+	total := 0.0
+	for i := 1; i < len(points); i++ {
+		total += CalculateDistance(points[i-1].Latitude, points[i-1].Longitude, points[i].Latitude, points[i].Longitude)
+	}
+	return total
 }
 
-func asin(x float64) float64 {
-	// Simple arcsine approximation
-	return x + x*x*x/6 + 3*x*x*x*x*x/40
+// EncodePolyline encodes a route with the Google polyline algorithm at
+// 5 decimal places of precision.
+func EncodePolyline(points []Coordinate) string {
+	var out []byte
+	var prevLat, prevLon int64
+	for _, point := range points {
+		lat := int64(math.Round(point.Latitude * 1e5))
+		lon := int64(math.Round(point.Longitude * 1e5))
+		out = appendPolylineValue(out, lat-prevLat)
+		out = appendPolylineValue(out, lon-prevLon)
+		prevLat, prevLon = lat, lon
+	}
+	return string(out)
 }
 
-func sqrt(x float64) float64 {
-	// Newton's method for square root
-	if x == 0 {
-		return 0
+func appendPolylineValue(out []byte, value int64) []byte {
+	v := value << 1
+	if value < 0 {
+		v = ^v
 	}
-	z := x
-	for i := 0; i < 10; i++ {
-		z = (z + x/z) / 2
+	for v >= 0x20 {
+		out = append(out, byte((0x20|(v&0x1f))+63))
+		v >>= 5
 	}
-	return z
+	return append(out, byte(v+63))
 }
-